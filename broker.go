@@ -0,0 +1,260 @@
+package thermabox
+
+import (
+	"sync"
+
+	"github.com/gurupras/thermabox/interfaces"
+	log "github.com/sirupsen/logrus"
+)
+
+// BrokerStats counts the states published by a broker and those its
+// subscribers dropped
+type BrokerStats struct {
+	Subscribers int    `json:"subscribers"`
+	Published   uint64 `json:"published"`
+	Dropped     uint64 `json:"dropped"`
+}
+
+// queue is the buffer of a subscriber. None of its methods block
+type queue interface {
+	// push adds v, returning false if the buffer is full
+	push(v interface{}) bool
+	// pop removes the oldest value, returning false if the buffer is empty
+	pop() (interface{}, bool)
+	// drop accounts for v having been dropped to make room
+	drop(v interface{})
+	dropped() uint64
+	close()
+}
+
+// fanout is what Broker and AlertBroker share. It offers every published
+// value to the queues of its subscribers without ever blocking.
+// The zero value is ready to use
+type fanout struct {
+	subscriptions map[queue]bool
+	published     uint64
+	// Dropped by subscriptions that have since unsubscribed
+	unsubscribedDropped uint64
+	mutex               sync.Mutex
+}
+
+// subscriptionBuffer returns the buffer size and policy to use for a
+// subscription that asked for buffer and policy
+func subscriptionBuffer(buffer int, policy interfaces.BufferPolicy) (int, interfaces.BufferPolicy) {
+	if buffer < 1 || policy == interfaces.COALESCE {
+		buffer = 1
+	}
+	if policy == "" {
+		policy = interfaces.DROP_OLDEST
+	}
+	return buffer, policy
+}
+
+func (f *fanout) subscribe(q queue) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.subscriptions == nil {
+		f.subscriptions = make(map[queue]bool)
+	}
+	f.subscriptions[q] = true
+}
+
+func (f *fanout) publish(v interface{}) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.published++
+	for q := range f.subscriptions {
+		// Drop buffered values until v fits
+		for !q.push(v) {
+			if dropped, ok := q.pop(); ok {
+				q.drop(dropped)
+			}
+		}
+	}
+}
+
+// Stats returns the counters. Dropped includes the values dropped by
+// subscribers that have since unsubscribed
+func (f *fanout) Stats() BrokerStats {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	stats := BrokerStats{
+		Subscribers: len(f.subscriptions),
+		Published:   f.published,
+		Dropped:     f.unsubscribedDropped,
+	}
+	for q := range f.subscriptions {
+		stats.Dropped += q.dropped()
+	}
+	return stats
+}
+
+func (f *fanout) unsubscribe(q queue) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if !f.subscriptions[q] {
+		return
+	}
+	delete(f.subscriptions, q)
+	f.unsubscribedDropped += q.dropped()
+	q.close()
+}
+
+func (f *fanout) droppedBy(q queue) uint64 {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return q.dropped()
+}
+
+// Broker fans states out to its subscribers. Publishing never blocks: a
+// subscriber that falls behind loses states according to its buffer policy.
+// The zero value is ready to use
+type Broker struct {
+	fanout
+}
+
+// Subscription is a subscriber of a Broker
+type Subscription struct {
+	broker    *Broker
+	policy    interfaces.BufferPolicy
+	c         chan *interfaces.ThermaboxState
+	dropCount uint64
+}
+
+// Subscribe returns a subscription that buffers up to buffer states
+func (b *Broker) Subscribe(buffer int, policy interfaces.BufferPolicy) *Subscription {
+	buffer, policy = subscriptionBuffer(buffer, policy)
+	s := &Subscription{
+		broker: b,
+		policy: policy,
+		c:      make(chan *interfaces.ThermaboxState, buffer),
+	}
+	b.subscribe(s)
+	return s
+}
+
+// Publish sends state to every subscriber
+func (b *Broker) Publish(state *interfaces.ThermaboxState) {
+	b.publish(state)
+}
+
+func (s *Subscription) push(v interface{}) bool {
+	select {
+	case s.c <- v.(*interfaces.ThermaboxState):
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *Subscription) pop() (interface{}, bool) {
+	select {
+	case state := <-s.c:
+		return state, true
+	default:
+		return nil, false
+	}
+}
+
+func (s *Subscription) drop(v interface{}) {
+	if s.dropCount == 0 {
+		log.Warnf("Subscriber is falling behind, dropping states (policy=%v)", s.policy)
+	}
+	s.dropCount++
+}
+
+func (s *Subscription) dropped() uint64 {
+	return s.dropCount
+}
+
+func (s *Subscription) close() {
+	close(s.c)
+}
+
+func (s *Subscription) C() <-chan *interfaces.ThermaboxState {
+	return s.c
+}
+
+// Unsubscribe stops the subscription and closes C. States that were buffered
+// may still be received
+func (s *Subscription) Unsubscribe() {
+	s.broker.unsubscribe(s)
+}
+
+func (s *Subscription) Dropped() uint64 {
+	return s.broker.droppedBy(s)
+}
+
+// AlertBroker fans alerts out to its subscribers the way Broker fans out
+// states. The zero value is ready to use
+type AlertBroker struct {
+	fanout
+}
+
+// AlertSubscription is a subscriber of an AlertBroker
+type AlertSubscription struct {
+	broker    *AlertBroker
+	c         chan *interfaces.Alert
+	dropCount uint64
+}
+
+// Subscribe returns a subscription that buffers up to buffer alerts
+func (b *AlertBroker) Subscribe(buffer int, policy interfaces.BufferPolicy) *AlertSubscription {
+	buffer, _ = subscriptionBuffer(buffer, policy)
+	s := &AlertSubscription{
+		broker: b,
+		c:      make(chan *interfaces.Alert, buffer),
+	}
+	b.subscribe(s)
+	return s
+}
+
+// Publish sends alert to every subscriber
+func (b *AlertBroker) Publish(alert *interfaces.Alert) {
+	b.publish(alert)
+}
+
+func (s *AlertSubscription) push(v interface{}) bool {
+	select {
+	case s.c <- v.(*interfaces.Alert):
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *AlertSubscription) pop() (interface{}, bool) {
+	select {
+	case alert := <-s.c:
+		return alert, true
+	default:
+		return nil, false
+	}
+}
+
+func (s *AlertSubscription) drop(v interface{}) {
+	alert := v.(*interfaces.Alert)
+	log.Warnf("Alert subscriber is falling behind, dropped alert: %v: %v", alert.Type, alert.Message)
+	s.dropCount++
+}
+
+func (s *AlertSubscription) dropped() uint64 {
+	return s.dropCount
+}
+
+func (s *AlertSubscription) close() {
+	close(s.c)
+}
+
+func (s *AlertSubscription) C() <-chan *interfaces.Alert {
+	return s.c
+}
+
+// Unsubscribe stops the subscription and closes C
+func (s *AlertSubscription) Unsubscribe() {
+	s.broker.unsubscribe(s)
+}
+
+func (s *AlertSubscription) Dropped() uint64 {
+	return s.broker.droppedBy(s)
+}
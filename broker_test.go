@@ -0,0 +1,162 @@
+package thermabox
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/gurupras/thermabox/interfaces"
+	"github.com/stretchr/testify/require"
+)
+
+var _ interfaces.ThermaboxSubscriberInterface = &Thermabox{}
+var _ interfaces.AlertSubscriberInterface = &Thermabox{}
+
+func newBrokerTestStates(n int) []*interfaces.ThermaboxState {
+	states := make([]*interfaces.ThermaboxState, n)
+	for idx := range states {
+		states[idx] = &interfaces.ThermaboxState{Temperature: float64(idx)}
+	}
+	return states
+}
+
+func TestBrokerDropOldest(t *testing.T) {
+	require := require.New(t)
+
+	b := &Broker{}
+	sub := b.Subscribe(2, interfaces.DROP_OLDEST)
+	states := newBrokerTestStates(4)
+	for _, state := range states {
+		b.Publish(state)
+	}
+	require.Equal(states[2], <-sub.C())
+	require.Equal(states[3], <-sub.C())
+	require.Equal(uint64(2), sub.Dropped())
+	require.Equal(BrokerStats{Subscribers: 1, Published: 4, Dropped: 2}, b.Stats())
+}
+
+func TestBrokerCoalesce(t *testing.T) {
+	require := require.New(t)
+
+	b := &Broker{}
+	// The buffer size is ignored
+	sub := b.Subscribe(10, interfaces.COALESCE)
+	states := newBrokerTestStates(3)
+	for _, state := range states {
+		b.Publish(state)
+	}
+	require.Equal(states[2], <-sub.C())
+	require.Equal(0, len(sub.C()))
+	require.Equal(uint64(2), sub.Dropped())
+}
+
+func TestBrokerUnsubscribe(t *testing.T) {
+	require := require.New(t)
+
+	b := &Broker{}
+	sub := b.Subscribe(1, interfaces.DROP_OLDEST)
+	other := b.Subscribe(1, "")
+	states := newBrokerTestStates(2)
+	b.Publish(states[0])
+	b.Publish(states[1])
+	require.Equal(states[1], <-other.C())
+
+	sub.Unsubscribe()
+	// Unsubscribing again is harmless
+	sub.Unsubscribe()
+	require.Equal(states[1], <-sub.C())
+	_, ok := <-sub.C()
+	require.False(ok)
+
+	// Publishing carries on for the other subscribers
+	b.Publish(states[0])
+	require.Equal(states[0], <-other.C())
+	// Drops by the unsubscribed subscriber are still counted
+	require.Equal(BrokerStats{Subscribers: 1, Published: 3, Dropped: 2}, b.Stats())
+}
+
+// requireForwarded waits for the goroutines forwarding to registered channels
+// to empty their subscriptions, which they can only do if they never block
+func requireForwarded(require *require.Assertions, b *Broker, except *Subscription) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		b.mutex.Lock()
+		pending := 0
+		for q := range b.subscriptions {
+			if s := q.(*Subscription); s != except {
+				pending += len(s.c)
+			}
+		}
+		b.mutex.Unlock()
+		if pending == 0 {
+			return
+		}
+		require.True(time.Now().Before(deadline), "registered channel forwarder is blocked")
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestThermaboxStalledListener(t *testing.T) {
+	require := require.New(t)
+
+	tbox := &Thermabox{temperature: 20, threshold: 0.5}
+	tbox.SetRelays(NewFakeRelay(false, []int{1}), NewFakeRelay(false, []int{1}))
+	tbox.SetProbe(&countingProbe{})
+	// Never drained
+	c := make(chan *interfaces.ThermaboxState, 1)
+	tbox.RegisterChannel(c)
+	sub := tbox.Subscribe(1, interfaces.COALESCE)
+
+	goroutines := runtime.NumGoroutine()
+	steps := registeredChannelBuffer + 10
+	for i := 0; i < steps; i++ {
+		require.Nil(tbox.Step())
+		requireForwarded(require, &tbox.broker, sub.(*Subscription))
+	}
+	require.True(runtime.NumGoroutine() <= goroutines, "goroutines leaked")
+
+	state := <-sub.C()
+	require.Equal(20.0, state.Temperature)
+	require.Equal(uint64(steps-1), sub.Dropped())
+	stats := tbox.SubscriberStats()
+	require.Equal(2, stats.Subscribers)
+	require.Equal(uint64(steps), stats.Published)
+	// The registered channel drops the states that do not fit in it instead
+	// of its subscription falling behind
+	require.Equal(uint64(steps-1), stats.Dropped)
+	require.Equal(1, len(c))
+
+	sub.Unsubscribe()
+	require.Equal(1, tbox.SubscriberStats().Subscribers)
+}
+
+func TestThermaboxStalledAlertListener(t *testing.T) {
+	require := require.New(t)
+
+	tbox := &Thermabox{}
+	// Never drained
+	tbox.RegisterAlertChannel(make(chan *interfaces.Alert))
+	sub := tbox.SubscribeAlerts(2, interfaces.DROP_OLDEST)
+
+	goroutines := runtime.NumGoroutine()
+	alerts := registeredChannelBuffer + 10
+	for i := 0; i < alerts; i++ {
+		tbox.alert(interfaces.RELAY_FAULT, fmt.Sprintf("%v", i))
+	}
+	time.Sleep(10 * time.Millisecond)
+	require.True(runtime.NumGoroutine() <= goroutines, "goroutines leaked")
+
+	// The latest alerts are kept
+	require.Equal(fmt.Sprintf("%v", alerts-2), (<-sub.C()).Message)
+	require.Equal(fmt.Sprintf("%v", alerts-1), (<-sub.C()).Message)
+	require.Equal(uint64(alerts-2), sub.Dropped())
+	stats := tbox.alertBroker.Stats()
+	require.Equal(2, stats.Subscribers)
+	require.Equal(uint64(alerts), stats.Published)
+
+	sub.Unsubscribe()
+	_, ok := <-sub.C()
+	require.False(ok)
+	require.Equal(1, tbox.alertBroker.Stats().Subscribers)
+}
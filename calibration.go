@@ -0,0 +1,283 @@
+package thermabox
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gurupras/thermabox/interfaces"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// CalibrationPoint maps a reading of the probe to the reference temperature
+type CalibrationPoint struct {
+	Raw    float64 `yaml:"raw"`
+	Actual float64 `yaml:"actual"`
+}
+
+// Calibration corrects a probe's readings. With two or more points, readings
+// are interpolated linearly between the points and extrapolated from the
+// outermost segments. Otherwise readings are corrected as gain * raw + offset,
+// with a gain of 0 treated as 1
+type Calibration struct {
+	Offset float64            `yaml:"offset,omitempty"`
+	Gain   float64            `yaml:"gain,omitempty"`
+	Points []CalibrationPoint `yaml:"points,omitempty"`
+}
+
+func (c *Calibration) UnmarshalYAML(unmarshal func(i interface{}) error) error {
+	m := make(map[string]interface{})
+	if err := unmarshal(&m); err != nil {
+		return err
+	}
+	var err error
+	if c.Offset, err = parseFloat(m, "offset", 0); err != nil {
+		return err
+	}
+	if c.Gain, err = parseFloat(m, "gain", 1); err != nil {
+		return err
+	}
+	if c.Gain == 0 {
+		return fmt.Errorf("Calibration gain must not be 0")
+	}
+	c.Points = nil
+	if data, ok := m["points"]; ok {
+		b, err := yaml.Marshal(data)
+		if err != nil {
+			return fmt.Errorf("Failed to marshal key 'points': %v: %v", data, err)
+		}
+		points := make([]CalibrationPoint, 0)
+		if err := yaml.Unmarshal(b, &points); err != nil {
+			return fmt.Errorf("Failed while parsing points: %v", err)
+		}
+		if len(points) == 1 {
+			return fmt.Errorf("Calibration table needs at least 2 points")
+		}
+		c.Points = points
+	}
+	return c.sortPoints()
+}
+
+func (c *Calibration) sortPoints() error {
+	sort.Slice(c.Points, func(i, j int) bool {
+		return c.Points[i].Raw < c.Points[j].Raw
+	})
+	for i := 1; i < len(c.Points); i++ {
+		if c.Points[i].Raw == c.Points[i-1].Raw {
+			return fmt.Errorf("Calibration table has more than one point at %v", c.Points[i].Raw)
+		}
+	}
+	return nil
+}
+
+// NewCalibration returns the calibration for a set of measured points.
+// A single point results in an offset and more than one in a table
+func NewCalibration(points []CalibrationPoint) (*Calibration, error) {
+	switch len(points) {
+	case 0:
+		return nil, fmt.Errorf("No calibration points")
+	case 1:
+		return &Calibration{Offset: points[0].Actual - points[0].Raw}, nil
+	}
+	c := &Calibration{Points: append([]CalibrationPoint(nil), points...)}
+	if err := c.sortPoints(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *Calibration) Apply(raw float64) float64 {
+	if len(c.Points) < 2 {
+		gain := c.Gain
+		if gain == 0 {
+			gain = 1
+		}
+		return gain*raw + c.Offset
+	}
+	// Find the segment containing raw, using the outermost segments for
+	// readings outside of the table
+	i := sort.Search(len(c.Points), func(i int) bool {
+		return c.Points[i].Raw >= raw
+	})
+	if i == 0 {
+		i = 1
+	} else if i == len(c.Points) {
+		i = len(c.Points) - 1
+	}
+	lo, hi := c.Points[i-1], c.Points[i]
+	return lo.Actual + (raw-lo.Raw)*(hi.Actual-lo.Actual)/(hi.Raw-lo.Raw)
+}
+
+func parseCalibration(data interface{}) (*Calibration, error) {
+	b, err := yaml.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal key 'calibration': %v: %v", data, err)
+	}
+	c := &Calibration{}
+	if err := yaml.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("Failed while parsing calibration: %v", err)
+	}
+	return c, nil
+}
+
+// CalibratedProbe applies a calibration to the readings of a probe
+type CalibratedProbe struct {
+	probe       interfaces.TemperatureSensorInterface
+	calibration *Calibration
+}
+
+func NewCalibratedProbe(probe interfaces.TemperatureSensorInterface, calibration *Calibration) *CalibratedProbe {
+	return &CalibratedProbe{probe, calibration}
+}
+
+// SetClock passes the clock on to the underlying probe if it accepts one
+func (p *CalibratedProbe) SetClock(clock Clock) {
+	if s, ok := p.probe.(clockSetter); ok {
+		s.SetClock(clock)
+	}
+}
+
+func (p *CalibratedProbe) GetTemperature() (float64, error) {
+	temp, err := p.probe.GetTemperature()
+	if err != nil {
+		return 0, err
+	}
+	return p.calibration.Apply(temp), nil
+}
+
+// Calibrator interactively records readings of an uncalibrated probe against
+// reference temperatures entered by the user
+type Calibrator struct {
+	Probe interfaces.TemperatureSensorInterface
+	// Number of readings averaged for each point
+	Samples  int
+	Interval time.Duration
+	clock    Clock
+}
+
+func (c *Calibrator) SetClock(clock Clock) {
+	c.clock = clock
+}
+
+func (c *Calibrator) read() (float64, error) {
+	clock := clockOrDefault(c.clock)
+	samples := c.Samples
+	if samples < 1 {
+		samples = 1
+	}
+	sum := 0.0
+	for i := 0; i < samples; i++ {
+		if i > 0 {
+			clock.Sleep(c.Interval)
+		}
+		temp, err := c.Probe.GetTemperature()
+		if err != nil {
+			return 0, err
+		}
+		sum += temp
+	}
+	return sum / float64(samples), nil
+}
+
+// Run prompts for reference temperatures on out and reads them from in until
+// an empty line or EOF. The probe is read after each reference temperature
+func (c *Calibrator) Run(in io.Reader, out io.Writer) (*Calibration, error) {
+	points := make([]CalibrationPoint, 0)
+	scanner := bufio.NewScanner(in)
+	for {
+		fmt.Fprintf(out, "Reference temperature (empty line to finish): ")
+		if !scanner.Scan() {
+			break
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			break
+		}
+		actual, err := strconv.ParseFloat(line, 64)
+		if err != nil {
+			fmt.Fprintf(out, "Invalid temperature '%v'\n", line)
+			continue
+		}
+		raw, err := c.read()
+		if err != nil {
+			fmt.Fprintf(out, "Failed to read probe: %v\n", err)
+			continue
+		}
+		fmt.Fprintf(out, "Probe read %.3f for %.3f\n", raw, actual)
+		points = append(points, CalibrationPoint{Raw: raw, Actual: actual})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return NewCalibration(points)
+}
+
+// WriteCalibration sets the calibration of a probe in the config file at path.
+// An empty probe name sets the top-level calibration used when the 'probes'
+// list is not in use. Other keys are left untouched, though comments are lost
+func WriteCalibration(path string, probe string, calibration *Calibration) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	conf := yaml.MapSlice{}
+	if err := yaml.Unmarshal(data, &conf); err != nil {
+		return fmt.Errorf("Failed to parse '%v': %v", path, err)
+	}
+
+	if probe == "" {
+		conf = setMapSliceKey(conf, "calibration", calibration)
+	} else {
+		found := false
+		for _, item := range conf {
+			if item.Key != "probes" {
+				continue
+			}
+			probes, ok := item.Value.([]interface{})
+			if !ok {
+				return fmt.Errorf("Failed while parsing probes: %v", item.Value)
+			}
+			for idx, p := range probes {
+				m, ok := p.(yaml.MapSlice)
+				if !ok {
+					continue
+				}
+				for _, kv := range m {
+					if kv.Key == "name" && fmt.Sprintf("%v", kv.Value) == probe {
+						probes[idx] = setMapSliceKey(m, "calibration", calibration)
+						found = true
+					}
+				}
+			}
+		}
+		if !found {
+			return fmt.Errorf("No probe named '%v' in '%v'", probe, path)
+		}
+	}
+
+	b, err := yaml.Marshal(conf)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, b, info.Mode())
+}
+
+func setMapSliceKey(m yaml.MapSlice, key string, value interface{}) yaml.MapSlice {
+	for idx := range m {
+		if m[idx].Key == key {
+			m[idx].Value = value
+			return m
+		}
+	}
+	return append(m, yaml.MapItem{Key: key, Value: value})
+}
@@ -0,0 +1,149 @@
+package thermabox
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gurupras/thermabox/interfaces"
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var _ interfaces.TemperatureSensorInterface = &CalibratedProbe{}
+
+func TestParseYamlCalibration(t *testing.T) {
+	require := require.New(t)
+
+	tbox := &Thermabox{}
+	tbox.SetRelays(&FakeRelay{}, &FakeRelay{})
+	err := yaml.Unmarshal([]byte(`
+heating_element:
+  relay:
+    pins: [22]
+cooling_element:
+  relay:
+    pins: [23]
+calibration:
+  offset: -1.2
+probes:
+  - name: linear
+    source: usb
+    calibration:
+      gain: 1.1
+      offset: 0.5
+  - name: table
+    source: usb
+    calibration:
+      points:
+        - {raw: 30, actual: 28}
+        - {raw: 0.5, actual: 0}
+`), tbox)
+	require.Nil(err)
+	require.Equal(&Calibration{Offset: -1.2, Gain: 1}, tbox.Calibration())
+	require.Equal(&Calibration{Offset: 0.5, Gain: 1.1}, tbox.ProbeConfigs()[0].Calibration)
+	// Sorted by raw
+	require.Equal([]CalibrationPoint{{0.5, 0}, {30, 28}}, tbox.ProbeConfigs()[1].Calibration.Points)
+
+	for _, str := range []string{
+		`calibration: {gain: 0}`,
+		`calibration: {points: [{raw: 1, actual: 2}]}`,
+		`calibration: {points: [{raw: 1, actual: 2}, {raw: 1, actual: 3}]}`,
+	} {
+		tbox = &Thermabox{}
+		require.NotNil(yaml.Unmarshal([]byte(str), tbox), str)
+	}
+}
+
+func TestCalibrationApply(t *testing.T) {
+	require := require.New(t)
+
+	require.Equal(19.0, (&Calibration{Offset: -1}).Apply(20))
+	require.InDelta(21.5, (&Calibration{Offset: -0.5, Gain: 1.1}).Apply(20), 1e-9)
+
+	table := &Calibration{Points: []CalibrationPoint{{0, 1}, {10, 10}, {20, 22}}}
+	require.InDelta(5.5, table.Apply(5), 1e-9)
+	require.InDelta(16.0, table.Apply(15), 1e-9)
+	require.InDelta(10.0, table.Apply(10), 1e-9)
+	// Extrapolated
+	require.InDelta(-8.0, table.Apply(-10), 1e-9)
+	require.InDelta(34.0, table.Apply(30), 1e-9)
+
+	probe := NewCalibratedProbe(&flakyProbe{temp: 15}, table)
+	temp, err := probe.GetTemperature()
+	require.Nil(err)
+	require.InDelta(16.0, temp, 1e-9)
+}
+
+func TestCalibrator(t *testing.T) {
+	require := require.New(t)
+
+	probe := &sequenceProbe{temps: []float64{0.4, 0.6, 20, 22, 40, 42}}
+	c := &Calibrator{Probe: probe, Samples: 2}
+	out := &bytes.Buffer{}
+	calibration, err := c.Run(strings.NewReader("0\nabc\n20\n40\n\n"), out)
+	require.Nil(err)
+	require.Equal([]CalibrationPoint{{0.5, 0}, {21, 20}, {41, 40}}, calibration.Points)
+	require.Contains(out.String(), "Invalid temperature 'abc'")
+
+	// A single point is an offset
+	probe = &sequenceProbe{temps: []float64{21.5}}
+	c = &Calibrator{Probe: probe}
+	calibration, err = c.Run(strings.NewReader("20"), out)
+	require.Nil(err)
+	require.Equal(&Calibration{Offset: -1.5}, calibration)
+
+	_, err = c.Run(strings.NewReader(""), out)
+	require.NotNil(err)
+}
+
+func TestWriteCalibration(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "thermabox-calibration")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "conf.yaml")
+
+	conf := `heating_element:
+  relay:
+    pins: [22]
+cooling_element:
+  relay:
+    pins: [23]
+temperature: 18
+probes:
+  - name: inner
+    source: usb
+  - name: outer
+    source: w1:28-000005e2fdc3
+    calibration:
+      offset: 1
+`
+	require.Nil(ioutil.WriteFile(path, []byte(conf), 0640))
+
+	table := &Calibration{Points: []CalibrationPoint{{0.5, 0}, {21, 20}}}
+	require.Nil(WriteCalibration(path, "outer", table))
+	require.Nil(WriteCalibration(path, "", &Calibration{Offset: -2}))
+	require.NotNil(WriteCalibration(path, "missing", table))
+
+	info, err := os.Stat(path)
+	require.Nil(err)
+	require.Equal(os.FileMode(0640), info.Mode())
+
+	tbox := &Thermabox{}
+	tbox.SetRelays(&FakeRelay{}, &FakeRelay{})
+	data, err := ioutil.ReadFile(path)
+	require.Nil(err)
+	require.Nil(yaml.Unmarshal(data, tbox))
+	require.Equal(18.0, tbox.temperature)
+	require.Nil(tbox.ProbeConfigs()[0].Calibration)
+	require.Equal(table.Points, tbox.ProbeConfigs()[1].Calibration.Points)
+	require.Equal(0.0, tbox.ProbeConfigs()[1].Calibration.Offset)
+	require.Equal(-2.0, tbox.Calibration().Offset)
+	// Key order is preserved
+	require.True(strings.HasPrefix(string(data), "heating_element:"))
+}
@@ -0,0 +1,95 @@
+package thermabox
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is the source of time for the control loop, elements and probes
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+type realClock struct {
+}
+
+func (r realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (r realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+// clockOrDefault returns the real clock if c is nil
+func clockOrDefault(c Clock) Clock {
+	if c == nil {
+		return realClock{}
+	}
+	return c
+}
+
+// FakeClock is a clock that only moves forward when Advance is called.
+// Sleep blocks until the clock has been advanced past the deadline
+type FakeClock struct {
+	now      time.Time
+	sleepers []*sleeper
+	mutex    sync.Mutex
+	cond     *sync.Cond
+}
+
+type sleeper struct {
+	until time.Time
+	done  chan struct{}
+}
+
+func NewFakeClock(start time.Time) *FakeClock {
+	f := &FakeClock{now: start}
+	f.cond = sync.NewCond(&f.mutex)
+	return f
+}
+
+func (f *FakeClock) Now() time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.now
+}
+
+func (f *FakeClock) Sleep(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	f.mutex.Lock()
+	s := &sleeper{f.now.Add(d), make(chan struct{})}
+	f.sleepers = append(f.sleepers, s)
+	f.cond.Broadcast()
+	f.mutex.Unlock()
+	<-s.done
+}
+
+// Advance moves the clock forward and wakes up any sleepers whose deadline
+// has passed
+func (f *FakeClock) Advance(d time.Duration) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.now = f.now.Add(d)
+	remaining := f.sleepers[:0]
+	for _, s := range f.sleepers {
+		if !s.until.After(f.now) {
+			close(s.done)
+		} else {
+			remaining = append(remaining, s)
+		}
+	}
+	f.sleepers = remaining
+}
+
+// BlockUntil waits until at least n goroutines are sleeping on the clock
+func (f *FakeClock) BlockUntil(n int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for len(f.sleepers) < n {
+		f.cond.Wait()
+	}
+}
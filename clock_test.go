@@ -0,0 +1,32 @@
+package thermabox
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFakeClock(t *testing.T) {
+	require := require.New(t)
+
+	start := time.Now()
+	clock := NewFakeClock(start)
+	require.Equal(start, clock.Now())
+
+	done := make(chan struct{})
+	go func() {
+		clock.Sleep(time.Minute)
+		close(done)
+	}()
+	clock.BlockUntil(1)
+	clock.Advance(30 * time.Second)
+	select {
+	case <-done:
+		require.Fail("Sleep returned before the deadline")
+	default:
+	}
+	clock.Advance(30 * time.Second)
+	<-done
+	require.Equal(start.Add(time.Minute), clock.Now())
+}
@@ -1,8 +1,12 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	yaml "gopkg.in/yaml.v2"
 
@@ -11,37 +15,91 @@ import (
 	easyfiles "github.com/gurupras/go-easyfiles"
 	"github.com/gurupras/thermabox"
 	"github.com/gurupras/thermabox/interfaces"
+	"github.com/gurupras/thermabox/sim"
 	log "github.com/sirupsen/logrus"
 )
 
 var (
 	app          = kingpin.New("ThermaBox", "Temperature-controller")
-	conf         = app.Arg("conf", "Configuration file (YAML)").Required().String()
 	verbose      = app.Flag("verbose", "Verbose logging").Short('v').Default("false").Bool()
-	sensorSource = app.Flag("sensor", "Temperature sensor source").Short('S').Default("usb").String()
-	temperature  = app.Flag("temperature", "Override conf temperature").Short('t').Default("-100").Float64()
-	threshold    = app.Flag("threshold", "Override conf threshold").Short('T').Default("-100").Float64()
+	sensorSource = app.Flag("sensor", "Temperature sensor source (usb, sim, w1:<id> or an HTTP URL)").Short('S').Default("usb").String()
+
+	runCmd      = app.Command("run", "Run the temperature controller").Default()
+	conf        = runCmd.Arg("conf", "Configuration file (YAML)").Required().String()
+	temperature = runCmd.Flag("temperature", "Override conf temperature").Short('t').Default("-100").Float64()
+	threshold   = runCmd.Flag("threshold", "Override conf threshold").Short('T').Default("-100").Float64()
+
+	calibrateCmd      = app.Command("calibrate", "Calibrate a probe against reference temperatures and write the result to the configuration file")
+	calibrateConf     = calibrateCmd.Arg("conf", "Configuration file (YAML)").Required().String()
+	calibrateProbe    = calibrateCmd.Flag("probe", "Name of the probe in the 'probes' list to calibrate. Defaults to --sensor").String()
+	calibrateSamples  = calibrateCmd.Flag("samples", "Number of readings averaged for each point").Default("5").Int()
+	calibrateInterval = calibrateCmd.Flag("interval", "Time between readings").Default("1s").Duration()
 )
 
 func main() {
-	kingpin.MustParse(app.Parse(os.Args[1:]))
+	cmd := kingpin.MustParse(app.Parse(os.Args[1:]))
 	if *verbose {
 		log.SetLevel(log.DebugLevel)
 	}
 
-	if !easyfiles.Exists(*conf) {
-		log.Fatalf("Configuration file '%v' does not exist")
+	switch cmd {
+	case runCmd.FullCommand():
+		run()
+	case calibrateCmd.FullCommand():
+		calibrate()
 	}
+}
 
-	tbox := thermabox.Thermabox{}
-	data, err := ioutil.ReadFile(*conf)
+func readConf(path string) []byte {
+	if !easyfiles.Exists(path) {
+		log.Fatalf("Configuration file '%v' does not exist", path)
+	}
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		log.Fatalf("Failed to read conf file: %v", err)
 	}
+	return data
+}
+
+// loadPlant returns the simulated box when using the simulated sensor.
+// Its parameters are read from the 'sim' key
+func loadPlant(data []byte) *sim.Plant {
+	if *sensorSource != "sim" {
+		return nil
+	}
+	simConf := struct {
+		Plant *sim.Plant `yaml:"sim"`
+	}{sim.NewPlant(sim.WallClock{}, 22)}
+	if err := yaml.Unmarshal(data, &simConf); err != nil {
+		log.Fatalf("Failed to unmarshal sim: %v", err)
+	}
+	return simConf.Plant
+}
+
+// load reads the configuration file. The returned plant is only set
+// when using the simulated sensor
+func load(path string) (*thermabox.Thermabox, *sim.Plant) {
+	data := readConf(path)
+	tbox := &thermabox.Thermabox{}
+	plant := loadPlant(data)
+	if plant != nil {
+		tbox.SetRelays(plant.HeatingRelay(), plant.CoolingRelay())
+	}
 
-	if err := yaml.Unmarshal(data, &tbox); err != nil {
+	if err := yaml.Unmarshal(data, tbox); err != nil {
 		log.Fatalf("Failed to unmarshal yaml: %v", err)
 	}
+	return tbox, plant
+}
+
+func run() {
+	tbox, plant := load(*conf)
+
+	// Restore before applying the command line limits so that they take
+	// precedence over the persisted ones
+	if err := tbox.RestoreState(); err != nil {
+		log.Fatalf("Failed to restore state: %v", err)
+	}
 
 	def_temperature, def_threshold := tbox.GetLimits()
 	if *temperature != -100 {
@@ -52,22 +110,136 @@ func main() {
 	}
 	tbox.SetLimits(def_temperature, def_threshold)
 
-	// Get a hold of the temperature sensor
-	var sensor interfaces.TemperatureSensorInterface
-	switch *sensorSource {
+	// Get a hold of the temperature sensors
+	if configs := tbox.ProbeConfigs(); len(configs) > 0 {
+		for _, c := range configs {
+			sensor, err := newSensor(c.Source, plant)
+			if err != nil {
+				log.Fatalf("Failed to acquire temperature sensor '%v': %v", c.Name, err)
+			}
+			if sensor, err = withCorrections(sensor, c.Calibration, c.Filters); err != nil {
+				log.Fatalf("Failed to set up filters for '%v': %v", c.Name, err)
+			}
+			tbox.AddProbe(c.Name, sensor)
+		}
+	} else {
+		sensor, err := newSensor(*sensorSource, plant)
+		if err != nil {
+			log.Fatalf("Failed to acquire temperature sensor: %v", err)
+		}
+		if sensor, err = withCorrections(sensor, tbox.Calibration(), tbox.FilterConfigs()); err != nil {
+			log.Fatalf("Failed to set up filters: %v", err)
+		}
+		tbox.SetProbe(sensor)
+	}
+	if source := tbox.SafetyProbeSource(); source != "" {
+		sensor, err := newSensor(source, plant)
+		if err != nil {
+			log.Fatalf("Failed to acquire safety temperature sensor: %v", err)
+		}
+		if sensor, err = withCorrections(sensor, tbox.SafetyProbeCalibration(), nil); err != nil {
+			log.Fatalf("Failed to calibrate safety temperature sensor: %v", err)
+		}
+		tbox.SetSafetyProbe(sensor)
+	}
+
+	// Turn the elements off on SIGINT/SIGTERM. Run returns once stopped
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Infof("Received %v. Stopping", sig)
+		tbox.Stop()
+	}()
+
+	// We now have the thermabox ready
+	err := tbox.Run()
+	if closeErr := tbox.Close(); closeErr != nil {
+		log.Errorf("Failed to release relays: %v", closeErr)
+	}
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+}
+
+func calibrate() {
+	// Only the probes are read. Loading the whole thermabox would take over
+	// the relays of a thermabox that may be running
+	data := readConf(*calibrateConf)
+	plant := loadPlant(data)
+	conf := struct {
+		Probes []*thermabox.ProbeConfig `yaml:"probes"`
+	}{}
+	if err := yaml.Unmarshal(data, &conf); err != nil {
+		log.Fatalf("Failed to unmarshal probes: %v", err)
+	}
+
+	source := *sensorSource
+	if *calibrateProbe == "" && len(conf.Probes) > 0 {
+		log.Fatalf("'%v' has a list of probes. Use --probe to choose one", *calibrateConf)
+	}
+	if *calibrateProbe != "" {
+		source = ""
+		for _, c := range conf.Probes {
+			if c.Name == *calibrateProbe {
+				source = c.Source
+			}
+		}
+		if source == "" {
+			log.Fatalf("No probe named '%v' in '%v'", *calibrateProbe, *calibrateConf)
+		}
+	}
+	sensor, err := newSensor(source, plant)
+	if err != nil {
+		log.Fatalf("Failed to acquire temperature sensor: %v", err)
+	}
+
+	calibrator := &thermabox.Calibrator{
+		Probe:    sensor,
+		Samples:  *calibrateSamples,
+		Interval: *calibrateInterval,
+	}
+	calibration, err := calibrator.Run(os.Stdin, os.Stdout)
+	if err != nil {
+		log.Fatalf("Failed to calibrate: %v", err)
+	}
+	if err := thermabox.WriteCalibration(*calibrateConf, *calibrateProbe, calibration); err != nil {
+		log.Fatalf("Failed to write calibration: %v", err)
+	}
+	b, _ := yaml.Marshal(calibration)
+	fmt.Printf("Wrote calibration to '%v':\n%v", *calibrateConf, string(b))
+}
+
+// newSensor returns the sensor for a source as accepted by --sensor.
+// plant is only used by the 'sim' source
+func newSensor(source string, plant *sim.Plant) (interfaces.TemperatureSensorInterface, error) {
+	if strings.HasPrefix(source, "w1:") {
+		return thermabox.NewW1Probe(strings.TrimPrefix(source, "w1:")), nil
+	}
+	switch source {
 	case "usb":
 		fallthrough
 	case "USB":
-		sensor, err = temperusb.New()
-		if err != nil {
-			log.Fatalf("Failed to acquire temperature sensor: %v", err)
+		return temperusb.New()
+	case "sim":
+		if plant == nil {
+			return nil, fmt.Errorf("The 'sim' source requires --sensor sim")
 		}
+		log.Infof("Using simulated thermabox: ambient=%v heater=%vW cooler=%vW", plant.Ambient, plant.HeaterWatts, plant.CoolerWatts)
+		return plant, nil
 	default:
 		// Assumes HTTP
-		sensor = &thermabox.HTTPProbe{*sensorSource}
+		return thermabox.NewHTTPProbe(source), nil
 	}
-	tbox.SetProbe(sensor)
+}
 
-	// We now have the thermabox ready
-	log.Fatalf("%v", tbox.Run())
+// withCorrections calibrates the sensor's readings and then filters them
+func withCorrections(sensor interfaces.TemperatureSensorInterface, calibration *thermabox.Calibration, filters []*thermabox.FilterConfig) (interfaces.TemperatureSensorInterface, error) {
+	if calibration != nil {
+		sensor = thermabox.NewCalibratedProbe(sensor, calibration)
+	}
+	if len(filters) == 0 {
+		return sensor, nil
+	}
+	return thermabox.NewFilteredProbe(sensor, filters)
 }
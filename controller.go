@@ -0,0 +1,244 @@
+package thermabox
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/gurupras/thermabox/interfaces"
+	yaml "gopkg.in/yaml.v2"
+)
+
+type ControlMode string
+
+const (
+	BANG_BANG ControlMode = "bang_bang"
+	PID       ControlMode = "pid"
+)
+
+// ControllerInput is handed to a Controller on every sample
+type ControllerInput struct {
+	Temperature float64
+	Setpoint    float64
+	Threshold   float64
+	State       interfaces.State
+	// Elapsed is the time since the previous sample.
+	// It is 0 on the first sample
+	Elapsed time.Duration
+}
+
+// ControllerOutput describes the desired state of the heating and cooling
+// elements along with the resulting thermabox state
+type ControllerOutput struct {
+	Heat  bool
+	Cool  bool
+	State interfaces.State
+}
+
+// Controller decides whether the heating and cooling elements should be on.
+// Controllers do not touch elements themselves; Thermabox actuates the
+// elements based on the returned output.
+// A State of UNKNOWN in the input signals that the controller should
+// discard any accumulated history.
+type Controller interface {
+	Update(in ControllerInput) ControllerOutput
+}
+
+func newController(mode ControlMode, m map[string]interface{}, cutoffAtThreshold bool) (Controller, error) {
+	switch mode {
+	case BANG_BANG:
+		return NewBangBangController(cutoffAtThreshold), nil
+	case PID:
+		pid := NewPIDController(0, 0, 0, 0)
+		if data, ok := m["pid"]; ok {
+			b, err := yaml.Marshal(data)
+			if err != nil {
+				return nil, fmt.Errorf("Failed to marshal key 'pid': %v: %v", data, err)
+			}
+			if err := yaml.Unmarshal(b, pid); err != nil {
+				return nil, fmt.Errorf("Failed while parsing pid: %v", err)
+			}
+		}
+		return pid, nil
+	default:
+		return nil, fmt.Errorf("Unknown control_mode: %v", mode)
+	}
+}
+
+// BangBangController is the threshold-based on/off controller.
+// Elements are switched on once the temperature leaves the band
+// (temperature +/- threshold) and switched off once it is back.
+// With CutoffAtThreshold, elements are switched off as soon as the
+// temperature re-enters the band rather than when it reaches the setpoint.
+type BangBangController struct {
+	CutoffAtThreshold bool
+}
+
+func NewBangBangController(cutoffAtThreshold bool) *BangBangController {
+	return &BangBangController{cutoffAtThreshold}
+}
+
+func (b *BangBangController) Update(in ControllerInput) ControllerOutput {
+	temp := in.Temperature
+	lowerLimit := in.Setpoint - in.Threshold
+	upperLimit := in.Setpoint + in.Threshold
+
+	state := in.State
+	if state == interfaces.STABLE || state == interfaces.UNKNOWN {
+		if temp < lowerLimit {
+			// Temperature has dropped below threshold
+			// Start heating element to warm it back up
+			return ControllerOutput{true, false, interfaces.HEATING_UP}
+		} else if temp > upperLimit {
+			return ControllerOutput{false, true, interfaces.COOLING_DOWN}
+		}
+		return ControllerOutput{false, false, interfaces.STABLE}
+	}
+
+	// Check if stable
+	// We now have 2 cases to deal with
+	cutoff := false
+	if b.CutoffAtThreshold {
+		if temp >= lowerLimit && temp <= upperLimit {
+			cutoff = true
+		}
+	} else {
+		// We only deal with 1 decimal point of precision
+		val := round(temp, 0.5, 1)
+		expected := round(in.Setpoint, 0.5, 1)
+		switch state {
+		case interfaces.HEATING_UP:
+			if val >= expected {
+				cutoff = true
+			}
+		case interfaces.COOLING_DOWN:
+			if val <= expected {
+				cutoff = true
+			}
+		}
+	}
+	if cutoff {
+		return ControllerOutput{false, false, interfaces.STABLE}
+	}
+	return ControllerOutput{state == interfaces.HEATING_UP, state == interfaces.COOLING_DOWN, state}
+}
+
+// PIDController computes a signed output in [-1, 1] from the error between
+// the target temperature and the measured temperature. A positive output is
+// the duty cycle of the heating element and a negative output is the duty
+// cycle of the cooling element. Elements are time-proportioned: within each
+// window, the element is on for output * window and off for the remainder.
+type PIDController struct {
+	Kp     float64       `yaml:"kp"`
+	Ki     float64       `yaml:"ki"`
+	Kd     float64       `yaml:"kd"`
+	Window time.Duration `yaml:"-"`
+
+	integral      float64
+	lastTemp      float64
+	initialized   bool
+	windowElapsed time.Duration
+	output        float64
+}
+
+// defaultPIDWindow is the time-proportioning window used when none is given
+const defaultPIDWindow = 60 * time.Second
+
+func NewPIDController(kp, ki, kd float64, window time.Duration) *PIDController {
+	if window == 0 {
+		window = defaultPIDWindow
+	}
+	return &PIDController{
+		Kp:     kp,
+		Ki:     ki,
+		Kd:     kd,
+		Window: window,
+	}
+}
+
+func (p *PIDController) UnmarshalYAML(unmarshal func(i interface{}) error) error {
+	m := make(map[string]interface{})
+	if err := unmarshal(&m); err != nil {
+		return err
+	}
+	keys := []string{"kp", "ki", "kd", "window_sec"}
+	vals := make([]float64, len(keys))
+	for idx, key := range keys {
+		v, err := parseFloat(m, key, 0)
+		if err != nil {
+			return err
+		}
+		vals[idx] = v
+	}
+	if _, ok := m["window_sec"]; ok && vals[3] <= 0 {
+		return fmt.Errorf("PID window_sec must be > 0: %v", vals[3])
+	}
+	*p = *NewPIDController(vals[0], vals[1], vals[2], seconds(vals[3]))
+	return nil
+}
+
+// Output returns the last computed output in [-1, 1]
+func (p *PIDController) Output() float64 {
+	return p.output
+}
+
+func (p *PIDController) reset() {
+	p.integral = 0
+	p.output = 0
+	p.initialized = false
+	p.windowElapsed = 0
+}
+
+func (p *PIDController) Update(in ControllerInput) ControllerOutput {
+	if in.State == interfaces.UNKNOWN {
+		p.reset()
+	}
+	temp := in.Temperature
+	err := in.Setpoint - temp
+
+	var derivative float64
+	if p.initialized {
+		dt := in.Elapsed.Seconds()
+		if dt > 0 {
+			// Derivative on measurement to avoid a kick when the limits change
+			derivative = -(temp - p.lastTemp) / dt
+			// Anti-windup: only integrate while the output is not saturated
+			// in the direction of the error
+			integral := p.integral + p.Ki*err*dt
+			unclamped := p.Kp*err + integral + p.Kd*derivative
+			if math.Abs(unclamped) < 1 || math.Signbit(err) != math.Signbit(unclamped) {
+				p.integral = clamp(integral, -1, 1)
+			}
+		}
+	}
+	p.lastTemp = temp
+	p.output = clamp(p.Kp*err+p.integral+p.Kd*derivative, -1, 1)
+
+	window := p.Window
+	if window <= 0 {
+		window = defaultPIDWindow
+	}
+	if p.initialized {
+		p.windowElapsed = (p.windowElapsed + in.Elapsed) % window
+	}
+	p.initialized = true
+	onTime := time.Duration(math.Abs(p.output) * float64(window))
+	on := p.windowElapsed < onTime
+
+	heat := on && p.output > 0
+	cool := on && p.output < 0
+
+	state := interfaces.STABLE
+	if math.Abs(err) > in.Threshold {
+		if err > 0 {
+			state = interfaces.HEATING_UP
+		} else {
+			state = interfaces.COOLING_DOWN
+		}
+	}
+	return ControllerOutput{heat, cool, state}
+}
+
+func clamp(val, min, max float64) float64 {
+	return math.Max(min, math.Min(max, val))
+}
@@ -0,0 +1,227 @@
+package thermabox
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gurupras/thermabox/interfaces"
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestParseYamlControlMode(t *testing.T) {
+	require := require.New(t)
+	str := `
+heating_element:
+  relay:
+    active_high: false
+    pins: [22]
+cooling_element:
+  relay:
+    active_high: false
+    pins: [23]
+temperature: 20
+threshold: 0.5
+control_mode: pid
+pid:
+  kp: 0.5
+  ki: 0.01
+  kd: 2
+  window_sec: 30
+`
+	tbox := &Thermabox{}
+	tbox.heatingElement = &Element{relay: &FakeRelay{}}
+	tbox.coolingElement = &Element{relay: &FakeRelay{}}
+
+	err := yaml.Unmarshal([]byte(str), tbox)
+	require.Nil(err)
+	require.Equal(PID, tbox.controlMode)
+	pid, ok := tbox.controller.(*PIDController)
+	require.True(ok)
+	require.Equal(0.5, pid.Kp)
+	require.Equal(0.01, pid.Ki)
+	require.Equal(2.0, pid.Kd)
+	require.Equal(30*time.Second, pid.Window)
+
+	// Default is bang-bang
+	tbox = &Thermabox{}
+	tbox.heatingElement = &Element{relay: &FakeRelay{}}
+	tbox.coolingElement = &Element{relay: &FakeRelay{}}
+	err = yaml.Unmarshal([]byte(`
+heating_element:
+  relay:
+    pins: [22]
+cooling_element:
+  relay:
+    pins: [23]
+`), tbox)
+	require.Nil(err)
+	require.Equal(BANG_BANG, tbox.controlMode)
+	_, ok = tbox.controller.(*BangBangController)
+	require.True(ok)
+
+	for _, str := range []string{
+		`control_mode: fuzzy`,
+		`{control_mode: pid, pid: {kp: 0.5, window_sec: 0}}`,
+		`{control_mode: pid, pid: {kp: 0.5, window_sec: -30}}`,
+	} {
+		tbox = &Thermabox{}
+		require.NotNil(yaml.Unmarshal([]byte(str), tbox), str)
+	}
+}
+
+func TestBangBangController(t *testing.T) {
+	require := require.New(t)
+
+	c := NewBangBangController(false)
+	in := ControllerInput{Setpoint: 20, Threshold: 0.5, State: interfaces.UNKNOWN}
+	update := func(temp float64) ControllerOutput {
+		in.Temperature = temp
+		out := c.Update(in)
+		in.State = out.State
+		return out
+	}
+
+	require.Equal(ControllerOutput{false, false, interfaces.STABLE}, update(20.2))
+	require.Equal(ControllerOutput{true, false, interfaces.HEATING_UP}, update(19.4))
+	// Still heating until we reach the target
+	require.Equal(ControllerOutput{true, false, interfaces.HEATING_UP}, update(19.8))
+	require.Equal(ControllerOutput{false, false, interfaces.STABLE}, update(20.0))
+	require.Equal(ControllerOutput{false, true, interfaces.COOLING_DOWN}, update(20.6))
+	require.Equal(ControllerOutput{false, true, interfaces.COOLING_DOWN}, update(20.4))
+
+	// With cutoff_at_threshold we stop as soon as we're back in the band
+	c.CutoffAtThreshold = true
+	update(20.6)
+	require.Equal(ControllerOutput{false, false, interfaces.STABLE}, update(20.4))
+}
+
+func TestPIDControllerTimeProportioned(t *testing.T) {
+	require := require.New(t)
+
+	pid := NewPIDController(0.5, 0, 0, 10*time.Second)
+	in := ControllerInput{Setpoint: 20, Threshold: 0.5, State: interfaces.UNKNOWN}
+	update := func(temp float64, elapsed time.Duration) ControllerOutput {
+		in.Temperature = temp
+		in.Elapsed = elapsed
+		out := pid.Update(in)
+		in.State = out.State
+		return out
+	}
+
+	// 1 degree below target => 50% heating duty
+	out := update(19, 0)
+	require.Equal(0.5, pid.Output())
+	require.Equal(ControllerOutput{true, false, interfaces.HEATING_UP}, out)
+
+	require.True(update(19, 4*time.Second).Heat)
+	require.False(update(19, 2*time.Second).Heat)
+	// New window
+	require.True(update(19, 4*time.Second).Heat)
+
+	// Above target => cooling
+	out = update(21, 10*time.Second)
+	require.Equal(-0.5, pid.Output())
+	require.Equal(ControllerOutput{false, true, interfaces.COOLING_DOWN}, out)
+
+	// Within threshold is reported as stable
+	require.Equal(interfaces.STABLE, update(20.2, 10*time.Second).State)
+
+	// Built without a window, the default is used
+	pid = &PIDController{Kp: 0.5}
+	in.State = interfaces.UNKNOWN
+	require.True(update(19, 0).Heat)
+	require.True(update(19, 20*time.Second).Heat)
+	require.False(update(19, 20*time.Second).Heat)
+}
+
+func TestPIDControllerAntiWindup(t *testing.T) {
+	require := require.New(t)
+
+	pid := NewPIDController(1, 0.1, 0, 10*time.Second)
+	in := ControllerInput{Temperature: 10, Setpoint: 20, Threshold: 0.5, State: interfaces.UNKNOWN}
+
+	// Stay far below the target for a long time
+	for i := 0; i < 1000; i++ {
+		in.State = pid.Update(in).State
+		in.Elapsed = time.Second
+	}
+	require.Equal(1.0, pid.Output())
+	require.True(pid.integral <= 1.0)
+
+	// Once above target, the controller must not keep heating because of
+	// accumulated integral
+	in.Temperature = 22
+	pid.Update(in)
+	require.True(pid.Output() <= 0, "output=%v", pid.Output())
+}
+
+type sequenceProbe struct {
+	temps []float64
+	idx   int
+}
+
+func (s *sequenceProbe) GetTemperature() (float64, error) {
+	temp := s.temps[s.idx]
+	if s.idx < len(s.temps)-1 {
+		s.idx++
+	}
+	return temp, nil
+}
+
+type recordingController struct {
+	inputs []ControllerInput
+	out    ControllerOutput
+}
+
+func (r *recordingController) Update(in ControllerInput) ControllerOutput {
+	r.inputs = append(r.inputs, in)
+	return r.out
+}
+
+func TestThermaboxStepController(t *testing.T) {
+	require := require.New(t)
+
+	tbox := &Thermabox{temperature: 20, threshold: 0.5}
+	tbox.heatingElement = &Element{relay: NewFakeRelay(false, []int{1})}
+	tbox.coolingElement = &Element{relay: NewFakeRelay(false, []int{1})}
+	tbox.SetProbe(&sequenceProbe{temps: []float64{19, 19.5}})
+
+	c := &recordingController{out: ControllerOutput{true, false, interfaces.HEATING_UP}}
+	tbox.SetController(c)
+
+	require.Nil(tbox.Step())
+	require.Equal(1, len(c.inputs))
+	require.Equal(ControllerInput{19, 20, 0.5, interfaces.UNKNOWN, 0}, c.inputs[0])
+	require.Equal(interfaces.HEATING_UP, tbox.state)
+	require.True(tbox.heatingElement.IsOn())
+	require.False(tbox.coolingElement.IsOn())
+
+	c.out = ControllerOutput{false, true, interfaces.COOLING_DOWN}
+	require.Nil(tbox.Step())
+	require.Equal(2, len(c.inputs))
+	require.Equal(19.5, c.inputs[1].Temperature)
+	require.Equal(interfaces.HEATING_UP, c.inputs[1].State)
+	require.True(c.inputs[1].Elapsed > 0)
+	require.False(tbox.heatingElement.IsOn())
+	require.True(tbox.coolingElement.IsOn())
+
+	// Elements are never turned on while disabled
+	tbox.DisableThermabox()
+	c.out = ControllerOutput{true, false, interfaces.HEATING_UP}
+	require.Nil(tbox.Step())
+	require.False(tbox.heatingElement.IsOn())
+	require.False(tbox.coolingElement.IsOn())
+}
+
+func TestThermaboxStepCutoff(t *testing.T) {
+	require := require.New(t)
+
+	tbox := &Thermabox{temperature: 20, threshold: 0.5, maxCutoffTemp: float64Ptr(30)}
+	tbox.heatingElement = &Element{relay: NewFakeRelay(false, []int{1})}
+	tbox.coolingElement = &Element{relay: NewFakeRelay(false, []int{1})}
+	tbox.SetProbe(&sequenceProbe{temps: []float64{25, 31}})
+
+	require.Nil(tbox.Step())
+	require.NotNil(tbox.Step())
+}
@@ -0,0 +1,227 @@
+package thermabox
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// ElementToggleDelayError is returned when an element cannot be switched
+// because its minimum on, off or cycle time has not elapsed yet
+type ElementToggleDelayError struct {
+	msg       string
+	Remaining time.Duration
+}
+
+func (e ElementToggleDelayError) Error() string {
+	return e.msg
+}
+
+// InterlockError is returned when an element is not switched on because the
+// element it is interlocked with does not read as off
+type InterlockError struct {
+	msg string
+}
+
+func (e InterlockError) Error() string {
+	return e.msg
+}
+
+// Element is a heating or cooling element driven through switch 1 of a relay.
+// To protect compressors from short-cycling, an element can be configured to
+// stay on for at least MinOn, stay off for at least MinOff and to not be
+// switched on more often than once every MinCycle.
+// Every switch is read back from the relay and retried according to Verify.
+// MaxRuntime limits how long the element may stay on, which is enforced by
+// the thermabox.
+type Element struct {
+	relay      RelayInterface `yaml:"relay"`
+	MinOn      time.Duration  `yaml:"min_on_sec"`
+	MinOff     time.Duration  `yaml:"min_off_sec"`
+	MinCycle   time.Duration  `yaml:"min_cycle_sec"`
+	MaxRuntime time.Duration  `yaml:"max_continuous_runtime_sec"`
+	Verify     RelayVerify
+	on         bool
+	lastOn     time.Time
+	lastOff    time.Time
+	interlock  *Element
+	clock      Clock
+}
+
+func (e *Element) SetClock(clock Clock) {
+	e.clock = clock
+	if r, ok := e.relay.(clockSetter); ok && clock != nil {
+		r.SetClock(clock)
+	}
+}
+
+func (e *Element) now() time.Time {
+	return clockOrDefault(e.clock).Now()
+}
+
+// Lockout returns how long the element must remain in its current state
+// before it is allowed to switch
+func (e *Element) Lockout() time.Duration {
+	now := e.now()
+	remaining := func(since time.Time, min time.Duration) time.Duration {
+		if since.IsZero() || min <= 0 {
+			return 0
+		}
+		if r := min - now.Sub(since); r > 0 {
+			return r
+		}
+		return 0
+	}
+	if e.on {
+		return remaining(e.lastOn, e.MinOn)
+	}
+	lockout := remaining(e.lastOff, e.MinOff)
+	if cycle := remaining(e.lastOn, e.MinCycle); cycle > lockout {
+		lockout = cycle
+	}
+	return lockout
+}
+
+// IsOn returns whether the element was last switched on
+func (e *Element) IsOn() bool {
+	return e.on
+}
+
+// SetInterlock prevents the element from being switched on unless other
+// reads as off from its relay
+func (e *Element) SetInterlock(other *Element) {
+	e.interlock = other
+}
+
+// Runtime returns how long the element has been on. It is 0 if the element
+// is off
+func (e *Element) Runtime() time.Duration {
+	if !e.on {
+		return 0
+	}
+	return e.now().Sub(e.lastOn)
+}
+
+func (e *Element) On() error {
+	if !e.on {
+		if lockout := e.Lockout(); lockout > 0 {
+			return ElementToggleDelayError{fmt.Sprintf("Minimum off/cycle time not elapsed: %v remaining", lockout), lockout}
+		}
+	}
+	if e.interlock != nil {
+		isOn, err := e.interlock.relay.IsOn(1)
+		if err != nil {
+			return InterlockError{fmt.Sprintf("Failed to read interlocked element: %v", err)}
+		}
+		if isOn {
+			return InterlockError{"Interlocked element is on"}
+		}
+	}
+	if err := SwitchRelay(e.relay, 1, true, e.Verify, e.clock); err != nil {
+		return err
+	}
+	if !e.on {
+		e.on = true
+		e.lastOn = e.now()
+	}
+	return nil
+}
+
+func (e *Element) Off() error {
+	if e.on {
+		if lockout := e.Lockout(); lockout > 0 {
+			return ElementToggleDelayError{fmt.Sprintf("Minimum on time not elapsed: %v remaining", lockout), lockout}
+		}
+	}
+	return e.ForceOff()
+}
+
+// ForceOff turns the element off regardless of its minimum on time.
+// This is meant for safety shutdowns
+func (e *Element) ForceOff() error {
+	if err := SwitchRelay(e.relay, 1, false, e.Verify, e.clock); err != nil {
+		return err
+	}
+	if e.on {
+		e.on = false
+		e.lastOff = e.now()
+	}
+	return nil
+}
+
+func (e *Element) Toggle() error {
+	if e.on {
+		return e.Off()
+	}
+	return e.On()
+}
+
+func (e *Element) UnmarshalYAML(unmarshal func(i interface{}) error) error {
+	m := make(map[string]interface{})
+	if err := unmarshal(&m); err != nil {
+		return err
+	}
+	log.Debugf("element.UnmarshalYAML: m=%v", m)
+	relayUnmarshaler := func(i interface{}) error {
+		b, _ := yaml.Marshal(m["relay"])
+		return yaml.Unmarshal(b, i)
+	}
+	if e.relay == nil {
+		relay, err := newRelay(m["relay"])
+		if err != nil {
+			return err
+		}
+		e.relay = relay
+	}
+	if err := e.relay.UnmarshalYAML(relayUnmarshaler); err != nil {
+		return err
+	}
+
+	minOn, err := parseFloat(m, "min_on_sec", 0)
+	if err != nil {
+		return err
+	}
+	// toggle_delay_sec is the old name for min_off_sec
+	toggleDelay, err := parseFloat(m, "toggle_delay_sec", 0)
+	if err != nil {
+		return err
+	}
+	minOff, err := parseFloat(m, "min_off_sec", toggleDelay)
+	if err != nil {
+		return err
+	}
+	minCycle, err := parseFloat(m, "min_cycle_sec", 0)
+	if err != nil {
+		return err
+	}
+	verifyRetries, err := parseFloat(m, "verify_retries", float64(DefaultRelayVerify.Retries))
+	if err != nil {
+		return err
+	}
+	if verifyRetries < 0 {
+		return fmt.Errorf("verify_retries must be >= 0: %v", verifyRetries)
+	}
+	verifyBackoff, err := parseFloat(m, "verify_backoff_sec", DefaultRelayVerify.Backoff.Seconds())
+	if err != nil {
+		return err
+	}
+	maxRuntime, err := parseFloat(m, "max_continuous_runtime_sec", 0)
+	if err != nil {
+		return err
+	}
+	if maxRuntime < 0 {
+		return fmt.Errorf("max_continuous_runtime_sec must be >= 0: %v", maxRuntime)
+	}
+	e.MinOn = seconds(minOn)
+	e.MinOff = seconds(minOff)
+	e.MinCycle = seconds(minCycle)
+	e.MaxRuntime = seconds(maxRuntime)
+	e.Verify = RelayVerify{int(verifyRetries), seconds(verifyBackoff)}
+	return nil
+}
+
+func seconds(val float64) time.Duration {
+	return time.Duration(val * float64(time.Second))
+}
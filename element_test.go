@@ -0,0 +1,227 @@
+package thermabox
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gurupras/thermabox/interfaces"
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestParseYamlElementMinTimes(t *testing.T) {
+	require := require.New(t)
+	str := `
+relay:
+  active_high: false
+  pins: [22]
+min_on_sec: 60
+min_off_sec: 300
+min_cycle_sec: 600.5
+`
+	element := &Element{relay: &FakeRelay{}}
+	err := yaml.Unmarshal([]byte(str), element)
+	require.Nil(err)
+	require.Equal(60*time.Second, element.MinOn)
+	require.Equal(300*time.Second, element.MinOff)
+	require.Equal(600500*time.Millisecond, element.MinCycle)
+
+	// min_off_sec takes precedence over the toggle_delay_sec alias
+	element = &Element{relay: &FakeRelay{}}
+	err = yaml.Unmarshal([]byte(`
+relay:
+  pins: [22]
+toggle_delay_sec: 30
+min_off_sec: 45
+`), element)
+	require.Nil(err)
+	require.Equal(45*time.Second, element.MinOff)
+	require.Equal(DefaultRelayVerify, element.Verify)
+}
+
+func TestParseYamlElementVerify(t *testing.T) {
+	require := require.New(t)
+
+	element := &Element{relay: &FakeRelay{}}
+	err := yaml.Unmarshal([]byte(`
+relay:
+  pins: [22]
+verify_retries: 5
+verify_backoff_sec: 0.25
+`), element)
+	require.Nil(err)
+	require.Equal(RelayVerify{5, 250 * time.Millisecond}, element.Verify)
+	require.Equal(time.Duration(0), element.MaxRuntime)
+
+	element = &Element{relay: &FakeRelay{}}
+	err = yaml.Unmarshal([]byte(`
+relay:
+  pins: [22]
+verify_retries: -1
+`), element)
+	require.NotNil(err)
+}
+
+func newTestElement(clock Clock) *Element {
+	e := &Element{relay: NewFakeRelay(false, []int{1})}
+	e.SetClock(clock)
+	return e
+}
+
+func TestElementMinOnOff(t *testing.T) {
+	require := require.New(t)
+
+	clock := NewFakeClock(time.Now())
+	e := newTestElement(clock)
+	e.MinOn = time.Minute
+	e.MinOff = 5 * time.Minute
+
+	// Never switched => no lockout
+	require.Equal(time.Duration(0), e.Lockout())
+	require.Nil(e.On())
+	require.True(e.IsOn())
+	require.Equal(time.Minute, e.Lockout())
+
+	clock.Advance(30 * time.Second)
+	err := e.Off()
+	require.NotNil(err)
+	delayErr, ok := err.(ElementToggleDelayError)
+	require.True(ok)
+	require.Equal(30*time.Second, delayErr.Remaining)
+	require.True(e.IsOn())
+
+	clock.Advance(30 * time.Second)
+	require.Nil(e.Off())
+	require.False(e.IsOn())
+	require.Equal(5*time.Minute, e.Lockout())
+
+	clock.Advance(4 * time.Minute)
+	_, ok = e.On().(ElementToggleDelayError)
+	require.True(ok)
+	require.False(e.IsOn())
+
+	clock.Advance(time.Minute)
+	require.Nil(e.On())
+	require.True(e.IsOn())
+
+	// Safety shutdowns ignore the minimum on time
+	require.Nil(e.ForceOff())
+	require.False(e.IsOn())
+}
+
+func TestElementMinCycle(t *testing.T) {
+	require := require.New(t)
+
+	clock := NewFakeClock(time.Now())
+	e := newTestElement(clock)
+	e.MinCycle = 10 * time.Minute
+
+	require.Nil(e.On())
+	clock.Advance(time.Minute)
+	require.Nil(e.Off())
+	require.Equal(9*time.Minute, e.Lockout())
+
+	clock.Advance(8 * time.Minute)
+	require.NotNil(e.On())
+	clock.Advance(time.Minute)
+	require.Nil(e.On())
+}
+
+func TestThermaboxPendingElement(t *testing.T) {
+	require := require.New(t)
+
+	clock := NewFakeClock(time.Now())
+	tbox := &Thermabox{temperature: 20, threshold: 0.5}
+	tbox.SetRelays(NewFakeRelay(false, []int{1}), NewFakeRelay(false, []int{1}))
+	tbox.SetClock(clock)
+	tbox.coolingElement.MinOff = 5 * time.Minute
+	tbox.coolingElement.lastOff = clock.Now()
+
+	c := make(chan *interfaces.ThermaboxState, 1)
+	tbox.RegisterChannel(c)
+
+	probe := &sequenceProbe{temps: []float64{25}}
+	tbox.SetProbe(probe)
+
+	// The cooling element is still locked out: this is not an error
+	require.Nil(tbox.Step())
+	state := <-c
+	require.Equal(interfaces.COOLING_DOWN, state.State)
+	require.False(state.CoolingElement.On)
+	require.True(state.CoolingElement.Pending)
+	require.Equal(300.0, state.CoolingElement.Lockout)
+	require.False(state.HeatingElement.Pending)
+
+	clock.Advance(5 * time.Minute)
+	require.Nil(tbox.Step())
+	state = <-c
+	require.True(state.CoolingElement.On)
+	require.False(state.CoolingElement.Pending)
+}
+
+func TestParseYamlElementMaxRuntime(t *testing.T) {
+	require := require.New(t)
+
+	element := &Element{relay: &FakeRelay{}}
+	err := yaml.Unmarshal([]byte(`
+relay:
+  pins: [22]
+max_continuous_runtime_sec: 3600
+`), element)
+	require.Nil(err)
+	require.Equal(time.Hour, element.MaxRuntime)
+
+	element = &Element{relay: &FakeRelay{}}
+	err = yaml.Unmarshal([]byte(`
+relay:
+  pins: [22]
+max_continuous_runtime_sec: -1
+`), element)
+	require.NotNil(err)
+}
+
+func TestElementInterlock(t *testing.T) {
+	require := require.New(t)
+
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	heater := newTestElement(clock)
+	cooler := newTestElement(clock)
+	heater.SetInterlock(cooler)
+	cooler.SetInterlock(heater)
+
+	require.Nil(heater.On())
+	err := cooler.On()
+	require.NotNil(err)
+	_, ok := err.(InterlockError)
+	require.True(ok)
+	require.False(cooler.IsOn())
+
+	// The relay is what counts, not what the element was told
+	require.Nil(heater.Off())
+	heater.relay.(*FakeRelay).StickOn(1)
+	require.False(heater.IsOn())
+	_, ok = cooler.On().(InterlockError)
+	require.True(ok)
+
+	heater.relay.(*FakeRelay).FailOnCall(1, fmt.Errorf("bus error"))
+	_, ok = cooler.On().(InterlockError)
+	require.True(ok)
+
+	heater.relay.(*FakeRelay).StickOff(1)
+	require.Nil(cooler.On())
+}
+
+func TestElementRuntime(t *testing.T) {
+	require := require.New(t)
+
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	e := newTestElement(clock)
+	require.Equal(time.Duration(0), e.Runtime())
+	require.Nil(e.On())
+	clock.Advance(time.Minute)
+	require.Nil(e.On())
+	require.Equal(time.Minute, e.Runtime())
+	require.Nil(e.Off())
+	require.Equal(time.Duration(0), e.Runtime())
+}
@@ -0,0 +1,233 @@
+package thermabox
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// RelayTransition is a change of a FakeRelay switch's physical state
+type RelayTransition struct {
+	Switch int
+	On     bool
+	Time   time.Time
+}
+
+type fakeRelayStuck int
+
+const (
+	notStuck fakeRelayStuck = iota
+	stuckOn
+	stuckOff
+)
+
+// FakeRelay is an in-memory relay used for testing. It tracks the state of
+// every switch, records a history of transitions and can be scripted to fail.
+// Like Relay, SwitchMap maps switch indices (starting at 1) to pins
+type FakeRelay struct {
+	activeHigh bool
+	SwitchMap  map[int]uint8
+	state      map[int]bool
+	stuck      map[int]fakeRelayStuck
+	history    []RelayTransition
+	calls      int
+	failures   map[int]error
+	closed     bool
+	clock      Clock
+	mutex      sync.Mutex
+}
+
+func NewFakeRelay(activeHigh bool, pins []int) *FakeRelay {
+	f := &FakeRelay{activeHigh: activeHigh}
+	f.setPins(pins)
+	return f
+}
+
+func (f *FakeRelay) setPins(pins []int) {
+	f.SwitchMap = make(map[int]uint8)
+	for idx, pin := range pins {
+		f.SwitchMap[idx+1] = uint8(pin)
+	}
+	f.state = make(map[int]bool)
+}
+
+func (f *FakeRelay) SetClock(clock Clock) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.clock = clock
+}
+
+func (f *FakeRelay) ActiveHigh() bool {
+	return f.activeHigh
+}
+
+func (f *FakeRelay) GetSwitchMap() map[int]uint8 {
+	return f.SwitchMap
+}
+
+// StickOn makes the switch stay on no matter what it is told to do.
+// The commands themselves still succeed
+func (f *FakeRelay) StickOn(swtch int) {
+	f.setStuck(swtch, stuckOn)
+}
+
+// StickOff makes the switch stay off no matter what it is told to do.
+// The commands themselves still succeed
+func (f *FakeRelay) StickOff(swtch int) {
+	f.setStuck(swtch, stuckOff)
+}
+
+// Unstick undoes StickOn and StickOff
+func (f *FakeRelay) Unstick(swtch int) {
+	f.setStuck(swtch, notStuck)
+}
+
+func (f *FakeRelay) setStuck(swtch int, stuck fakeRelayStuck) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.stuck == nil {
+		f.stuck = make(map[int]fakeRelayStuck)
+	}
+	f.stuck[swtch] = stuck
+	switch stuck {
+	case stuckOn:
+		f.transition(swtch, true)
+	case stuckOff:
+		f.transition(swtch, false)
+	}
+}
+
+// FailOnCall makes the n-th call from now to On, Off, Toggle or IsOn return
+// err instead of doing anything. n starts at 1
+func (f *FakeRelay) FailOnCall(n int, err error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.failures == nil {
+		f.failures = make(map[int]error)
+	}
+	f.failures[f.calls+n] = err
+}
+
+// Calls returns the number of calls made to On, Off, Toggle and IsOn
+func (f *FakeRelay) Calls() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.calls
+}
+
+// History returns every change of state so far
+func (f *FakeRelay) History() []RelayTransition {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return append([]RelayTransition(nil), f.history...)
+}
+
+// Close makes every further call fail
+func (f *FakeRelay) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.closed = true
+	return nil
+}
+
+func (f *FakeRelay) Closed() bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.closed
+}
+
+// call accounts for a call on swtch and returns any error it should fail with.
+// Must be called with the mutex held
+func (f *FakeRelay) call(swtch int) error {
+	f.calls++
+	if err, ok := f.failures[f.calls]; ok {
+		delete(f.failures, f.calls)
+		return err
+	}
+	if f.closed {
+		return fmt.Errorf("Relay is closed")
+	}
+	if _, ok := f.SwitchMap[swtch]; !ok {
+		return fmt.Errorf("Switch %v not initialized in relay", swtch)
+	}
+	return nil
+}
+
+// transition sets the physical state of a switch.
+// Must be called with the mutex held
+func (f *FakeRelay) transition(swtch int, on bool) {
+	if f.state == nil {
+		f.state = make(map[int]bool)
+	}
+	if f.state[swtch] == on {
+		return
+	}
+	f.state[swtch] = on
+	f.history = append(f.history, RelayTransition{swtch, on, clockOrDefault(f.clock).Now()})
+}
+
+func (f *FakeRelay) set(swtch int, on bool) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.call(swtch); err != nil {
+		return err
+	}
+	if f.stuck[swtch] == notStuck {
+		f.transition(swtch, on)
+	}
+	return nil
+}
+
+func (f *FakeRelay) On(swtch int) error {
+	return f.set(swtch, true)
+}
+
+func (f *FakeRelay) Off(swtch int) error {
+	return f.set(swtch, false)
+}
+
+func (f *FakeRelay) Toggle(swtch int) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.call(swtch); err != nil {
+		return err
+	}
+	if f.stuck[swtch] == notStuck {
+		f.transition(swtch, !f.state[swtch])
+	}
+	return nil
+}
+
+func (f *FakeRelay) IsOn(swtch int) (bool, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if err := f.call(swtch); err != nil {
+		return false, err
+	}
+	return f.state[swtch], nil
+}
+
+func (f *FakeRelay) UnmarshalYAML(unmarshal func(i interface{}) error) error {
+	conf := struct {
+		ActiveHigh   bool        `yaml:"active_high"`
+		InitialState interface{} `yaml:"initial_state"`
+		Pins         []int       `yaml:"pins"`
+	}{}
+	if err := unmarshal(&conf); err != nil {
+		return err
+	}
+	initialState, err := parseInitialState(conf.InitialState)
+	if err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.activeHigh = conf.ActiveHigh
+	f.setPins(conf.Pins)
+	if initialState == INITIAL_ON {
+		for swtch := range f.SwitchMap {
+			f.state[swtch] = true
+		}
+	}
+	return nil
+}
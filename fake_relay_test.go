@@ -0,0 +1,167 @@
+package thermabox
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gurupras/thermabox/interfaces"
+	"github.com/stretchr/testify/require"
+)
+
+var _ RelayInterface = &FakeRelay{}
+
+func TestFakeRelay(t *testing.T) {
+	require := require.New(t)
+
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	relay := NewFakeRelay(false, []int{22, 23})
+	relay.SetClock(clock)
+	require.Equal(map[int]uint8{1: 22, 2: 23}, relay.GetSwitchMap())
+
+	isOn, err := relay.IsOn(1)
+	require.Nil(err)
+	require.False(isOn)
+
+	require.Nil(relay.On(1))
+	clock.Advance(time.Second)
+	require.Nil(relay.Toggle(2))
+	// Already on => no transition
+	require.Nil(relay.On(1))
+	clock.Advance(time.Second)
+	require.Nil(relay.Off(1))
+
+	isOn, err = relay.IsOn(1)
+	require.Nil(err)
+	require.False(isOn)
+	isOn, err = relay.IsOn(2)
+	require.Nil(err)
+	require.True(isOn)
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	require.Equal([]RelayTransition{
+		{1, true, start},
+		{2, true, start.Add(time.Second)},
+		{1, false, start.Add(2 * time.Second)},
+	}, relay.History())
+	require.Equal(7, relay.Calls())
+
+	require.NotNil(relay.On(3))
+	_, err = relay.IsOn(3)
+	require.NotNil(err)
+}
+
+func TestFakeRelayFaults(t *testing.T) {
+	require := require.New(t)
+
+	relay := NewFakeRelay(false, []int{22})
+
+	// Stuck on
+	relay.StickOn(1)
+	require.Nil(relay.Off(1))
+	isOn, err := relay.IsOn(1)
+	require.Nil(err)
+	require.True(isOn)
+
+	// Stuck off
+	relay.StickOff(1)
+	require.Nil(relay.On(1))
+	require.Nil(relay.Toggle(1))
+	isOn, err = relay.IsOn(1)
+	require.Nil(err)
+	require.False(isOn)
+
+	relay.Unstick(1)
+	require.Nil(relay.On(1))
+	isOn, err = relay.IsOn(1)
+	require.Nil(err)
+	require.True(isOn)
+
+	// Error on the 2nd call from now
+	relay.FailOnCall(2, fmt.Errorf("bus error"))
+	require.Nil(relay.Off(1))
+	err = relay.On(1)
+	require.NotNil(err)
+	require.Equal("bus error", err.Error())
+	isOn, err = relay.IsOn(1)
+	require.Nil(err)
+	require.False(isOn)
+}
+
+func TestElementRelayFault(t *testing.T) {
+	require := require.New(t)
+
+	relay := NewFakeRelay(false, []int{22})
+	e := &Element{relay: relay}
+
+	relay.FailOnCall(1, fmt.Errorf("bus error"))
+	require.NotNil(e.On())
+	require.False(e.IsOn())
+	require.Equal(0, len(relay.History()))
+
+	require.Nil(e.On())
+	require.True(e.IsOn())
+
+	relay.FailOnCall(1, fmt.Errorf("bus error"))
+	require.NotNil(e.ForceOff())
+	require.True(e.IsOn())
+	isOn, _ := relay.IsOn(1)
+	require.True(isOn)
+}
+
+func TestThermaboxRelayFault(t *testing.T) {
+	require := require.New(t)
+
+	heater := NewFakeRelay(false, []int{22})
+	cooler := NewFakeRelay(false, []int{23})
+	tbox := &Thermabox{temperature: 20, threshold: 0.5}
+	tbox.SetRelays(heater, cooler)
+	tbox.heatingElement.Verify.Backoff = 0
+	tbox.coolingElement.Verify.Backoff = 0
+	tbox.SetProbe(&sequenceProbe{temps: []float64{10}})
+
+	c := make(chan *interfaces.ThermaboxState, 1)
+	tbox.RegisterChannel(c)
+	alerts := make(chan *interfaces.Alert, 1)
+	tbox.RegisterAlertChannel(alerts)
+
+	// A transient error is retried within the step
+	heater.FailOnCall(1, fmt.Errorf("bus error"))
+	require.Nil(tbox.Step())
+	state := <-c
+	require.Equal(interfaces.HEATING_UP, state.State)
+	require.True(state.HeatingElement.On)
+	isOn, err := heater.IsOn(1)
+	require.Nil(err)
+	require.True(isOn)
+	require.Equal(0, len(cooler.History()))
+
+	// A heater that is stuck on faults the box once the retries run out
+	heater.StickOn(1)
+	tbox.SetLimits(5, 0.5)
+	require.Nil(tbox.Step())
+	state = <-c
+	require.Equal(interfaces.FAULT, state.State)
+	require.Contains(state.Fault, "heating element")
+	require.False(state.CoolingElement.On)
+
+	alert := <-alerts
+	require.Equal(interfaces.RELAY_FAULT, alert.Type)
+	require.Equal("relay_fault: "+alert.Message, state.Fault)
+
+	// Both elements were forced off, which the stuck heater ignored
+	isOn, err = cooler.IsOn(1)
+	require.Nil(err)
+	require.False(isOn)
+	require.Equal(0, len(cooler.History()))
+
+	// The fault is latched and the controller no longer runs
+	heater.Unstick(1)
+	tbox.SetLimits(30, 0.5)
+	require.Nil(tbox.Step())
+	state = <-c
+	require.Equal(interfaces.FAULT, state.State)
+	isOn, err = heater.IsOn(1)
+	require.Nil(err)
+	require.True(isOn)
+}
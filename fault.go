@@ -0,0 +1,184 @@
+package thermabox
+
+import (
+	"fmt"
+
+	"github.com/gurupras/thermabox/interfaces"
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// FaultPolicy decides what happens when a fault is raised. Whatever the
+// policy, the elements are turned off and the thermabox enters the FAULT state
+type FaultPolicy string
+
+const (
+	// SHUTDOWN makes Run return the fault
+	SHUTDOWN FaultPolicy = "shutdown"
+	// LATCH keeps the thermabox in the FAULT state until ResetFault is called
+	LATCH FaultPolicy = "latch"
+	// AUTO_RESUME leaves the FAULT state as soon as the cause of the fault is gone
+	AUTO_RESUME FaultPolicy = "auto_resume"
+)
+
+var defaultFaultPolicies = map[interfaces.AlertType]FaultPolicy{
+	interfaces.PROBE_LOST:        SHUTDOWN,
+	interfaces.OVER_TEMPERATURE:  SHUTDOWN,
+	interfaces.UNDER_TEMPERATURE: SHUTDOWN,
+	interfaces.RATE_OF_CHANGE:    LATCH,
+	interfaces.RUNTIME_EXCEEDED:  LATCH,
+	interfaces.RELAY_FAULT:       LATCH,
+}
+
+// The cause of these faults is gone as soon as the elements are turned off,
+// so AUTO_RESUME would clear them on the next step. A rate alarm that only
+// applies while heating or cooling stops applying once the element is off
+var noAutoResume = map[interfaces.AlertType]bool{
+	interfaces.RATE_OF_CHANGE:   true,
+	interfaces.RUNTIME_EXCEEDED: true,
+}
+
+// FaultError is a fault of the thermabox. Run returns a *FaultError when a
+// fault with the SHUTDOWN policy is raised
+type FaultError struct {
+	Class interfaces.AlertType
+	Err   error
+}
+
+func (f *FaultError) Error() string {
+	return fmt.Sprintf("%v: %v", f.Class, f.Err)
+}
+
+// parseFaultPolicies parses the 'fault_policy' key, a map of fault classes
+// to policies. Classes that are not listed keep their default policy
+func parseFaultPolicies(data interface{}) (map[interfaces.AlertType]FaultPolicy, error) {
+	b, err := yaml.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal key 'fault_policy': %v: %v", data, err)
+	}
+	m := make(map[string]string)
+	if err := yaml.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("Failed while parsing fault_policy: %v", err)
+	}
+	policies := make(map[interfaces.AlertType]FaultPolicy)
+	for class, policy := range defaultFaultPolicies {
+		policies[class] = policy
+	}
+	for class, policy := range m {
+		if _, ok := defaultFaultPolicies[interfaces.AlertType(class)]; !ok {
+			return nil, fmt.Errorf("Unknown fault class: %v", class)
+		}
+		switch FaultPolicy(policy) {
+		case SHUTDOWN, LATCH, AUTO_RESUME:
+		default:
+			return nil, fmt.Errorf("Unknown fault policy for %v: %v", class, policy)
+		}
+		if FaultPolicy(policy) == AUTO_RESUME && noAutoResume[interfaces.AlertType(class)] {
+			return nil, fmt.Errorf("Fault policy for %v cannot be %v", class, policy)
+		}
+		policies[interfaces.AlertType(class)] = FaultPolicy(policy)
+	}
+	return policies, nil
+}
+
+func (t *Thermabox) faultPolicy(class interfaces.AlertType) FaultPolicy {
+	if policy, ok := t.faultPolicies[class]; ok {
+		return policy
+	}
+	return defaultFaultPolicies[class]
+}
+
+// FaultPolicies returns the policy of every fault class
+func (t *Thermabox) FaultPolicies() map[interfaces.AlertType]FaultPolicy {
+	policies := make(map[interfaces.AlertType]FaultPolicy)
+	for class := range defaultFaultPolicies {
+		policies[class] = t.faultPolicy(class)
+	}
+	return policies
+}
+
+// SetFaultPolicy sets the policy for a class of faults
+func (t *Thermabox) SetFaultPolicy(class interfaces.AlertType, policy FaultPolicy) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if policy == AUTO_RESUME && noAutoResume[class] {
+		log.Warnf("Fault policy for %v cannot be %v. Using %v", class, policy, LATCH)
+		policy = LATCH
+	}
+	if t.faultPolicies == nil {
+		t.faultPolicies = make(map[interfaces.AlertType]FaultPolicy)
+	}
+	t.faultPolicies[class] = policy
+}
+
+// Fault returns the current fault or nil if there is none
+func (t *Thermabox) Fault() *FaultError {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.fault
+}
+
+// raiseFault puts the thermabox in the FAULT state, forces both elements off
+// and raises an alert. Only the first fault is recorded until it is cleared.
+// The fault is returned if its policy is SHUTDOWN.
+// Must be called with the mutex held
+func (t *Thermabox) raiseFault(class interfaces.AlertType, err error) error {
+	fault := &FaultError{class, err}
+	if t.fault == nil {
+		log.Errorf("Entering fault state: %v", fault)
+		t.fault = fault
+		t.state = interfaces.FAULT
+		t.allOff()
+		t.alert(class, err.Error())
+	}
+	if t.faultPolicy(class) == SHUTDOWN {
+		return fault
+	}
+	return nil
+}
+
+// recoverFault clears the current fault if it is of the given class and the
+// class auto-resumes. Callers must have checked that the cause of the fault
+// is gone. Must be called with the mutex held
+func (t *Thermabox) recoverFault(class interfaces.AlertType) {
+	if t.fault == nil || t.fault.Class != class || t.faultPolicy(class) != AUTO_RESUME {
+		return
+	}
+	log.Infof("Recovered from fault: %v", t.fault)
+	t.clearFault()
+}
+
+// recoverRelayFault tries to turn the elements off again after a relay fault
+// that auto-resumes, and recovers once that succeeds.
+// Must be called with the mutex held
+func (t *Thermabox) recoverRelayFault() {
+	if t.fault == nil || t.fault.Class != interfaces.RELAY_FAULT || t.faultPolicy(interfaces.RELAY_FAULT) != AUTO_RESUME {
+		return
+	}
+	if t.heatingElement.ForceOff() != nil || t.coolingElement.ForceOff() != nil {
+		return
+	}
+	t.recoverFault(interfaces.RELAY_FAULT)
+}
+
+// clearFault leaves the FAULT state. Must be called with the mutex held
+func (t *Thermabox) clearFault() {
+	t.alert(interfaces.FAULT_CLEARED, t.fault.Error())
+	t.fault = nil
+	t.state = interfaces.UNKNOWN
+}
+
+// ResetFault clears the current fault. If its cause is still present, the
+// fault is raised again on the next step
+func (t *Thermabox) ResetFault() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.fault == nil {
+		return fmt.Errorf("Thermabox is not in a fault state")
+	}
+	log.Infof("Resetting fault: %v", t.fault)
+	t.clearFault()
+	// Give a lost probe as long to come back as it had originally
+	t.lastTempTimestamp = clockOrDefault(t.clock).Now()
+	return nil
+}
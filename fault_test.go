@@ -0,0 +1,206 @@
+package thermabox
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gurupras/thermabox/interfaces"
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var _ interfaces.FaultInterface = &Thermabox{}
+
+func TestParseYamlFaultPolicy(t *testing.T) {
+	require := require.New(t)
+
+	tbox := &Thermabox{}
+	tbox.SetRelays(&FakeRelay{}, &FakeRelay{})
+	err := yaml.Unmarshal([]byte(`
+heating_element:
+  relay:
+    pins: [22]
+cooling_element:
+  relay:
+    pins: [23]
+fault_policy:
+  probe_lost: latch
+  over_temperature: auto_resume
+`), tbox)
+	require.Nil(err)
+	require.Equal(map[interfaces.AlertType]FaultPolicy{
+		interfaces.PROBE_LOST:        LATCH,
+		interfaces.OVER_TEMPERATURE:  AUTO_RESUME,
+		interfaces.UNDER_TEMPERATURE: SHUTDOWN,
+		interfaces.RATE_OF_CHANGE:    LATCH,
+		interfaces.RUNTIME_EXCEEDED:  LATCH,
+		interfaces.RELAY_FAULT:       LATCH,
+	}, tbox.FaultPolicies())
+
+	for _, str := range []string{
+		`fault_policy: {door_open: latch}`,
+		`fault_policy: {probe_lost: ignore}`,
+		`fault_policy: [latch]`,
+		`fault_policy: {runtime_exceeded: auto_resume}`,
+		`fault_policy: {rate_of_change: auto_resume}`,
+	} {
+		tbox = &Thermabox{}
+		require.NotNil(yaml.Unmarshal([]byte(str), tbox), str)
+	}
+}
+
+// newFaultTestThermabox returns a thermabox that is heating when the
+// probe reads below 20
+func newFaultTestThermabox(probe interfaces.TemperatureSensorInterface) (*Thermabox, *FakeRelay, chan *interfaces.ThermaboxState, chan *interfaces.Alert) {
+	heater := NewFakeRelay(false, []int{22})
+	tbox := &Thermabox{temperature: 20, threshold: 0.5, maxCutoffTemp: float64Ptr(30)}
+	tbox.SetRelays(heater, NewFakeRelay(false, []int{23}))
+	tbox.SetProbe(probe)
+	c := make(chan *interfaces.ThermaboxState, 1)
+	tbox.RegisterChannel(c)
+	alerts := make(chan *interfaces.Alert, 1)
+	tbox.RegisterAlertChannel(alerts)
+	return tbox, heater, c, alerts
+}
+
+func TestFaultPolicyShutdown(t *testing.T) {
+	require := require.New(t)
+
+	tbox, heater, c, alerts := newFaultTestThermabox(&sequenceProbe{temps: []float64{10, 35}})
+	require.Nil(tbox.Step())
+	<-c
+	isOn, err := heater.IsOn(1)
+	require.Nil(err)
+	require.True(isOn)
+
+	err = tbox.Step()
+	require.NotNil(err)
+	fault, ok := err.(*FaultError)
+	require.True(ok)
+	require.Equal(interfaces.OVER_TEMPERATURE, fault.Class)
+	require.Equal(string(interfaces.FAULT), tbox.GetState())
+	require.Equal(interfaces.OVER_TEMPERATURE, (<-alerts).Type)
+	isOn, err = heater.IsOn(1)
+	require.Nil(err)
+	require.False(isOn)
+}
+
+func TestFaultPolicyLatch(t *testing.T) {
+	require := require.New(t)
+
+	probe := &flakyProbe{temp: 35}
+	tbox, heater, c, alerts := newFaultTestThermabox(probe)
+	tbox.SetFaultPolicy(interfaces.OVER_TEMPERATURE, LATCH)
+
+	require.Nil(tbox.Step())
+	state := <-c
+	require.Equal(interfaces.FAULT, state.State)
+	require.Equal("over_temperature: Temperature > cutoff temperature: 35 > 30", state.Fault)
+	require.Equal(interfaces.OVER_TEMPERATURE, (<-alerts).Type)
+
+	// Stays latched after the temperature is back to normal
+	probe.temp = 10
+	require.Nil(tbox.Step())
+	state = <-c
+	require.Equal(interfaces.FAULT, state.State)
+	require.False(state.HeatingElement.On)
+
+	require.Nil(tbox.ResetFault())
+	require.Equal(interfaces.FAULT_CLEARED, (<-alerts).Type)
+	require.Nil(tbox.Fault())
+	require.NotNil(tbox.ResetFault())
+
+	require.Nil(tbox.Step())
+	state = <-c
+	require.Equal(interfaces.HEATING_UP, state.State)
+	require.Equal("", state.Fault)
+	isOn, err := heater.IsOn(1)
+	require.Nil(err)
+	require.True(isOn)
+}
+
+func TestFaultPolicyAutoResume(t *testing.T) {
+	require := require.New(t)
+
+	probe := &flakyProbe{temp: 35}
+	tbox, heater, c, alerts := newFaultTestThermabox(probe)
+	tbox.SetFaultPolicy(interfaces.OVER_TEMPERATURE, AUTO_RESUME)
+
+	require.Nil(tbox.Step())
+	require.Equal(interfaces.FAULT, (<-c).State)
+	<-alerts
+
+	probe.temp = 10
+	require.Nil(tbox.Step())
+	require.Equal(interfaces.HEATING_UP, (<-c).State)
+	require.Equal(interfaces.FAULT_CLEARED, (<-alerts).Type)
+	isOn, err := heater.IsOn(1)
+	require.Nil(err)
+	require.True(isOn)
+}
+
+func TestFaultProbeLost(t *testing.T) {
+	require := require.New(t)
+
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	probe := &flakyProbe{temp: 10}
+	tbox, heater, c, alerts := newFaultTestThermabox(probe)
+	tbox.SetClock(clock)
+	tbox.SetFaultPolicy(interfaces.PROBE_LOST, LATCH)
+
+	require.Nil(tbox.Step())
+	<-c
+
+	// Tolerated for 10 seconds
+	probe.err = fmt.Errorf("unplugged")
+	clock.Advance(10 * time.Second)
+	require.Nil(tbox.Step())
+	require.Nil(tbox.Fault())
+	clock.Advance(time.Second)
+	require.Nil(tbox.Step())
+	require.Equal(interfaces.PROBE_LOST, tbox.Fault().Class)
+	require.Equal(interfaces.PROBE_LOST, (<-alerts).Type)
+	isOn, err := heater.IsOn(1)
+	require.Nil(err)
+	require.False(isOn)
+
+	// A reset while the probe is still lost faults again once the grace
+	// period is over
+	require.Nil(tbox.ResetFault())
+	<-alerts
+	require.Nil(tbox.Step())
+	require.Nil(tbox.Fault())
+	clock.Advance(11 * time.Second)
+	require.Nil(tbox.Step())
+	require.NotNil(tbox.Fault())
+	<-alerts
+
+	// Shut down
+	tbox.SetFaultPolicy(interfaces.PROBE_LOST, SHUTDOWN)
+	err = tbox.Step()
+	require.NotNil(err)
+	require.Equal(interfaces.PROBE_LOST, err.(*FaultError).Class)
+}
+
+func TestFaultRelayAutoResume(t *testing.T) {
+	require := require.New(t)
+
+	tbox, heater, c, alerts := newFaultTestThermabox(&flakyProbe{temp: 10})
+	tbox.heatingElement.Verify.Backoff = 0
+	tbox.SetFaultPolicy(interfaces.RELAY_FAULT, AUTO_RESUME)
+
+	heater.StickOff(1)
+	require.Nil(tbox.Step())
+	require.Equal(interfaces.FAULT, (<-c).State)
+	require.Equal(interfaces.RELAY_FAULT, (<-alerts).Type)
+
+	// Recovers once the elements can be turned off and then heats again
+	heater.Unstick(1)
+	require.Nil(tbox.Step())
+	require.Equal(interfaces.HEATING_UP, (<-c).State)
+	require.Equal(interfaces.FAULT_CLEARED, (<-alerts).Type)
+	isOn, err := heater.IsOn(1)
+	require.Nil(err)
+	require.True(isOn)
+}
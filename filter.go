@@ -0,0 +1,241 @@
+package thermabox
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/gurupras/thermabox/interfaces"
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+type FilterType string
+
+const (
+	FILTER_MOVING_AVERAGE FilterType = "moving_average"
+	FILTER_EMA            FilterType = "ema"
+	FILTER_MEDIAN         FilterType = "median"
+	FILTER_MAX_RATE       FilterType = "max_rate"
+)
+
+// FilterConfig configures one filter in a probe's filter chain.
+// Window is used by moving_average and median, Alpha by ema and MaxRate, in
+// degrees per second, by max_rate
+type FilterConfig struct {
+	Type    FilterType `yaml:"type"`
+	Window  int        `yaml:"window"`
+	Alpha   float64    `yaml:"alpha"`
+	MaxRate float64    `yaml:"max_rate"`
+}
+
+func (c *FilterConfig) UnmarshalYAML(unmarshal func(i interface{}) error) error {
+	m := make(map[string]interface{})
+	if err := unmarshal(&m); err != nil {
+		return err
+	}
+	filterType, ok := m["type"]
+	if !ok {
+		return fmt.Errorf("Filter is missing type")
+	}
+	c.Type = FilterType(fmt.Sprintf("%v", filterType))
+	window, err := parseFloat(m, "window", 5)
+	if err != nil {
+		return err
+	}
+	c.Window = int(window)
+	if c.Alpha, err = parseFloat(m, "alpha", 0.5); err != nil {
+		return err
+	}
+	if c.MaxRate, err = parseFloat(m, "max_rate", 0); err != nil {
+		return err
+	}
+	_, err = newFilter(c)
+	return err
+}
+
+func parseFilterConfigs(data interface{}) ([]*FilterConfig, error) {
+	b, err := yaml.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal key 'filters': %v: %v", data, err)
+	}
+	configs := make([]*FilterConfig, 0)
+	if err := yaml.Unmarshal(b, &configs); err != nil {
+		return nil, fmt.Errorf("Failed while parsing filters: %v", err)
+	}
+	return configs, nil
+}
+
+// Filter processes successive readings of a probe. An error rejects the
+// reading
+type Filter interface {
+	Filter(temp float64, now time.Time) (float64, error)
+}
+
+func newFilter(c *FilterConfig) (Filter, error) {
+	switch c.Type {
+	case FILTER_MOVING_AVERAGE, FILTER_MEDIAN:
+		if c.Window < 1 {
+			return nil, fmt.Errorf("Filter %v window must be >= 1: %v", c.Type, c.Window)
+		}
+		aggregation := MEAN
+		if c.Type == FILTER_MEDIAN {
+			aggregation = MEDIAN
+		}
+		return &windowFilter{aggregation: aggregation, window: c.Window}, nil
+	case FILTER_EMA:
+		if c.Alpha <= 0 || c.Alpha > 1 {
+			return nil, fmt.Errorf("Filter ema alpha must be in (0, 1]: %v", c.Alpha)
+		}
+		return &emaFilter{alpha: c.Alpha}, nil
+	case FILTER_MAX_RATE:
+		if c.MaxRate <= 0 {
+			return nil, fmt.Errorf("Filter max_rate must be > 0: %v", c.MaxRate)
+		}
+		return &maxRateFilter{maxRate: c.MaxRate}, nil
+	default:
+		return nil, fmt.Errorf("Unknown filter type: %v", c.Type)
+	}
+}
+
+// windowFilter aggregates the last window readings
+type windowFilter struct {
+	aggregation ProbeAggregation
+	window      int
+	samples     []float64
+}
+
+func (f *windowFilter) Filter(temp float64, now time.Time) (float64, error) {
+	f.samples = append(f.samples, temp)
+	if len(f.samples) > f.window {
+		f.samples = f.samples[1:]
+	}
+	return aggregate(f.aggregation, f.samples), nil
+}
+
+type emaFilter struct {
+	alpha   float64
+	value   float64
+	started bool
+}
+
+func (f *emaFilter) Filter(temp float64, now time.Time) (float64, error) {
+	if !f.started {
+		f.value = temp
+		f.started = true
+	} else {
+		f.value = f.alpha*temp + (1-f.alpha)*f.value
+	}
+	return f.value, nil
+}
+
+// maxRateFilter limits how fast readings may change. A reading that differs
+// from the last output by more than maxRate degrees per second is rejected and
+// the output moves towards it by maxRate degrees per second instead. A
+// rejection is not an error, so that a probe whose readings change faster
+// than maxRate is not counted as failing. A spike only moves the output a
+// little, while a sustained change is tracked at maxRate until it is caught up
+type maxRateFilter struct {
+	maxRate  float64
+	last     float64
+	lastTime time.Time
+	rejected uint64
+}
+
+func (f *maxRateFilter) Filter(temp float64, now time.Time) (float64, error) {
+	if !f.lastTime.IsZero() {
+		allowed := f.maxRate * now.Sub(f.lastTime).Seconds()
+		if diff := temp - f.last; math.Abs(diff) > allowed {
+			f.rejected++
+			log.Debugf("Rejected reading %v: changed by more than %v from %v", temp, allowed, f.last)
+			temp = f.last + math.Copysign(allowed, diff)
+		}
+	}
+	f.last = temp
+	f.lastTime = now
+	return temp, nil
+}
+
+func (f *maxRateFilter) Rejected() uint64 {
+	return f.rejected
+}
+
+// rejecter is implemented by filters that replace the readings they reject
+type rejecter interface {
+	Rejected() uint64
+}
+
+// FilteredProbe passes the readings of a probe through a chain of filters
+type FilteredProbe struct {
+	probe   interfaces.TemperatureSensorInterface
+	filters []Filter
+	raw     float64
+	clock   Clock
+	mutex   sync.Mutex
+}
+
+func NewFilteredProbe(probe interfaces.TemperatureSensorInterface, configs []*FilterConfig) (*FilteredProbe, error) {
+	f := &FilteredProbe{probe: probe}
+	for _, c := range configs {
+		filter, err := newFilter(c)
+		if err != nil {
+			return nil, err
+		}
+		f.filters = append(f.filters, filter)
+	}
+	return f, nil
+}
+
+// SetClock sets the clock used to time readings and is passed on to the
+// underlying probe if it accepts one
+func (f *FilteredProbe) SetClock(clock Clock) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.clock = clock
+	if p, ok := f.probe.(clockSetter); ok {
+		p.SetClock(clock)
+	}
+}
+
+func (f *FilteredProbe) GetTemperature() (float64, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	temp, err := f.probe.GetTemperature()
+	if err != nil {
+		return 0, err
+	}
+	f.raw = temp
+	now := clockOrDefault(f.clock).Now()
+	for _, filter := range f.filters {
+		if temp, err = filter.Filter(temp, now); err != nil {
+			return 0, err
+		}
+	}
+	return temp, nil
+}
+
+// Rejected returns the number of readings rejected by the filters
+func (f *FilteredProbe) Rejected() uint64 {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	var rejected uint64
+	for _, filter := range f.filters {
+		if r, ok := filter.(rejecter); ok {
+			rejected += r.Rejected()
+		}
+	}
+	return rejected
+}
+
+// RawTemperature returns the last unfiltered reading
+func (f *FilteredProbe) RawTemperature() float64 {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.raw
+}
+
+// rawReader is implemented by probes that modify the readings they receive
+type rawReader interface {
+	RawTemperature() float64
+}
@@ -0,0 +1,212 @@
+package thermabox
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gurupras/thermabox/interfaces"
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var _ interfaces.TemperatureSensorInterface = &FilteredProbe{}
+
+func TestParseYamlFilters(t *testing.T) {
+	require := require.New(t)
+
+	tbox := &Thermabox{}
+	tbox.SetRelays(&FakeRelay{}, &FakeRelay{})
+	err := yaml.Unmarshal([]byte(`
+heating_element:
+  relay:
+    pins: [22]
+cooling_element:
+  relay:
+    pins: [23]
+filters:
+  - type: max_rate
+    max_rate: 0.5
+  - type: median
+probes:
+  - name: inner
+    source: usb
+    filters:
+      - type: ema
+        alpha: 0.2
+      - type: moving_average
+        window: 10
+`), tbox)
+	require.Nil(err)
+	require.Equal([]*FilterConfig{
+		{FILTER_MAX_RATE, 5, 0.5, 0.5},
+		{FILTER_MEDIAN, 5, 0.5, 0},
+	}, tbox.FilterConfigs())
+	require.Equal([]*FilterConfig{
+		{FILTER_EMA, 5, 0.2, 0},
+		{FILTER_MOVING_AVERAGE, 10, 0.5, 0},
+	}, tbox.ProbeConfigs()[0].Filters)
+
+	for _, str := range []string{
+		`filters: [{type: lowpass}]`,
+		`filters: [{window: 3}]`,
+		`filters: [{type: median, window: 0}]`,
+		`filters: [{type: ema, alpha: 1.5}]`,
+		`filters: [{type: max_rate}]`,
+	} {
+		tbox = &Thermabox{}
+		require.NotNil(yaml.Unmarshal([]byte(str), tbox), str)
+	}
+}
+
+func filterAll(require *require.Assertions, c *FilterConfig, temps ...float64) []float64 {
+	probe := &sequenceProbe{temps: temps}
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	f, err := NewFilteredProbe(probe, []*FilterConfig{c})
+	require.Nil(err)
+	f.SetClock(clock)
+	ret := make([]float64, 0)
+	for range temps {
+		temp, err := f.GetTemperature()
+		require.Nil(err)
+		ret = append(ret, temp)
+		clock.Advance(time.Second)
+	}
+	return ret
+}
+
+func TestFilters(t *testing.T) {
+	require := require.New(t)
+
+	require.Equal([]float64{10, 15, 20, 30}, filterAll(require, &FilterConfig{Type: FILTER_MOVING_AVERAGE, Window: 3}, 10, 20, 30, 40))
+	require.Equal([]float64{20, 20, 20, 20, 20}, filterAll(require, &FilterConfig{Type: FILTER_MEDIAN, Window: 3}, 20, 20, 95, 20, 20))
+	require.Equal([]float64{10, 15, 17.5}, filterAll(require, &FilterConfig{Type: FILTER_EMA, Alpha: 0.5}, 10, 20, 20))
+}
+
+func TestFilterMaxRate(t *testing.T) {
+	require := require.New(t)
+
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	source := &flakyProbe{temp: 20}
+	f, err := NewFilteredProbe(source, []*FilterConfig{{Type: FILTER_MAX_RATE, MaxRate: 0.1}})
+	require.Nil(err)
+	f.SetClock(clock)
+
+	temp, err := f.GetTemperature()
+	require.Nil(err)
+	require.Equal(20.0, temp)
+
+	// Spike. The output only moves by max_rate towards it
+	clock.Advance(time.Second)
+	source.temp = 85
+	temp, err = f.GetTemperature()
+	require.Nil(err)
+	require.InDelta(20.1, temp, 1e-9)
+	require.Equal(85.0, f.RawTemperature())
+	require.Equal(uint64(1), f.Rejected())
+
+	clock.Advance(time.Second)
+	source.temp = 20.15
+	temp, err = f.GetTemperature()
+	require.Nil(err)
+	require.Equal(20.15, temp)
+
+	// A real step change is tracked at max_rate until it is caught up
+	source.temp = 25
+	clock.Advance(10 * time.Second)
+	temp, err = f.GetTemperature()
+	require.Nil(err)
+	require.InDelta(21.15, temp, 1e-9)
+	require.Equal(uint64(2), f.Rejected())
+	clock.Advance(40 * time.Second)
+	temp, err = f.GetTemperature()
+	require.Nil(err)
+	require.Equal(25.0, temp)
+}
+
+func TestFilterMaxRateTracksSustainedChange(t *testing.T) {
+	require := require.New(t)
+
+	// Readings that keep changing faster than max_rate must neither trip
+	// PROBE_LOST nor freeze the reported temperature
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	source := &flakyProbe{temp: 20}
+	f, err := NewFilteredProbe(source, []*FilterConfig{{Type: FILTER_MAX_RATE, MaxRate: 0.05}})
+	require.Nil(err)
+
+	tbox := &Thermabox{temperature: 20, threshold: 0.5}
+	tbox.SetRelays(NewFakeRelay(false, []int{1}), NewFakeRelay(false, []int{1}))
+	tbox.SetProbe(f)
+	tbox.SetClock(clock)
+	c := make(chan *interfaces.ThermaboxState, 1)
+	tbox.RegisterChannel(c)
+	alerts := make(chan *interfaces.Alert, 1)
+	tbox.RegisterAlertChannel(alerts)
+
+	require.Nil(tbox.Step())
+	require.Equal(20.0, (<-c).Temperature)
+	source.temp = 25
+	last := 20.0
+	for i := 0; i < 10; i++ {
+		clock.Advance(10 * time.Second)
+		require.Nil(tbox.Step())
+		state := <-c
+		require.True(state.Temperature > last, "%v <= %v", state.Temperature, last)
+		require.Equal(25.0, state.RawTemperature)
+		last = state.Temperature
+	}
+	require.InDelta(25.0, last, 1e-9)
+	require.Equal(uint64(9), f.Rejected())
+	select {
+	case alert := <-alerts:
+		require.FailNow("Unexpected alert", "%v", alert)
+	default:
+	}
+}
+
+func TestFilterDoesNotHideCutoff(t *testing.T) {
+	require := require.New(t)
+
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	source := &flakyProbe{temp: 20}
+	f, err := NewFilteredProbe(source, []*FilterConfig{{Type: FILTER_MAX_RATE, MaxRate: 0.01}})
+	require.Nil(err)
+	tbox, _, c, alerts := newFaultTestThermabox(f)
+	tbox.SetClock(clock)
+
+	require.Nil(tbox.Step())
+	<-c
+
+	// The filtered temperature lags far behind, but the raw reading is over
+	// the cutoff
+	source.temp = 35
+	clock.Advance(10 * time.Second)
+	err = tbox.Step()
+	require.NotNil(err)
+	require.Equal(interfaces.OVER_TEMPERATURE, err.(*FaultError).Class)
+	require.Equal("Temperature > cutoff temperature: 35 > 30", err.(*FaultError).Err.Error())
+	require.Equal(interfaces.OVER_TEMPERATURE, (<-alerts).Type)
+}
+
+func TestThermaboxRawTemperature(t *testing.T) {
+	require := require.New(t)
+
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	f, err := NewFilteredProbe(&sequenceProbe{temps: []float64{20, 30}}, []*FilterConfig{{Type: FILTER_MOVING_AVERAGE, Window: 2}})
+	require.Nil(err)
+
+	tbox := &Thermabox{temperature: 20, threshold: 0.5}
+	tbox.SetRelays(NewFakeRelay(false, []int{1}), NewFakeRelay(false, []int{1}))
+	tbox.AddProbe("inner", f)
+	tbox.SetClock(clock)
+	c := make(chan *interfaces.ThermaboxState, 1)
+	tbox.RegisterChannel(c)
+
+	require.Nil(tbox.Step())
+	<-c
+	require.Nil(tbox.Step())
+	state := <-c
+	require.Equal(25.0, state.Temperature)
+	require.Equal(30.0, state.RawTemperature)
+	require.Equal(25.0, state.Probes[0].Temperature)
+	require.Equal(30.0, state.Probes[0].Raw)
+}
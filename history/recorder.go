@@ -0,0 +1,415 @@
+package history
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gurupras/thermabox/interfaces"
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Tier is a resolution at which history is kept and how long it is kept for
+type Tier struct {
+	Resolution time.Duration
+	Retention  time.Duration
+}
+
+func (t Tier) bucket() string {
+	return strconv.FormatInt(int64(t.Resolution/time.Millisecond), 10)
+}
+
+// DefaultTiers keep 5 second samples for a day, minutes for a week and
+// quarter hours for a year
+var DefaultTiers = []Tier{
+	{5 * time.Second, 24 * time.Hour},
+	{time.Minute, 7 * 24 * time.Hour},
+	{15 * time.Minute, 365 * 24 * time.Hour},
+}
+
+// Recorder downsamples thermabox states into every tier and writes them to a
+// Store, deleting samples once they are past the tier's retention.
+// Samples are written by a goroutine of their own so that recording never
+// waits on the disk
+type Recorder struct {
+	Path    string
+	Tiers   []Tier
+	store   *Store
+	pending []*aggregate
+	// Timestamp of the latest state recorded
+	latest int64
+	mutex  sync.Mutex
+
+	writes chan *write
+	done   chan struct{}
+	// queued and written count the writes and are guarded by writeMutex
+	queued     uint64
+	written    uint64
+	writeMutex sync.Mutex
+	flushed    *sync.Cond
+}
+
+// writeQueueSize is how many samples may wait for the writer before
+// further samples are dropped
+const writeQueueSize = 64
+
+// write is a sample waiting to be written. Samples of the bucket older than
+// before are pruned once it is
+type write struct {
+	bucket string
+	sample *interfaces.HistorySample
+	before int64
+}
+
+func NewRecorder(path string, tiers []Tier) *Recorder {
+	return &Recorder{Path: path, Tiers: tiers}
+}
+
+func (r *Recorder) UnmarshalYAML(unmarshal func(i interface{}) error) error {
+	m := make(map[string]interface{})
+	if err := unmarshal(&m); err != nil {
+		return err
+	}
+	path, ok := m["path"]
+	if !ok {
+		return fmt.Errorf("History is missing path")
+	}
+	r.Path = fmt.Sprintf("%v", path)
+	r.Tiers = DefaultTiers
+	if data, ok := m["tiers"]; ok {
+		b, err := yaml.Marshal(data)
+		if err != nil {
+			return fmt.Errorf("Failed to marshal key 'tiers': %v: %v", data, err)
+		}
+		conf := make([]struct {
+			Resolution float64 `yaml:"resolution_sec"`
+			Retention  float64 `yaml:"retention_sec"`
+		}, 0)
+		if err := yaml.Unmarshal(b, &conf); err != nil {
+			return fmt.Errorf("Failed while parsing tiers: %v", err)
+		}
+		r.Tiers = make([]Tier, len(conf))
+		for idx, c := range conf {
+			r.Tiers[idx] = Tier{seconds(c.Resolution), seconds(c.Retention)}
+		}
+	}
+	return r.validate()
+}
+
+func (r *Recorder) validate() error {
+	if len(r.Tiers) == 0 {
+		return fmt.Errorf("History has no tiers")
+	}
+	for idx, tier := range r.Tiers {
+		if tier.Resolution < time.Second {
+			return fmt.Errorf("History resolution must be >= 1s: %v", tier.Resolution)
+		}
+		if tier.Retention < tier.Resolution {
+			return fmt.Errorf("History retention must be >= resolution: %v < %v", tier.Retention, tier.Resolution)
+		}
+		if idx > 0 && tier.Resolution <= r.Tiers[idx-1].Resolution {
+			return fmt.Errorf("History tiers must be in order of increasing resolution")
+		}
+	}
+	return nil
+}
+
+func (r *Recorder) Open() error {
+	if err := r.validate(); err != nil {
+		return err
+	}
+	store, err := OpenStore(r.Path)
+	if err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.writeMutex.Lock()
+	if r.flushed == nil {
+		r.flushed = sync.NewCond(&r.writeMutex)
+	}
+	r.writeMutex.Unlock()
+	r.store = store
+	r.pending = make([]*aggregate, len(r.Tiers))
+	r.writes = make(chan *write, writeQueueSize)
+	r.done = make(chan struct{})
+	go r.writer(store, r.writes, r.done)
+	return nil
+}
+
+// Close writes out the samples that are still being aggregated, waits for
+// the writer and closes the store
+func (r *Recorder) Close() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.store == nil {
+		return nil
+	}
+	for idx, tier := range r.Tiers {
+		if a := r.pending[idx]; a != nil {
+			r.writeMutex.Lock()
+			r.queued++
+			r.writeMutex.Unlock()
+			r.writes <- &write{bucket: tier.bucket(), sample: a.sample()}
+		}
+	}
+	close(r.writes)
+	<-r.done
+	err := r.store.Close()
+	r.store = nil
+	r.writes = nil
+	return err
+}
+
+// writer writes queued samples until writes is closed. A sample that is
+// already stored for the same interval was written before a restart, and
+// is merged with the new one rather than replaced by it
+func (r *Recorder) writer(store *Store, writes <-chan *write, done chan<- struct{}) {
+	defer close(done)
+	for w := range writes {
+		if err := w.apply(store); err != nil {
+			log.Errorf("Failed to write history: %v", err)
+		}
+		r.writeMutex.Lock()
+		r.written++
+		r.flushed.Broadcast()
+		r.writeMutex.Unlock()
+	}
+}
+
+func (w *write) apply(store *Store) error {
+	sample := w.sample
+	stored, err := store.Get(w.bucket, sample.Timestamp)
+	if err != nil {
+		return err
+	}
+	if stored != nil {
+		sample = merge(stored, sample)
+	}
+	if err := store.Put(w.bucket, sample); err != nil {
+		return err
+	}
+	if w.before > 0 {
+		return store.Prune(w.bucket, w.before)
+	}
+	return nil
+}
+
+// queue hands w to the writer without blocking. It is dropped if the writer
+// has fallen too far behind
+func (r *Recorder) queue(w *write) {
+	r.writeMutex.Lock()
+	defer r.writeMutex.Unlock()
+	select {
+	case r.writes <- w:
+		r.queued++
+	default:
+		log.Warnf("History writer is falling behind, dropped sample at %v", w.sample.Timestamp)
+	}
+}
+
+// flush waits until the samples queued so far have been written
+func (r *Recorder) flush() {
+	r.writeMutex.Lock()
+	defer r.writeMutex.Unlock()
+	target := r.queued
+	for r.written < target {
+		r.flushed.Wait()
+	}
+}
+
+func (r *Recorder) unwritten() bool {
+	r.writeMutex.Lock()
+	defer r.writeMutex.Unlock()
+	return r.written < r.queued
+}
+
+// Record adds a state to the sample of every tier. Samples are queued for
+// writing once a state past the end of their interval is recorded
+func (r *Recorder) Record(state *interfaces.ThermaboxState) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.store == nil {
+		return fmt.Errorf("History is not open")
+	}
+	r.latest = state.Timestamp
+	for idx, tier := range r.Tiers {
+		resolution := int64(tier.Resolution / time.Millisecond)
+		start := state.Timestamp - state.Timestamp%resolution
+		a := r.pending[idx]
+		if a != nil && a.start != start {
+			r.queue(&write{
+				bucket: tier.bucket(),
+				sample: a.sample(),
+				before: state.Timestamp - int64(tier.Retention/time.Millisecond),
+			})
+			a = nil
+		}
+		if a == nil {
+			a = &aggregate{start: start, duration: resolution}
+			r.pending[idx] = a
+		}
+		a.add(state)
+	}
+	return nil
+}
+
+// Query returns the samples between from and to, in milliseconds since the
+// epoch. Samples come from the coarsest tier that still holds from and is no
+// coarser than resolution, and are combined further if the tier is finer
+// than resolution. The sample that is still being aggregated is included
+func (r *Recorder) Query(from int64, to int64, resolution time.Duration) ([]*interfaces.HistorySample, error) {
+	if to < from {
+		return nil, fmt.Errorf("History query ends before it starts: %v < %v", to, from)
+	}
+	// Wait for the writer outside the mutex so that Record is not held up.
+	// Only Record queues samples, so once there are none left unwritten
+	// while the mutex is held the store is up to date
+	for {
+		r.flush()
+		r.mutex.Lock()
+		if !r.unwritten() {
+			break
+		}
+		r.mutex.Unlock()
+	}
+	defer r.mutex.Unlock()
+	if r.store == nil {
+		return nil, fmt.Errorf("History is not open")
+	}
+
+	idx := -1
+	for i, t := range r.Tiers {
+		if r.latest-int64(t.Retention/time.Millisecond) > from {
+			continue
+		}
+		if idx == -1 || t.Resolution <= resolution {
+			idx = i
+		}
+	}
+	if idx == -1 {
+		idx = len(r.Tiers) - 1
+	}
+	tier := r.Tiers[idx]
+	samples, err := r.store.Range(tier.bucket(), from, to)
+	if err != nil {
+		return nil, err
+	}
+	if a := r.pending[idx]; a != nil && a.start >= from && a.start < to {
+		pending := a.sample()
+		// Part of the interval may have been stored before a restart
+		if n := len(samples); n > 0 && samples[n-1].Timestamp == pending.Timestamp {
+			samples[n-1] = merge(samples[n-1], pending)
+		} else {
+			samples = append(samples, pending)
+		}
+	}
+	if resolution <= tier.Resolution {
+		return samples, nil
+	}
+	return downsample(samples, int64(resolution/time.Millisecond)), nil
+}
+
+// aggregate accumulates the states within one interval of a tier
+type aggregate struct {
+	start    int64
+	duration int64
+	count    int
+	sum      float64
+	min      float64
+	max      float64
+	heating  float64
+	cooling  float64
+	// Number of states, which count weighs by duration when downsampling
+	states int
+	last   interfaces.HistorySample
+}
+
+func (a *aggregate) add(state *interfaces.ThermaboxState) {
+	s := &interfaces.HistorySample{
+		Temperature:    state.Temperature,
+		MinTemperature: state.Temperature,
+		MaxTemperature: state.Temperature,
+		Setpoint:       state.Setpoint,
+		Threshold:      state.Threshold,
+		State:          state.State,
+		Count:          1,
+	}
+	if state.HeatingElement.On {
+		s.Heating = 1
+	}
+	if state.CoolingElement.On {
+		s.Cooling = 1
+	}
+	a.addSample(s, 1)
+}
+
+func (a *aggregate) addSample(s *interfaces.HistorySample, weight int) {
+	if a.count == 0 {
+		a.min = s.MinTemperature
+		a.max = s.MaxTemperature
+	}
+	a.count += weight
+	a.states += s.Count
+	a.sum += s.Temperature * float64(weight)
+	a.min = math.Min(a.min, s.MinTemperature)
+	a.max = math.Max(a.max, s.MaxTemperature)
+	a.heating += s.Heating * float64(weight)
+	a.cooling += s.Cooling * float64(weight)
+	a.last = *s
+}
+
+func (a *aggregate) sample() *interfaces.HistorySample {
+	n := float64(a.count)
+	return &interfaces.HistorySample{
+		Timestamp:      a.start,
+		Duration:       a.duration,
+		Temperature:    a.sum / n,
+		MinTemperature: a.min,
+		MaxTemperature: a.max,
+		Setpoint:       a.last.Setpoint,
+		Threshold:      a.last.Threshold,
+		State:          a.last.State,
+		Heating:        a.heating / n,
+		Cooling:        a.cooling / n,
+		Count:          a.states,
+	}
+}
+
+// merge combines two samples of the same interval, weighing them by the
+// number of states in each. later was aggregated after earlier
+func merge(earlier *interfaces.HistorySample, later *interfaces.HistorySample) *interfaces.HistorySample {
+	a := &aggregate{start: later.Timestamp, duration: later.Duration}
+	a.addSample(earlier, earlier.Count)
+	a.addSample(later, later.Count)
+	return a.sample()
+}
+
+// downsample combines samples into intervals of resolution milliseconds,
+// weighing each sample by its duration
+func downsample(samples []*interfaces.HistorySample, resolution int64) []*interfaces.HistorySample {
+	ret := make([]*interfaces.HistorySample, 0)
+	var a *aggregate
+	for _, s := range samples {
+		start := s.Timestamp - s.Timestamp%resolution
+		if a != nil && a.start != start {
+			ret = append(ret, a.sample())
+			a = nil
+		}
+		if a == nil {
+			a = &aggregate{start: start, duration: resolution}
+		}
+		a.addSample(s, int(s.Duration))
+	}
+	if a != nil {
+		ret = append(ret, a.sample())
+	}
+	return ret
+}
+
+func seconds(val float64) time.Duration {
+	return time.Duration(val * float64(time.Second))
+}
@@ -0,0 +1,208 @@
+package history
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gurupras/thermabox/interfaces"
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestParseYamlRecorder(t *testing.T) {
+	require := require.New(t)
+
+	r := &Recorder{}
+	require.Nil(yaml.Unmarshal([]byte(`path: /var/lib/thermabox/history.db`), r))
+	require.Equal("/var/lib/thermabox/history.db", r.Path)
+	require.Equal(DefaultTiers, r.Tiers)
+
+	r = &Recorder{}
+	require.Nil(yaml.Unmarshal([]byte(`
+path: history.db
+tiers:
+  - {resolution_sec: 10, retention_sec: 3600}
+  - {resolution_sec: 300, retention_sec: 86400}
+`), r))
+	require.Equal([]Tier{{10 * time.Second, time.Hour}, {5 * time.Minute, 24 * time.Hour}}, r.Tiers)
+
+	for _, str := range []string{
+		`tiers: [{resolution_sec: 10, retention_sec: 3600}]`,
+		`{path: a, tiers: []}`,
+		`{path: a, tiers: [{resolution_sec: 0.5, retention_sec: 3600}]}`,
+		`{path: a, tiers: [{resolution_sec: 10, retention_sec: 5}]}`,
+		`{path: a, tiers: [{resolution_sec: 60, retention_sec: 3600}, {resolution_sec: 10, retention_sec: 3600}]}`,
+	} {
+		r = &Recorder{}
+		require.NotNil(yaml.Unmarshal([]byte(str), r), str)
+	}
+}
+
+func state(timestamp int64, temp float64, heating bool) *interfaces.ThermaboxState {
+	s := &interfaces.ThermaboxState{
+		Timestamp:   timestamp,
+		Temperature: temp,
+		Setpoint:    20,
+		Threshold:   0.5,
+		State:       interfaces.STABLE,
+	}
+	if heating {
+		s.State = interfaces.HEATING_UP
+		s.HeatingElement.On = true
+	}
+	return s
+}
+
+func TestRecorder(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "thermabox-history")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "history.db")
+
+	r := NewRecorder(path, []Tier{{5 * time.Second, time.Minute}, {time.Minute, time.Hour}})
+	require.NotNil(r.Record(state(0, 20, false)))
+	require.Nil(r.Open())
+
+	// One reading a second for two minutes, heating for the first half of
+	// every 10 seconds
+	base := int64(1000 * 3600)
+	for i := int64(0); i < 120; i++ {
+		require.Nil(r.Record(state(base+i*1000, float64(i%10), i%10 < 5)))
+	}
+
+	samples, err := r.Query(base+100000, base+120000, 0)
+	require.Nil(err)
+	require.Equal(4, len(samples))
+	require.Equal(base+100000, samples[0].Timestamp)
+	require.Equal(int64(5000), samples[0].Duration)
+	require.Equal(2.0, samples[0].Temperature)
+	require.Equal(0.0, samples[0].MinTemperature)
+	require.Equal(4.0, samples[0].MaxTemperature)
+	require.Equal(1.0, samples[0].Heating)
+	require.Equal(interfaces.HEATING_UP, samples[0].State)
+	require.Equal(0.0, samples[1].Heating)
+	require.Equal(interfaces.STABLE, samples[1].State)
+	require.Equal(20.0, samples[1].Setpoint)
+	// The last sample is still being aggregated
+	require.Equal(base+115000, samples[3].Timestamp)
+
+	// Downsampled from the finest tier
+	samples, err = r.Query(base+100000, base+120000, 10*time.Second)
+	require.Nil(err)
+	require.Equal(2, len(samples))
+	require.Equal(int64(10000), samples[0].Duration)
+	require.Equal(4.5, samples[0].Temperature)
+	require.Equal(0.5, samples[0].Heating)
+
+	// Older than the finest tier's retention
+	samples, err = r.Query(base, base+60000, 0)
+	require.Nil(err)
+	require.Equal(1, len(samples))
+	require.Equal(int64(60000), samples[0].Duration)
+	require.Equal(4.5, samples[0].Temperature)
+	require.Equal(0.5, samples[0].Heating)
+
+	// Pruned past retention
+	samples, err = r.store.Range("5000", base, base+120000)
+	require.Nil(err)
+	require.True(samples[0].Timestamp >= base+115000-60000)
+
+	_, err = r.Query(base+1000, base, 0)
+	require.NotNil(err)
+
+	// Pending samples are written on close
+	require.Nil(r.Close())
+	_, err = r.Query(base, base+120000, 0)
+	require.NotNil(err)
+	require.Nil(r.Open())
+	defer r.Close()
+	samples, err = r.Query(base, base+120000, time.Minute)
+	require.Nil(err)
+	require.Equal(2, len(samples))
+	require.Equal(base+60000, samples[1].Timestamp)
+}
+
+func TestRecorderRestart(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "thermabox-history")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "history.db")
+
+	base := int64(1000 * 3600)
+	r := NewRecorder(path, []Tier{{5 * time.Second, time.Minute}})
+	require.Nil(r.Open())
+	for i := int64(0); i < 3; i++ {
+		require.Nil(r.Record(state(base+i*1000, 10, false)))
+	}
+	require.Nil(r.Close())
+
+	// Restarted within the same interval
+	require.Nil(r.Open())
+	defer r.Close()
+	require.Nil(r.Record(state(base+3000, 20, true)))
+	samples, err := r.Query(base, base+5000, 0)
+	require.Nil(err)
+	require.Equal(1, len(samples))
+	require.Equal(4, samples[0].Count)
+	require.Equal(12.5, samples[0].Temperature)
+
+	require.Nil(r.Record(state(base+4000, 20, true)))
+	require.Nil(r.Record(state(base+5000, 20, true)))
+	samples, err = r.Query(base, base+5000, 0)
+	require.Nil(err)
+	require.Equal(1, len(samples))
+	require.Equal(5, samples[0].Count)
+	require.Equal(14.0, samples[0].Temperature)
+	require.Equal(10.0, samples[0].MinTemperature)
+	require.Equal(20.0, samples[0].MaxTemperature)
+	require.Equal(0.4, samples[0].Heating)
+	require.Equal(interfaces.HEATING_UP, samples[0].State)
+}
+
+func TestRecorderDoesNotWaitForStore(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "thermabox-history")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+
+	r := NewRecorder(filepath.Join(dir, "history.db"), []Tier{{5 * time.Second, time.Minute}})
+	require.Nil(r.Open())
+	defer r.Close()
+
+	// Hold the store's write lock so that the writer cannot make progress
+	tx, err := r.store.db.Begin(true)
+	require.Nil(err)
+
+	base := int64(1000 * 3600)
+	done := make(chan error)
+	go func() {
+		for i := int64(0); i < 20; i++ {
+			if err := r.Record(state(base+i*1000, float64(i), false)); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		require.Nil(err)
+	case <-time.After(time.Second):
+		require.Fail("Record waited for the store")
+	}
+
+	require.Nil(tx.Rollback())
+	samples, err := r.Query(base, base+20000, 0)
+	require.Nil(err)
+	require.Equal(4, len(samples))
+	require.Equal(2.0, samples[0].Temperature)
+	require.Equal(17.0, samples[3].Temperature)
+}
@@ -0,0 +1,111 @@
+package history
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gurupras/thermabox/interfaces"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Store keeps history samples in a bolt database, with one bucket per
+// resolution. Samples are keyed by their timestamp
+type Store struct {
+	db *bolt.DB
+}
+
+func OpenStore(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open history store '%v': %v", path, err)
+	}
+	return &Store{db}, nil
+}
+
+func (s *Store) Close() error {
+	return s.db.Close()
+}
+
+func key(timestamp int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(timestamp))
+	return b
+}
+
+// Put stores a sample, replacing any sample with the same timestamp
+func (s *Store) Put(bucket string, sample *interfaces.HistorySample) error {
+	value, err := json.Marshal(sample)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		return b.Put(key(sample.Timestamp), value)
+	})
+}
+
+// Get returns the sample with the given timestamp, or nil if there is none
+func (s *Store) Get(bucket string, timestamp int64) (*interfaces.HistorySample, error) {
+	var sample *interfaces.HistorySample
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		v := b.Get(key(timestamp))
+		if v == nil {
+			return nil
+		}
+		sample = &interfaces.HistorySample{}
+		if err := json.Unmarshal(v, sample); err != nil {
+			return fmt.Errorf("Failed to decode history sample: %v", err)
+		}
+		return nil
+	})
+	return sample, err
+}
+
+// Range returns the samples with from <= timestamp < to, oldest first
+func (s *Store) Range(bucket string, from int64, to int64) ([]*interfaces.HistorySample, error) {
+	samples := make([]*interfaces.HistorySample, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		end := key(to)
+		for k, v := c.Seek(key(from)); k != nil && string(k) < string(end); k, v = c.Next() {
+			sample := &interfaces.HistorySample{}
+			if err := json.Unmarshal(v, sample); err != nil {
+				return fmt.Errorf("Failed to decode history sample: %v", err)
+			}
+			samples = append(samples, sample)
+		}
+		return nil
+	})
+	return samples, err
+}
+
+// Prune deletes the samples older than before
+func (s *Store) Prune(bucket string, before int64) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		c := b.Cursor()
+		end := key(before)
+		for k, _ := c.First(); k != nil && string(k) < string(end); k, _ = c.First() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,50 @@
+package history
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gurupras/thermabox/interfaces"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "thermabox-history")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+
+	store, err := OpenStore(filepath.Join(dir, "history.db"))
+	require.Nil(err)
+	defer store.Close()
+
+	samples, err := store.Range("5000", 0, 100000)
+	require.Nil(err)
+	require.Equal(0, len(samples))
+
+	for _, ts := range []int64{30000, 10000, 20000} {
+		require.Nil(store.Put("5000", &interfaces.HistorySample{Timestamp: ts, Temperature: float64(ts / 1000)}))
+	}
+	// Replaced
+	require.Nil(store.Put("5000", &interfaces.HistorySample{Timestamp: 20000, Temperature: 21}))
+
+	samples, err = store.Range("5000", 10000, 30000)
+	require.Nil(err)
+	require.Equal(2, len(samples))
+	require.Equal(int64(10000), samples[0].Timestamp)
+	require.Equal(21.0, samples[1].Temperature)
+
+	require.Nil(store.Prune("5000", 20000))
+	samples, err = store.Range("5000", 0, 100000)
+	require.Nil(err)
+	require.Equal(2, len(samples))
+	require.Equal(int64(20000), samples[0].Timestamp)
+
+	// Other buckets are separate
+	samples, err = store.Range("60000", 0, 100000)
+	require.Nil(err)
+	require.Equal(0, len(samples))
+}
@@ -1,5 +1,7 @@
 package interfaces
 
+import "time"
+
 type State string
 
 const (
@@ -7,22 +9,185 @@ const (
 	COOLING_DOWN State = "cooling_down"
 	STABLE       State = "stable"
 	UNKNOWN      State = "unknown"
+	// FAULT means the thermabox has turned the elements off because of a
+	// fault and stopped driving them
+	FAULT State = "fault"
 )
 
 type TemperatureSensorInterface interface {
 	GetTemperature() (float64, error)
 }
 
+// ElementState reports whether an element is on. Pending is set when the
+// element is in a different state than the controller wants because the
+// switch is held back by the element's minimum on, off or cycle time or,
+// when switching on, by the interlock while the other element is still on or
+// by the dead time after it turned off. Lockout is the number of seconds
+// before the element's minimum times allow it to switch again.
+// A fault, including exceeding max_continuous_runtime, turns both elements
+// off and withdraws the request, so it never leaves an element pending.
+type ElementState struct {
+	On      bool    `json:"on"`
+	Pending bool    `json:"pending"`
+	Lockout float64 `json:"lockout"`
+}
+
 type ThermaboxState struct {
+	Temperature    float64        `json:"temperature"`
+	RawTemperature float64        `json:"raw_temperature"`
+	Timestamp      int64          `json:"timestamp"`
+	Setpoint       float64        `json:"setpoint"`
+	Threshold      float64        `json:"threshold"`
+	State          State          `json:"state"`
+	HeatingElement ElementState   `json:"heating_element"`
+	CoolingElement ElementState   `json:"cooling_element"`
+	Profile        *ProfileStatus `json:"profile,omitempty"`
+	Probes         []ProbeReading `json:"probes,omitempty"`
+	Fault          string         `json:"fault,omitempty"`
+}
+
+// AlertType is the kind of an alert. Alerts raised by a fault are of the
+// fault's class
+type AlertType string
+
+const (
+	PROBE_LOST        AlertType = "probe_lost"
+	OVER_TEMPERATURE  AlertType = "over_temperature"
+	UNDER_TEMPERATURE AlertType = "under_temperature"
+	RATE_OF_CHANGE    AlertType = "rate_of_change"
+	RUNTIME_EXCEEDED  AlertType = "runtime_exceeded"
+	RELAY_FAULT       AlertType = "relay_fault"
+	// FAULT_CLEARED is raised when a fault is reset or recovers on its own
+	FAULT_CLEARED AlertType = "fault_cleared"
+)
+
+// Alert is raised when something needs attention. Timestamp is in
+// milliseconds since the epoch
+type Alert struct {
+	Type      AlertType `json:"type"`
+	Message   string    `json:"message"`
+	Timestamp int64     `json:"timestamp"`
+}
+
+type AlertListenerInterface interface {
+	RegisterAlertChannel(chan *Alert)
+}
+
+// AlertSubscription receives raised alerts on C the way Subscription
+// receives states
+type AlertSubscription interface {
+	C() <-chan *Alert
+	Unsubscribe()
+	Dropped() uint64
+}
+
+// AlertSubscriberInterface is implemented by thermaboxes that raise alerts
+// without ever blocking on a slow subscriber
+type AlertSubscriberInterface interface {
+	SubscribeAlerts(buffer int, policy BufferPolicy) AlertSubscription
+}
+
+// FaultInterface is implemented by thermaboxes whose faults can be reset
+type FaultInterface interface {
+	ResetFault() error
+}
+
+// ProbeReading is the latest reading of a single probe. Temperature holds the
+// last successful reading after filtering and Raw the last reading before
+// filtering. LastSuccess is in milliseconds since the epoch
+type ProbeReading struct {
+	Name        string  `json:"name"`
 	Temperature float64 `json:"temperature"`
-	Timestamp   int64   `json:"timestamp"`
-	State       State   `json:"state"`
+	Raw         float64 `json:"raw"`
+	Healthy     bool    `json:"healthy"`
+	Error       string  `json:"error,omitempty"`
+	Failures    int     `json:"failures"`
+	LastSuccess int64   `json:"last_success"`
+}
+
+// ProfileStatus describes the progress through a temperature profile
+type ProfileStatus struct {
+	Running       bool    `json:"running"`
+	Paused        bool    `json:"paused"`
+	Completed     bool    `json:"completed"`
+	Step          int     `json:"step"`
+	Steps         int     `json:"steps"`
+	StepName      string  `json:"step_name"`
+	StepType      string  `json:"step_type"`
+	StepElapsed   float64 `json:"step_elapsed"`
+	StepRemaining float64 `json:"step_remaining"`
+	Setpoint      float64 `json:"setpoint"`
+	Threshold     float64 `json:"threshold"`
+}
+
+// ProfileInterface is implemented by thermaboxes that can follow a
+// temperature profile
+type ProfileInterface interface {
+	StartProfile() error
+	PauseProfile() error
+	ResumeProfile() error
+	SkipProfileStep() error
+	StopProfile() error
+	GetProfileStatus() (*ProfileStatus, error)
+}
+
+// HistorySample summarizes the thermabox over Duration milliseconds starting
+// at Timestamp. Temperatures are the mean, minimum and maximum over the
+// interval. Heating and Cooling are the fraction of the interval each
+// element was on and State is the state at the end of the interval. Count is
+// the number of states the sample was aggregated from
+type HistorySample struct {
+	Timestamp      int64   `json:"timestamp"`
+	Duration       int64   `json:"duration"`
+	Temperature    float64 `json:"temperature"`
+	MinTemperature float64 `json:"min_temperature"`
+	MaxTemperature float64 `json:"max_temperature"`
+	Setpoint       float64 `json:"setpoint"`
+	Threshold      float64 `json:"threshold"`
+	State          State   `json:"state"`
+	Heating        float64 `json:"heating"`
+	Cooling        float64 `json:"cooling"`
+	Count          int     `json:"count"`
+}
+
+// HistoryInterface is implemented by thermaboxes that record their history.
+// from and to are in milliseconds since the epoch. A resolution of 0 returns
+// the finest resolution available
+type HistoryInterface interface {
+	GetHistory(from int64, to int64, resolution time.Duration) ([]*HistorySample, error)
 }
 
 type ThermaboxListenerInterface interface {
 	RegisterChannel(chan *ThermaboxState)
 }
 
+// BufferPolicy decides which states a subscriber loses when it falls behind
+type BufferPolicy string
+
+const (
+	// DROP_OLDEST discards the oldest buffered state to make room for a new
+	// one
+	DROP_OLDEST BufferPolicy = "drop_oldest"
+	// COALESCE keeps only the latest state that has not been received,
+	// whatever the buffer size
+	COALESCE BufferPolicy = "coalesce"
+)
+
+// Subscription receives published states on C until Unsubscribe is called,
+// after which C is closed. Dropped is the number of states the subscriber
+// lost to its buffer policy
+type Subscription interface {
+	C() <-chan *ThermaboxState
+	Unsubscribe()
+	Dropped() uint64
+}
+
+// ThermaboxSubscriberInterface is implemented by thermaboxes that publish
+// their state without ever blocking on a slow subscriber
+type ThermaboxSubscriberInterface interface {
+	Subscribe(buffer int, policy BufferPolicy) Subscription
+}
+
 type ThermaboxInterface interface {
 	TemperatureSensorInterface
 	ThermaboxListenerInterface
@@ -0,0 +1,240 @@
+package mqtt
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// testBroker is a minimal MQTT 3.1.1 broker for tests. It supports QoS 0 and
+// 1, retained messages, wills and the '+' and '#' wildcards
+type testBroker struct {
+	listener net.Listener
+	clients  map[string]*testBrokerClient
+	retained map[string]*packets.PublishPacket
+	mutex    sync.Mutex
+}
+
+type testBrokerClient struct {
+	id            string
+	conn          net.Conn
+	subscriptions []string
+	will          *packets.PublishPacket
+	mutex         sync.Mutex
+}
+
+func newTestBroker() (*testBroker, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	b := &testBroker{
+		listener: listener,
+		clients:  make(map[string]*testBrokerClient),
+		retained: make(map[string]*packets.PublishPacket),
+	}
+	go b.serve()
+	return b, nil
+}
+
+func (b *testBroker) URL() string {
+	return fmt.Sprintf("tcp://%v", b.listener.Addr())
+}
+
+func (b *testBroker) Close() {
+	b.listener.Close()
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for _, c := range b.clients {
+		c.conn.Close()
+	}
+}
+
+// Drop closes a client's connection as if the network had failed, so that
+// its will is published
+func (b *testBroker) Drop(id string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	c, ok := b.clients[id]
+	if ok {
+		c.conn.Close()
+	}
+	return ok
+}
+
+func (b *testBroker) serve() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			return
+		}
+		go b.handle(conn)
+	}
+}
+
+func (b *testBroker) handle(conn net.Conn) {
+	defer conn.Close()
+	packet, err := packets.ReadPacket(conn)
+	if err != nil {
+		return
+	}
+	connect, ok := packet.(*packets.ConnectPacket)
+	if !ok {
+		return
+	}
+	c := &testBrokerClient{id: connect.ClientIdentifier, conn: conn}
+	if connect.WillFlag {
+		c.will = packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		c.will.TopicName = connect.WillTopic
+		c.will.Payload = connect.WillMessage
+		c.will.Qos = connect.WillQos
+		c.will.Retain = connect.WillRetain
+	}
+	b.mutex.Lock()
+	if old, ok := b.clients[c.id]; ok {
+		old.conn.Close()
+	}
+	b.clients[c.id] = c
+	b.mutex.Unlock()
+	defer func() {
+		b.mutex.Lock()
+		if b.clients[c.id] == c {
+			delete(b.clients, c.id)
+		}
+		b.mutex.Unlock()
+		if c.will != nil {
+			b.publish(c.will)
+		}
+	}()
+
+	connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	connack.ReturnCode = packets.Accepted
+	if c.write(connack) != nil {
+		return
+	}
+	for {
+		packet, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		switch p := packet.(type) {
+		case *packets.PublishPacket:
+			if p.Qos > 0 {
+				puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				puback.MessageID = p.MessageID
+				c.write(puback)
+			}
+			b.publish(p)
+		case *packets.SubscribePacket:
+			suback := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			suback.MessageID = p.MessageID
+			for _, qos := range p.Qoss {
+				if qos > 1 {
+					qos = 1
+				}
+				suback.ReturnCodes = append(suback.ReturnCodes, qos)
+			}
+			c.mutex.Lock()
+			c.subscriptions = append(c.subscriptions, p.Topics...)
+			c.mutex.Unlock()
+			c.write(suback)
+			b.sendRetained(c, p.Topics)
+		case *packets.UnsubscribePacket:
+			unsuback := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+			unsuback.MessageID = p.MessageID
+			c.write(unsuback)
+		case *packets.PingreqPacket:
+			c.write(packets.NewControlPacket(packets.Pingresp))
+		case *packets.DisconnectPacket:
+			// A clean disconnect discards the will
+			c.will = nil
+			return
+		}
+	}
+}
+
+func (b *testBroker) publish(p *packets.PublishPacket) {
+	b.mutex.Lock()
+	if p.Retain {
+		if len(p.Payload) == 0 {
+			delete(b.retained, p.TopicName)
+		} else {
+			b.retained[p.TopicName] = p.Copy()
+		}
+	}
+	clients := make([]*testBrokerClient, 0, len(b.clients))
+	for _, c := range b.clients {
+		clients = append(clients, c)
+	}
+	b.mutex.Unlock()
+
+	for _, c := range clients {
+		if c.subscribed(p.TopicName) {
+			// Retain is only set on messages sent because of a new
+			// subscription
+			out := p.Copy()
+			out.Retain = false
+			c.deliver(out)
+		}
+	}
+}
+
+func (b *testBroker) sendRetained(c *testBrokerClient, filters []string) {
+	b.mutex.Lock()
+	retained := make([]*packets.PublishPacket, 0)
+	for topic, p := range b.retained {
+		for _, filter := range filters {
+			if topicMatches(filter, topic) {
+				retained = append(retained, p.Copy())
+				break
+			}
+		}
+	}
+	b.mutex.Unlock()
+	for _, p := range retained {
+		p.Retain = true
+		c.deliver(p)
+	}
+}
+
+func (c *testBrokerClient) subscribed(topic string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, filter := range c.subscriptions {
+		if topicMatches(filter, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// deliver sends a message at QoS 0, which subscribers must accept whatever
+// QoS they asked for
+func (c *testBrokerClient) deliver(p *packets.PublishPacket) {
+	p.Qos = 0
+	p.MessageID = 0
+	c.write(p)
+}
+
+func (c *testBrokerClient) write(p packets.ControlPacket) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return p.Write(c.conn)
+}
+
+func topicMatches(filter string, topic string) bool {
+	f := strings.Split(filter, "/")
+	t := strings.Split(topic, "/")
+	for idx, level := range f {
+		if level == "#" {
+			return true
+		}
+		if idx >= len(t) || (level != "+" && level != t[idx]) {
+			return false
+		}
+	}
+	return len(f) == len(t)
+}
@@ -0,0 +1,349 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gurupras/thermabox/interfaces"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	ONLINE  = "online"
+	OFFLINE = "offline"
+)
+
+// Client connects the thermabox to an MQTT broker. Under Topic it publishes
+//
+//	<topic>/status   'online' or 'offline', retained and set to 'offline' by
+//	                 the broker if the connection is lost
+//	<topic>/state    every published state as JSON, retained
+//	<topic>/alert    every alert as JSON
+//	<topic>/result   the outcome of every command
+//
+// and handles the commands
+//
+//	<topic>/cmd/limits             {"temperature": <float>, "threshold": <float>}
+//	<topic>/cmd/enable
+//	<topic>/cmd/disable
+//	<topic>/cmd/reset-fault
+//	<topic>/cmd/profile/<action>   start, pause, resume, skip or stop
+type Client struct {
+	Broker   string
+	ClientID string
+	Username string
+	Password string
+	Topic    string
+	QoS      byte
+	// States are published at most once per Interval
+	Interval time.Duration
+
+	client            paho.Client
+	tbox              interfaces.ThermaboxInterface
+	subscription      interfaces.Subscription
+	alertSubscription interfaces.AlertSubscription
+	lastPublish       time.Time
+	stopped           chan struct{}
+	mutex             sync.Mutex
+}
+
+// alertBuffer is the number of alerts buffered before the oldest are dropped
+const alertBuffer = 16
+
+// CommandResult is published to <topic>/result after every command
+type CommandResult struct {
+	Command string `json:"command"`
+	Error   string `json:"error,omitempty"`
+}
+
+func New(broker string) *Client {
+	return &Client{Broker: broker, ClientID: "thermabox", Topic: "thermabox", QoS: 1}
+}
+
+func (c *Client) UnmarshalYAML(unmarshal func(i interface{}) error) error {
+	m := make(map[string]interface{})
+	if err := unmarshal(&m); err != nil {
+		return err
+	}
+	broker, ok := m["broker"]
+	if !ok {
+		return fmt.Errorf("MQTT is missing broker")
+	}
+	*c = *New(fmt.Sprintf("%v", broker))
+	for key, dst := range map[string]*string{
+		"client_id": &c.ClientID,
+		"username":  &c.Username,
+		"password":  &c.Password,
+		"topic":     &c.Topic,
+	} {
+		if val, ok := m[key]; ok {
+			*dst = fmt.Sprintf("%v", val)
+		}
+	}
+	c.Topic = strings.TrimSuffix(c.Topic, "/")
+	if c.Topic == "" || strings.ContainsAny(c.Topic, "+#") {
+		return fmt.Errorf("Invalid MQTT topic: '%v'", c.Topic)
+	}
+	if val, ok := m["qos"]; ok {
+		qos, ok := val.(int)
+		if !ok || qos < 0 || qos > 2 {
+			return fmt.Errorf("Failed while parsing qos: %v", val)
+		}
+		c.QoS = byte(qos)
+	}
+	interval, err := parseFloat(m, "interval_sec", 0)
+	if err != nil {
+		return err
+	}
+	if interval < 0 {
+		return fmt.Errorf("interval_sec must not be negative: %v", interval)
+	}
+	c.Interval = time.Duration(interval * float64(time.Second))
+	return nil
+}
+
+func parseFloat(m map[string]interface{}, key string, defaultValue float64) (float64, error) {
+	val, ok := m[key]
+	if !ok {
+		return defaultValue, nil
+	}
+	f, err := strconv.ParseFloat(fmt.Sprintf("%v", val), 64)
+	if err != nil {
+		return 0, fmt.Errorf("Failed while parsing %v: %v", key, err)
+	}
+	return f, nil
+}
+
+func (c *Client) topic(suffix string) string {
+	return c.Topic + "/" + suffix
+}
+
+// Start connects to the broker and publishes the thermabox's states until
+// Stop is called. The connection is retried in the background, so Start does
+// not fail if the broker is unreachable
+func (c *Client) Start(tbox interfaces.ThermaboxInterface) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.client != nil {
+		return fmt.Errorf("MQTT client already started")
+	}
+	c.tbox = tbox
+
+	opts := paho.NewClientOptions()
+	opts.AddBroker(c.Broker)
+	opts.SetClientID(c.ClientID)
+	opts.SetUsername(c.Username)
+	opts.SetPassword(c.Password)
+	opts.SetWill(c.topic("status"), OFFLINE, c.QoS, true)
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(true)
+	opts.SetConnectRetryInterval(5 * time.Second)
+	opts.SetMaxReconnectInterval(time.Minute)
+	// Subscriptions do not outlive a clean session, so they are made on
+	// every connect
+	opts.SetCleanSession(true)
+	opts.SetOnConnectHandler(c.onConnect)
+	opts.SetConnectionLostHandler(func(client paho.Client, err error) {
+		log.Warnf("Lost connection to MQTT broker %v: %v", c.Broker, err)
+	})
+	c.client = paho.NewClient(opts)
+	c.client.Connect()
+
+	var states <-chan *interfaces.ThermaboxState
+	if subscriber, ok := tbox.(interfaces.ThermaboxSubscriberInterface); ok {
+		c.subscription = subscriber.Subscribe(1, interfaces.COALESCE)
+		states = c.subscription.C()
+	} else {
+		tboxChan := make(chan *interfaces.ThermaboxState, 1)
+		tbox.RegisterChannel(tboxChan)
+		states = tboxChan
+	}
+	// Alerts are never coalesced, since each one matters
+	var alerts <-chan *interfaces.Alert
+	if alerter, ok := tbox.(interfaces.AlertSubscriberInterface); ok {
+		c.alertSubscription = alerter.SubscribeAlerts(alertBuffer, interfaces.DROP_OLDEST)
+		alerts = c.alertSubscription.C()
+	}
+	c.stopped = make(chan struct{})
+	go c.publishStates(states, alerts, c.stopped)
+	log.Infof("Connecting to MQTT broker %v as '%v'", c.Broker, c.ClientID)
+	return nil
+}
+
+// Stop marks the thermabox offline and disconnects from the broker
+func (c *Client) Stop() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.client == nil {
+		return
+	}
+	close(c.stopped)
+	if c.subscription != nil {
+		c.subscription.Unsubscribe()
+		c.subscription = nil
+	}
+	if c.alertSubscription != nil {
+		c.alertSubscription.Unsubscribe()
+		c.alertSubscription = nil
+	}
+	if c.client.IsConnectionOpen() {
+		c.client.Publish(c.topic("status"), c.QoS, true, OFFLINE).WaitTimeout(time.Second)
+	}
+	c.client.Disconnect(250)
+	c.client = nil
+}
+
+func (c *Client) onConnect(client paho.Client) {
+	log.Infof("Connected to MQTT broker %v", c.Broker)
+	client.Publish(c.topic("status"), c.QoS, true, ONLINE)
+	token := client.Subscribe(c.topic("cmd/#"), c.QoS, c.handleCommand)
+	if token.WaitTimeout(10*time.Second) && token.Error() != nil {
+		log.Errorf("Failed to subscribe to MQTT commands: %v", token.Error())
+	}
+}
+
+func (c *Client) publishStates(states <-chan *interfaces.ThermaboxState, alerts <-chan *interfaces.Alert, stopped chan struct{}) {
+	for {
+		select {
+		case <-stopped:
+			return
+		case state, ok := <-states:
+			if !ok {
+				return
+			}
+			c.publishState(state)
+		case alert, ok := <-alerts:
+			if !ok {
+				return
+			}
+			c.publishAlert(alert)
+		}
+	}
+}
+
+func (c *Client) publishState(state *interfaces.ThermaboxState) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	now := time.Now()
+	if c.client == nil || now.Sub(c.lastPublish) < c.Interval {
+		return
+	}
+	// States are not queued while disconnected. The next one is retained
+	// once connected again
+	if !c.client.IsConnectionOpen() {
+		return
+	}
+	b, err := json.Marshal(state)
+	if err != nil {
+		log.Errorf("Failed to marshal state: %v", err)
+		return
+	}
+	c.lastPublish = now
+	c.client.Publish(c.topic("state"), c.QoS, true, b)
+}
+
+// publishAlert publishes alert regardless of Interval
+func (c *Client) publishAlert(alert *interfaces.Alert) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.client == nil {
+		return
+	}
+	if !c.client.IsConnectionOpen() {
+		log.Warnf("Not connected to MQTT broker. Dropping alert: %v: %v", alert.Type, alert.Message)
+		return
+	}
+	b, err := json.Marshal(alert)
+	if err != nil {
+		log.Errorf("Failed to marshal alert: %v", err)
+		return
+	}
+	c.client.Publish(c.topic("alert"), c.QoS, false, b)
+}
+
+func (c *Client) handleCommand(client paho.Client, msg paho.Message) {
+	command := strings.TrimPrefix(msg.Topic(), c.topic("cmd/"))
+	// A retained command would be run again on every reconnect
+	if msg.Retained() {
+		log.Warnf("Ignoring retained MQTT command '%v'", command)
+		return
+	}
+	result := CommandResult{Command: command}
+	if err := c.runCommand(command, msg.Payload()); err != nil {
+		log.Errorf("Failed to run MQTT command '%v': %v", command, err)
+		result.Error = err.Error()
+	} else {
+		log.Infof("Ran MQTT command '%v'", command)
+	}
+	b, _ := json.Marshal(result)
+	client.Publish(c.topic("result"), c.QoS, false, b)
+}
+
+func (c *Client) runCommand(command string, payload []byte) error {
+	switch command {
+	case "limits":
+		limits := struct {
+			Temperature *float64 `json:"temperature"`
+			Threshold   *float64 `json:"threshold"`
+		}{}
+		if err := json.Unmarshal(payload, &limits); err != nil {
+			return fmt.Errorf("Failed to parse limits: %v", err)
+		}
+		if limits.Temperature == nil || limits.Threshold == nil {
+			return fmt.Errorf("Limits must have both temperature and threshold")
+		}
+		for _, val := range []float64{*limits.Temperature, *limits.Threshold} {
+			if math.IsNaN(val) || math.IsInf(val, 0) {
+				return fmt.Errorf("Limits must be finite: %v", val)
+			}
+		}
+		if *limits.Threshold < 0 {
+			return fmt.Errorf("Threshold must not be negative: %v", *limits.Threshold)
+		}
+		c.tbox.SetLimits(*limits.Temperature, *limits.Threshold)
+		return nil
+	case "enable":
+		c.tbox.EnableThermabox()
+		return nil
+	case "disable":
+		c.tbox.DisableThermabox()
+		return nil
+	case "reset-fault":
+		fault, ok := c.tbox.(interfaces.FaultInterface)
+		if !ok {
+			return fmt.Errorf("Thermabox does not support faults")
+		}
+		return fault.ResetFault()
+	}
+	if strings.HasPrefix(command, "profile/") {
+		return c.profileCommand(strings.TrimPrefix(command, "profile/"))
+	}
+	return fmt.Errorf("Unknown command: %v", command)
+}
+
+// profileActions maps the name of a profile command to the corresponding call
+var profileActions = map[string]func(interfaces.ProfileInterface) error{
+	"start":  interfaces.ProfileInterface.StartProfile,
+	"pause":  interfaces.ProfileInterface.PauseProfile,
+	"resume": interfaces.ProfileInterface.ResumeProfile,
+	"skip":   interfaces.ProfileInterface.SkipProfileStep,
+	"stop":   interfaces.ProfileInterface.StopProfile,
+}
+
+func (c *Client) profileCommand(action string) error {
+	fn, ok := profileActions[action]
+	if !ok {
+		return fmt.Errorf("Unknown profile action: %v", action)
+	}
+	profile, ok := c.tbox.(interfaces.ProfileInterface)
+	if !ok {
+		return fmt.Errorf("Thermabox does not support profiles")
+	}
+	return fn(profile)
+}
@@ -0,0 +1,361 @@
+package mqtt
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/gurupras/thermabox/interfaces"
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+)
+
+type DummyThermabox struct {
+	channels    []chan *interfaces.ThermaboxState
+	alerts      []*dummyAlertSubscription
+	temperature float64
+	threshold   float64
+	enabled     bool
+	faults      int
+	mutex       sync.Mutex
+}
+
+func (d *DummyThermabox) GetTemperature() (float64, error) {
+	return 20, nil
+}
+
+func (d *DummyThermabox) RegisterChannel(c chan *interfaces.ThermaboxState) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.channels = append(d.channels, c)
+}
+
+func (d *DummyThermabox) publish(state *interfaces.ThermaboxState) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for _, c := range d.channels {
+		c <- state
+	}
+}
+
+type dummyAlertSubscription struct {
+	c chan *interfaces.Alert
+}
+
+func (s *dummyAlertSubscription) C() <-chan *interfaces.Alert {
+	return s.c
+}
+
+func (s *dummyAlertSubscription) Unsubscribe() {
+}
+
+func (s *dummyAlertSubscription) Dropped() uint64 {
+	return 0
+}
+
+func (d *DummyThermabox) SubscribeAlerts(buffer int, policy interfaces.BufferPolicy) interfaces.AlertSubscription {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	s := &dummyAlertSubscription{make(chan *interfaces.Alert, buffer)}
+	d.alerts = append(d.alerts, s)
+	return s
+}
+
+func (d *DummyThermabox) alert(alert *interfaces.Alert) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for _, s := range d.alerts {
+		s.c <- alert
+	}
+}
+
+func (d *DummyThermabox) SetLimits(temperature float64, threshold float64) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.temperature = temperature
+	d.threshold = threshold
+}
+
+func (d *DummyThermabox) GetLimits() (float64, float64) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.temperature, d.threshold
+}
+
+func (d *DummyThermabox) GetState() string {
+	return string(interfaces.STABLE)
+}
+
+func (d *DummyThermabox) DisableThermabox() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.enabled = false
+}
+
+func (d *DummyThermabox) EnableThermabox() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.enabled = true
+}
+
+func (d *DummyThermabox) Enabled() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.enabled
+}
+
+func (d *DummyThermabox) ResetFault() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.faults++
+	if d.faults > 1 {
+		return fmt.Errorf("No fault to reset")
+	}
+	return nil
+}
+
+// observer is a client that records every message under a topic
+type observer struct {
+	client   paho.Client
+	messages chan paho.Message
+}
+
+func newObserver(require *require.Assertions, broker *testBroker, filter string) *observer {
+	o := &observer{messages: make(chan paho.Message, 100)}
+	opts := paho.NewClientOptions()
+	opts.AddBroker(broker.URL())
+	opts.SetClientID(fmt.Sprintf("observer-%v", time.Now().UnixNano()))
+	o.client = paho.NewClient(opts)
+	token := o.client.Connect()
+	require.True(token.WaitTimeout(time.Second))
+	require.Nil(token.Error())
+	token = o.client.Subscribe(filter, 1, func(client paho.Client, msg paho.Message) {
+		o.messages <- msg
+	})
+	require.True(token.WaitTimeout(time.Second))
+	require.Nil(token.Error())
+	return o
+}
+
+// next returns the next message on topic, skipping messages on other topics
+func (o *observer) next(require *require.Assertions, topic string) paho.Message {
+	timeout := time.After(2 * time.Second)
+	for {
+		select {
+		case msg := <-o.messages:
+			if msg.Topic() == topic {
+				return msg
+			}
+		case <-timeout:
+			require.FailNow("No message", topic)
+			return nil
+		}
+	}
+}
+
+func (o *observer) publish(require *require.Assertions, topic string, payload string) {
+	token := o.client.Publish(topic, 1, false, payload)
+	require.True(token.WaitTimeout(time.Second))
+	require.Nil(token.Error())
+}
+
+func startTestClient(require *require.Assertions) (*testBroker, *DummyThermabox, *Client) {
+	broker, err := newTestBroker()
+	require.Nil(err)
+	tbox := &DummyThermabox{}
+	client := New(broker.URL())
+	client.Topic = "lab/thermabox"
+	require.Nil(client.Start(tbox))
+	return broker, tbox, client
+}
+
+func TestParseYamlClient(t *testing.T) {
+	require := require.New(t)
+
+	c := &Client{}
+	require.Nil(yaml.Unmarshal([]byte(`broker: tcp://localhost:1883`), c))
+	require.Equal("tcp://localhost:1883", c.Broker)
+	require.Equal("thermabox", c.ClientID)
+	require.Equal("thermabox", c.Topic)
+	require.Equal(byte(1), c.QoS)
+	require.Equal(time.Duration(0), c.Interval)
+
+	c = &Client{}
+	require.Nil(yaml.Unmarshal([]byte(`
+broker: tcp://localhost:1883
+client_id: box1
+username: user
+password: pass
+topic: lab/box1/
+qos: 0
+interval_sec: 2.5
+`), c))
+	require.Equal(&Client{
+		Broker:   "tcp://localhost:1883",
+		ClientID: "box1",
+		Username: "user",
+		Password: "pass",
+		Topic:    "lab/box1",
+		QoS:      0,
+		Interval: 2500 * time.Millisecond,
+	}, c)
+
+	for _, str := range []string{
+		`client_id: box1`,
+		`{broker: tcp://localhost:1883, qos: 3}`,
+		`{broker: tcp://localhost:1883, topic: lab/#}`,
+		`{broker: tcp://localhost:1883, interval_sec: abc}`,
+		`{broker: tcp://localhost:1883, interval_sec: -1}`,
+	} {
+		require.NotNil(yaml.Unmarshal([]byte(str), &Client{}), str)
+	}
+}
+
+func TestClientPublishesState(t *testing.T) {
+	require := require.New(t)
+
+	broker, tbox, client := startTestClient(require)
+	defer broker.Close()
+	defer client.Stop()
+
+	o := newObserver(require, broker, "lab/thermabox/#")
+	require.Equal(ONLINE, string(o.next(require, "lab/thermabox/status").Payload()))
+
+	tbox.publish(&interfaces.ThermaboxState{Temperature: 21.5, State: interfaces.STABLE})
+	msg := o.next(require, "lab/thermabox/state")
+	state := &interfaces.ThermaboxState{}
+	require.Nil(json.Unmarshal(msg.Payload(), state))
+	require.Equal(21.5, state.Temperature)
+
+	// Late subscribers get the retained status and state
+	late := newObserver(require, broker, "lab/thermabox/#")
+	msg = late.next(require, "lab/thermabox/state")
+	require.True(msg.Retained())
+	require.Nil(json.Unmarshal(msg.Payload(), state))
+	require.Equal(21.5, state.Temperature)
+
+	client.Stop()
+	require.Equal(OFFLINE, string(o.next(require, "lab/thermabox/status").Payload()))
+}
+
+func TestClientPublishesAlerts(t *testing.T) {
+	require := require.New(t)
+
+	broker, err := newTestBroker()
+	require.Nil(err)
+	defer broker.Close()
+	o := newObserver(require, broker, "lab/thermabox/#")
+
+	tbox := &DummyThermabox{}
+	client := New(broker.URL())
+	client.Topic = "lab/thermabox"
+	client.Interval = time.Hour
+	require.Nil(client.Start(tbox))
+	defer client.Stop()
+	o.next(require, "lab/thermabox/status")
+
+	// Alerts are not held back by the interval
+	for _, msg := range []string{"stuck", "still stuck"} {
+		tbox.alert(&interfaces.Alert{Type: interfaces.RELAY_FAULT, Message: msg, Timestamp: 1000})
+		received := o.next(require, "lab/thermabox/alert")
+		require.False(received.Retained())
+		alert := &interfaces.Alert{}
+		require.Nil(json.Unmarshal(received.Payload(), alert))
+		require.Equal(interfaces.Alert{Type: interfaces.RELAY_FAULT, Message: msg, Timestamp: 1000}, *alert)
+	}
+}
+
+func TestClientInterval(t *testing.T) {
+	require := require.New(t)
+
+	broker, err := newTestBroker()
+	require.Nil(err)
+	defer broker.Close()
+	o := newObserver(require, broker, "thermabox/#")
+
+	tbox := &DummyThermabox{}
+	client := New(broker.URL())
+	client.Interval = time.Hour
+	require.Nil(client.Start(tbox))
+	defer client.Stop()
+	o.next(require, "thermabox/status")
+
+	tbox.publish(&interfaces.ThermaboxState{Temperature: 20})
+	tbox.publish(&interfaces.ThermaboxState{Temperature: 21})
+	msg := o.next(require, "thermabox/state")
+	require.Contains(string(msg.Payload()), `"temperature":20`)
+	time.Sleep(100 * time.Millisecond)
+	for len(o.messages) > 0 {
+		require.NotEqual("thermabox/state", (<-o.messages).Topic())
+	}
+}
+
+func TestClientCommands(t *testing.T) {
+	require := require.New(t)
+
+	broker, tbox, client := startTestClient(require)
+	defer broker.Close()
+	defer client.Stop()
+
+	o := newObserver(require, broker, "lab/thermabox/#")
+	o.next(require, "lab/thermabox/status")
+	command := func(cmd string, payload string) *CommandResult {
+		o.publish(require, "lab/thermabox/cmd/"+cmd, payload)
+		result := &CommandResult{}
+		require.Nil(json.Unmarshal(o.next(require, "lab/thermabox/result").Payload(), result))
+		require.Equal(cmd, result.Command)
+		return result
+	}
+
+	require.Equal("", command("limits", `{"temperature": 18, "threshold": 0.5}`).Error)
+	temp, threshold := tbox.GetLimits()
+	require.Equal(18.0, temp)
+	require.Equal(0.5, threshold)
+	for _, payload := range []string{`{"temperature": 18}`, `{"temperature": 18, "threshold": -1}`, `not json`} {
+		require.NotEqual("", command("limits", payload).Error, payload)
+	}
+	temp, _ = tbox.GetLimits()
+	require.Equal(18.0, temp)
+
+	require.Equal("", command("enable", "").Error)
+	require.True(tbox.Enabled())
+	require.Equal("", command("disable", "").Error)
+	require.False(tbox.Enabled())
+
+	require.Equal("", command("reset-fault", "").Error)
+	require.Equal("No fault to reset", command("reset-fault", "").Error)
+
+	require.Equal("Thermabox does not support profiles", command("profile/start", "").Error)
+	require.Contains(command("profile/jump", "").Error, "Unknown profile action")
+	require.Contains(command("explode", "").Error, "Unknown command")
+
+	// A retained command is run when it is published, but not again when
+	// it is replayed on connecting
+	client.Stop()
+	require.Equal(OFFLINE, string(o.next(require, "lab/thermabox/status").Payload()))
+	token := o.client.Publish("lab/thermabox/cmd/enable", 1, true, "{}")
+	require.True(token.WaitTimeout(time.Second))
+	tbox = &DummyThermabox{}
+	require.Nil(client.Start(tbox))
+	require.Equal(ONLINE, string(o.next(require, "lab/thermabox/status").Payload()))
+	time.Sleep(100 * time.Millisecond)
+	require.False(tbox.Enabled())
+}
+
+func TestClientWill(t *testing.T) {
+	require := require.New(t)
+
+	broker, _, client := startTestClient(require)
+	defer broker.Close()
+	defer client.Stop()
+
+	o := newObserver(require, broker, "lab/thermabox/status")
+	require.Equal(ONLINE, string(o.next(require, "lab/thermabox/status").Payload()))
+
+	// The broker publishes the will when the connection is lost
+	require.True(broker.Drop("thermabox"))
+	require.Equal(OFFLINE, string(o.next(require, "lab/thermabox/status").Payload()))
+}
@@ -10,7 +10,17 @@ import (
 )
 
 type HTTPProbe struct {
-	Url string `yaml:"url"`
+	Url   string `yaml:"url"`
+	clock Clock
+}
+
+func NewHTTPProbe(url string) *HTTPProbe {
+	return &HTTPProbe{Url: url}
+}
+
+// SetClock sets the clock used to wait between retries
+func (p *HTTPProbe) SetClock(clock Clock) {
+	p.clock = clock
 }
 
 func (p *HTTPProbe) GetTemperature() (float64, error) {
@@ -38,7 +48,7 @@ func (p *HTTPProbe) GetTemperature() (float64, error) {
 		}
 		return temp, nil
 	retry:
-		time.Sleep(100 * time.Millisecond)
+		clockOrDefault(p.clock).Sleep(100 * time.Millisecond)
 	}
 	return 0, err
 }
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
 	stoppablenetlistener "github.com/gurupras/go-stoppable-net-listener"
@@ -45,8 +46,29 @@ func TestProbeHTTP(t *testing.T) {
 		server.Serve(snl)
 	}()
 
-	probe := HTTPProbe{"http://localhost:31121/temp"}
+	probe := NewHTTPProbe("http://localhost:31121/temp")
 	temp, err := probe.GetTemperature()
 	require.Nil(err)
 	require.Equal(testTemp, temp)
 }
+
+func TestProbeHTTPRetryClock(t *testing.T) {
+	require := require.New(t)
+
+	clock := NewFakeClock(time.Now())
+	// Nothing is listening on this port
+	probe := NewHTTPProbe("http://localhost:31124/temp")
+	probe.SetClock(clock)
+
+	errChan := make(chan error)
+	go func() {
+		_, err := probe.GetTemperature()
+		errChan <- err
+	}()
+	// Retries only happen as the clock moves
+	for i := 0; i < 5; i++ {
+		clock.BlockUntil(1)
+		clock.Advance(100 * time.Millisecond)
+	}
+	require.NotNil(<-errChan)
+}
@@ -0,0 +1,92 @@
+package thermabox
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const DefaultW1Root = "/sys/bus/w1/devices"
+
+// The DS18B20 reads 85°C until its first conversion after power-on
+const w1PowerOnReset = 85000
+
+// W1Probe reads a DS18B20 through the Linux w1 sysfs interface
+type W1Probe struct {
+	ID   string `yaml:"id"`
+	Root string `yaml:"root"`
+}
+
+func NewW1Probe(id string) *W1Probe {
+	return &W1Probe{ID: id, Root: DefaultW1Root}
+}
+
+func (p *W1Probe) path() string {
+	root := p.Root
+	if root == "" {
+		root = DefaultW1Root
+	}
+	return filepath.Join(root, p.ID, "w1_slave")
+}
+
+func (p *W1Probe) GetTemperature() (float64, error) {
+	data, err := ioutil.ReadFile(p.path())
+	if err != nil {
+		return 0, fmt.Errorf("Failed to get temperature: %v", err)
+	}
+	return parseW1Slave(string(data))
+}
+
+// parseW1Slave parses the contents of w1_slave, which look like
+//
+//	72 01 4b 46 7f ff 0e 10 57 : crc=57 YES
+//	72 01 4b 46 7f ff 0e 10 57 t=23125
+func parseW1Slave(data string) (float64, error) {
+	lines := strings.Split(strings.TrimSpace(data), "\n")
+	if len(lines) != 2 {
+		return 0, fmt.Errorf("Failed to parse w1_slave: expected 2 lines, got %v", len(lines))
+	}
+	if !strings.HasSuffix(strings.TrimSpace(lines[0]), "YES") {
+		return 0, fmt.Errorf("Failed to get temperature: CRC check failed")
+	}
+	fields := strings.Split(lines[0], ":")
+	scratchpad, err := hex.DecodeString(strings.Replace(strings.TrimSpace(fields[0]), " ", "", -1))
+	if err != nil || len(scratchpad) != 9 {
+		return 0, fmt.Errorf("Failed to parse w1_slave scratchpad: %v", fields[0])
+	}
+	if crc8(scratchpad[:8]) != scratchpad[8] {
+		return 0, fmt.Errorf("Failed to get temperature: CRC mismatch")
+	}
+
+	idx := strings.Index(lines[1], "t=")
+	if idx < 0 {
+		return 0, fmt.Errorf("Failed to parse w1_slave: no temperature found")
+	}
+	milli, err := strconv.Atoi(strings.TrimSpace(lines[1][idx+2:]))
+	if err != nil {
+		return 0, fmt.Errorf("Failed to parse w1_slave temperature: %v", err)
+	}
+	if milli == w1PowerOnReset {
+		return 0, fmt.Errorf("Failed to get temperature: sensor returned its power-on reset value")
+	}
+	return float64(milli) / 1000, nil
+}
+
+// crc8 is the Dallas/Maxim 1-Wire CRC
+func crc8(data []byte) byte {
+	var crc byte
+	for _, b := range data {
+		for i := 0; i < 8; i++ {
+			mix := (crc ^ b) & 0x01
+			crc >>= 1
+			if mix != 0 {
+				crc ^= 0x8c
+			}
+			b >>= 1
+		}
+	}
+	return crc
+}
@@ -0,0 +1,64 @@
+package thermabox
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gurupras/thermabox/interfaces"
+	"github.com/stretchr/testify/require"
+)
+
+var _ interfaces.TemperatureSensorInterface = &W1Probe{}
+
+func writeW1Slave(require *require.Assertions, root string, id string, data string) {
+	dir := filepath.Join(root, id)
+	require.Nil(os.MkdirAll(dir, 0755))
+	require.Nil(ioutil.WriteFile(filepath.Join(dir, "w1_slave"), []byte(data), 0644))
+}
+
+func TestW1Probe(t *testing.T) {
+	require := require.New(t)
+
+	root, err := ioutil.TempDir("", "thermabox-w1")
+	require.Nil(err)
+	defer os.RemoveAll(root)
+
+	writeW1Slave(require, root, "28-000005e2fdc3", `72 01 4b 46 7f ff 0e 10 57 : crc=57 YES
+72 01 4b 46 7f ff 0e 10 57 t=23125
+`)
+	writeW1Slave(require, root, "28-000005e2fdc4", `5e ff 55 00 7f ff 0c 10 57 : crc=57 YES
+5e ff 55 00 7f ff 0c 10 57 t=-10125
+`)
+	writeW1Slave(require, root, "28-000005e2fdc5", `72 01 4b 46 7f ff 0e 10 00 : crc=57 NO
+72 01 4b 46 7f ff 0e 10 00 t=23125
+`)
+	// Kernel claims the CRC is fine but the scratchpad disagrees
+	writeW1Slave(require, root, "28-000005e2fdc6", `72 01 4b 46 7f ff 0e 10 00 : crc=00 YES
+72 01 4b 46 7f ff 0e 10 00 t=23125
+`)
+	writeW1Slave(require, root, "28-000005e2fdc7", `50 05 4b 46 7f ff 0c 10 1c : crc=1c YES
+50 05 4b 46 7f ff 0c 10 1c t=85000
+`)
+	writeW1Slave(require, root, "28-000005e2fdc8", `72 01 4b 46 7f ff 0e 10 57 : crc=57 YES
+`)
+
+	probe := NewW1Probe("28-000005e2fdc3")
+	require.Equal(DefaultW1Root, probe.Root)
+	probe.Root = root
+	temp, err := probe.GetTemperature()
+	require.Nil(err)
+	require.Equal(23.125, temp)
+
+	probe.ID = "28-000005e2fdc4"
+	temp, err = probe.GetTemperature()
+	require.Nil(err)
+	require.Equal(-10.125, temp)
+
+	for _, id := range []string{"28-000005e2fdc5", "28-000005e2fdc6", "28-000005e2fdc7", "28-000005e2fdc8", "28-missing"} {
+		probe.ID = id
+		_, err = probe.GetTemperature()
+		require.NotNil(err, "id=%v", id)
+	}
+}
@@ -0,0 +1,284 @@
+package thermabox
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gurupras/thermabox/interfaces"
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+type ProbeAggregation string
+
+const (
+	// PRIMARY uses the first healthy probe in the order they were added
+	PRIMARY ProbeAggregation = "primary"
+	MEAN    ProbeAggregation = "mean"
+	MEDIAN  ProbeAggregation = "median"
+	MIN     ProbeAggregation = "min"
+	MAX     ProbeAggregation = "max"
+)
+
+func parseProbeAggregation(val interface{}) (ProbeAggregation, error) {
+	aggregation := ProbeAggregation(fmt.Sprintf("%v", val))
+	switch aggregation {
+	case PRIMARY, MEAN, MEDIAN, MIN, MAX:
+		return aggregation, nil
+	default:
+		return "", fmt.Errorf("Unknown probe_aggregation: %v", val)
+	}
+}
+
+// ProbeConfig describes a probe in the 'probes' list. The source has the
+// same format as the --sensor flag and is turned into a sensor by the caller
+type ProbeConfig struct {
+	Name        string          `yaml:"name"`
+	Source      string          `yaml:"source"`
+	Calibration *Calibration    `yaml:"calibration"`
+	Filters     []*FilterConfig `yaml:"filters"`
+}
+
+func (c *ProbeConfig) UnmarshalYAML(unmarshal func(i interface{}) error) error {
+	m := make(map[string]interface{})
+	if err := unmarshal(&m); err != nil {
+		return err
+	}
+	name, ok := m["name"]
+	if !ok {
+		return fmt.Errorf("Probe is missing name")
+	}
+	c.Name = fmt.Sprintf("%v", name)
+	source, ok := m["source"]
+	if !ok {
+		return fmt.Errorf("Probe '%v' is missing source", c.Name)
+	}
+	c.Source = fmt.Sprintf("%v", source)
+	if data, ok := m["calibration"]; ok {
+		calibration, err := parseCalibration(data)
+		if err != nil {
+			return fmt.Errorf("Probe '%v': %v", c.Name, err)
+		}
+		c.Calibration = calibration
+	}
+	if data, ok := m["filters"]; ok {
+		filters, err := parseFilterConfigs(data)
+		if err != nil {
+			return fmt.Errorf("Probe '%v': %v", c.Name, err)
+		}
+		c.Filters = filters
+	}
+	return nil
+}
+
+func parseProbeConfigs(data interface{}) ([]*ProbeConfig, error) {
+	b, err := yaml.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal key 'probes': %v: %v", data, err)
+	}
+	configs := make([]*ProbeConfig, 0)
+	if err := yaml.Unmarshal(b, &configs); err != nil {
+		return nil, fmt.Errorf("Failed while parsing probes: %v", err)
+	}
+	names := make(map[string]bool)
+	for _, c := range configs {
+		if names[c.Name] {
+			return nil, fmt.Errorf("Duplicate probe name: %v", c.Name)
+		}
+		names[c.Name] = true
+	}
+	return configs, nil
+}
+
+type namedProbe struct {
+	name        string
+	probe       interfaces.TemperatureSensorInterface
+	temperature float64
+	raw         float64
+	healthy     bool
+	err         error
+	failures    int
+	lastSuccess time.Time
+}
+
+func (p *namedProbe) reading() interfaces.ProbeReading {
+	r := interfaces.ProbeReading{
+		Name:        p.name,
+		Temperature: p.temperature,
+		Raw:         p.raw,
+		Healthy:     p.healthy,
+		Failures:    p.failures,
+	}
+	if p.err != nil {
+		r.Error = p.err.Error()
+	}
+	if !p.lastSuccess.IsZero() {
+		r.LastSuccess = p.lastSuccess.UnixNano() / 1000000
+	}
+	return r
+}
+
+// MultiProbe reads a set of named probes and aggregates their readings.
+// A probe is unhealthy while its reads are failing and is left out of the
+// aggregate. Reading fails only if every probe is unhealthy
+type MultiProbe struct {
+	Aggregation ProbeAggregation
+	probes      []*namedProbe
+	raw         float64
+	rawMin      float64
+	rawMax      float64
+	clock       Clock
+	mutex       sync.Mutex
+}
+
+func NewMultiProbe(aggregation ProbeAggregation) *MultiProbe {
+	return &MultiProbe{Aggregation: aggregation}
+}
+
+// Add adds a probe. With the primary aggregation, probes added earlier take
+// precedence
+func (m *MultiProbe) Add(name string, probe interfaces.TemperatureSensorInterface) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if p, ok := probe.(clockSetter); ok && m.clock != nil {
+		p.SetClock(m.clock)
+	}
+	m.probes = append(m.probes, &namedProbe{name: name, probe: probe})
+}
+
+// SetClock sets the clock used to timestamp readings and is passed on to
+// any probe that accepts one
+func (m *MultiProbe) SetClock(clock Clock) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.clock = clock
+	for _, p := range m.probes {
+		if s, ok := p.probe.(clockSetter); ok {
+			s.SetClock(clock)
+		}
+	}
+}
+
+func (m *MultiProbe) GetTemperature() (float64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if len(m.probes) == 0 {
+		return 0, fmt.Errorf("No probes configured")
+	}
+
+	temps := make([]float64, 0, len(m.probes))
+	raws := make([]float64, 0, len(m.probes))
+	for _, p := range m.probes {
+		temp, err := p.probe.GetTemperature()
+		if r, ok := p.probe.(rawReader); ok {
+			p.raw = r.RawTemperature()
+		} else if err == nil {
+			p.raw = temp
+		}
+		if err != nil {
+			if p.healthy || p.failures == 0 {
+				log.Warnf("Probe '%v' failed: %v", p.name, err)
+			}
+			p.healthy = false
+			p.err = err
+			p.failures++
+			continue
+		}
+		if !p.healthy && p.failures > 0 {
+			log.Infof("Probe '%v' recovered after %v failures", p.name, p.failures)
+		}
+		p.temperature = temp
+		p.healthy = true
+		p.err = nil
+		p.failures = 0
+		p.lastSuccess = clockOrDefault(m.clock).Now()
+		temps = append(temps, temp)
+		raws = append(raws, p.raw)
+	}
+	if len(temps) == 0 {
+		return 0, fmt.Errorf("All probes failed. Last error from '%v': %v", m.probes[0].name, m.probes[0].err)
+	}
+	m.raw = aggregate(m.Aggregation, raws)
+	m.rawMin = aggregate(MIN, raws)
+	m.rawMax = aggregate(MAX, raws)
+	return aggregate(m.Aggregation, temps), nil
+}
+
+// RawTemperature returns the aggregate of the unfiltered readings of the
+// probes that contributed to the last reading
+func (m *MultiProbe) RawTemperature() float64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.raw
+}
+
+// RawRange returns the lowest and highest unfiltered readings of the probes
+// that contributed to the last reading
+func (m *MultiProbe) RawRange() (float64, float64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.rawMin, m.rawMax
+}
+
+// Readings returns the latest reading of every probe
+func (m *MultiProbe) Readings() []interfaces.ProbeReading {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	readings := make([]interfaces.ProbeReading, len(m.probes))
+	for i, p := range m.probes {
+		readings[i] = p.reading()
+	}
+	return readings
+}
+
+// aggregate combines the readings of the healthy probes, given in the order
+// the probes were added
+func aggregate(aggregation ProbeAggregation, temps []float64) float64 {
+	switch aggregation {
+	case MEAN:
+		sum := 0.0
+		for _, t := range temps {
+			sum += t
+		}
+		return sum / float64(len(temps))
+	case MEDIAN:
+		sorted := append([]float64(nil), temps...)
+		sort.Float64s(sorted)
+		mid := len(sorted) / 2
+		if len(sorted)%2 == 0 {
+			return (sorted[mid-1] + sorted[mid]) / 2
+		}
+		return sorted[mid]
+	case MIN:
+		min := temps[0]
+		for _, t := range temps[1:] {
+			if t < min {
+				min = t
+			}
+		}
+		return min
+	case MAX:
+		max := temps[0]
+		for _, t := range temps[1:] {
+			if t > max {
+				max = t
+			}
+		}
+		return max
+	default:
+		return temps[0]
+	}
+}
+
+// probeReader is implemented by probes that can report individual readings
+type probeReader interface {
+	Readings() []interfaces.ProbeReading
+}
+
+// rawRangeReader is implemented by probes that combine the readings of
+// several probes
+type rawRangeReader interface {
+	RawRange() (float64, float64)
+}
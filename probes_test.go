@@ -0,0 +1,192 @@
+package thermabox
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gurupras/thermabox/interfaces"
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var _ interfaces.TemperatureSensorInterface = &MultiProbe{}
+
+type flakyProbe struct {
+	temp float64
+	err  error
+}
+
+func (f *flakyProbe) GetTemperature() (float64, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+	return f.temp, nil
+}
+
+func TestParseYamlProbes(t *testing.T) {
+	require := require.New(t)
+
+	tbox := &Thermabox{}
+	tbox.SetRelays(&FakeRelay{}, &FakeRelay{})
+	err := yaml.Unmarshal([]byte(`
+heating_element:
+  relay:
+    pins: [22]
+cooling_element:
+  relay:
+    pins: [23]
+probes:
+  - name: inner
+    source: usb
+  - name: outer
+    source: http://localhost:8080/temperature
+probe_aggregation: median
+`), tbox)
+	require.Nil(err)
+	require.Equal(MEDIAN, tbox.probeAggregation)
+	require.Equal([]*ProbeConfig{
+		{Name: "inner", Source: "usb"},
+		{Name: "outer", Source: "http://localhost:8080/temperature"},
+	}, tbox.ProbeConfigs())
+
+	tbox = &Thermabox{}
+	err = yaml.Unmarshal([]byte(`probe_aggregation: mode`), tbox)
+	require.NotNil(err)
+
+	tbox = &Thermabox{}
+	err = yaml.Unmarshal([]byte(`
+probes:
+  - source: usb
+`), tbox)
+	require.NotNil(err)
+
+	tbox = &Thermabox{}
+	err = yaml.Unmarshal([]byte(`
+probes:
+  - name: a
+    source: usb
+  - name: a
+    source: usb
+`), tbox)
+	require.NotNil(err)
+}
+
+func TestMultiProbeAggregation(t *testing.T) {
+	require := require.New(t)
+
+	a := &flakyProbe{temp: 20}
+	b := &flakyProbe{temp: 21}
+	c := &flakyProbe{temp: 25}
+
+	expected := map[ProbeAggregation]float64{
+		PRIMARY: 20,
+		MEAN:    22,
+		MEDIAN:  21,
+		MIN:     20,
+		MAX:     25,
+	}
+	for aggregation, value := range expected {
+		m := NewMultiProbe(aggregation)
+		m.Add("a", a)
+		m.Add("b", b)
+		m.Add("c", c)
+		temp, err := m.GetTemperature()
+		require.Nil(err)
+		require.Equal(value, temp, "aggregation=%v", aggregation)
+		min, max := m.RawRange()
+		require.Equal(20.0, min)
+		require.Equal(25.0, max)
+	}
+
+	// Even number of probes
+	m := NewMultiProbe(MEDIAN)
+	m.Add("a", a)
+	m.Add("b", b)
+	temp, err := m.GetTemperature()
+	require.Nil(err)
+	require.Equal(20.5, temp)
+}
+
+func TestMultiProbeFailover(t *testing.T) {
+	require := require.New(t)
+
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	primary := &flakyProbe{temp: 20}
+	backup := &flakyProbe{temp: 22}
+	m := NewMultiProbe(PRIMARY)
+	m.SetClock(clock)
+	m.Add("primary", primary)
+	m.Add("backup", backup)
+
+	temp, err := m.GetTemperature()
+	require.Nil(err)
+	require.Equal(20.0, temp)
+
+	primary.err = fmt.Errorf("unplugged")
+	clock.Advance(time.Second)
+	for i := 0; i < 3; i++ {
+		temp, err = m.GetTemperature()
+		require.Nil(err)
+		require.Equal(22.0, temp)
+	}
+	readings := m.Readings()
+	require.Equal(2, len(readings))
+	require.Equal(interfaces.ProbeReading{
+		Name:        "primary",
+		Temperature: 20,
+		Raw:         20,
+		Healthy:     false,
+		Error:       "unplugged",
+		Failures:    3,
+		LastSuccess: clock.Now().Add(-time.Second).UnixNano() / 1000000,
+	}, readings[0])
+	require.True(readings[1].Healthy)
+	require.Equal(22.0, readings[1].Temperature)
+
+	// Recovers
+	primary.err = nil
+	temp, err = m.GetTemperature()
+	require.Nil(err)
+	require.Equal(20.0, temp)
+	require.True(m.Readings()[0].Healthy)
+	require.Equal(0, m.Readings()[0].Failures)
+
+	// Fails only once every probe has failed
+	primary.err = fmt.Errorf("unplugged")
+	backup.err = fmt.Errorf("unplugged")
+	_, err = m.GetTemperature()
+	require.NotNil(err)
+
+	_, err = NewMultiProbe(PRIMARY).GetTemperature()
+	require.NotNil(err)
+}
+
+func TestThermaboxProbes(t *testing.T) {
+	require := require.New(t)
+
+	primary := &flakyProbe{temp: 25}
+	backup := &flakyProbe{temp: 15}
+	tbox := &Thermabox{temperature: 20, threshold: 0.5}
+	tbox.SetRelays(NewFakeRelay(false, []int{1}), NewFakeRelay(false, []int{1}))
+	tbox.AddProbe("primary", primary)
+	tbox.AddProbe("backup", backup)
+
+	c := make(chan *interfaces.ThermaboxState, 1)
+	tbox.RegisterChannel(c)
+
+	require.Nil(tbox.Step())
+	state := <-c
+	require.Equal(25.0, state.Temperature)
+	require.Equal(2, len(state.Probes))
+	require.Equal("primary", state.Probes[0].Name)
+	require.Equal(15.0, state.Probes[1].Temperature)
+	require.True(tbox.coolingElement.IsOn())
+
+	// A failed primary does not shut the box down
+	primary.err = fmt.Errorf("unplugged")
+	require.Nil(tbox.Step())
+	state = <-c
+	require.Equal(15.0, state.Temperature)
+	require.False(state.Probes[0].Healthy)
+}
@@ -0,0 +1,284 @@
+package thermabox
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gurupras/thermabox/interfaces"
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+type ProfileStepType string
+
+const (
+	HOLD ProfileStepType = "hold"
+	RAMP ProfileStepType = "ramp"
+)
+
+// ProfileStep either holds Target for Duration or ramps linearly from the
+// setpoint at the start of the step to Target over Duration.
+// A Threshold of 0 leaves the threshold unchanged
+type ProfileStep struct {
+	Name      string          `yaml:"name"`
+	Type      ProfileStepType `yaml:"type"`
+	Duration  time.Duration   `yaml:"duration"`
+	Target    float64         `yaml:"target"`
+	Threshold float64         `yaml:"threshold"`
+}
+
+func (s *ProfileStep) UnmarshalYAML(unmarshal func(i interface{}) error) error {
+	m := make(map[string]interface{})
+	if err := unmarshal(&m); err != nil {
+		return err
+	}
+	if name, ok := m["name"]; ok {
+		s.Name = fmt.Sprintf("%v", name)
+	}
+	s.Type = HOLD
+	if stepType, ok := m["type"]; ok {
+		s.Type = ProfileStepType(fmt.Sprintf("%v", stepType))
+	}
+	if s.Type != HOLD && s.Type != RAMP {
+		return fmt.Errorf("Unknown profile step type: %v", s.Type)
+	}
+	durationVal, ok := m["duration"]
+	if !ok {
+		return fmt.Errorf("Profile step '%v' is missing duration", s.Name)
+	}
+	duration, err := parseDuration(fmt.Sprintf("%v", durationVal))
+	if err != nil {
+		return fmt.Errorf("Failed while parsing duration: %v", err)
+	}
+	s.Duration = duration
+	if _, ok := m["target"]; !ok {
+		return fmt.Errorf("Profile step '%v' is missing target", s.Name)
+	}
+	if s.Target, err = parseFloat(m, "target", 0); err != nil {
+		return err
+	}
+	if s.Threshold, err = parseFloat(m, "threshold", 0); err != nil {
+		return err
+	}
+	return nil
+}
+
+// parseDuration accepts anything time.ParseDuration does along with a 'd'
+// suffix for days. Plain numbers are treated as seconds
+func parseDuration(str string) (time.Duration, error) {
+	str = strings.TrimSpace(str)
+	if secs, err := strconv.ParseFloat(str, 64); err == nil {
+		return seconds(secs), nil
+	}
+	if strings.HasSuffix(str, "d") {
+		days, err := strconv.ParseFloat(strings.TrimSuffix(str, "d"), 64)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(days * float64(24*time.Hour)), nil
+	}
+	return time.ParseDuration(str)
+}
+
+// Profile drives the thermabox limits over time through a list of steps.
+// Progress is persisted along with the rest of the state in the thermabox's
+// state file, if configured, so that a profile picks up where it left off
+// after a restart. Time spent while the process was not running counts
+// towards the current step unless the profile was paused.
+type Profile struct {
+	Steps     []*ProfileStep `yaml:"steps"`
+	Autostart bool           `yaml:"autostart"`
+
+	progress   profileProgress
+	lastUpdate time.Time
+}
+
+type profileProgress struct {
+	Running     bool      `json:"running"`
+	Paused      bool      `json:"paused"`
+	Completed   bool      `json:"completed"`
+	Step        int       `json:"step"`
+	StepElapsed float64   `json:"step_elapsed_sec"`
+	RampStart   float64   `json:"ramp_start"`
+	SavedAt     time.Time `json:"saved_at"`
+}
+
+func (p *Profile) UnmarshalYAML(unmarshal func(i interface{}) error) error {
+	conf := struct {
+		Steps     []*ProfileStep `yaml:"steps"`
+		Autostart bool           `yaml:"autostart"`
+	}{}
+	if err := unmarshal(&conf); err != nil {
+		return err
+	}
+	if len(conf.Steps) == 0 {
+		return fmt.Errorf("Profile has no steps")
+	}
+	p.Steps = conf.Steps
+	p.Autostart = conf.Autostart
+	return nil
+}
+
+func (p *Profile) elapsed() time.Duration {
+	return seconds(p.progress.StepElapsed)
+}
+
+// restore restores previously saved progress
+func (p *Profile) restore(progress profileProgress, now time.Time) error {
+	p.lastUpdate = now
+	if progress.Step < 0 || progress.Step >= len(p.Steps) {
+		return fmt.Errorf("Progress is at step %v but the profile only has %v steps", progress.Step, len(p.Steps))
+	}
+	if progress.Running && !progress.Paused && !progress.SavedAt.IsZero() && now.After(progress.SavedAt) {
+		progress.StepElapsed += now.Sub(progress.SavedAt).Seconds()
+	}
+	p.progress = progress
+	return nil
+}
+
+func (p *Profile) start(now time.Time, setpoint float64) {
+	p.progress = profileProgress{
+		Running:   true,
+		RampStart: setpoint,
+	}
+	p.lastUpdate = now
+	log.Infof("Starting profile")
+}
+
+func (p *Profile) pause(now time.Time) error {
+	if !p.progress.Running {
+		return fmt.Errorf("Profile is not running")
+	}
+	p.advance(now)
+	p.progress.Paused = true
+	return nil
+}
+
+func (p *Profile) resume(now time.Time) error {
+	if !p.progress.Running {
+		return fmt.Errorf("Profile is not running")
+	}
+	p.progress.Paused = false
+	p.lastUpdate = now
+	return nil
+}
+
+func (p *Profile) skip(now time.Time, setpoint float64) error {
+	if !p.progress.Running {
+		return fmt.Errorf("Profile is not running")
+	}
+	p.advance(now)
+	p.nextStep(setpoint)
+	return nil
+}
+
+func (p *Profile) stop(now time.Time) {
+	p.progress.Running = false
+	p.progress.Paused = false
+}
+
+// nextStep moves on to the next step, with any ramp starting from setpoint
+func (p *Profile) nextStep(setpoint float64) {
+	p.progress.Step++
+	p.progress.StepElapsed = 0
+	p.progress.RampStart = setpoint
+	if p.progress.Step >= len(p.Steps) {
+		// Stay on the last step's target
+		p.progress.Step = len(p.Steps) - 1
+		p.progress.Running = false
+		p.progress.Paused = false
+		p.progress.Completed = true
+		log.Infof("Profile completed")
+		return
+	}
+	log.Infof("Profile moving to step %v (%v)", p.progress.Step, p.Steps[p.progress.Step].Name)
+}
+
+// advance accounts for the time since the last update and moves through
+// any steps that have finished. It returns whether the step changed
+func (p *Profile) advance(now time.Time) bool {
+	if !p.progress.Running {
+		return false
+	}
+	if !p.progress.Paused && now.After(p.lastUpdate) {
+		p.progress.StepElapsed += now.Sub(p.lastUpdate).Seconds()
+	}
+	p.lastUpdate = now
+
+	changed := false
+	for p.progress.Running && p.elapsed() >= p.Steps[p.progress.Step].Duration {
+		step := p.Steps[p.progress.Step]
+		carry := p.elapsed() - step.Duration
+		p.nextStep(step.Target)
+		if p.progress.Running {
+			p.progress.StepElapsed = carry.Seconds()
+		}
+		changed = true
+	}
+	return changed
+}
+
+// setpoint returns the target temperature for the current position
+func (p *Profile) setpoint() float64 {
+	step := p.Steps[p.progress.Step]
+	if p.progress.Completed || step.Type == HOLD || step.Duration <= 0 {
+		return step.Target
+	}
+	frac := p.elapsed().Seconds() / step.Duration.Seconds()
+	if frac > 1 {
+		frac = 1
+	}
+	return p.progress.RampStart + (step.Target-p.progress.RampStart)*frac
+}
+
+// update returns the limits the thermabox should be using at time now.
+// ok is false if the profile is not driving the limits
+func (p *Profile) update(now time.Time, threshold float64) (setpoint float64, newThreshold float64, ok bool) {
+	if !p.progress.Running {
+		return 0, 0, false
+	}
+	p.advance(now)
+	newThreshold = threshold
+	if t := p.Steps[p.progress.Step].Threshold; t > 0 {
+		newThreshold = t
+	}
+	return p.setpoint(), newThreshold, true
+}
+
+func (p *Profile) status(threshold float64) *interfaces.ProfileStatus {
+	step := p.Steps[p.progress.Step]
+	remaining := step.Duration - p.elapsed()
+	if remaining < 0 || p.progress.Completed {
+		remaining = 0
+	}
+	if t := step.Threshold; t > 0 {
+		threshold = t
+	}
+	return &interfaces.ProfileStatus{
+		Running:       p.progress.Running,
+		Paused:        p.progress.Paused,
+		Completed:     p.progress.Completed,
+		Step:          p.progress.Step,
+		Steps:         len(p.Steps),
+		StepName:      step.Name,
+		StepType:      string(step.Type),
+		StepElapsed:   p.progress.StepElapsed,
+		StepRemaining: remaining.Seconds(),
+		Setpoint:      p.setpoint(),
+		Threshold:     threshold,
+	}
+}
+
+func parseProfile(data interface{}) (*Profile, error) {
+	b, err := yaml.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal key 'profile': %v: %v", data, err)
+	}
+	profile := &Profile{}
+	if err := yaml.Unmarshal(b, profile); err != nil {
+		return nil, fmt.Errorf("Failed while parsing profile: %v", err)
+	}
+	return profile, nil
+}
@@ -0,0 +1,200 @@
+package thermabox
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const testProfileYaml = `
+steps:
+  - name: primary
+    type: hold
+    target: 18
+    threshold: 0.5
+    duration: 4d
+  - name: rest
+    type: ramp
+    target: 22
+    duration: 12h
+  - name: crash
+    target: 2
+    threshold: 1
+    duration: 86400
+`
+
+func TestParseYamlProfile(t *testing.T) {
+	require := require.New(t)
+
+	profile := &Profile{}
+	err := yaml.Unmarshal([]byte(testProfileYaml), profile)
+	require.Nil(err)
+	require.Equal(3, len(profile.Steps))
+	require.Equal(&ProfileStep{"primary", HOLD, 96 * time.Hour, 18, 0.5}, profile.Steps[0])
+	require.Equal(&ProfileStep{"rest", RAMP, 12 * time.Hour, 22, 0}, profile.Steps[1])
+	require.Equal(&ProfileStep{"crash", HOLD, 24 * time.Hour, 2, 1}, profile.Steps[2])
+
+	tbox := &Thermabox{}
+	tbox.SetRelays(&FakeRelay{}, &FakeRelay{})
+	err = yaml.Unmarshal([]byte(`
+heating_element:
+  relay:
+    pins: [22]
+cooling_element:
+  relay:
+    pins: [23]
+profile:
+  autostart: true
+  steps:
+    - target: 18
+      duration: 1h
+`), tbox)
+	require.Nil(err)
+	require.NotNil(tbox.profile)
+	require.True(tbox.profile.Autostart)
+	require.Equal(1, len(tbox.profile.Steps))
+
+	err = yaml.Unmarshal([]byte(`
+steps:
+  - type: wiggle
+    target: 1
+    duration: 1h
+`), &Profile{})
+	require.NotNil(err)
+
+	err = yaml.Unmarshal([]byte(`
+steps:
+  - target: 1
+`), &Profile{})
+	require.NotNil(err)
+}
+
+func newProfileThermabox(require *require.Assertions) (*Thermabox, *FakeClock) {
+	profile := &Profile{}
+	err := yaml.Unmarshal([]byte(testProfileYaml), profile)
+	require.Nil(err)
+
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	tbox := &Thermabox{temperature: 20, threshold: 0.2}
+	tbox.SetRelays(NewFakeRelay(false, []int{1}), NewFakeRelay(false, []int{1}))
+	tbox.SetProbe(&sequenceProbe{temps: []float64{20}})
+	tbox.SetClock(clock)
+	tbox.SetProfile(profile)
+	return tbox, clock
+}
+
+func TestProfileSteps(t *testing.T) {
+	require := require.New(t)
+
+	tbox, clock := newProfileThermabox(require)
+
+	// Not started => limits untouched
+	require.Nil(tbox.Step())
+	require.Equal(20.0, tbox.temperature)
+
+	require.Nil(tbox.StartProfile())
+	require.Nil(tbox.Step())
+	temp, threshold := tbox.GetLimits()
+	require.Equal(18.0, temp)
+	require.Equal(0.5, threshold)
+
+	clock.Advance(96 * time.Hour)
+	require.Nil(tbox.Step())
+	status, err := tbox.GetProfileStatus()
+	require.Nil(err)
+	require.Equal(1, status.Step)
+	require.Equal("rest", status.StepName)
+	require.Equal(18.0, tbox.temperature)
+
+	// Halfway through the ramp
+	clock.Advance(6 * time.Hour)
+	require.Nil(tbox.Step())
+	require.InDelta(20.0, tbox.temperature, 1e-9)
+	// Threshold carries over from the previous step
+	require.Equal(0.5, tbox.threshold)
+
+	// Paused time does not count
+	require.Nil(tbox.PauseProfile())
+	clock.Advance(100 * time.Hour)
+	require.Nil(tbox.Step())
+	require.InDelta(20.0, tbox.temperature, 1e-9)
+	require.Nil(tbox.ResumeProfile())
+
+	clock.Advance(3 * time.Hour)
+	require.Nil(tbox.Step())
+	require.InDelta(21.0, tbox.temperature, 1e-9)
+
+	require.Nil(tbox.SkipProfileStep())
+	require.Nil(tbox.Step())
+	status, err = tbox.GetProfileStatus()
+	require.Nil(err)
+	require.Equal("crash", status.StepName)
+	require.Equal(2.0, tbox.temperature)
+	require.Equal(1.0, tbox.threshold)
+
+	clock.Advance(25 * time.Hour)
+	require.Nil(tbox.Step())
+	status, err = tbox.GetProfileStatus()
+	require.Nil(err)
+	require.True(status.Completed)
+	require.False(status.Running)
+	require.Equal(2.0, tbox.temperature)
+
+	// Profile no longer drives the limits
+	tbox.SetLimits(10, 0.5)
+	require.Nil(tbox.Step())
+	require.Equal(10.0, tbox.temperature)
+	require.NotNil(tbox.PauseProfile())
+}
+
+func TestProfileNotConfigured(t *testing.T) {
+	require := require.New(t)
+
+	tbox := &Thermabox{}
+	require.NotNil(tbox.StartProfile())
+	_, err := tbox.GetProfileStatus()
+	require.NotNil(err)
+}
+
+func TestProfileProgressRestore(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "thermabox-profile")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "state.json")
+
+	tbox, clock := newProfileThermabox(require)
+	tbox.stateFile = stateFile
+	require.Nil(tbox.StartProfile())
+	clock.Advance(100 * time.Hour)
+	require.Nil(tbox.Step())
+	require.Equal(1, tbox.profile.progress.Step)
+
+	restart := func(at time.Time) *Thermabox {
+		restarted, _ := newProfileThermabox(require)
+		restarted.stateFile = stateFile
+		restarted.SetClock(NewFakeClock(at))
+		require.Nil(restarted.RestoreState())
+		return restarted
+	}
+
+	// Simulate a restart 2 hours later
+	now := clock.Now().Add(2 * time.Hour)
+	status := restart(now).profile.status(0.2)
+	require.True(status.Running)
+	require.Equal(1, status.Step)
+	require.InDelta(6*60*60, status.StepElapsed, 1e-6)
+	require.InDelta(20.0, status.Setpoint, 1e-9)
+
+	// Paused profiles don't accumulate time while down
+	require.Nil(tbox.PauseProfile())
+	status = restart(now.Add(10 * time.Hour)).profile.status(0.2)
+	require.True(status.Paused)
+	require.InDelta(4*60*60, status.StepElapsed, 1e-6)
+}
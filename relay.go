@@ -2,7 +2,7 @@ package thermabox
 
 import (
 	"fmt"
-	"os"
+	"sync"
 	"time"
 
 	"gopkg.in/yaml.v2"
@@ -19,12 +19,74 @@ type RelayInterface interface {
 	Off(swtch int) error
 	IsOn(swtch int) (bool, error)
 	GetSwitchMap() map[int]uint8
+	// Close releases the relay's GPIO resources. Switches are left as they are
+	Close() error
+}
+
+// InitialState is the state every switch of a relay is put in when the relay
+// is set up
+type InitialState string
+
+const (
+	INITIAL_OFF InitialState = "off"
+	INITIAL_ON  InitialState = "on"
+)
+
+// parseInitialState parses the 'initial_state' key of a relay. YAML reads a
+// bare on or off as a boolean, so booleans are accepted too
+func parseInitialState(val interface{}) (InitialState, error) {
+	switch v := val.(type) {
+	case nil:
+		return INITIAL_OFF, nil
+	case bool:
+		if v {
+			return INITIAL_ON, nil
+		}
+		return INITIAL_OFF, nil
+	case string:
+		switch InitialState(v) {
+		case INITIAL_OFF, INITIAL_ON:
+			return InitialState(v), nil
+		}
+	}
+	return "", fmt.Errorf("Unknown initial state: %v", val)
+}
+
+// go-rpio maps GPIO memory globally. It is opened by the first relay and
+// closed once every relay has been closed
+var (
+	rpioUsers int
+	rpioMutex sync.Mutex
+)
+
+func openRpio() error {
+	rpioMutex.Lock()
+	defer rpioMutex.Unlock()
+	if rpioUsers == 0 {
+		if err := rpio.Open(); err != nil {
+			return fmt.Errorf("Failed to call rpio.Open(): %v", err)
+		}
+	}
+	rpioUsers++
+	return nil
+}
+
+func closeRpio() error {
+	rpioMutex.Lock()
+	defer rpioMutex.Unlock()
+	rpioUsers--
+	if rpioUsers == 0 {
+		return rpio.Close()
+	}
+	return nil
 }
 
 type Relay struct {
-	activeHigh bool       `yaml:"active_high"`
-	pins       []rpio.Pin `yaml:"pins"`
-	SwitchMap  map[int]uint8
+	activeHigh   bool       `yaml:"active_high"`
+	pins         []rpio.Pin `yaml:"pins"`
+	initialState InitialState
+	SwitchMap    map[int]uint8
+	open         bool
 }
 
 func (r *Relay) ActiveHigh() bool {
@@ -48,14 +110,17 @@ func (r *Relay) UnmarshalYAML(unmarshal func(i interface{}) error) error {
 	for i := 0; i < len(pins); i++ {
 		pins[i] = pinsInterface[i].(int)
 	}
+	if r.initialState, err = parseInitialState(m["initial_state"]); err != nil {
+		return err
+	}
 	r.activeHigh = activeHigh
-	r.buildSwitchMap(pins)
-	return nil
+	return r.buildSwitchMap(pins)
 }
 
 func NewRelay(activeHigh bool, gpioPins []int) (*Relay, error) {
 	r := &Relay{}
 	r.activeHigh = activeHigh
+	r.initialState = INITIAL_OFF
 	if err := r.buildSwitchMap(gpioPins); err != nil {
 		return nil, err
 	}
@@ -66,25 +131,26 @@ func (r *Relay) buildSwitchMap(gpioPins []int) error {
 	pins := make([]rpio.Pin, len(gpioPins))
 	switchMap := make(map[int]uint8)
 
-	if err := rpio.Open(); err != nil {
-		return fmt.Errorf("Failed to call rpio.Open(): %v", err)
+	if !r.open {
+		if err := openRpio(); err != nil {
+			return err
+		}
+		r.open = true
 	}
 
+	// Set the level before switching to output mode so that the pin never
+	// drives the wrong level
+	high := (r.initialState == INITIAL_ON) == r.activeHigh
 	for idx, gpioPin := range gpioPins {
 		pin := rpio.Pin(gpioPin)
 		// Update switchMap
 		switchMap[idx+1] = uint8(pin)
-		// Set pin to output mode
+		if high {
+			pin.High()
+		} else {
+			pin.Low()
+		}
 		pin.Output()
-		/*
-			// Turn it off
-			switch r.activeHigh {
-			case true:
-				pin.Low()
-			case false:
-				pin.High()
-			}
-		*/
 		pins[idx] = pin
 	}
 	r.pins = pins
@@ -92,6 +158,14 @@ func (r *Relay) buildSwitchMap(gpioPins []int) error {
 	return nil
 }
 
+func (r *Relay) Close() error {
+	if !r.open {
+		return nil
+	}
+	r.open = false
+	return closeRpio()
+}
+
 func (r *Relay) Toggle(swtch int) error {
 	if p, ok := r.SwitchMap[swtch]; !ok {
 		return fmt.Errorf("Switch %v not initialized in relay", swtch)
@@ -102,64 +176,36 @@ func (r *Relay) Toggle(swtch int) error {
 	}
 }
 
+// On drives the switch's pin to its on level. Use SwitchRelay to also verify
+// that the switch is on
 func (r *Relay) On(swtch int) error {
-	var (
-		isOn bool
-		err  error
-	)
-	if p, ok := r.SwitchMap[swtch]; !ok {
+	p, ok := r.SwitchMap[swtch]
+	if !ok {
 		return fmt.Errorf("Switch %v not initialized in relay", swtch)
+	}
+	pin := rpio.Pin(p)
+	if r.activeHigh {
+		pin.High()
 	} else {
-		pin := rpio.Pin(p)
-		for {
-			switch r.activeHigh {
-			case true:
-				pin.High()
-			case false:
-				pin.Low()
-			}
-			if isOn, err = r.IsOn(1); err != nil {
-				fmt.Fprintf(os.Stderr, "Failed to check if relay is on: %v\n", err)
-				break
-			} else if isOn {
-				break
-			} else {
-				fmt.Fprintf(os.Stderr, "Failed to turn on relay...retrying\n")
-			}
-			time.Sleep(500 * time.Millisecond)
-		}
+		pin.Low()
 	}
-	return err
+	return nil
 }
 
+// Off drives the switch's pin to its off level. Use SwitchRelay to also
+// verify that the switch is off
 func (r *Relay) Off(swtch int) error {
-	var (
-		isOn bool
-		err  error
-	)
-	if p, ok := r.SwitchMap[swtch]; !ok {
+	p, ok := r.SwitchMap[swtch]
+	if !ok {
 		return fmt.Errorf("Switch %v not initialized in relay", swtch)
+	}
+	pin := rpio.Pin(p)
+	if r.activeHigh {
+		pin.Low()
 	} else {
-		pin := rpio.Pin(p)
-		for {
-			switch r.activeHigh {
-			case true:
-				pin.Low()
-			case false:
-				pin.High()
-			}
-			if isOn, err = r.IsOn(1); err != nil {
-				fmt.Fprintf(os.Stderr, "Failed to check if relay is on: %v", err)
-				break
-			} else if !isOn {
-				break
-			} else {
-				fmt.Fprintf(os.Stderr, "Failed to turn off relay...retrying\n")
-			}
-			time.Sleep(500 * time.Millisecond)
-		}
+		pin.High()
 	}
-	return err
+	return nil
 }
 
 func (r *Relay) IsOn(swtch int) (bool, error) {
@@ -179,77 +225,65 @@ func (r *Relay) IsOn(swtch int) (bool, error) {
 	}
 }
 
-// This is a fake relay used for testing
-// Ideally, this should be implemented using some kind of mock object
-type FakeRelay struct {
-	activeHigh bool       `yaml:"active_high"`
-	pins       []rpio.Pin `yaml:"pins"`
-	SwitchMap  map[int]uint8
-}
-
-func NewFakeRelay(activeHigh bool, pins []int) *FakeRelay {
-	f := FakeRelay{}
-	f.activeHigh = activeHigh
-	p := make([]rpio.Pin, len(pins))
-	sMap := make(map[int]uint8)
-	for idx, pin := range pins {
-		p[idx] = rpio.Pin(pin)
-		sMap[pin] = 1
-	}
-	f.pins = p
-	f.SwitchMap = sMap
-	return &f
+// RelayFaultError is returned when a switch could not be confirmed to be in
+// the requested state
+type RelayFaultError struct {
+	Switch   int
+	On       bool
+	Attempts int
+	// Err is the last error returned by the relay, if any
+	Err error
 }
 
-func (f *FakeRelay) ActiveHigh() bool {
-	return f.activeHigh
-}
-func (f *FakeRelay) commonHandle(swtch int) error {
-	if _, ok := f.SwitchMap[swtch]; !ok {
-		return fmt.Errorf("Switch %v not initialized in relay", swtch)
-	} else {
-		return nil
+func (e RelayFaultError) Error() string {
+	msg := fmt.Sprintf("Relay switch %v failed to turn %v after %v attempts", e.Switch, onOff(e.On), e.Attempts)
+	if e.Err != nil {
+		msg += fmt.Sprintf(": %v", e.Err)
 	}
+	return msg
 }
 
-func (f *FakeRelay) Toggle(swtch int) error {
-	return f.commonHandle(swtch)
-}
-func (f *FakeRelay) On(swtch int) error {
-	return f.commonHandle(swtch)
-}
-func (f *FakeRelay) Off(swtch int) error {
-	return f.commonHandle(swtch)
+// RelayVerify configures how SwitchRelay verifies a switch. After a failed
+// attempt it waits Backoff before retrying, doubling the wait every time
+type RelayVerify struct {
+	Retries int
+	Backoff time.Duration
 }
 
-func (f *FakeRelay) GetSwitchMap() map[int]uint8 {
-	return f.SwitchMap
-}
+var DefaultRelayVerify = RelayVerify{Retries: 3, Backoff: 100 * time.Millisecond}
 
-// TODO: Properly implement IsOn() after a fake rpio.Pin interface is implemented
-func (f *FakeRelay) IsOn(swtch int) (bool, error) {
-	log.Warnf("IsOn() hasn't been implemented!")
-	return false, nil
-}
-
-func (f *FakeRelay) UnmarshalYAML(unmarshal func(i interface{}) error) error {
-	m := make(map[string]interface{})
-	err := unmarshal(&m)
-	if err != nil {
-		return err
-	}
-	if _, ok := m["active_high"]; !ok {
-		m["active_high"] = false
-	}
-	activeHigh := m["active_high"].(bool)
-	pinsInterface := m["pins"].([]interface{})
-	pins := make([]rpio.Pin, len(pinsInterface))
-	sMap := make(map[int]uint8)
-	for i := 0; i < len(pins); i++ {
-		pins[i] = rpio.Pin(pinsInterface[i].(int))
-		sMap[int(pins[i])] = 1
+// SwitchRelay switches a relay and reads the switch back to verify it took
+// effect, retrying according to verify. A RelayFaultError is returned if the
+// switch is not in the requested state after all retries
+func SwitchRelay(r RelayInterface, swtch int, on bool, verify RelayVerify, clock Clock) error {
+	var err error
+	backoff := verify.Backoff
+	attempts := 0
+	for attempts <= verify.Retries {
+		if attempts > 0 {
+			log.Warnf("Failed to turn %v relay switch %v: %v. Retrying", onOff(on), swtch, err)
+			if backoff > 0 {
+				clockOrDefault(clock).Sleep(backoff)
+				backoff *= 2
+			}
+		}
+		attempts++
+		if on {
+			err = r.On(swtch)
+		} else {
+			err = r.Off(swtch)
+		}
+		if err != nil {
+			continue
+		}
+		var isOn bool
+		if isOn, err = r.IsOn(swtch); err != nil {
+			continue
+		}
+		if isOn == on {
+			return nil
+		}
+		err = fmt.Errorf("read back %v", onOff(isOn))
 	}
-	relay := &FakeRelay{activeHigh, pins, sMap}
-	*f = *relay
-	return nil
+	return RelayFaultError{swtch, on, attempts, err}
 }
@@ -0,0 +1,109 @@
+//go:build linux
+// +build linux
+
+package thermabox
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// From linux/gpio.h (v1 ABI)
+const (
+	gpioHandlesMax           = 64
+	gpioHandleRequestOutput  = 1 << 1
+	gpioGetLineHandleIoctl   = 0xc16cb403
+	gpioHandleGetValuesIoctl = 0xc040b408
+	gpioHandleSetValuesIoctl = 0xc040b409
+)
+
+type gpioHandleRequest struct {
+	LineOffsets   [gpioHandlesMax]uint32
+	Flags         uint32
+	DefaultValues [gpioHandlesMax]uint8
+	ConsumerLabel [32]byte
+	Lines         uint32
+	Fd            int32
+}
+
+type gpioHandleData struct {
+	Values [gpioHandlesMax]uint8
+}
+
+// cdevBackend drives lines through a GPIO character device such as
+// /dev/gpiochip0, holding a line handle for every line that is set up
+type cdevBackend struct {
+	chip    *os.File
+	handles map[int]uintptr
+}
+
+func newCdevBackend(path string) (gpioBackend, error) {
+	chip, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open GPIO chip: %v", err)
+	}
+	return &cdevBackend{chip: chip, handles: make(map[int]uintptr)}, nil
+}
+
+func ioctl(fd uintptr, req uintptr, arg unsafe.Pointer) error {
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, req, uintptr(arg)); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (c *cdevBackend) Setup(line int, high bool) error {
+	req := gpioHandleRequest{Flags: gpioHandleRequestOutput, Lines: 1}
+	req.LineOffsets[0] = uint32(line)
+	if high {
+		req.DefaultValues[0] = 1
+	}
+	copy(req.ConsumerLabel[:], "thermabox")
+	if err := ioctl(c.chip.Fd(), gpioGetLineHandleIoctl, unsafe.Pointer(&req)); err != nil {
+		return fmt.Errorf("Failed to request line: %v", err)
+	}
+	c.handles[line] = uintptr(req.Fd)
+	return nil
+}
+
+func (c *cdevBackend) handle(line int) (uintptr, error) {
+	fd, ok := c.handles[line]
+	if !ok {
+		return 0, fmt.Errorf("GPIO %v has not been set up", line)
+	}
+	return fd, nil
+}
+
+func (c *cdevBackend) Set(line int, high bool) error {
+	fd, err := c.handle(line)
+	if err != nil {
+		return err
+	}
+	data := gpioHandleData{}
+	if high {
+		data.Values[0] = 1
+	}
+	return ioctl(fd, gpioHandleSetValuesIoctl, unsafe.Pointer(&data))
+}
+
+func (c *cdevBackend) Get(line int) (bool, error) {
+	fd, err := c.handle(line)
+	if err != nil {
+		return false, err
+	}
+	data := gpioHandleData{}
+	if err := ioctl(fd, gpioHandleGetValuesIoctl, unsafe.Pointer(&data)); err != nil {
+		return false, err
+	}
+	return data.Values[0] != 0, nil
+}
+
+func (c *cdevBackend) Close() error {
+	for line, fd := range c.handles {
+		syscall.Close(int(fd))
+		delete(c.handles, line)
+	}
+	return c.chip.Close()
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package thermabox
+
+import "fmt"
+
+func newCdevBackend(path string) (gpioBackend, error) {
+	return nil, fmt.Errorf("The GPIO character device is only supported on Linux")
+}
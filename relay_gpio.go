@@ -0,0 +1,295 @@
+package thermabox
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type RelayDriver string
+
+const (
+	// RPIO drives Broadcom SoC pins directly through go-rpio
+	RPIO RelayDriver = "rpio"
+	// CDEV uses the Linux GPIO character device. It fails if the chip
+	// device does not exist rather than falling back to SYSFS
+	CDEV  RelayDriver = "cdev"
+	SYSFS RelayDriver = "sysfs"
+)
+
+const (
+	DefaultGPIODevRoot   = "/dev"
+	DefaultGPIOChip      = "gpiochip0"
+	DefaultGPIOSysfsRoot = "/sys/class/gpio"
+)
+
+// newRelay returns an unconfigured relay for the driver named by the
+// 'driver' key of the relay YAML. The default driver is rpio
+func newRelay(data interface{}) (RelayInterface, error) {
+	m, _ := data.(map[interface{}]interface{})
+	driver := RPIO
+	if val, ok := m["driver"]; ok {
+		driver = RelayDriver(fmt.Sprintf("%v", val))
+	}
+	switch driver {
+	case RPIO:
+		return &Relay{}, nil
+	case CDEV, SYSFS:
+		return &GPIORelay{}, nil
+	default:
+		return nil, fmt.Errorf("Unknown relay driver: %v", driver)
+	}
+}
+
+// gpioBackend sets and reads the level of GPIO lines
+type gpioBackend interface {
+	// Setup configures line as an output at the given level
+	Setup(line int, high bool) error
+	Set(line int, high bool) error
+	Get(line int) (bool, error)
+	Close() error
+}
+
+// GPIORelay is a relay driven through the Linux GPIO character device or
+// the sysfs GPIO interface. Pins are line offsets on the chip for cdev and
+// global GPIO numbers for sysfs. SwitchMap is limited to pins below 256 by
+// RelayInterface, but every pin can be driven
+type GPIORelay struct {
+	Driver       RelayDriver
+	DevRoot      string
+	Chip         string
+	SysfsRoot    string
+	InitialState InitialState
+	activeHigh   bool
+	pins         []int
+	SwitchMap    map[int]uint8
+	backend      gpioBackend
+}
+
+func NewGPIORelay(driver RelayDriver, activeHigh bool, pins []int) (*GPIORelay, error) {
+	r := &GPIORelay{
+		Driver:       driver,
+		DevRoot:      DefaultGPIODevRoot,
+		Chip:         DefaultGPIOChip,
+		SysfsRoot:    DefaultGPIOSysfsRoot,
+		InitialState: INITIAL_OFF,
+		activeHigh:   activeHigh,
+		pins:         pins,
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *GPIORelay) UnmarshalYAML(unmarshal func(i interface{}) error) error {
+	conf := struct {
+		Driver       RelayDriver `yaml:"driver"`
+		DevRoot      string      `yaml:"dev_root"`
+		Chip         string      `yaml:"chip"`
+		SysfsRoot    string      `yaml:"sysfs_root"`
+		InitialState interface{} `yaml:"initial_state"`
+		ActiveHigh   bool        `yaml:"active_high"`
+		Pins         []int       `yaml:"pins"`
+	}{CDEV, DefaultGPIODevRoot, DefaultGPIOChip, DefaultGPIOSysfsRoot, nil, false, nil}
+	if err := unmarshal(&conf); err != nil {
+		return err
+	}
+	log.Debugf("GPIORelay unmarshalling: %+v", conf)
+	if conf.Driver != CDEV && conf.Driver != SYSFS {
+		return fmt.Errorf("Unknown GPIO relay driver: %v", conf.Driver)
+	}
+	if len(conf.Pins) == 0 {
+		return fmt.Errorf("Relay has no pins")
+	}
+	initialState, err := parseInitialState(conf.InitialState)
+	if err != nil {
+		return err
+	}
+	r.InitialState = initialState
+	r.Driver = conf.Driver
+	r.DevRoot = conf.DevRoot
+	r.Chip = conf.Chip
+	r.SysfsRoot = conf.SysfsRoot
+	r.activeHigh = conf.ActiveHigh
+	r.pins = conf.Pins
+	return r.open()
+}
+
+// open sets up the backend and configures every pin as an output in the
+// initial state
+func (r *GPIORelay) open() error {
+	var err error
+	if r.Driver == CDEV {
+		chip := filepath.Join(r.DevRoot, r.Chip)
+		// There is no falling back to sysfs, since pins are line offsets
+		// here but global GPIO numbers there, which differ unless the chip's
+		// base is 0
+		if _, statErr := os.Stat(chip); os.IsNotExist(statErr) {
+			return fmt.Errorf("GPIO chip '%v' does not exist. Set 'driver: sysfs' with global GPIO numbers to use sysfs", chip)
+		}
+		if r.backend, err = newCdevBackend(chip); err != nil {
+			return err
+		}
+	}
+	if r.Driver == SYSFS {
+		r.backend = &sysfsBackend{root: r.SysfsRoot}
+	}
+
+	switchMap := make(map[int]uint8)
+	for idx, pin := range r.pins {
+		if err := r.backend.Setup(pin, (r.InitialState == INITIAL_ON) == r.activeHigh); err != nil {
+			r.release()
+			return fmt.Errorf("Failed to set up GPIO %v: %v", pin, err)
+		}
+		switchMap[idx+1] = uint8(pin)
+	}
+	r.SwitchMap = switchMap
+	return nil
+}
+
+// release closes a backend that failed to set up. Lines exported for it are
+// unexported again, since they were never driven
+func (r *GPIORelay) release() {
+	if s, ok := r.backend.(*sysfsBackend); ok {
+		if err := s.unexport(); err != nil {
+			log.Warnf("Failed to unexport GPIOs: %v", err)
+		}
+	}
+	if err := r.backend.Close(); err != nil {
+		log.Warnf("Failed to close GPIO backend: %v", err)
+	}
+	r.backend = nil
+}
+
+func (r *GPIORelay) Close() error {
+	if r.backend == nil {
+		return nil
+	}
+	err := r.backend.Close()
+	r.backend = nil
+	return err
+}
+
+func (r *GPIORelay) ActiveHigh() bool {
+	return r.activeHigh
+}
+
+func (r *GPIORelay) GetSwitchMap() map[int]uint8 {
+	return r.SwitchMap
+}
+
+func (r *GPIORelay) line(swtch int) (int, error) {
+	if r.backend == nil {
+		return 0, fmt.Errorf("Relay is not open")
+	}
+	if swtch < 1 || swtch > len(r.pins) {
+		return 0, fmt.Errorf("Switch %v not initialized in relay", swtch)
+	}
+	return r.pins[swtch-1], nil
+}
+
+func (r *GPIORelay) set(swtch int, on bool) error {
+	line, err := r.line(swtch)
+	if err != nil {
+		return err
+	}
+	return r.backend.Set(line, on == r.activeHigh)
+}
+
+func (r *GPIORelay) On(swtch int) error {
+	return r.set(swtch, true)
+}
+
+func (r *GPIORelay) Off(swtch int) error {
+	return r.set(swtch, false)
+}
+
+func (r *GPIORelay) Toggle(swtch int) error {
+	isOn, err := r.IsOn(swtch)
+	if err != nil {
+		return err
+	}
+	return r.set(swtch, !isOn)
+}
+
+func (r *GPIORelay) IsOn(swtch int) (bool, error) {
+	line, err := r.line(swtch)
+	if err != nil {
+		return false, err
+	}
+	high, err := r.backend.Get(line)
+	if err != nil {
+		return false, err
+	}
+	return high == r.activeHigh, nil
+}
+
+// sysfsBackend drives lines through /sys/class/gpio
+type sysfsBackend struct {
+	root     string
+	exported []int
+}
+
+func (s *sysfsBackend) path(line int, file string) string {
+	return filepath.Join(s.root, fmt.Sprintf("gpio%v", line), file)
+}
+
+func (s *sysfsBackend) Setup(line int, high bool) error {
+	if _, err := os.Stat(filepath.Join(s.root, fmt.Sprintf("gpio%v", line))); os.IsNotExist(err) {
+		if err := ioutil.WriteFile(filepath.Join(s.root, "export"), []byte(strconv.Itoa(line)), 0200); err != nil {
+			return fmt.Errorf("Failed to export: %v", err)
+		}
+		s.exported = append(s.exported, line)
+	}
+	// Writing high or low sets the direction and the initial level at once
+	direction := "low"
+	if high {
+		direction = "high"
+	}
+	return ioutil.WriteFile(s.path(line, "direction"), []byte(direction), 0644)
+}
+
+func (s *sysfsBackend) Set(line int, high bool) error {
+	value := "0"
+	if high {
+		value = "1"
+	}
+	return ioutil.WriteFile(s.path(line, "value"), []byte(value), 0644)
+}
+
+func (s *sysfsBackend) Get(line int) (bool, error) {
+	b, err := ioutil.ReadFile(s.path(line, "value"))
+	if err != nil {
+		return false, err
+	}
+	switch strings.TrimSpace(string(b)) {
+	case "0":
+		return false, nil
+	case "1":
+		return true, nil
+	default:
+		return false, fmt.Errorf("Unexpected value for GPIO %v: %q", line, string(b))
+	}
+}
+
+// unexport unexports the lines that were exported by Setup
+func (s *sysfsBackend) unexport() error {
+	var ret error
+	for _, line := range s.exported {
+		if err := ioutil.WriteFile(filepath.Join(s.root, "unexport"), []byte(strconv.Itoa(line)), 0200); err != nil && ret == nil {
+			ret = fmt.Errorf("Failed to unexport GPIO %v: %v", line, err)
+		}
+	}
+	s.exported = nil
+	return ret
+}
+
+func (s *sysfsBackend) Close() error {
+	return nil
+}
@@ -0,0 +1,224 @@
+package thermabox
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var _ RelayInterface = &GPIORelay{}
+
+// fakeSysfsGPIO creates the files the kernel would create when the given
+// lines are exported
+func fakeSysfsGPIO(require *require.Assertions, lines ...int) string {
+	root, err := ioutil.TempDir("", "thermabox-gpio")
+	require.Nil(err)
+	require.Nil(ioutil.WriteFile(filepath.Join(root, "export"), nil, 0644))
+	for _, line := range lines {
+		dir := filepath.Join(root, "gpio"+strconv.Itoa(line))
+		require.Nil(os.MkdirAll(dir, 0755))
+		require.Nil(ioutil.WriteFile(filepath.Join(dir, "direction"), []byte("in\n"), 0644))
+		require.Nil(ioutil.WriteFile(filepath.Join(dir, "value"), []byte("0\n"), 0644))
+	}
+	return root
+}
+
+func readGPIO(require *require.Assertions, root string, line int, file string) string {
+	b, err := ioutil.ReadFile(filepath.Join(root, "gpio"+strconv.Itoa(line), file))
+	require.Nil(err)
+	return string(b)
+}
+
+func TestSysfsRelay(t *testing.T) {
+	require := require.New(t)
+
+	root := fakeSysfsGPIO(require, 22, 23)
+	defer os.RemoveAll(root)
+
+	relay := &GPIORelay{}
+	err := yaml.Unmarshal([]byte(`
+driver: sysfs
+sysfs_root: `+root+`
+active_high: false
+pins: [22, 23]
+`), relay)
+	require.Nil(err)
+	require.Equal(SYSFS, relay.Driver)
+	require.Equal(map[int]uint8{1: 22, 2: 23}, relay.GetSwitchMap())
+	// Outputs start off
+	require.Equal("high", readGPIO(require, root, 22, "direction"))
+	require.Equal("high", readGPIO(require, root, 23, "direction"))
+
+	require.Nil(relay.On(1))
+	require.Nil(relay.Off(2))
+	require.Equal("0", readGPIO(require, root, 22, "value"))
+	require.Equal("1", readGPIO(require, root, 23, "value"))
+	isOn, err := relay.IsOn(1)
+	require.Nil(err)
+	require.True(isOn)
+	isOn, err = relay.IsOn(2)
+	require.Nil(err)
+	require.False(isOn)
+
+	require.Nil(relay.Toggle(1))
+	require.Equal("1", readGPIO(require, root, 22, "value"))
+	require.Nil(relay.Toggle(2))
+	require.Equal("0", readGPIO(require, root, 23, "value"))
+
+	require.NotNil(relay.On(3))
+	_, err = relay.IsOn(0)
+	require.NotNil(err)
+
+	// Lines that aren't exported are exported first
+	_, err = NewGPIORelay(SYSFS, true, []int{24})
+	require.NotNil(err)
+	sysfs := &sysfsBackend{root: root}
+	require.NotNil(sysfs.Setup(24, false))
+	b, err := ioutil.ReadFile(filepath.Join(root, "export"))
+	require.Nil(err)
+	require.Equal("24", string(b))
+
+	// A relay that fails to set up unexports the lines it exported
+	relay = &GPIORelay{}
+	err = yaml.Unmarshal([]byte(`
+driver: sysfs
+sysfs_root: `+root+`
+pins: [22, 25]
+`), relay)
+	require.NotNil(err)
+	b, err = ioutil.ReadFile(filepath.Join(root, "unexport"))
+	require.Nil(err)
+	require.Equal("25", string(b))
+	require.NotNil(relay.On(1))
+}
+
+func TestCdevRelayMissingChip(t *testing.T) {
+	require := require.New(t)
+
+	root := fakeSysfsGPIO(require, 5)
+	defer os.RemoveAll(root)
+
+	// No chip device. Pins are line offsets, so sysfs is not used instead
+	relay := &GPIORelay{}
+	err := yaml.Unmarshal([]byte(`
+driver: cdev
+dev_root: `+root+`/dev
+sysfs_root: `+root+`
+active_high: true
+pins: [5]
+`), relay)
+	require.NotNil(err)
+	require.Contains(err.Error(), "driver: sysfs")
+	require.Equal("in\n", readGPIO(require, root, 5, "direction"))
+
+	// Released relays can no longer be switched
+	relay = &GPIORelay{}
+	require.Nil(yaml.Unmarshal([]byte(`
+driver: sysfs
+sysfs_root: `+root+`
+active_high: true
+pins: [5]
+`), relay))
+	require.Nil(relay.On(1))
+	require.Equal("1", readGPIO(require, root, 5, "value"))
+	require.Nil(relay.Close())
+	require.NotNil(relay.Off(1))
+	require.Nil(relay.Close())
+
+	// A chip that isn't a GPIO character device fails
+	require.Nil(os.MkdirAll(filepath.Join(root, "dev"), 0755))
+	require.Nil(ioutil.WriteFile(filepath.Join(root, "dev", "gpiochip0"), nil, 0644))
+	relay = &GPIORelay{}
+	err = yaml.Unmarshal([]byte(`
+driver: cdev
+dev_root: `+root+`/dev
+pins: [5]
+`), relay)
+	require.NotNil(err)
+}
+
+func TestParseYamlRelayDriver(t *testing.T) {
+	require := require.New(t)
+
+	root := fakeSysfsGPIO(require, 22)
+	defer os.RemoveAll(root)
+
+	element := &Element{}
+	err := yaml.Unmarshal([]byte(`
+relay:
+  driver: sysfs
+  sysfs_root: `+root+`
+  pins: [22]
+min_on_sec: 10
+`), element)
+	require.Nil(err)
+	relay, ok := element.relay.(*GPIORelay)
+	require.True(ok)
+	require.Equal(SYSFS, relay.Driver)
+	require.Equal(INITIAL_OFF, relay.InitialState)
+
+	element = &Element{}
+	err = yaml.Unmarshal([]byte(`
+relay:
+  driver: sysfs
+  sysfs_root: `+root+`
+  initial_state: on
+  pins: [22]
+`), element)
+	require.Nil(err)
+	require.Equal("low", readGPIO(require, root, 22, "direction"))
+	isOn, err := element.relay.IsOn(1)
+	require.Nil(err)
+	require.True(isOn)
+
+	element = &Element{}
+	err = yaml.Unmarshal([]byte(`
+relay:
+  driver: i2c
+  pins: [22]
+`), element)
+	require.NotNil(err)
+
+	element = &Element{}
+	err = yaml.Unmarshal([]byte(`
+relay:
+  driver: sysfs
+  sysfs_root: `+root+`
+`), element)
+	require.NotNil(err)
+
+	element = &Element{}
+	err = yaml.Unmarshal([]byte(`
+relay:
+  driver: sysfs
+  sysfs_root: `+root+`
+  initial_state: keep
+  pins: [22]
+`), element)
+	require.NotNil(err)
+}
+
+func TestParseYamlThermaboxRelayDriver(t *testing.T) {
+	require := require.New(t)
+
+	// An invalid element must fail the whole config rather than leave the
+	// element without a relay
+	tbox := &Thermabox{}
+	err := yaml.Unmarshal([]byte(`
+heating_element:
+  relay:
+    driver: i2c
+    pins: [22]
+cooling_element:
+  relay:
+    pins: [23]
+`), tbox)
+	require.NotNil(err)
+	require.Contains(err.Error(), "heating_element")
+	require.Contains(err.Error(), "Unknown relay driver: i2c")
+}
@@ -1,6 +1,7 @@
 package thermabox
 
 import (
+	"fmt"
 	"testing"
 	"time"
 
@@ -16,6 +17,10 @@ func getRelay(require *require.Assertions) *Relay {
 	return relay
 }
 
+func genFakeRelay(activeHigh bool, pins []int) RelayInterface {
+	return NewFakeRelay(activeHigh, pins)
+}
+
 func TestParseRelayYaml(t *testing.T) {
 	require := require.New(t)
 
@@ -29,9 +34,26 @@ pins: [14, 17, 18]
 	require.Nil(err)
 	require.True(relay.ActiveHigh())
 	require.Equal(3, len(relay.SwitchMap))
-	require.NotNil(relay.SwitchMap[14])
-	require.NotNil(relay.SwitchMap[17])
-	require.NotNil(relay.SwitchMap[18])
+	require.Equal(uint8(14), relay.SwitchMap[1])
+	require.Equal(uint8(17), relay.SwitchMap[2])
+	require.Equal(uint8(18), relay.SwitchMap[3])
+
+	relay = &FakeRelay{}
+	err = yaml.Unmarshal([]byte(`
+initial_state: on
+pins: [14]
+`), relay)
+	require.Nil(err)
+	isOn, err := relay.IsOn(1)
+	require.Nil(err)
+	require.True(isOn)
+
+	relay = &FakeRelay{}
+	err = yaml.Unmarshal([]byte(`
+initial_state: maybe
+pins: [14]
+`), relay)
+	require.NotNil(err)
 }
 
 func TestRelay(t *testing.T) {
@@ -82,3 +104,58 @@ func TestRelayOnOff(t *testing.T) {
 	err = relay.Off(2)
 	require.Nil(err)
 }
+
+func TestSwitchRelay(t *testing.T) {
+	require := require.New(t)
+
+	relay := NewFakeRelay(false, []int{22, 23})
+	verify := RelayVerify{Retries: 2}
+
+	// Verifies the requested switch
+	require.Nil(SwitchRelay(relay, 2, true, verify, nil))
+	isOn, err := relay.IsOn(1)
+	require.Nil(err)
+	require.False(isOn)
+	isOn, err = relay.IsOn(2)
+	require.Nil(err)
+	require.True(isOn)
+
+	// Transient errors are retried
+	relay.FailOnCall(1, fmt.Errorf("bus error"))
+	require.Nil(SwitchRelay(relay, 1, true, verify, nil))
+
+	relay.StickOn(2)
+	calls := relay.Calls()
+	err = SwitchRelay(relay, 2, false, verify, nil)
+	require.NotNil(err)
+	fault, ok := err.(RelayFaultError)
+	require.True(ok)
+	require.Equal(RelayFaultError{Switch: 2, On: false, Attempts: 3, Err: fault.Err}, fault)
+	// Off followed by IsOn for every attempt
+	require.Equal(calls+6, relay.Calls())
+
+	err = SwitchRelay(relay, 3, true, verify, nil)
+	require.NotNil(err)
+	require.Equal(3, err.(RelayFaultError).Attempts)
+}
+
+func TestSwitchRelayBackoff(t *testing.T) {
+	require := require.New(t)
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(start)
+	relay := NewFakeRelay(false, []int{22})
+	relay.StickOff(1)
+
+	done := make(chan error)
+	go func() {
+		done <- SwitchRelay(relay, 1, true, RelayVerify{Retries: 2, Backoff: time.Second}, clock)
+	}()
+	// Waits 1s, then 2s
+	for _, d := range []time.Duration{time.Second, 2 * time.Second} {
+		clock.BlockUntil(1)
+		clock.Advance(d)
+	}
+	require.NotNil(<-done)
+	require.Equal(start.Add(3*time.Second), clock.Now())
+}
@@ -0,0 +1,328 @@
+package thermabox
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gurupras/thermabox/interfaces"
+	yaml "gopkg.in/yaml.v2"
+)
+
+type RateDirection string
+
+const (
+	RISING  RateDirection = "rising"
+	FALLING RateDirection = "falling"
+)
+
+// RateCondition restricts a rate alarm to times when an element is running
+type RateCondition string
+
+const (
+	WHILE_ANY     RateCondition = "any"
+	WHILE_HEATING RateCondition = "heating"
+	WHILE_COOLING RateCondition = "cooling"
+)
+
+// RateAlarmConfig raises a RATE_OF_CHANGE fault when the temperature changes
+// in Direction faster than Rate °C/min, measured over Window.
+// Alarms restricted to heating or cooling only apply once that element has
+// been on for the whole window, so that the box has had time to respond
+type RateAlarmConfig struct {
+	Direction RateDirection
+	Rate      float64
+	While     RateCondition
+	Window    time.Duration
+}
+
+func (c *RateAlarmConfig) UnmarshalYAML(unmarshal func(i interface{}) error) error {
+	m := make(map[string]interface{})
+	if err := unmarshal(&m); err != nil {
+		return err
+	}
+	c.Direction = RateDirection(fmt.Sprintf("%v", m["direction"]))
+	if c.Direction != RISING && c.Direction != FALLING {
+		return fmt.Errorf("Rate alarm direction must be rising or falling: %v", m["direction"])
+	}
+	var err error
+	if c.Rate, err = parseFloat(m, "rate", 0); err != nil {
+		return err
+	}
+	if c.Rate <= 0 {
+		return fmt.Errorf("Rate alarm rate must be > 0: %v", c.Rate)
+	}
+	c.While = WHILE_ANY
+	if val, ok := m["while"]; ok {
+		c.While = RateCondition(fmt.Sprintf("%v", val))
+	}
+	switch c.While {
+	case WHILE_ANY, WHILE_HEATING, WHILE_COOLING:
+	default:
+		return fmt.Errorf("Unknown rate alarm condition: %v", c.While)
+	}
+	window, err := parseFloat(m, "window_sec", 60)
+	if err != nil {
+		return err
+	}
+	if window <= 0 {
+		return fmt.Errorf("Rate alarm window_sec must be > 0: %v", window)
+	}
+	c.Window = seconds(window)
+	return nil
+}
+
+func parseRateAlarmConfigs(data interface{}) ([]*RateAlarmConfig, error) {
+	b, err := yaml.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal key 'rate_alarms': %v: %v", data, err)
+	}
+	configs := make([]*RateAlarmConfig, 0)
+	if err := yaml.Unmarshal(b, &configs); err != nil {
+		return nil, fmt.Errorf("Failed while parsing rate_alarms: %v", err)
+	}
+	return configs, nil
+}
+
+type tempSample struct {
+	time time.Time
+	temp float64
+}
+
+// rateWindow holds the readings of one probe over a rate alarm's window
+type rateWindow struct {
+	samples []tempSample
+}
+
+// update adds a reading and returns the rate of change in °C/min over at
+// least window. ok is false until a full window has been seen
+func (w *rateWindow) update(temp float64, now time.Time, window time.Duration) (rate float64, start time.Time, ok bool) {
+	w.samples = append(w.samples, tempSample{now, temp})
+	// Keep the newest sample that is at least a window old
+	for len(w.samples) > 1 && now.Sub(w.samples[1].time) >= window {
+		w.samples = w.samples[1:]
+	}
+	oldest := w.samples[0]
+	elapsed := now.Sub(oldest.time)
+	if elapsed < window {
+		return 0, time.Time{}, false
+	}
+	return (temp - oldest.temp) / elapsed.Minutes(), oldest.time, true
+}
+
+// rateAlarm tracks the readings needed to evaluate a RateAlarmConfig. The
+// control probe and the safety probe are tracked separately
+type rateAlarm struct {
+	*RateAlarmConfig
+	control rateWindow
+	safety  rateWindow
+}
+
+// check returns an error if the alarm is triggered by the latest reading of
+// the probe tracked by w. name is used for the probe in the error
+func (r *rateAlarm) check(name string, w *rateWindow, temp float64, now time.Time, heating *Element, cooling *Element) error {
+	rate, start, ok := w.update(temp, now, r.Window)
+	if !ok {
+		return nil
+	}
+	runningSince := func(e *Element) bool {
+		return e.IsOn() && !e.lastOn.After(start)
+	}
+	switch r.While {
+	case WHILE_HEATING:
+		if !runningSince(heating) {
+			return nil
+		}
+	case WHILE_COOLING:
+		if !runningSince(cooling) {
+			return nil
+		}
+	}
+	if r.Direction == FALLING {
+		rate = -rate
+	}
+	if rate <= r.Rate {
+		return nil
+	}
+	msg := fmt.Sprintf("%v %v at %.2f°C/min > %v°C/min", name, r.Direction, rate, r.Rate)
+	if r.While != WHILE_ANY {
+		msg += fmt.Sprintf(" while %v", r.While)
+	}
+	return fmt.Errorf("%v", msg)
+}
+
+// SetSafetyProbe sets a probe that is checked against the cutoff temperatures
+// in addition to the control probe. It is not used for control
+func (t *Thermabox) SetSafetyProbe(probe interfaces.TemperatureSensorInterface) {
+	t.safetyProbe = probe
+	if p, ok := probe.(clockSetter); ok && t.clock != nil {
+		p.SetClock(t.clock)
+	}
+}
+
+// SafetyProbeSource returns the source of the safety probe given in the
+// config, if any
+func (t *Thermabox) SafetyProbeSource() string {
+	return t.safetyProbeSource
+}
+
+// SafetyProbeCalibration returns the calibration to apply to the safety
+// probe. It is nil if there is none
+func (t *Thermabox) SafetyProbeCalibration() *Calibration {
+	return t.safetyCalibration
+}
+
+// parseSafetyProbe parses safety_probe, which is either the source of the
+// probe or a mapping with its source and calibration. The safety probe is
+// calibrated like any other probe but never filtered
+func parseSafetyProbe(data interface{}) (string, *Calibration, error) {
+	m, ok := data.(map[interface{}]interface{})
+	if !ok {
+		return fmt.Sprintf("%v", data), nil, nil
+	}
+	source, ok := m["source"]
+	if !ok {
+		return "", nil, fmt.Errorf("safety_probe is missing source")
+	}
+	if _, ok := m["filters"]; ok {
+		return "", nil, fmt.Errorf("safety_probe cannot have filters")
+	}
+	var calibration *Calibration
+	if data, ok := m["calibration"]; ok {
+		var err error
+		if calibration, err = parseCalibration(data); err != nil {
+			return "", nil, fmt.Errorf("Failed while parsing safety_probe: %v", err)
+		}
+	}
+	return fmt.Sprintf("%v", source), calibration, nil
+}
+
+// SetCutoffs sets the temperatures outside of which the thermabox faults.
+// A nil limit is not checked
+func (t *Thermabox) SetCutoffs(min *float64, max *float64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.minCutoffTemp = min
+	t.maxCutoffTemp = max
+}
+
+// rawRange returns the lowest and highest unfiltered readings behind temp,
+// the latest reading of probe
+func rawRange(probe interfaces.TemperatureSensorInterface, temp float64) (float64, float64) {
+	switch p := probe.(type) {
+	case rawRangeReader:
+		return p.RawRange()
+	case rawReader:
+		raw := p.RawTemperature()
+		return raw, raw
+	}
+	return temp, temp
+}
+
+// safetyReadings are the readings of one step that checkSafety works from
+type safetyReadings struct {
+	// The control temperature and the lowest and highest unfiltered readings
+	// of the control probes. Unset if the control probe failed with err
+	temp   float64
+	rawMin float64
+	rawMax float64
+	err    error
+	// The unfiltered safety temperature. Unset if there is no safety probe
+	// or it failed with safetyErr
+	safetyTemp float64
+	safetyErr  error
+}
+
+// checkSafety checks the readings of the control probe and the safety probe
+// against the cutoffs and rate alarms, and the elements against their maximum
+// runtimes, raising or recovering faults.
+// The cutoffs are checked against the unfiltered readings of every probe, so
+// that neither a filter nor the aggregation of several probes can hide one
+// that is running away.
+// The safety probe is checked even while the control probe is failing. The
+// temperature faults are not recovered then, as their cause cannot be ruled
+// out. Must be called with the mutex held
+func (t *Thermabox) checkSafety(r safetyReadings, now time.Time) error {
+	safetyErr := r.safetyErr
+	if t.safetyProbe != nil {
+		if safetyErr != nil {
+			if t.lastSafetyTimestamp.IsZero() {
+				t.lastSafetyTimestamp = now
+			}
+			if now.Sub(t.lastSafetyTimestamp) > 10*time.Second {
+				if err := t.raiseFault(interfaces.PROBE_LOST, fmt.Errorf("Failed to get safety temperature: %v", safetyErr)); err != nil {
+					return err
+				}
+			}
+		} else {
+			t.lastSafetyTimestamp = now
+		}
+	}
+	if r.err == nil && safetyErr == nil {
+		t.recoverFault(interfaces.PROBE_LOST)
+	}
+	checkSafetyProbe := t.safetyProbe != nil && safetyErr == nil
+
+	var over, under error
+	checkCutoffs := func(name string, min float64, max float64) {
+		if t.maxCutoffTemp != nil && max > *t.maxCutoffTemp && over == nil {
+			over = fmt.Errorf("%v > cutoff temperature: %v > %v", name, max, *t.maxCutoffTemp)
+		}
+		if t.minCutoffTemp != nil && min < *t.minCutoffTemp && under == nil {
+			under = fmt.Errorf("%v < minimum cutoff temperature: %v < %v", name, min, *t.minCutoffTemp)
+		}
+	}
+	if r.err == nil {
+		checkCutoffs("Temperature", r.rawMin, r.rawMax)
+	}
+	if checkSafetyProbe {
+		checkCutoffs("Safety temperature", r.safetyTemp, r.safetyTemp)
+	}
+
+	var rateErr error
+	for _, alarm := range t.rateAlarms {
+		var errs []error
+		if r.err == nil {
+			errs = append(errs, alarm.check("Temperature", &alarm.control, r.temp, now, t.heatingElement, t.coolingElement))
+		}
+		if checkSafetyProbe {
+			errs = append(errs, alarm.check("Safety temperature", &alarm.safety, r.safetyTemp, now, t.heatingElement, t.coolingElement))
+		}
+		for _, err := range errs {
+			if err != nil && rateErr == nil {
+				rateErr = err
+			}
+		}
+	}
+
+	var runtimeErr error
+	for _, e := range []struct {
+		name    string
+		element *Element
+	}{{"Heating", t.heatingElement}, {"Cooling", t.coolingElement}} {
+		limit := e.element.MaxRuntime
+		if runtime := e.element.Runtime(); limit > 0 && runtime > limit && runtimeErr == nil {
+			runtimeErr = fmt.Errorf("%v element on for %v > max_continuous_runtime %v", e.name, runtime, limit)
+		}
+	}
+
+	for _, check := range []struct {
+		class interfaces.AlertType
+		err   error
+		// Whether the lack of err shows that the cause of the fault is gone
+		conclusive bool
+	}{
+		{interfaces.OVER_TEMPERATURE, over, r.err == nil},
+		{interfaces.UNDER_TEMPERATURE, under, r.err == nil},
+		{interfaces.RATE_OF_CHANGE, rateErr, r.err == nil},
+		{interfaces.RUNTIME_EXCEEDED, runtimeErr, true},
+	} {
+		if check.err != nil {
+			if err := t.raiseFault(check.class, check.err); err != nil {
+				return err
+			}
+		} else if check.conclusive {
+			t.recoverFault(check.class)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,401 @@
+package thermabox
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gurupras/thermabox/interfaces"
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestParseYamlSafety(t *testing.T) {
+	require := require.New(t)
+
+	tbox := &Thermabox{}
+	tbox.SetRelays(&FakeRelay{}, &FakeRelay{})
+	err := yaml.Unmarshal([]byte(`
+heating_element:
+  relay:
+    pins: [22]
+cooling_element:
+  relay:
+    pins: [23]
+cutoff_temperature: 50
+max_cutoff_temperature: 40
+min_cutoff_temperature: 0
+safety_probe: w1:28-000005e2fdc3
+dead_time_sec: 120
+rate_alarms:
+  - direction: rising
+    rate: 0.5
+    while: cooling
+  - direction: falling
+    rate: 2
+    window_sec: 30
+`), tbox)
+	require.Nil(err)
+	require.Equal(40.0, *tbox.maxCutoffTemp)
+	require.Equal(0.0, *tbox.minCutoffTemp)
+	require.Equal("w1:28-000005e2fdc3", tbox.SafetyProbeSource())
+	require.Equal(2*time.Minute, tbox.deadTime)
+	require.Equal(2, len(tbox.rateAlarms))
+	require.Equal(&RateAlarmConfig{RISING, 0.5, WHILE_COOLING, time.Minute}, tbox.rateAlarms[0].RateAlarmConfig)
+	require.Equal(&RateAlarmConfig{FALLING, 2, WHILE_ANY, 30 * time.Second}, tbox.rateAlarms[1].RateAlarmConfig)
+
+	require.Nil(tbox.SafetyProbeCalibration())
+
+	tbox = &Thermabox{}
+	tbox.SetRelays(&FakeRelay{}, &FakeRelay{})
+	require.Nil(yaml.Unmarshal([]byte(`
+safety_probe:
+  source: w1:28-000005e2fdc3
+  calibration: {offset: -0.5}
+`), tbox))
+	require.Equal("w1:28-000005e2fdc3", tbox.SafetyProbeSource())
+	require.Equal(-0.5, tbox.SafetyProbeCalibration().Offset)
+
+	// A cutoff_temperature of 0 means no cutoff
+	tbox = &Thermabox{}
+	tbox.SetRelays(&FakeRelay{}, &FakeRelay{})
+	require.Nil(yaml.Unmarshal([]byte(`cutoff_temperature: 0`), tbox))
+	require.Nil(tbox.maxCutoffTemp)
+
+	for _, str := range []string{
+		`{min_cutoff_temperature: 10, max_cutoff_temperature: 5}`,
+		`{min_cutoff_temperature: cold}`,
+		`dead_time_sec: -1`,
+		`safety_probe: {calibration: {offset: 1}}`,
+		`safety_probe: {source: w1:28-000005e2fdc3, calibration: {gain: 0}}`,
+		`safety_probe: {source: w1:28-000005e2fdc3, filters: [{type: ema}]}`,
+		`rate_alarms: [{direction: up, rate: 1}]`,
+		`rate_alarms: [{direction: rising}]`,
+		`rate_alarms: [{direction: rising, rate: 1, while: idle}]`,
+		`rate_alarms: [{direction: rising, rate: 1, window_sec: 0}]`,
+	} {
+		tbox = &Thermabox{}
+		require.NotNil(yaml.Unmarshal([]byte(str), tbox), str)
+	}
+}
+
+func TestMinCutoff(t *testing.T) {
+	require := require.New(t)
+
+	probe := &flakyProbe{temp: 30}
+	tbox, _, c, alerts := newFaultTestThermabox(probe)
+	tbox.SetCutoffs(float64Ptr(2), nil)
+	cooler := tbox.coolingElement.relay.(*FakeRelay)
+
+	require.Nil(tbox.Step())
+	<-c
+	isOn, err := cooler.IsOn(1)
+	require.Nil(err)
+	require.True(isOn)
+
+	// A stuck cooler freezing the box
+	cooler.StickOn(1)
+	probe.temp = 1
+	err = tbox.Step()
+	require.NotNil(err)
+	require.Equal(interfaces.UNDER_TEMPERATURE, err.(*FaultError).Class)
+	require.Equal("Temperature < minimum cutoff temperature: 1 < 2", err.(*FaultError).Err.Error())
+	require.Equal(interfaces.UNDER_TEMPERATURE, (<-alerts).Type)
+}
+
+func TestSafetyProbe(t *testing.T) {
+	require := require.New(t)
+
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	safety := &flakyProbe{temp: 25}
+	tbox, heater, c, alerts := newFaultTestThermabox(&flakyProbe{temp: 10})
+	tbox.SetClock(clock)
+	tbox.SetSafetyProbe(safety)
+	tbox.SetFaultPolicy(interfaces.OVER_TEMPERATURE, AUTO_RESUME)
+	tbox.SetFaultPolicy(interfaces.PROBE_LOST, LATCH)
+
+	require.Nil(tbox.Step())
+	<-c
+	isOn, err := heater.IsOn(1)
+	require.Nil(err)
+	require.True(isOn)
+
+	// The control probe is fine, but the heater is overheating its corner
+	safety.temp = 35
+	require.Nil(tbox.Step())
+	state := <-c
+	require.Equal(interfaces.FAULT, state.State)
+	require.Equal("over_temperature: Safety temperature > cutoff temperature: 35 > 30", state.Fault)
+	<-alerts
+	isOn, err = heater.IsOn(1)
+	require.Nil(err)
+	require.False(isOn)
+
+	safety.temp = 25
+	require.Nil(tbox.Step())
+	require.Equal(interfaces.HEATING_UP, (<-c).State)
+	<-alerts
+
+	// A lost safety probe is a lost probe
+	safety.err = fmt.Errorf("unplugged")
+	require.Nil(tbox.Step())
+	<-c
+	clock.Advance(11 * time.Second)
+	require.Nil(tbox.Step())
+	require.Equal(interfaces.FAULT, (<-c).State)
+	require.Equal(interfaces.PROBE_LOST, tbox.Fault().Class)
+	require.Equal(interfaces.PROBE_LOST, (<-alerts).Type)
+}
+
+func TestSafetyProbeWithoutControlProbe(t *testing.T) {
+	require := require.New(t)
+
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	probe := &flakyProbe{err: fmt.Errorf("unplugged")}
+	safety := &flakyProbe{temp: 25}
+	tbox, _, _, alerts := newFaultTestThermabox(probe)
+	tbox.SetClock(clock)
+	tbox.SetSafetyProbe(safety)
+	tbox.SetFaultPolicy(interfaces.OVER_TEMPERATURE, AUTO_RESUME)
+	tbox.SetFaultPolicy(interfaces.PROBE_LOST, AUTO_RESUME)
+
+	require.Nil(tbox.Step())
+	require.Nil(tbox.Fault())
+
+	// Caught well before the control probe is considered lost
+	safety.temp = 35
+	clock.Advance(time.Second)
+	require.Nil(tbox.Step())
+	require.Equal(interfaces.OVER_TEMPERATURE, tbox.Fault().Class)
+	alert := <-alerts
+	require.Equal(interfaces.OVER_TEMPERATURE, alert.Type)
+	require.Equal("Safety temperature > cutoff temperature: 35 > 30", alert.Message)
+
+	// The control probe could still be over the cutoff
+	safety.temp = 25
+	clock.Advance(time.Second)
+	require.Nil(tbox.Step())
+	require.Equal(interfaces.OVER_TEMPERATURE, tbox.Fault().Class)
+
+	require.Nil(tbox.ResetFault())
+	<-alerts
+	clock.Advance(11 * time.Second)
+	require.Nil(tbox.Step())
+	require.Equal(interfaces.PROBE_LOST, tbox.Fault().Class)
+	<-alerts
+	// A healthy safety probe does not make up for the control probe
+	clock.Advance(time.Second)
+	require.Nil(tbox.Step())
+	require.Equal(interfaces.PROBE_LOST, tbox.Fault().Class)
+}
+
+func TestSafetyProbeRateAlarm(t *testing.T) {
+	require := require.New(t)
+
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	safety := &flakyProbe{temp: 20}
+	tbox, _, c, alerts := newFaultTestThermabox(&flakyProbe{temp: 20})
+	tbox.SetClock(clock)
+	tbox.SetSafetyProbe(safety)
+	tbox.rateAlarms = []*rateAlarm{{RateAlarmConfig: &RateAlarmConfig{RISING, 0.5, WHILE_ANY, time.Minute}}}
+
+	// The control probe is steady while the safety probe rises at 1°C/min
+	for i := 0; i < 3; i++ {
+		require.Nil(tbox.Step())
+		<-c
+		clock.Advance(30 * time.Second)
+		safety.temp += 0.5
+	}
+	require.Equal(interfaces.RATE_OF_CHANGE, tbox.Fault().Class)
+	alert := <-alerts
+	require.Equal(interfaces.RATE_OF_CHANGE, alert.Type)
+	require.Contains(alert.Message, "Safety temperature rising")
+}
+
+func TestCutoffEveryProbe(t *testing.T) {
+	require := require.New(t)
+
+	tbox, heater, c, alerts := newFaultTestThermabox(&flakyProbe{temp: 10})
+	tbox.minCutoffTemp = float64Ptr(5)
+	tbox.SetFaultPolicy(interfaces.OVER_TEMPERATURE, LATCH)
+	tbox.SetFaultPolicy(interfaces.UNDER_TEMPERATURE, LATCH)
+	tbox.probeAggregation = MEAN
+	probes := []*flakyProbe{{temp: 10}, {temp: 10}, {temp: 10}}
+	tbox.probe = nil
+	for i, p := range probes {
+		tbox.AddProbe(fmt.Sprintf("probe%v", i), p)
+	}
+
+	require.Nil(tbox.Step())
+	require.Equal(interfaces.HEATING_UP, (<-c).State)
+
+	// The mean of 10°C is well within the cutoffs, but one probe is not
+	probes[2].temp = 35
+	require.Nil(tbox.Step())
+	state := <-c
+	require.Equal(interfaces.FAULT, state.State)
+	require.Equal("over_temperature: Temperature > cutoff temperature: 35 > 30", state.Fault)
+	require.Equal(interfaces.OVER_TEMPERATURE, (<-alerts).Type)
+	isOn, err := heater.IsOn(1)
+	require.Nil(err)
+	require.False(isOn)
+
+	require.Nil(tbox.ResetFault())
+	<-alerts
+	probes[2].temp = 10
+	probes[0].temp = 0
+	require.Nil(tbox.Step())
+	require.Equal("under_temperature: Temperature < minimum cutoff temperature: 0 < 5", (<-c).Fault)
+	require.Equal(interfaces.UNDER_TEMPERATURE, (<-alerts).Type)
+}
+
+func TestRateAlarm(t *testing.T) {
+	require := require.New(t)
+
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	probe := &flakyProbe{temp: 30}
+	tbox, _, c, alerts := newFaultTestThermabox(probe)
+	tbox.maxCutoffTemp = nil
+	tbox.SetClock(clock)
+	tbox.rateAlarms = []*rateAlarm{{RateAlarmConfig: &RateAlarmConfig{RISING, 0.5, WHILE_COOLING, time.Minute}}}
+
+	// Cooling starts. Rising at 0.25°C/min is tolerated
+	for i := 0; i < 4; i++ {
+		require.Nil(tbox.Step())
+		require.Equal(interfaces.COOLING_DOWN, (<-c).State)
+		clock.Advance(30 * time.Second)
+		probe.temp += 0.125
+	}
+
+	// Rising at 1°C/min while cooling
+	for i := 0; i < 2; i++ {
+		probe.temp += 0.5
+		require.Nil(tbox.Step())
+		<-c
+		clock.Advance(30 * time.Second)
+	}
+	require.Equal(interfaces.RATE_OF_CHANGE, tbox.Fault().Class)
+	alert := <-alerts
+	require.Equal(interfaces.RATE_OF_CHANGE, alert.Type)
+	require.Contains(alert.Message, "while cooling")
+	require.False(tbox.coolingElement.IsOn())
+}
+
+func TestRateAlarmAutoResume(t *testing.T) {
+	require := require.New(t)
+
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	probe := &flakyProbe{temp: 30}
+	tbox, _, c, alerts := newFaultTestThermabox(probe)
+	tbox.maxCutoffTemp = nil
+	tbox.SetClock(clock)
+	tbox.rateAlarms = []*rateAlarm{{RateAlarmConfig: &RateAlarmConfig{RISING, 0.5, WHILE_COOLING, time.Minute}}}
+	// Turning the cooler off stops the alarm from applying, so the fault
+	// must latch rather than toggle the cooler on every other step
+	tbox.SetFaultPolicy(interfaces.RATE_OF_CHANGE, AUTO_RESUME)
+	require.Equal(LATCH, tbox.FaultPolicies()[interfaces.RATE_OF_CHANGE])
+	cooler := tbox.coolingElement.relay.(*FakeRelay)
+
+	// Rising at 1°C/min while cooling
+	for i := 0; i < 3; i++ {
+		require.Nil(tbox.Step())
+		<-c
+		clock.Advance(30 * time.Second)
+		probe.temp += 0.5
+	}
+	require.Equal(interfaces.RATE_OF_CHANGE, tbox.Fault().Class)
+	require.Equal(interfaces.RATE_OF_CHANGE, (<-alerts).Type)
+	switches := len(cooler.History())
+
+	for i := 0; i < 10; i++ {
+		require.Nil(tbox.Step())
+		require.Equal(interfaces.FAULT, (<-c).State)
+		clock.Advance(30 * time.Second)
+		probe.temp += 0.5
+	}
+	require.False(tbox.coolingElement.IsOn())
+	require.Equal(switches, len(cooler.History()))
+}
+
+func TestMaxContinuousRuntime(t *testing.T) {
+	require := require.New(t)
+
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	tbox, heater, c, alerts := newFaultTestThermabox(&flakyProbe{temp: 10})
+	tbox.SetClock(clock)
+	tbox.heatingElement.MaxRuntime = time.Hour
+	// Turning the heater off ends its runtime, so the fault must latch
+	tbox.SetFaultPolicy(interfaces.RUNTIME_EXCEEDED, AUTO_RESUME)
+	require.Equal(LATCH, tbox.FaultPolicies()[interfaces.RUNTIME_EXCEEDED])
+
+	require.Nil(tbox.Step())
+	<-c
+	clock.Advance(time.Hour)
+	require.Nil(tbox.Step())
+	require.Equal(interfaces.HEATING_UP, (<-c).State)
+
+	clock.Advance(time.Second)
+	require.Nil(tbox.Step())
+	state := <-c
+	require.Equal(interfaces.FAULT, state.State)
+	require.Equal("runtime_exceeded: Heating element on for 1h0m1s > max_continuous_runtime 1h0m0s", state.Fault)
+	require.Equal(interfaces.RUNTIME_EXCEEDED, (<-alerts).Type)
+	isOn, err := heater.IsOn(1)
+	require.Nil(err)
+	require.False(isOn)
+
+	clock.Advance(time.Second)
+	require.Nil(tbox.Step())
+	require.Equal(interfaces.FAULT, (<-c).State)
+}
+
+func TestThermaboxInterlock(t *testing.T) {
+	require := require.New(t)
+
+	probe := &flakyProbe{temp: 10}
+	tbox, heater, c, alerts := newFaultTestThermabox(probe)
+	cooler := tbox.coolingElement.relay.(*FakeRelay)
+
+	// The cooler is on even though it was never switched on
+	cooler.StickOn(1)
+	require.Nil(tbox.Step())
+	state := <-c
+	require.Equal(interfaces.FAULT, state.State)
+	require.Equal("relay_fault: heating element: Interlocked element is on", state.Fault)
+	require.Equal(interfaces.RELAY_FAULT, (<-alerts).Type)
+	isOn, err := heater.IsOn(1)
+	require.Nil(err)
+	require.False(isOn)
+}
+
+func TestThermaboxDeadTime(t *testing.T) {
+	require := require.New(t)
+
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	probe := &flakyProbe{temp: 10}
+	tbox, _, c, _ := newFaultTestThermabox(probe)
+	tbox.SetClock(clock)
+	tbox.SetDeadTime(time.Minute)
+
+	require.Nil(tbox.Step())
+	require.True((<-c).HeatingElement.On)
+
+	// Overshoot. The cooler waits for the dead time after the heater is off
+	probe.temp = 25
+	clock.Advance(time.Second)
+	require.Nil(tbox.Step())
+	require.False((<-c).HeatingElement.On)
+	clock.Advance(time.Second)
+	require.Nil(tbox.Step())
+	state := <-c
+	require.Equal(interfaces.COOLING_DOWN, state.State)
+	require.False(state.CoolingElement.On)
+	require.True(state.CoolingElement.Pending)
+
+	clock.Advance(58 * time.Second)
+	require.Nil(tbox.Step())
+	require.False((<-c).CoolingElement.On)
+	clock.Advance(time.Second)
+	require.Nil(tbox.Step())
+	require.True((<-c).CoolingElement.On)
+}
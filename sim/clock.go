@@ -0,0 +1,45 @@
+package sim
+
+import (
+	"sync"
+	"time"
+)
+
+type Clock interface {
+	Now() time.Time
+}
+
+type WallClock struct {
+}
+
+func (w WallClock) Now() time.Time {
+	return time.Now()
+}
+
+// VirtualClock only moves forward when told to.
+// Sleep advances the clock instead of blocking, which lets a control loop
+// driven by the simulator run hours of control in milliseconds
+type VirtualClock struct {
+	now   time.Time
+	mutex sync.Mutex
+}
+
+func NewVirtualClock(start time.Time) *VirtualClock {
+	return &VirtualClock{now: start}
+}
+
+func (v *VirtualClock) Now() time.Time {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	return v.now
+}
+
+func (v *VirtualClock) Advance(d time.Duration) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.now = v.now.Add(d)
+}
+
+func (v *VirtualClock) Sleep(d time.Duration) {
+	v.Advance(d)
+}
@@ -0,0 +1,145 @@
+package sim
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Plant is a first-order thermal model of the box.
+//
+//	C * dT/dt = P_heater - P_cooler - Leakage * (T - Ambient)
+//
+// where C is the thermal mass in J/°C and Leakage is the heat lost through
+// the walls in W/°C. The heater and cooler are driven through the relays
+// returned by HeatingRelay and CoolingRelay.
+type Plant struct {
+	Ambient     float64 `yaml:"ambient"`
+	HeaterWatts float64 `yaml:"heater_watts"`
+	CoolerWatts float64 `yaml:"cooler_watts"`
+	ThermalMass float64 `yaml:"thermal_mass"`
+	Leakage     float64 `yaml:"leakage"`
+
+	clock       Clock
+	temperature float64
+	heaterOn    bool
+	coolerOn    bool
+	lastUpdate  time.Time
+	mutex       sync.Mutex
+}
+
+func NewPlant(clock Clock, initialTemperature float64) *Plant {
+	p := &Plant{
+		Ambient:     22,
+		HeaterWatts: 100,
+		CoolerWatts: 60,
+		ThermalMass: 20000,
+		Leakage:     2,
+	}
+	p.SetClock(clock)
+	p.temperature = initialTemperature
+	return p
+}
+
+func (p *Plant) UnmarshalYAML(unmarshal func(i interface{}) error) error {
+	m := make(map[string]interface{})
+	if err := unmarshal(&m); err != nil {
+		return err
+	}
+	fields := map[string]*float64{
+		"ambient":      &p.Ambient,
+		"heater_watts": &p.HeaterWatts,
+		"cooler_watts": &p.CoolerWatts,
+		"thermal_mass": &p.ThermalMass,
+		"leakage":      &p.Leakage,
+	}
+	for key, field := range fields {
+		if val, ok := m[key]; ok {
+			f, err := strconv.ParseFloat(fmt.Sprintf("%v", val), 64)
+			if err != nil {
+				return fmt.Errorf("Failed while parsing %v: %v", key, err)
+			}
+			*field = f
+		}
+	}
+	if val, ok := m["initial_temperature"]; ok {
+		f, err := strconv.ParseFloat(fmt.Sprintf("%v", val), 64)
+		if err != nil {
+			return fmt.Errorf("Failed while parsing initial_temperature: %v", err)
+		}
+		p.temperature = f
+	} else {
+		p.temperature = p.Ambient
+	}
+	return nil
+}
+
+func (p *Plant) SetClock(clock Clock) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.clock = clock
+	p.lastUpdate = clock.Now()
+}
+
+// advance integrates the model up to the current time.
+// Must be called with the mutex held
+func (p *Plant) advance() {
+	now := p.clock.Now()
+	dt := now.Sub(p.lastUpdate).Seconds()
+	p.lastUpdate = now
+	if dt <= 0 || p.ThermalMass <= 0 {
+		return
+	}
+	power := 0.0
+	if p.heaterOn {
+		power += p.HeaterWatts
+	}
+	if p.coolerOn {
+		power -= p.CoolerWatts
+	}
+	if p.Leakage <= 0 {
+		p.temperature += power * dt / p.ThermalMass
+		return
+	}
+	// Inputs are constant between updates so use the exact solution
+	equilibrium := p.Ambient + power/p.Leakage
+	p.temperature = equilibrium + (p.temperature-equilibrium)*math.Exp(-p.Leakage*dt/p.ThermalMass)
+}
+
+func (p *Plant) GetTemperature() (float64, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.advance()
+	return p.temperature, nil
+}
+
+func (p *Plant) SetTemperature(temperature float64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.advance()
+	p.temperature = temperature
+}
+
+func (p *Plant) setHeater(on bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.advance()
+	p.heaterOn = on
+}
+
+func (p *Plant) setCooler(on bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.advance()
+	p.coolerOn = on
+}
+
+func (p *Plant) HeatingRelay() *Relay {
+	return newRelay(p.setHeater)
+}
+
+func (p *Plant) CoolingRelay() *Relay {
+	return newRelay(p.setCooler)
+}
@@ -0,0 +1,87 @@
+package sim
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Relay is a single-switch relay wired to a heater or cooler of a Plant.
+// Switch 1 is the only valid switch
+type Relay struct {
+	activeHigh bool
+	on         bool
+	set        func(on bool)
+	mutex      sync.Mutex
+}
+
+func newRelay(set func(on bool)) *Relay {
+	return &Relay{set: set}
+}
+
+func (r *Relay) ActiveHigh() bool {
+	return r.activeHigh
+}
+
+func (r *Relay) GetSwitchMap() map[int]uint8 {
+	return map[int]uint8{1: 0}
+}
+
+func (r *Relay) check(swtch int) error {
+	if swtch != 1 {
+		return fmt.Errorf("Switch %v not initialized in relay", swtch)
+	}
+	return nil
+}
+
+func (r *Relay) setOn(swtch int, on bool) error {
+	if err := r.check(swtch); err != nil {
+		return err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.on = on
+	r.set(on)
+	return nil
+}
+
+func (r *Relay) On(swtch int) error {
+	return r.setOn(swtch, true)
+}
+
+func (r *Relay) Off(swtch int) error {
+	return r.setOn(swtch, false)
+}
+
+func (r *Relay) Toggle(swtch int) error {
+	isOn, err := r.IsOn(swtch)
+	if err != nil {
+		return err
+	}
+	return r.setOn(swtch, !isOn)
+}
+
+func (r *Relay) IsOn(swtch int) (bool, error) {
+	if err := r.check(swtch); err != nil {
+		return false, err
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.on, nil
+}
+
+func (r *Relay) Close() error {
+	return nil
+}
+
+// UnmarshalYAML accepts any relay configuration so that a config written for
+// real hardware can be used as-is with the simulator
+func (r *Relay) UnmarshalYAML(unmarshal func(i interface{}) error) error {
+	m := make(map[string]interface{})
+	if err := unmarshal(&m); err != nil {
+		return err
+	}
+	if activeHigh, ok := m["active_high"].(bool); ok {
+		r.activeHigh = activeHigh
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package sim
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gurupras/thermabox"
+	"github.com/gurupras/thermabox/interfaces"
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var (
+	_ interfaces.TemperatureSensorInterface = &Plant{}
+	_ thermabox.RelayInterface              = &Relay{}
+	_ thermabox.Clock                       = &VirtualClock{}
+)
+
+func TestUnmarshalYamlPlant(t *testing.T) {
+	require := require.New(t)
+	str := `
+ambient: 18
+heater_watts: 200
+cooler_watts: 80
+thermal_mass: 10000
+leakage: 1.5
+initial_temperature: 10
+`
+	clock := NewVirtualClock(time.Now())
+	plant := NewPlant(clock, 0)
+	err := yaml.Unmarshal([]byte(str), plant)
+	require.Nil(err)
+	require.Equal(18.0, plant.Ambient)
+	require.Equal(200.0, plant.HeaterWatts)
+	require.Equal(80.0, plant.CoolerWatts)
+	require.Equal(10000.0, plant.ThermalMass)
+	require.Equal(1.5, plant.Leakage)
+	temp, err := plant.GetTemperature()
+	require.Nil(err)
+	require.Equal(10.0, temp)
+}
+
+func TestPlantRelays(t *testing.T) {
+	require := require.New(t)
+
+	clock := NewVirtualClock(time.Now())
+	plant := NewPlant(clock, 22)
+	heater := plant.HeatingRelay()
+	cooler := plant.CoolingRelay()
+
+	// Nothing on => stays at ambient
+	clock.Advance(time.Hour)
+	temp, _ := plant.GetTemperature()
+	require.InDelta(22.0, temp, 1e-9)
+
+	require.Nil(heater.On(1))
+	isOn, err := heater.IsOn(1)
+	require.Nil(err)
+	require.True(isOn)
+	clock.Advance(10 * time.Minute)
+	hot, _ := plant.GetTemperature()
+	require.True(hot > 22, "temp=%v", hot)
+
+	// Approaches ambient + P/leakage
+	clock.Advance(1000 * time.Hour)
+	temp, _ = plant.GetTemperature()
+	require.InDelta(22+100/2.0, temp, 1e-6)
+
+	require.Nil(heater.Off(1))
+	require.Nil(cooler.On(1))
+	clock.Advance(1000 * time.Hour)
+	temp, _ = plant.GetTemperature()
+	require.InDelta(22-60/2.0, temp, 1e-6)
+
+	require.NotNil(cooler.On(2))
+}
+
+func TestSimulatedThermabox(t *testing.T) {
+	require := require.New(t)
+
+	clock := NewVirtualClock(time.Now())
+	plant := NewPlant(clock, 30)
+
+	tbox := &thermabox.Thermabox{}
+	tbox.SetRelays(plant.HeatingRelay(), plant.CoolingRelay())
+	tbox.SetProbe(plant)
+	tbox.SetClock(clock)
+	tbox.SetLimits(18, 0.5)
+
+	// 6 hours of control with a 500ms sample interval
+	settled := false
+	for i := 0; i < 6*60*60*2; i++ {
+		require.Nil(tbox.Step())
+		clock.Sleep(500 * time.Millisecond)
+		temp, _ := plant.GetTemperature()
+		if !settled && temp <= 18.5 {
+			settled = true
+		}
+		if settled {
+			require.InDelta(18.0, temp, 0.6, "temp=%v state=%v", temp, tbox.GetState())
+		}
+	}
+	require.True(settled)
+}
+
+func TestSimulatedThermaboxPID(t *testing.T) {
+	require := require.New(t)
+
+	clock := NewVirtualClock(time.Now())
+	plant := NewPlant(clock, 30)
+
+	tbox := &thermabox.Thermabox{}
+	tbox.SetRelays(plant.HeatingRelay(), plant.CoolingRelay())
+	tbox.SetProbe(plant)
+	tbox.SetClock(clock)
+	tbox.SetLimits(18, 0.5)
+	tbox.SetController(thermabox.NewPIDController(0.5, 0.0005, 0, 60*time.Second))
+
+	// 12 hours of control. After the first 3 hours the PID controller
+	// should be holding the temperature much tighter than the threshold
+	for i := 0; i < 12*60*60*2; i++ {
+		require.Nil(tbox.Step())
+		clock.Sleep(500 * time.Millisecond)
+		if i > 3*60*60*2 {
+			temp, _ := plant.GetTemperature()
+			require.InDelta(18.0, temp, 0.1)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+package thermabox
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type RestorePolicy string
+
+const (
+	// PREFER_CONFIG keeps the limits and disabled flag from the config.
+	// Everything else is still restored from the state file
+	PREFER_CONFIG RestorePolicy = "prefer_config"
+	// PREFER_PERSISTED restores the limits and disabled flag from the state
+	// file, falling back to the config if there is no state file
+	PREFER_PERSISTED RestorePolicy = "prefer_persisted"
+)
+
+// How often the state is written while only the profile's elapsed time
+// is changing
+const stateSaveInterval = time.Minute
+
+// persistedState is the runtime state written to the state file
+type persistedState struct {
+	Temperature    float64          `json:"temperature"`
+	Threshold      float64          `json:"threshold"`
+	Disabled       bool             `json:"disabled"`
+	Profile        *profileProgress `json:"profile,omitempty"`
+	HeatingElement persistedElement `json:"heating_element"`
+	CoolingElement persistedElement `json:"cooling_element"`
+	SavedAt        time.Time        `json:"saved_at"`
+}
+
+type persistedElement struct {
+	On      bool      `json:"on"`
+	LastOn  time.Time `json:"last_on"`
+	LastOff time.Time `json:"last_off"`
+}
+
+func (e *Element) persisted() persistedElement {
+	return persistedElement{e.on, e.lastOn, e.lastOff}
+}
+
+// restore restores the last switch times. Elements always start off, so an
+// element that was on when the state was saved is treated as having been
+// switched off now in order to honor its minimum off time
+func (e *Element) restore(p persistedElement, now time.Time) {
+	e.lastOn = p.LastOn
+	e.lastOff = p.LastOff
+	if p.On {
+		e.lastOff = now
+	}
+}
+
+func parseRestorePolicy(val interface{}) (RestorePolicy, error) {
+	policy := RestorePolicy(fmt.Sprintf("%v", val))
+	switch policy {
+	case PREFER_CONFIG, PREFER_PERSISTED:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("Unknown restore_policy: %v", val)
+	}
+}
+
+// snapshot returns the state to be persisted.
+// Must be called with the mutex held
+func (t *Thermabox) snapshot() *persistedState {
+	state := &persistedState{
+		Temperature: t.temperature,
+		Threshold:   t.threshold,
+		Disabled:    t.disabled,
+	}
+	if t.profile != nil {
+		progress := t.profile.progress
+		state.Profile = &progress
+	}
+	if t.heatingElement != nil {
+		state.HeatingElement = t.heatingElement.persisted()
+	}
+	if t.coolingElement != nil {
+		state.CoolingElement = t.coolingElement.persisted()
+	}
+	return state
+}
+
+// saveState writes the state file if anything has changed since it was last
+// written, or if the profile is running and stateSaveInterval has elapsed.
+// Must be called with the mutex held
+func (t *Thermabox) saveState() {
+	if t.stateFile == "" {
+		return
+	}
+	now := clockOrDefault(t.clock).Now()
+	state := t.snapshot()
+
+	// Compare without the fields that change on every iteration of a
+	// running profile. These are covered by stateSaveInterval
+	profileRunning := state.Profile != nil && state.Profile.Running && !state.Profile.Paused
+	compare := *state
+	if state.Profile != nil {
+		progress := *state.Profile
+		progress.StepElapsed = 0
+		progress.SavedAt = time.Time{}
+		compare.Profile = &progress
+		if profileRunning {
+			// Ramps move the setpoint continuously
+			compare.Temperature = 0
+		}
+	}
+	b, err := json.Marshal(&compare)
+	if err != nil {
+		log.Errorf("Failed to marshal state: %v", err)
+		return
+	}
+	if bytes.Equal(b, t.lastSavedState) && (!profileRunning || now.Sub(t.lastStateSave) < stateSaveInterval) {
+		return
+	}
+
+	state.SavedAt = now
+	if state.Profile != nil {
+		state.Profile.SavedAt = now
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		log.Errorf("Failed to marshal state: %v", err)
+		return
+	}
+	if err := writeFileAtomic(t.stateFile, data, 0644); err != nil {
+		log.Errorf("Failed to save state to '%v': %v", t.stateFile, err)
+		return
+	}
+	t.lastSavedState = b
+	t.lastStateSave = now
+}
+
+// RestoreState restores the state saved in the state file, if any, according
+// to the restore policy. It is called by Run if it has not been called before.
+// Call it explicitly before Run to be able to override the restored limits
+func (t *Thermabox) RestoreState() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.restored = true
+	now := clockOrDefault(t.clock).Now()
+
+	var state *persistedState
+	if t.stateFile != "" {
+		data, err := ioutil.ReadFile(t.stateFile)
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("Failed to read state file '%v': %v", t.stateFile, err)
+		}
+		if err == nil {
+			state = &persistedState{}
+			if err := json.Unmarshal(data, state); err != nil {
+				return fmt.Errorf("Failed to parse state file '%v': %v", t.stateFile, err)
+			}
+		}
+	}
+
+	if state == nil {
+		return nil
+	}
+
+	log.Infof("Restoring state saved at %v", state.SavedAt)
+	if t.restorePolicy == PREFER_PERSISTED {
+		t.temperature = state.Temperature
+		t.threshold = state.Threshold
+		t.disabled = state.Disabled
+	}
+	if t.heatingElement != nil {
+		t.heatingElement.restore(state.HeatingElement, now)
+	}
+	if t.coolingElement != nil {
+		t.coolingElement.restore(state.CoolingElement, now)
+	}
+	if t.profile != nil && state.Profile != nil {
+		if err := t.profile.restore(*state.Profile, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package thermabox
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestParseYamlState(t *testing.T) {
+	require := require.New(t)
+
+	tbox := &Thermabox{}
+	tbox.SetRelays(&FakeRelay{}, &FakeRelay{})
+	err := yaml.Unmarshal([]byte(`
+heating_element:
+  relay:
+    pins: [22]
+cooling_element:
+  relay:
+    pins: [23]
+disabled: true
+state_file: /var/lib/thermabox/state.json
+restore_policy: prefer_config
+`), tbox)
+	require.Nil(err)
+	require.True(tbox.disabled)
+	require.Equal("/var/lib/thermabox/state.json", tbox.stateFile)
+	require.Equal(PREFER_CONFIG, tbox.restorePolicy)
+
+	// Defaults
+	tbox = &Thermabox{}
+	tbox.SetRelays(&FakeRelay{}, &FakeRelay{})
+	err = yaml.Unmarshal([]byte(`
+heating_element:
+  relay:
+    pins: [22]
+cooling_element:
+  relay:
+    pins: [23]
+`), tbox)
+	require.Nil(err)
+	require.False(tbox.disabled)
+	require.Equal("", tbox.stateFile)
+	require.Equal(PREFER_PERSISTED, tbox.restorePolicy)
+
+	tbox = &Thermabox{}
+	err = yaml.Unmarshal([]byte(`restore_policy: sometimes`), tbox)
+	require.NotNil(err)
+}
+
+func newStateThermabox(stateFile string, policy RestorePolicy, clock Clock) *Thermabox {
+	tbox := &Thermabox{temperature: 20, threshold: 0.5, stateFile: stateFile, restorePolicy: policy}
+	tbox.SetRelays(NewFakeRelay(false, []int{1}), NewFakeRelay(false, []int{1}))
+	tbox.heatingElement.MinOff = 5 * time.Minute
+	tbox.coolingElement.MinOff = 5 * time.Minute
+	tbox.SetProbe(&sequenceProbe{temps: []float64{10}})
+	tbox.SetClock(clock)
+	return tbox
+}
+
+func TestStateRestore(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "thermabox-state")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "state.json")
+
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	// Nothing to restore
+	tbox := newStateThermabox(stateFile, PREFER_PERSISTED, clock)
+	require.Nil(tbox.RestoreState())
+	require.Equal(20.0, tbox.temperature)
+
+	tbox.SetLimits(25, 1)
+	require.Nil(tbox.Step())
+	require.True(tbox.heatingElement.IsOn())
+
+	state := persistedState{}
+	data, err := ioutil.ReadFile(stateFile)
+	require.Nil(err)
+	require.Nil(json.Unmarshal(data, &state))
+	require.Equal(25.0, state.Temperature)
+	require.Equal(1.0, state.Threshold)
+	require.True(state.HeatingElement.On)
+	require.Equal(clock.Now(), state.HeatingElement.LastOn)
+
+	// Crash while heating and come back a minute later
+	clock.Advance(time.Minute)
+	restarted := newStateThermabox(stateFile, PREFER_PERSISTED, clock)
+	require.Nil(restarted.RestoreState())
+	require.Equal(25.0, restarted.temperature)
+	require.Equal(1.0, restarted.threshold)
+	require.False(restarted.disabled)
+	// The heater may have been on until the crash
+	require.False(restarted.heatingElement.IsOn())
+	require.Equal(5*time.Minute, restarted.heatingElement.Lockout())
+	require.Equal(time.Duration(0), restarted.coolingElement.Lockout())
+
+	// Limits from the config win with prefer_config
+	restarted = newStateThermabox(stateFile, PREFER_CONFIG, clock)
+	require.Nil(restarted.RestoreState())
+	require.Equal(20.0, restarted.temperature)
+	require.Equal(0.5, restarted.threshold)
+	require.Equal(5*time.Minute, restarted.heatingElement.Lockout())
+
+	// Disabled is persisted
+	tbox.DisableThermabox()
+	restarted = newStateThermabox(stateFile, PREFER_PERSISTED, clock)
+	require.Nil(restarted.RestoreState())
+	require.True(restarted.disabled)
+
+	// Corrupt state is an error
+	require.Nil(ioutil.WriteFile(stateFile, []byte("{"), 0644))
+	restarted = newStateThermabox(stateFile, PREFER_PERSISTED, clock)
+	require.NotNil(restarted.RestoreState())
+}
+
+func TestStateSaveOnlyOnChange(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "thermabox-state")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "state.json")
+
+	clock := NewFakeClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	tbox := newStateThermabox(stateFile, PREFER_PERSISTED, clock)
+	require.Nil(tbox.Step())
+	saved := tbox.lastStateSave
+	require.Equal(clock.Now(), saved)
+
+	clock.Advance(time.Hour)
+	require.Nil(tbox.Step())
+	require.Equal(saved, tbox.lastStateSave)
+
+	tbox.SetLimits(21, 0.5)
+	require.Equal(clock.Now(), tbox.lastStateSave)
+}
+
+func TestStateRestoreProfile(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "thermabox-state")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+	stateFile := filepath.Join(dir, "state.json")
+
+	tbox, clock := newProfileThermabox(require)
+	tbox.stateFile = stateFile
+	require.Nil(tbox.StartProfile())
+	clock.Advance(100 * time.Hour)
+	require.Nil(tbox.Step())
+
+	// A running profile is saved periodically even if nothing else changed
+	clock.Advance(30 * time.Second)
+	require.Nil(tbox.Step())
+	require.Equal(clock.Now().Add(-30*time.Second), tbox.lastStateSave)
+	clock.Advance(30 * time.Second)
+	require.Nil(tbox.Step())
+	require.Equal(clock.Now(), tbox.lastStateSave)
+
+	// Restart 2 hours later
+	restarted, _ := newProfileThermabox(require)
+	restarted.stateFile = stateFile
+	restarted.SetClock(clock)
+	clock.Advance(2 * time.Hour)
+	require.Nil(restarted.RestoreState())
+	status, err := restarted.GetProfileStatus()
+	require.Nil(err)
+	require.True(status.Running)
+	require.Equal(1, status.Step)
+	require.InDelta(6*60*60+60, status.StepElapsed, 1e-6)
+}
@@ -7,93 +7,58 @@ import (
 	"sync"
 	"time"
 
+	"github.com/gurupras/thermabox/history"
 	"github.com/gurupras/thermabox/interfaces"
+	"github.com/gurupras/thermabox/mqtt"
 	"github.com/gurupras/thermabox/webserver"
 	log "github.com/sirupsen/logrus"
 	yaml "gopkg.in/yaml.v2"
 )
 
-type ElementToggleDelayError struct {
-	msg string
-}
-
-func (e ElementToggleDelayError) Error() string {
-	return e.msg
-}
-
-type Element struct {
-	relay       RelayInterface `yaml:"relay"`
-	ToggleDelay time.Duration  `yaml:"toggle_delay_sec"`
-	lastOn      time.Time
-}
-
-func (e *Element) On() error {
-	/*	// FIXME: This doesn't seem to be working
-		if e.ToggleDelay > 0 {
-			now := time.Now()
-			sinceLastOn := now.Sub(e.lastOn)
-			sleepDuration := e.ToggleDelay.Nanoseconds() - sinceLastOn.Nanoseconds()
-			if sleepDuration > 0 {
-				return ElementToggleDelayError{"Minimum delay not elapsed"}
-			}
-		}
-	*/
-	return e.relay.On(1)
-}
-
-func (e *Element) Off() error {
-	e.lastOn = time.Now()
-	return e.relay.Off(1)
-}
-
-func (e *Element) Toggle() error {
-	if isOn, err := e.relay.IsOn(1); err != nil {
-		if isOn {
-			return e.Off()
-		} else {
-			return e.On()
-		}
-	} else {
-		return err
-	}
-}
-
-func (e *Element) UnmarshalYAML(unmarshal func(i interface{}) error) error {
-	m := make(map[string]interface{})
-	if err := unmarshal(&m); err != nil {
-		return err
-	}
-	log.Debugf("element.UnmarshalYAML: m=%v", m)
-	relayUnmarshaler := func(i interface{}) error {
-		b, _ := yaml.Marshal(m["relay"])
-		return yaml.Unmarshal(b, i)
-	}
-	if e.relay == nil {
-		e.relay = &Relay{}
-	}
-	if err := e.relay.UnmarshalYAML(relayUnmarshaler); err != nil {
-		return err
-	}
-	if _, ok := m["toggle_delay_sec"]; !ok {
-		m["toggle_delay_sec"] = 0
-	}
-	val := m["toggle_delay_sec"].(int)
-	e.ToggleDelay = time.Duration(val) * time.Second
-	return nil
-}
-
 type Thermabox struct {
-	heatingElement       *Element `yaml:"heating_element"`
-	coolingElement       *Element `yaml:"cooling_element"`
-	temperature          float64  `yaml:"temperature"`
-	threshold            float64  `yaml:"threshold"`
-	cutoffAtThreshold    bool     `yaml:"cutoff_at_threshold"`
-	cutoffTemp           float64  `yaml:"cutoff_temperature"`
+	heatingElement       *Element      `yaml:"heating_element"`
+	coolingElement       *Element      `yaml:"cooling_element"`
+	temperature          float64       `yaml:"temperature"`
+	threshold            float64       `yaml:"threshold"`
+	cutoffAtThreshold    bool          `yaml:"cutoff_at_threshold"`
+	minCutoffTemp        *float64      `yaml:"min_cutoff_temperature"`
+	maxCutoffTemp        *float64      `yaml:"max_cutoff_temperature"`
+	sampleInterval       time.Duration `yaml:"sample_interval_sec"`
+	deadTime             time.Duration `yaml:"dead_time_sec"`
+	controlMode          ControlMode   `yaml:"control_mode"`
+	controller           Controller
+	profile              *Profile `yaml:"profile"`
 	probe                interfaces.TemperatureSensorInterface
+	safetyProbe          interfaces.TemperatureSensorInterface
+	safetyProbeSource    string
+	safetyCalibration    *Calibration
+	rateAlarms           []*rateAlarm
+	probeConfigs         []*ProbeConfig   `yaml:"probes"`
+	probeAggregation     ProbeAggregation `yaml:"probe_aggregation"`
+	filterConfigs        []*FilterConfig  `yaml:"filters"`
+	calibration          *Calibration     `yaml:"calibration"`
 	state                interfaces.State
-	listeners            []chan *interfaces.ThermaboxState
+	broker               Broker
+	alertBroker          AlertBroker
+	faultPolicies        map[interfaces.AlertType]FaultPolicy
+	fault                *FaultError
+	history              *history.Recorder `yaml:"history"`
+	mqttClient           *mqtt.Client      `yaml:"mqtt"`
+	stopped              bool
 	*webserver.Webserver `yaml:"webserver"`
-	disabled             bool `yaml:"disabled"`
+	disabled             bool          `yaml:"disabled"`
+	stateFile            string        `yaml:"state_file"`
+	restorePolicy        RestorePolicy `yaml:"restore_policy"`
+	restored             bool
+	lastSavedState       []byte
+	lastStateSave        time.Time
+	wantHeat             bool
+	wantCool             bool
+	lastState            interfaces.State
+	lastSample           time.Time
+	lastTempTimestamp    time.Time
+	lastSafetyTimestamp  time.Time
+	clock                Clock
 	mutex                sync.Mutex
 }
 
@@ -136,12 +101,26 @@ func (t *Thermabox) UnmarshalYAML(unmarshal func(i interface{}) error) error {
 	if err != nil {
 		return fmt.Errorf("Failed while parsing threshold: %v", err)
 	}
-	if _, ok := m["cutoff_temperature"]; !ok {
-		m["cutoff_temperature"] = 0.0
+	// max_cutoff_temperature takes precedence over the cutoff_temperature
+	// alias, where 0 means no cutoff
+	maxCutoffTemp, err := parseOptionalFloat(m, "max_cutoff_temperature")
+	if err != nil {
+		return err
 	}
-	cutoffTemp, err := strconv.ParseFloat(fmt.Sprintf("%v", m["cutoff_temperature"]), 64)
+	if maxCutoffTemp == nil {
+		if maxCutoffTemp, err = parseOptionalFloat(m, "cutoff_temperature"); err != nil {
+			return err
+		}
+		if maxCutoffTemp != nil && *maxCutoffTemp == 0 {
+			maxCutoffTemp = nil
+		}
+	}
+	minCutoffTemp, err := parseOptionalFloat(m, "min_cutoff_temperature")
 	if err != nil {
-		return fmt.Errorf("Failed while parsing cutoff_temperature: %v", err)
+		return err
+	}
+	if minCutoffTemp != nil && maxCutoffTemp != nil && *minCutoffTemp >= *maxCutoffTemp {
+		return fmt.Errorf("min_cutoff_temperature must be < max_cutoff_temperature: %v >= %v", *minCutoffTemp, *maxCutoffTemp)
 	}
 
 	if _, ok := m["cutoff_at_threshold"]; !ok {
@@ -152,15 +131,117 @@ func (t *Thermabox) UnmarshalYAML(unmarshal func(i interface{}) error) error {
 		return fmt.Errorf("Failed while parsing cutoff_at_threshold: %t", m["cutoff_at_threshold"])
 	}
 
+	sampleInterval, err := parseFloat(m, "sample_interval_sec", 0.5)
+	if err != nil {
+		return err
+	}
+	if sampleInterval <= 0 {
+		return fmt.Errorf("sample_interval_sec must be > 0: %v", sampleInterval)
+	}
+	deadTime, err := parseFloat(m, "dead_time_sec", 0)
+	if err != nil {
+		return err
+	}
+	if deadTime < 0 {
+		return fmt.Errorf("dead_time_sec must be >= 0: %v", deadTime)
+	}
+
+	if _, ok := m["control_mode"]; !ok {
+		m["control_mode"] = string(BANG_BANG)
+	}
+	controlMode := ControlMode(fmt.Sprintf("%v", m["control_mode"]))
+	controller, err := newController(controlMode, m, cutoffAtThreshold)
+	if err != nil {
+		return err
+	}
+
+	disabled := false
+	if val, ok := m["disabled"]; ok {
+		if disabled, ok = val.(bool); !ok {
+			return fmt.Errorf("Failed while parsing disabled: %v", val)
+		}
+	}
+
+	stateFile := ""
+	if val, ok := m["state_file"]; ok {
+		stateFile = fmt.Sprintf("%v", val)
+	}
+	restorePolicy := PREFER_PERSISTED
+	if val, ok := m["restore_policy"]; ok {
+		if restorePolicy, err = parseRestorePolicy(val); err != nil {
+			return err
+		}
+	}
+
+	var probeConfigs []*ProbeConfig
+	if data, ok := m["probes"]; ok {
+		if probeConfigs, err = parseProbeConfigs(data); err != nil {
+			return err
+		}
+	}
+	var filterConfigs []*FilterConfig
+	if data, ok := m["filters"]; ok {
+		if filterConfigs, err = parseFilterConfigs(data); err != nil {
+			return err
+		}
+	}
+	var calibration *Calibration
+	if data, ok := m["calibration"]; ok {
+		if calibration, err = parseCalibration(data); err != nil {
+			return err
+		}
+	}
+	probeAggregation := PRIMARY
+	if val, ok := m["probe_aggregation"]; ok {
+		if probeAggregation, err = parseProbeAggregation(val); err != nil {
+			return err
+		}
+	}
+	safetyProbeSource := ""
+	var safetyProbeCalibration *Calibration
+	if val, ok := m["safety_probe"]; ok {
+		if safetyProbeSource, safetyProbeCalibration, err = parseSafetyProbe(val); err != nil {
+			return err
+		}
+	}
+	var rateAlarms []*rateAlarm
+	if data, ok := m["rate_alarms"]; ok {
+		configs, err := parseRateAlarmConfigs(data)
+		if err != nil {
+			return err
+		}
+		for _, c := range configs {
+			rateAlarms = append(rateAlarms, &rateAlarm{RateAlarmConfig: c})
+		}
+	}
+	var faultPolicies map[interfaces.AlertType]FaultPolicy
+	if data, ok := m["fault_policy"]; ok {
+		if faultPolicies, err = parseFaultPolicies(data); err != nil {
+			return err
+		}
+	}
+
 	if t.heatingElement == nil {
 		t.heatingElement = &Element{}
 	}
-	t.heatingElement.UnmarshalYAML(heatingElementUnmarshaler)
+	if err := t.heatingElement.UnmarshalYAML(heatingElementUnmarshaler); err != nil {
+		return fmt.Errorf("Failed while parsing heating_element: %v", err)
+	}
 
 	if t.coolingElement == nil {
 		t.coolingElement = &Element{}
 	}
-	t.coolingElement.UnmarshalYAML(coolingElementUnmarshaler)
+	if err := t.coolingElement.UnmarshalYAML(coolingElementUnmarshaler); err != nil {
+		return fmt.Errorf("Failed while parsing cooling_element: %v", err)
+	}
+
+	if data, ok := m["profile"]; ok {
+		profile, err := parseProfile(data)
+		if err != nil {
+			return err
+		}
+		t.profile = profile
+	}
 
 	// Parse webserver
 	if _, ok := m["webserver"]; ok {
@@ -171,16 +252,97 @@ func (t *Thermabox) UnmarshalYAML(unmarshal func(i interface{}) error) error {
 		}
 		t.Webserver = ws
 	}
+	if _, ok := m["history"]; ok {
+		recorder := &history.Recorder{}
+		b, _ := yaml.Marshal(m["history"])
+		if err := yaml.Unmarshal(b, recorder); err != nil {
+			return fmt.Errorf("Failed while parsing history: %v", err)
+		}
+		t.history = recorder
+	}
+	if _, ok := m["mqtt"]; ok {
+		client := &mqtt.Client{}
+		b, _ := yaml.Marshal(m["mqtt"])
+		if err := yaml.Unmarshal(b, client); err != nil {
+			return fmt.Errorf("Failed while parsing mqtt: %v", err)
+		}
+		t.mqttClient = client
+	}
 	t.temperature = temperature
 	t.threshold = threshold
 	t.cutoffAtThreshold = cutoffAtThreshold
-	t.cutoffTemp = cutoffTemp
-	t.listeners = make([]chan *interfaces.ThermaboxState, 0)
+	t.minCutoffTemp = minCutoffTemp
+	t.maxCutoffTemp = maxCutoffTemp
+	t.safetyProbeSource = safetyProbeSource
+	t.safetyCalibration = safetyProbeCalibration
+	t.rateAlarms = rateAlarms
+	t.sampleInterval = seconds(sampleInterval)
+	t.deadTime = seconds(deadTime)
+	t.interlockElements()
+	t.controlMode = controlMode
+	t.controller = controller
+	t.disabled = disabled
+	t.stateFile = stateFile
+	t.restorePolicy = restorePolicy
+	t.probeConfigs = probeConfigs
+	t.probeAggregation = probeAggregation
+	t.filterConfigs = filterConfigs
+	t.calibration = calibration
+	t.faultPolicies = faultPolicies
 	return nil
 }
 
+// registeredChannelBuffer is the number of states buffered for a channel
+// registered with RegisterChannel before the oldest are dropped
+const registeredChannelBuffer = 16
+
+// RegisterChannel sends every published state to c. States that do not fit
+// in c are dropped rather than blocking the thermabox, or the goroutine
+// forwarding them, if c is not drained. Subscribe should be preferred, since
+// a registered channel can not be unregistered
 func (t *Thermabox) RegisterChannel(c chan *interfaces.ThermaboxState) {
-	t.listeners = append(t.listeners, c)
+	sub := t.broker.Subscribe(registeredChannelBuffer, interfaces.DROP_OLDEST)
+	go func() {
+		for state := range sub.C() {
+			select {
+			case c <- state:
+			default:
+				log.Debugf("Registered channel is full, dropped state")
+			}
+		}
+	}()
+}
+
+// Subscribe returns a subscription to the published states
+func (t *Thermabox) Subscribe(buffer int, policy interfaces.BufferPolicy) interfaces.Subscription {
+	return t.broker.Subscribe(buffer, policy)
+}
+
+// SubscriberStats returns the counters of the published states
+func (t *Thermabox) SubscriberStats() BrokerStats {
+	return t.broker.Stats()
+}
+
+// RegisterAlertChannel sends every alert to c. Alerts that do not fit in c
+// are dropped rather than blocking the thermabox, or the goroutine forwarding
+// them, if c is not drained. SubscribeAlerts should be preferred, since a
+// registered channel can not be unregistered
+func (t *Thermabox) RegisterAlertChannel(c chan *interfaces.Alert) {
+	sub := t.alertBroker.Subscribe(registeredChannelBuffer, interfaces.DROP_OLDEST)
+	go func() {
+		for alert := range sub.C() {
+			select {
+			case c <- alert:
+			default:
+				log.Warnf("Registered alert channel is full, dropped alert: %v: %v", alert.Type, alert.Message)
+			}
+		}
+	}()
+}
+
+// SubscribeAlerts returns a subscription to the raised alerts
+func (t *Thermabox) SubscribeAlerts(buffer int, policy interfaces.BufferPolicy) interfaces.AlertSubscription {
+	return t.alertBroker.Subscribe(buffer, policy)
 }
 
 func (t *Thermabox) GetTemperature() (float64, error) {
@@ -188,26 +350,131 @@ func (t *Thermabox) GetTemperature() (float64, error) {
 }
 
 func (t *Thermabox) SetLimits(temperature float64, threshold float64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
 	t.temperature = temperature
 	t.threshold = threshold
+	t.saveState()
 }
 
 func (t *Thermabox) GetLimits() (float64, float64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
 	return t.temperature, t.threshold
 }
 
 func (t *Thermabox) SetProbe(probe interfaces.TemperatureSensorInterface) {
 	t.probe = probe
+	if p, ok := probe.(clockSetter); ok && t.clock != nil {
+		p.SetClock(t.clock)
+	}
+}
+
+// AddProbe adds a named probe. Once more than one probe is added, readings
+// are combined according to probe_aggregation. Replaces any probe set
+// through SetProbe
+func (t *Thermabox) AddProbe(name string, probe interfaces.TemperatureSensorInterface) {
+	multi, ok := t.probe.(*MultiProbe)
+	if !ok {
+		aggregation := t.probeAggregation
+		if aggregation == "" {
+			aggregation = PRIMARY
+		}
+		multi = NewMultiProbe(aggregation)
+		t.SetProbe(multi)
+	}
+	multi.Add(name, probe)
+}
+
+// ProbeConfigs returns the probes listed in the config
+func (t *Thermabox) ProbeConfigs() []*ProbeConfig {
+	return t.probeConfigs
+}
+
+// FilterConfigs returns the filters to apply when a single probe is used
+// instead of the 'probes' list
+func (t *Thermabox) FilterConfigs() []*FilterConfig {
+	return t.filterConfigs
+}
+
+// Calibration returns the calibration to apply when a single probe is used
+// instead of the 'probes' list. It is nil if there is none
+func (t *Thermabox) Calibration() *Calibration {
+	return t.calibration
+}
+
+// SetRelays replaces the relays driving the heating and cooling elements.
+// When called before unmarshalling, the given relays are configured from
+// the YAML instead of the default GPIO relay
+func (t *Thermabox) SetRelays(heating RelayInterface, cooling RelayInterface) {
+	if t.heatingElement == nil {
+		t.heatingElement = &Element{Verify: DefaultRelayVerify}
+	}
+	if t.coolingElement == nil {
+		t.coolingElement = &Element{Verify: DefaultRelayVerify}
+	}
+	t.heatingElement.relay = heating
+	t.coolingElement.relay = cooling
+	t.interlockElements()
+	t.SetClock(t.clock)
+}
+
+// interlockElements prevents either element from being switched on while the
+// other reads as on
+func (t *Thermabox) interlockElements() {
+	t.heatingElement.SetInterlock(t.coolingElement)
+	t.coolingElement.SetInterlock(t.heatingElement)
+}
+
+// SetDeadTime sets the minimum time between one element turning off and the
+// other turning on
+func (t *Thermabox) SetDeadTime(deadTime time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.deadTime = deadTime
+}
+
+// SetClock sets the clock used by the control loop and the elements.
+// The probe is also updated if it accepts a clock
+func (t *Thermabox) SetClock(clock Clock) {
+	t.clock = clock
+	if t.heatingElement != nil {
+		t.heatingElement.SetClock(clock)
+	}
+	if t.coolingElement != nil {
+		t.coolingElement.SetClock(clock)
+	}
+	if probe, ok := t.probe.(clockSetter); ok && clock != nil {
+		probe.SetClock(clock)
+	}
+	if probe, ok := t.safetyProbe.(clockSetter); ok && clock != nil {
+		probe.SetClock(clock)
+	}
+}
+
+type clockSetter interface {
+	SetClock(clock Clock)
+}
+
+// SetSampleInterval sets the time between iterations of the control loop
+func (t *Thermabox) SetSampleInterval(interval time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.sampleInterval = interval
 }
 
 func (t *Thermabox) GetState() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
 	return fmt.Sprintf("%v", t.state)
 }
 
 func (t *Thermabox) DisableThermabox() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
 	t.disabled = true
-	t.heatingElement.Off()
-	t.coolingElement.Off()
+	t.allOff()
+	t.saveState()
 }
 
 func (t *Thermabox) EnableThermabox() {
@@ -215,6 +482,112 @@ func (t *Thermabox) EnableThermabox() {
 	defer t.mutex.Unlock()
 	t.state = interfaces.UNKNOWN
 	t.disabled = false
+	t.saveState()
+}
+
+var errNoProfile = fmt.Errorf("No profile configured")
+
+// withProfile calls fn with the mutex held and the current time
+func (t *Thermabox) withProfile(fn func(p *Profile, now time.Time) error) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.profile == nil {
+		return errNoProfile
+	}
+	if err := fn(t.profile, clockOrDefault(t.clock).Now()); err != nil {
+		return err
+	}
+	t.saveState()
+	return nil
+}
+
+// StartProfile starts the profile from its first step.
+// While a profile is running, it overrides the limits
+func (t *Thermabox) StartProfile() error {
+	return t.withProfile(func(p *Profile, now time.Time) error {
+		p.start(now, t.temperature)
+		return nil
+	})
+}
+
+func (t *Thermabox) PauseProfile() error {
+	return t.withProfile(func(p *Profile, now time.Time) error {
+		return p.pause(now)
+	})
+}
+
+func (t *Thermabox) ResumeProfile() error {
+	return t.withProfile(func(p *Profile, now time.Time) error {
+		return p.resume(now)
+	})
+}
+
+// SkipProfileStep ends the current step. A ramp in the next step starts
+// from the current setpoint
+func (t *Thermabox) SkipProfileStep() error {
+	return t.withProfile(func(p *Profile, now time.Time) error {
+		return p.skip(now, t.temperature)
+	})
+}
+
+// StopProfile stops the profile, leaving the limits where they are
+func (t *Thermabox) StopProfile() error {
+	return t.withProfile(func(p *Profile, now time.Time) error {
+		p.stop(now)
+		return nil
+	})
+}
+
+func (t *Thermabox) GetProfileStatus() (*interfaces.ProfileStatus, error) {
+	var status *interfaces.ProfileStatus
+	err := t.withProfile(func(p *Profile, now time.Time) error {
+		status = p.status(t.threshold)
+		return nil
+	})
+	return status, err
+}
+
+// SetProfile sets the profile to be followed
+func (t *Thermabox) SetProfile(profile *Profile) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.profile = profile
+}
+
+// SetHistory sets the recorder that keeps the history of the thermabox.
+// It is opened and closed by Run
+func (t *Thermabox) SetHistory(recorder *history.Recorder) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.history = recorder
+}
+
+// SetMQTT sets the client that connects the thermabox to an MQTT broker.
+// It is started and stopped by Run
+func (t *Thermabox) SetMQTT(client *mqtt.Client) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.mqttClient = client
+}
+
+// GetHistory returns the recorded history between from and to, in
+// milliseconds since the epoch, at no finer than resolution
+func (t *Thermabox) GetHistory(from int64, to int64, resolution time.Duration) ([]*interfaces.HistorySample, error) {
+	t.mutex.Lock()
+	recorder := t.history
+	t.mutex.Unlock()
+	if recorder == nil {
+		return nil, fmt.Errorf("No history configured")
+	}
+	return recorder.Query(from, to, resolution)
+}
+
+// SetController replaces the controller used to drive the elements
+func (t *Thermabox) SetController(c Controller) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.controller = c
+	t.state = interfaces.UNKNOWN
 }
 
 func (t *Thermabox) Run() error {
@@ -223,135 +596,346 @@ func (t *Thermabox) Run() error {
 		defer t.Webserver.Stop()
 	}
 
-	lastState := interfaces.UNKNOWN
-	t.state = interfaces.UNKNOWN
-	lastTempTimestamp := time.Now().UnixNano() / 1000000
-	var (
-		upperLimit float64
-		lowerLimit float64
-	)
-	for {
-		lowerLimit = t.temperature - t.threshold
-		upperLimit = t.temperature + t.threshold
-
-		now := time.Now().UnixNano() / 1000000
-		temp, err := t.GetTemperature()
-		if err != nil {
-			if now-lastTempTimestamp > 10*1e3 {
-				log.Errorf("Failed to get temperature: %v", err)
-				// Turn off all elements and exit
-				t.heatingElement.Off()
-				t.coolingElement.Off()
-				log.Fatalf("Shutting down at time: %v", time.Now())
-				break
-			}
-			continue
+	clock := clockOrDefault(t.clock)
+
+	if !t.restored {
+		if err := t.RestoreState(); err != nil {
+			log.Errorf("Failed to restore state: %v", err)
+		}
+	}
+
+	if t.history != nil {
+		if err := t.history.Open(); err != nil {
+			log.Errorf("Failed to open history. Not recording history: %v", err)
+		} else {
+			defer t.history.Close()
+		}
+	}
+
+	if t.mqttClient != nil {
+		if err := t.mqttClient.Start(t); err != nil {
+			log.Errorf("Failed to start MQTT client: %v", err)
+		} else {
+			defer t.mqttClient.Stop()
 		}
-		lastTempTimestamp = now
+	}
 
-		if t.cutoffTemp != 0.0 && temp > t.cutoffTemp {
-			log.Errorf("Temperature > cutoff temperature: %v > %v", temp, t.cutoffTemp)
-			t.heatingElement.Off()
-			t.coolingElement.Off()
-			log.Fatalf("Shutting down at time: %v", time.Now())
-			break
+	t.mutex.Lock()
+	if t.sampleInterval == 0 {
+		t.sampleInterval = 500 * time.Millisecond
+	}
+	t.state = interfaces.UNKNOWN
+	t.lastState = interfaces.UNKNOWN
+	t.lastSample = time.Time{}
+	t.lastTempTimestamp = clock.Now()
+	if t.profile != nil {
+		if t.profile.Autostart && !t.profile.progress.Running && !t.profile.progress.Completed {
+			t.profile.start(clock.Now(), t.temperature)
 		}
+	}
+	t.mutex.Unlock()
 
+	// Whatever the reason for returning, leave the elements off
+	defer func() {
 		t.mutex.Lock()
-		if t.state == interfaces.STABLE || t.state == interfaces.UNKNOWN {
-			if temp < lowerLimit {
-				// Temperature has dropped below threshold
-				// Start heating element to warm it back up
-				t.state = interfaces.HEATING_UP
-				if !t.disabled {
-					if err := t.coolingElement.Off(); err != nil {
-						log.Errorf("Failed to turn off cooling element: %v", err)
-					}
-					if err := t.heatingElement.On(); err != nil {
-						if _, ok := err.(ElementToggleDelayError); !ok {
-							log.Errorf("Failed to turn on heating element: %v", err)
-						} else {
-							// This was just a regular toggle delay error..just continue
-						}
-					}
-				}
-			} else if temp > upperLimit {
-				t.state = interfaces.COOLING_DOWN
-				if !t.disabled {
-					if err := t.heatingElement.Off(); err != nil {
-						log.Errorf("Failed to turn off heating element: %v", err)
-					}
-					if err := t.coolingElement.On(); err != nil {
-						if _, ok := err.(ElementToggleDelayError); !ok {
-							log.Errorf("Failed to turn on cooling element: %v", err)
-						} else {
-							// This was just a regular toggle delay error..just continue
-						}
-					}
-				}
-			} else {
-				t.state = interfaces.STABLE
+		defer t.mutex.Unlock()
+		t.allOff()
+		log.Infof("Shutting down at time: %v", clock.Now())
+	}()
+	for !t.isStopped() {
+		if err := t.Step(); err != nil {
+			return err
+		}
+		t.mutex.Lock()
+		interval := t.sampleInterval
+		t.mutex.Unlock()
+		clock.Sleep(interval)
+	}
+	return nil
+}
+
+// Stop turns both elements off and makes Run return after its current
+// iteration. The elements are not switched on again once stopped
+func (t *Thermabox) Stop() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.stopped = true
+	t.allOff()
+}
+
+func (t *Thermabox) isStopped() bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.stopped
+}
+
+// Close turns both elements off and releases their relays
+func (t *Thermabox) Close() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.stopped = true
+	t.allOff()
+	var ret error
+	for _, e := range []*Element{t.heatingElement, t.coolingElement} {
+		if err := e.relay.Close(); err != nil && ret == nil {
+			ret = err
+		}
+	}
+	return ret
+}
+
+// Step runs a single iteration of the control loop. It samples the probe,
+// asks the controller what to do and actuates the elements.
+// A *FaultError is returned if the thermabox must be shut down
+func (t *Thermabox) Step() error {
+	now := clockOrDefault(t.clock).Now()
+	temp, err := t.GetTemperature()
+	readings := safetyReadings{temp: temp, err: err}
+	if err == nil {
+		readings.rawMin, readings.rawMax = rawRange(t.probe, temp)
+	}
+	if t.safetyProbe != nil {
+		safetyTemp, safetyErr := t.safetyProbe.GetTemperature()
+		if r, ok := t.safetyProbe.(rawReader); ok && safetyErr == nil {
+			safetyTemp = r.RawTemperature()
+		}
+		readings.safetyTemp, readings.safetyErr = safetyTemp, safetyErr
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if err != nil {
+		if t.lastTempTimestamp.IsZero() {
+			t.lastTempTimestamp = now
+		}
+		if now.Sub(t.lastTempTimestamp) > 10*time.Second {
+			if err := t.raiseFault(interfaces.PROBE_LOST, fmt.Errorf("Failed to get temperature: %v", err)); err != nil {
+				return err
 			}
+		}
+		// The safety probe does not depend on the control probe
+		return t.checkSafety(readings, now)
+	}
+	t.lastTempTimestamp = now
+	raw := temp
+	if r, ok := t.probe.(rawReader); ok {
+		raw = r.RawTemperature()
+	}
+
+	if err := t.checkSafety(readings, now); err != nil {
+		return err
+	}
+	t.recoverRelayFault()
+
+	if t.profile != nil {
+		if setpoint, threshold, ok := t.profile.update(now, t.threshold); ok {
+			t.temperature = setpoint
+			t.threshold = threshold
+		}
+	}
+	state, err := t.control(temp, now)
+	state.RawTemperature = raw
+	t.saveState()
+
+	t.publish(state)
+	if t.history != nil {
+		if err := t.history.Record(state); err != nil {
+			log.Debugf("Failed to record history: %v", err)
+		}
+	}
+	log.Debugf("temp=%v", temp)
+	return err
+}
+
+// control asks the controller for the desired outputs and actuates the
+// elements. The error of a fault that shuts the thermabox down is returned
+// along with the state. Must be called with the mutex held
+func (t *Thermabox) control(temp float64, now time.Time) (*interfaces.ThermaboxState, error) {
+	if t.controller == nil {
+		t.controlMode = BANG_BANG
+		t.controller = NewBangBangController(t.cutoffAtThreshold)
+	}
+	if t.state == "" {
+		t.state = interfaces.UNKNOWN
+	}
+
+	var elapsed time.Duration
+	if !t.lastSample.IsZero() {
+		elapsed = now.Sub(t.lastSample)
+	}
+	t.lastSample = now
+
+	var err error
+	if t.fault == nil && !t.stopped {
+		out := t.controller.Update(ControllerInput{
+			Temperature: temp,
+			Setpoint:    t.temperature,
+			Threshold:   t.threshold,
+			State:       t.state,
+			Elapsed:     elapsed,
+		})
+		t.state = out.State
+		err = t.actuate(out.Heat, out.Cool)
+	}
+
+	if t.lastState != t.state {
+		log.Infof("temp=%.2f target=%.2f threshold=%.2f -> %v", temp, t.temperature, t.threshold, t.state)
+		t.lastState = t.state
+	}
+	tboxState := &interfaces.ThermaboxState{
+		Temperature:    temp,
+		Timestamp:      now.UnixNano() / 1000000,
+		Setpoint:       t.temperature,
+		Threshold:      t.threshold,
+		State:          t.state,
+		HeatingElement: elementState(t.heatingElement, t.wantHeat),
+		CoolingElement: elementState(t.coolingElement, t.wantCool),
+	}
+	if t.fault != nil {
+		tboxState.Fault = t.fault.Error()
+	}
+	if t.profile != nil {
+		tboxState.Profile = t.profile.status(t.threshold)
+	}
+	if reader, ok := t.probe.(probeReader); ok {
+		tboxState.Probes = reader.Readings()
+	}
+	return tboxState, err
+}
+
+// publish sends the state to all subscribers
+func (t *Thermabox) publish(tboxState *interfaces.ThermaboxState) {
+	t.broker.Publish(tboxState)
+}
+
+// actuate switches the heating and cooling elements to match the
+// controller's output. Elements are only toggled when the output changes and
+// are never switched on while the thermabox is disabled.
+// Elements are always turned off before the other is turned on, and the
+// other is held off until the dead time has passed.
+// A switch that is blocked by an element's minimum on/off time or by the
+// dead time is left pending and retried on the next call.
+// A relay that fails to switch raises a fault, whose error is returned if
+// the thermabox must be shut down
+func (t *Thermabox) actuate(heat bool, cool bool) error {
+	if t.disabled {
+		heat = false
+		cool = false
+	}
+	t.wantHeat = heat
+	t.wantCool = cool
+
+	var faultErr error
+	switchElement := func(name string, e *Element, on bool) {
+		if t.fault != nil {
+			return
+		}
+		var err error
+		if on {
+			err = e.On()
 		} else {
-			// Check if stable
-			// We now have 2 cases to deal with
-			cutoff := false
-			if t.cutoffAtThreshold {
-				if temp >= lowerLimit && temp <= upperLimit {
-					cutoff = true
-				}
-			} else if !t.cutoffAtThreshold {
-				// We only deal with 1 decimal point of precision
-				val := round(temp, 0.5, 1)
-				expected := round(t.temperature, 0.5, 1)
-				switch t.state {
-				case interfaces.HEATING_UP:
-					if val >= expected {
-						cutoff = true
-					}
-				case interfaces.COOLING_DOWN:
-					if val <= expected {
-						cutoff = true
-					}
-				case interfaces.UNKNOWN:
-					if val >= lowerLimit && val <= upperLimit {
-						cutoff = true
-					}
-				}
-			}
-			// Common cutoff logic
-			if cutoff {
-				log.Debugf("Attempting to turn off heating/cooling elements")
-				t.state = interfaces.STABLE
-				if err := t.heatingElement.Off(); err != nil {
-					log.Errorf("Failed to turn off heating element: %v", err)
-				}
-				if err := t.coolingElement.Off(); err != nil {
-					log.Errorf("Failed to turn off heating element: %v", err)
-				}
+			err = e.Off()
+		}
+		if err != nil {
+			switch err.(type) {
+			case ElementToggleDelayError:
+				log.Debugf("Switching %v element %v is pending: %v", name, onOff(on), err)
+			case RelayFaultError, InterlockError:
+				faultErr = t.raiseFault(interfaces.RELAY_FAULT, fmt.Errorf("%v element: %v", name, err))
+			default:
+				log.Errorf("Failed to turn %v %v element: %v", onOff(on), name, err)
 			}
 		}
-		if lastState != t.state {
-			log.Infof("temp=%.2f target=%.2f threshold=%.2f -> %v", temp, t.temperature, t.threshold, t.state)
-			lastState = t.state
+	}
+
+	if !heat && t.heatingElement.IsOn() {
+		switchElement("heating", t.heatingElement, false)
+	}
+	if !cool && t.coolingElement.IsOn() {
+		switchElement("cooling", t.coolingElement, false)
+	}
+	now := clockOrDefault(t.clock).Now()
+	deadTime := func(other *Element) time.Duration {
+		if t.deadTime <= 0 || other.lastOff.IsZero() {
+			return 0
+		}
+		return t.deadTime - now.Sub(other.lastOff)
+	}
+	if heat && !t.heatingElement.IsOn() && !t.coolingElement.IsOn() {
+		if remaining := deadTime(t.coolingElement); remaining > 0 {
+			log.Debugf("Switching heating element on is pending: %v of dead time remaining", remaining)
+		} else {
+			switchElement("heating", t.heatingElement, true)
+		}
+	}
+	if cool && !t.coolingElement.IsOn() && !t.heatingElement.IsOn() {
+		if remaining := deadTime(t.heatingElement); remaining > 0 {
+			log.Debugf("Switching cooling element on is pending: %v of dead time remaining", remaining)
+		} else {
+			switchElement("cooling", t.coolingElement, true)
 		}
+	}
+	return faultErr
+}
 
-		go func(temperature float64, timestamp int64, state interfaces.State) {
-			tboxState := &interfaces.ThermaboxState{
-				temperature,
-				timestamp,
-				state,
-			}
-			for _, channel := range t.listeners {
-				channel <- tboxState
-			}
-		}(temp, now, t.state)
-		t.mutex.Unlock()
+// alert sends an alert to all alert subscribers
+func (t *Thermabox) alert(alertType interfaces.AlertType, msg string) {
+	t.alertBroker.Publish(&interfaces.Alert{
+		Type:      alertType,
+		Message:   msg,
+		Timestamp: clockOrDefault(t.clock).Now().UnixNano() / 1000000,
+	})
+}
 
-		log.Debugf("temp=%v", temp)
-		time.Sleep(500 * time.Millisecond)
+func onOff(on bool) string {
+	if on {
+		return "on"
 	}
-	return nil
+	return "off"
+}
+
+// allOff unconditionally turns off both elements, ignoring minimum on times
+func (t *Thermabox) allOff() {
+	if err := t.heatingElement.ForceOff(); err != nil {
+		log.Errorf("Failed to turn off heating element: %v", err)
+	}
+	if err := t.coolingElement.ForceOff(); err != nil {
+		log.Errorf("Failed to turn off cooling element: %v", err)
+	}
+	t.wantHeat = false
+	t.wantCool = false
+}
+
+func elementState(e *Element, want bool) interfaces.ElementState {
+	return interfaces.ElementState{
+		On:      e.IsOn(),
+		Pending: e.IsOn() != want,
+		Lockout: e.Lockout().Seconds(),
+	}
+}
+
+// parseOptionalFloat is like parseFloat but returns nil if key is not set
+func parseOptionalFloat(m map[string]interface{}, key string) (*float64, error) {
+	if _, ok := m[key]; !ok {
+		return nil, nil
+	}
+	f, err := parseFloat(m, key, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+func parseFloat(m map[string]interface{}, key string, defaultValue float64) (float64, error) {
+	val, ok := m[key]
+	if !ok {
+		return defaultValue, nil
+	}
+	f, err := strconv.ParseFloat(fmt.Sprintf("%v", val), 64)
+	if err != nil {
+		return 0, fmt.Errorf("Failed while parsing %v: %v", key, err)
+	}
+	return f, nil
 }
 
 // Borrowed from https://gist.github.com/DavidVaini/10308388
@@ -1,11 +1,16 @@
 package thermabox
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
 	"gopkg.in/yaml.v2"
 
+	"github.com/gurupras/thermabox/history"
 	log "github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/require"
 )
@@ -31,7 +36,7 @@ toggle_delay_sec: 30
 	require.Equal(1, len(sMap))
 	require.NotNil(sMap[22])
 
-	require.Equal(30*time.Second, element.ToggleDelay)
+	require.Equal(30*time.Second, element.MinOff)
 }
 
 func TestParseYamlThermabox(t *testing.T) {
@@ -49,6 +54,7 @@ cooling_element:
 temperature: 45
 threshold: 0.5
 cutoff_temperature: 50
+sample_interval_sec: 2
 webserver:
   port: 8080
 `
@@ -68,14 +74,228 @@ webserver:
 	require.Nil(err)
 
 	expectedHeating := &Element{
-		genFakeRelay(false, []int{22}), 0, time.Time{},
+		relay:  genFakeRelay(false, []int{22}),
+		Verify: DefaultRelayVerify,
 	}
 	expectedCooling := &Element{
-		genFakeRelay(false, []int{23}), 30 * time.Second, time.Time{},
+		relay:  genFakeRelay(false, []int{23}),
+		MinOff: 30 * time.Second,
+		Verify: DefaultRelayVerify,
 	}
+	expectedHeating.interlock = expectedCooling
+	expectedCooling.interlock = expectedHeating
 	require.Equal(expectedHeating, tbox.heatingElement)
 	require.Equal(expectedCooling, tbox.coolingElement)
 	require.Equal(45.0, tbox.temperature)
 	require.Equal(0.5, tbox.threshold)
-	require.Equal(50.0, tbox.cutoffTemp)
+	require.Equal(50.0, *tbox.maxCutoffTemp)
+	require.Nil(tbox.minCutoffTemp)
+	require.Equal(2*time.Second, tbox.sampleInterval)
+}
+
+type countingProbe struct {
+	count int
+	mutex sync.Mutex
+}
+
+func (c *countingProbe) GetTemperature() (float64, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.count++
+	return 20, nil
+}
+
+func (c *countingProbe) Count() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.count
+}
+
+func TestThermaboxSampleInterval(t *testing.T) {
+	require := require.New(t)
+
+	clock := NewFakeClock(time.Now())
+	probe := &countingProbe{}
+
+	tbox := &Thermabox{temperature: 20, threshold: 0.5}
+	tbox.SetRelays(NewFakeRelay(false, []int{1}), NewFakeRelay(false, []int{1}))
+	tbox.SetProbe(probe)
+	tbox.SetClock(clock)
+	tbox.SetSampleInterval(10 * time.Second)
+
+	go tbox.Run()
+	for i := 1; i <= 5; i++ {
+		clock.BlockUntil(1)
+		require.Equal(i, probe.Count())
+		clock.Advance(10 * time.Second)
+	}
+}
+
+func TestThermaboxConcurrentAccess(t *testing.T) {
+	// Only meaningful with -race
+	tbox := &Thermabox{temperature: 20, threshold: 0.5}
+	tbox.SetRelays(NewFakeRelay(false, []int{1}), NewFakeRelay(false, []int{1}))
+	tbox.SetProbe(&countingProbe{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			tbox.Step()
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		tbox.SetSampleInterval(time.Second)
+		tbox.GetState()
+	}
+	<-done
+}
+
+func TestThermaboxStop(t *testing.T) {
+	require := require.New(t)
+
+	clock := NewFakeClock(time.Now())
+	heater := NewFakeRelay(false, []int{1})
+	cooler := NewFakeRelay(false, []int{1})
+	tbox := &Thermabox{temperature: 20, threshold: 0.5}
+	tbox.SetRelays(heater, cooler)
+	tbox.SetProbe(&sequenceProbe{temps: []float64{10}})
+	tbox.SetClock(clock)
+	tbox.SetSampleInterval(time.Second)
+
+	done := make(chan error)
+	go func() {
+		done <- tbox.Run()
+	}()
+	clock.BlockUntil(1)
+	isOn, err := heater.IsOn(1)
+	require.Nil(err)
+	require.True(isOn)
+
+	// Elements are off as soon as Stop returns
+	tbox.Stop()
+	isOn, err = heater.IsOn(1)
+	require.Nil(err)
+	require.False(isOn)
+	clock.Advance(time.Second)
+	require.Nil(<-done)
+	isOn, err = heater.IsOn(1)
+	require.Nil(err)
+	require.False(isOn)
+
+	require.Nil(tbox.Close())
+	require.True(heater.Closed())
+	require.True(cooler.Closed())
+}
+
+func TestThermaboxRunError(t *testing.T) {
+	require := require.New(t)
+
+	heater := NewFakeRelay(false, []int{1})
+	cooler := NewFakeRelay(false, []int{1})
+	tbox := &Thermabox{temperature: 20, threshold: 0.5, maxCutoffTemp: float64Ptr(30)}
+	tbox.SetRelays(heater, cooler)
+	tbox.SetProbe(&sequenceProbe{temps: []float64{25, 35}})
+	clock := NewFakeClock(time.Now())
+	tbox.SetClock(clock)
+	tbox.SetSampleInterval(time.Second)
+
+	done := make(chan error)
+	go func() {
+		done <- tbox.Run()
+	}()
+	clock.BlockUntil(1)
+	isOn, err := cooler.IsOn(1)
+	require.Nil(err)
+	require.True(isOn)
+
+	// Over the cutoff on the second iteration
+	clock.Advance(time.Second)
+	require.NotNil(<-done)
+	require.Equal(2, len(cooler.History()))
+	isOn, err = cooler.IsOn(1)
+	require.Nil(err)
+	require.False(isOn)
+}
+
+func TestThermaboxHistory(t *testing.T) {
+	require := require.New(t)
+
+	dir, err := ioutil.TempDir("", "thermabox-history")
+	require.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "history.db")
+
+	tbox := &Thermabox{}
+	tbox.SetRelays(&FakeRelay{}, &FakeRelay{})
+	require.Nil(yaml.Unmarshal([]byte(`
+heating_element:
+  relay:
+    pins: [22]
+cooling_element:
+  relay:
+    pins: [23]
+history:
+  path: `+path+`
+`), tbox))
+	require.Equal(path, tbox.history.Path)
+	require.Equal(history.DefaultTiers, tbox.history.Tiers)
+
+	tbox = &Thermabox{temperature: 20, threshold: 0.5}
+	tbox.SetRelays(NewFakeRelay(false, []int{1}), NewFakeRelay(false, []int{1}))
+	tbox.SetProbe(&sequenceProbe{temps: []float64{25}})
+	_, err = tbox.GetHistory(0, 1, 0)
+	require.NotNil(err)
+
+	start := time.Unix(3600, 0)
+	clock := NewFakeClock(start)
+	tbox.SetClock(clock)
+	tbox.SetSampleInterval(time.Second)
+	tbox.SetHistory(history.NewRecorder(path, history.DefaultTiers))
+
+	done := make(chan error)
+	go func() {
+		done <- tbox.Run()
+	}()
+	clock.BlockUntil(1)
+	samples, err := tbox.GetHistory(0, 2*3600*1000, 0)
+	require.Nil(err)
+	require.Equal(1, len(samples))
+	require.Equal(int64(3600*1000), samples[0].Timestamp)
+	require.Equal(25.0, samples[0].Temperature)
+	require.Equal(20.0, samples[0].Setpoint)
+	require.Equal(0.5, samples[0].Threshold)
+	require.Equal(1.0, samples[0].Cooling)
+
+	tbox.Stop()
+	clock.Advance(time.Second)
+	require.Nil(<-done)
+}
+
+func float64Ptr(f float64) *float64 {
+	return &f
+}
+
+func TestThermaboxMQTT(t *testing.T) {
+	require := require.New(t)
+
+	conf := `
+heating_element:
+  relay:
+    pins: [22]
+cooling_element:
+  relay:
+    pins: [23]
+mqtt:
+  broker: tcp://localhost:1883
+  topic: lab/thermabox
+`
+	tbox := &Thermabox{}
+	tbox.SetRelays(&FakeRelay{}, &FakeRelay{})
+	require.Nil(yaml.Unmarshal([]byte(conf), tbox))
+	require.Equal("tcp://localhost:1883", tbox.mqttClient.Broker)
+	require.Equal("lab/thermabox", tbox.mqttClient.Topic)
+
+	tbox = &Thermabox{}
+	tbox.SetRelays(&FakeRelay{}, &FakeRelay{})
+	require.NotNil(yaml.Unmarshal([]byte(conf+"  qos: 5\n"), tbox))
 }
@@ -0,0 +1,337 @@
+package webserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	thermabox_interfaces "github.com/gurupras/thermabox/interfaces"
+	log "github.com/sirupsen/logrus"
+)
+
+// APIError is an error with the HTTP status and error code to respond with.
+// It is written as {"error": {"code": ..., "message": ...}}
+type APIError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *APIError) Error() string {
+	return e.Message
+}
+
+func newAPIError(status int, code string, format string, args ...interface{}) *APIError {
+	return &APIError{status, code, fmt.Sprintf(format, args...)}
+}
+
+func badRequest(format string, args ...interface{}) *APIError {
+	return newAPIError(http.StatusBadRequest, "bad_request", format, args...)
+}
+
+func notImplemented(format string, args ...interface{}) *APIError {
+	return newAPIError(http.StatusNotImplemented, "not_implemented", format, args...)
+}
+
+func conflict(err error) *APIError {
+	return newAPIError(http.StatusConflict, "conflict", "%v", err)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Errorf("Failed to marshal response: %v", err)
+		status = http.StatusInternalServerError
+		b = []byte(`{"error":{"code":"internal","message":"Failed to marshal response"}}`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	apiErr, ok := err.(*APIError)
+	if !ok {
+		apiErr = newAPIError(http.StatusInternalServerError, "internal", "%v", err)
+	}
+	writeJSON(w, apiErr.Status, map[string]*APIError{"error": apiErr})
+}
+
+// Limits is the body of the limits resource
+type Limits struct {
+	Temperature *float64 `json:"temperature"`
+	Threshold   *float64 `json:"threshold"`
+}
+
+func (l *Limits) validate() error {
+	if l.Temperature == nil || l.Threshold == nil {
+		return badRequest("Limits must have both temperature and threshold")
+	}
+	for _, val := range []float64{*l.Temperature, *l.Threshold} {
+		if math.IsNaN(val) || math.IsInf(val, 0) {
+			return badRequest("Limits must be finite: %v", val)
+		}
+	}
+	if *l.Threshold < 0 {
+		return badRequest("threshold must be >= 0: %v", *l.Threshold)
+	}
+	return nil
+}
+
+// limitsFromEvent returns the validated limits sent with a websocket event
+func limitsFromEvent(data interface{}) (*Limits, error) {
+	m, ok := data.(map[string]interface{})
+	if !ok {
+		return nil, badRequest("Limits must be an object: %v", data)
+	}
+	limits := &Limits{}
+	for key, dst := range map[string]**float64{"temperature": &limits.Temperature, "threshold": &limits.Threshold} {
+		val, ok := m[key]
+		if !ok {
+			continue
+		}
+		f, ok := val.(float64)
+		if !ok {
+			return nil, badRequest("%v must be a number: %v", key, val)
+		}
+		*dst = &f
+	}
+	if err := limits.validate(); err != nil {
+		return nil, err
+	}
+	return limits, nil
+}
+
+func getLimits(tbox thermabox_interfaces.ThermaboxInterface) *Limits {
+	temp, threshold := tbox.GetLimits()
+	return &Limits{&temp, &threshold}
+}
+
+func getTemperature(tbox thermabox_interfaces.ThermaboxInterface) (float64, error) {
+	temp, err := tbox.GetTemperature()
+	if err != nil {
+		return 0, newAPIError(http.StatusServiceUnavailable, "probe_unavailable", "Failed to get temperature: %v", err)
+	}
+	return temp, nil
+}
+
+func getStatus(webserver *Webserver) (*thermabox_interfaces.ThermaboxState, error) {
+	state := webserver.getState()
+	if state == nil {
+		return nil, newAPIError(http.StatusServiceUnavailable, "unavailable", "No state published yet")
+	}
+	return state, nil
+}
+
+func resetFault(tbox thermabox_interfaces.ThermaboxInterface) error {
+	fault, ok := tbox.(thermabox_interfaces.FaultInterface)
+	if !ok {
+		return notImplemented("Thermabox does not support resetting faults")
+	}
+	if err := fault.ResetFault(); err != nil {
+		return conflict(err)
+	}
+	return nil
+}
+
+func getProfileInterface(tbox thermabox_interfaces.ThermaboxInterface) (thermabox_interfaces.ProfileInterface, error) {
+	profile, ok := tbox.(thermabox_interfaces.ProfileInterface)
+	if !ok {
+		return nil, notImplemented("Thermabox does not support profiles")
+	}
+	return profile, nil
+}
+
+func profileAction(action string, tbox thermabox_interfaces.ThermaboxInterface) error {
+	fn, ok := profileActions[action]
+	if !ok {
+		return newAPIError(http.StatusNotFound, "not_found", "Unknown profile action: %v", action)
+	}
+	profile, err := getProfileInterface(tbox)
+	if err != nil {
+		return err
+	}
+	if err := fn(profile); err != nil {
+		return conflict(err)
+	}
+	return nil
+}
+
+func getProfileStatus(tbox thermabox_interfaces.ThermaboxInterface) (*thermabox_interfaces.ProfileStatus, error) {
+	profile, err := getProfileInterface(tbox)
+	if err != nil {
+		return nil, err
+	}
+	status, err := profile.GetProfileStatus()
+	if err != nil {
+		return nil, conflict(err)
+	}
+	return status, nil
+}
+
+// getHistory returns the history between the 'from' and 'to' query
+// parameters, in milliseconds since the epoch, at no finer than 'resolution'
+// seconds. The last hour is returned by default
+func getHistory(tbox thermabox_interfaces.ThermaboxInterface, req *http.Request) ([]*thermabox_interfaces.HistorySample, error) {
+	history, ok := tbox.(thermabox_interfaces.HistoryInterface)
+	if !ok {
+		return nil, notImplemented("Thermabox does not record history")
+	}
+	parseInt := func(key string, def int64) (int64, error) {
+		str := req.FormValue(key)
+		if str == "" {
+			return def, nil
+		}
+		val, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			return 0, badRequest("Failed to parse %v: %v", key, str)
+		}
+		return val, nil
+	}
+	to, err := parseInt("to", time.Now().UnixNano()/int64(time.Millisecond))
+	if err != nil {
+		return nil, err
+	}
+	from, err := parseInt("from", to-int64(time.Hour/time.Millisecond))
+	if err != nil {
+		return nil, err
+	}
+	if to < from {
+		return nil, badRequest("to must be >= from: %v < %v", to, from)
+	}
+	resolution := 0.0
+	if str := req.FormValue("resolution"); str != "" {
+		if resolution, err = strconv.ParseFloat(str, 64); err != nil || resolution < 0 {
+			return nil, badRequest("Failed to parse resolution: %v", str)
+		}
+	}
+	samples, err := history.GetHistory(from, to, time.Duration(resolution*float64(time.Second)))
+	if err != nil {
+		return nil, newAPIError(http.StatusServiceUnavailable, "unavailable", "%v", err)
+	}
+	return samples, nil
+}
+
+// apiFunc handles a request to a resource of the API. The value returned is
+// written as JSON, with a nil value responding with 204
+type apiFunc func(req *http.Request) (interface{}, error)
+
+// resource maps the methods of a resource to their apiFunc
+type resource map[string]apiFunc
+
+func (m resource) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	fn, ok := m[req.Method]
+	if !ok {
+		allowed := make([]string, 0, len(m))
+		for method := range m {
+			allowed = append(allowed, method)
+		}
+		sort.Strings(allowed)
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeError(w, newAPIError(http.StatusMethodNotAllowed, "method_not_allowed", "Method %v not allowed on %v", req.Method, req.URL.Path))
+		return
+	}
+	v, err := fn(req)
+	if err != nil {
+		log.Errorf("Failed to handle '%v %v': %v", req.Method, req.URL.Path, err)
+		writeError(w, err)
+		return
+	}
+	if v == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, http.StatusOK, v)
+}
+
+// initializeAPI adds the /api/v1 routes under basePath to r
+func initializeAPI(r *mux.Router, basePath string, tbox thermabox_interfaces.ThermaboxInterface, webserver *Webserver) {
+	api := r.PathPrefix(filepath.Join(basePath, "api", "v1")).Subrouter()
+	api.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		writeError(w, newAPIError(http.StatusNotFound, "not_found", "No such resource: %v", req.URL.Path))
+	})
+
+	// Methods are dispatched here rather than with Route.Methods, since
+	// mux's subrouters report a method mismatch as not found
+	resources := make(map[string]resource)
+	handle := func(path string, method string, fn apiFunc) {
+		if resources[path] == nil {
+			resources[path] = make(resource)
+		}
+		resources[path][method] = fn
+	}
+
+	handle("/temperature", "GET", func(req *http.Request) (interface{}, error) {
+		temp, err := getTemperature(tbox)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]float64{"temperature": temp}, nil
+	})
+	handle("/limits", "GET", func(req *http.Request) (interface{}, error) {
+		return getLimits(tbox), nil
+	})
+	handle("/limits", "PUT", func(req *http.Request) (interface{}, error) {
+		limits := &Limits{}
+		decoder := json.NewDecoder(req.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(limits); err != nil {
+			return nil, badRequest("Failed to parse limits: %v", err)
+		}
+		if err := limits.validate(); err != nil {
+			return nil, err
+		}
+		webserver.SetLimits(tbox, *limits.Temperature, *limits.Threshold)
+		return getLimits(tbox), nil
+	})
+	handle("/state", "GET", func(req *http.Request) (interface{}, error) {
+		return map[string]string{"state": tbox.GetState()}, nil
+	})
+	handle("/status", "GET", func(req *http.Request) (interface{}, error) {
+		return getStatus(webserver)
+	})
+	handle("/enable", "POST", func(req *http.Request) (interface{}, error) {
+		webserver.EnableThermabox(tbox)
+		return nil, nil
+	})
+	handle("/disable", "POST", func(req *http.Request) (interface{}, error) {
+		webserver.DisableThermabox(tbox)
+		return nil, nil
+	})
+	handle("/fault/reset", "POST", func(req *http.Request) (interface{}, error) {
+		return nil, resetFault(tbox)
+	})
+	handle("/history", "GET", func(req *http.Request) (interface{}, error) {
+		return getHistory(tbox, req)
+	})
+	handle("/profile", "GET", func(req *http.Request) (interface{}, error) {
+		return getProfileStatus(tbox)
+	})
+	handle("/profile/{action}", "POST", func(req *http.Request) (interface{}, error) {
+		return nil, profileAction(mux.Vars(req)["action"], tbox)
+	})
+
+	for path, methods := range resources {
+		api.Handle(path, methods)
+	}
+
+	// The event stream is not a JSON resource, so it is routed on its own
+	api.HandleFunc("/events", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			w.Header().Set("Allow", "GET")
+			writeError(w, newAPIError(http.StatusMethodNotAllowed, "method_not_allowed", "Method %v not allowed on %v", req.Method, req.URL.Path))
+			return
+		}
+		if err := EventsHandler(webserver, tbox, w, req); err != nil {
+			log.Errorf("Failed to handle '%v %v': %v", req.Method, req.URL.Path, err)
+			writeError(w, err)
+		}
+	})
+}
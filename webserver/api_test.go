@@ -0,0 +1,174 @@
+package webserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gurupras/go-stoppable-net-listener"
+	thermabox_interfaces "github.com/gurupras/thermabox/interfaces"
+	"github.com/parnurzeal/gorequest"
+	"github.com/stretchr/testify/require"
+)
+
+// DummyAPIThermabox supports every optional interface
+type DummyAPIThermabox struct {
+	*DummyThermaboxInterface
+	*DummyProfileThermabox
+	*DummyFaultThermabox
+	*DummyHistoryThermabox
+	enabled bool
+}
+
+func (d *DummyAPIThermabox) DisableThermabox() {
+	d.enabled = false
+}
+
+func (d *DummyAPIThermabox) EnableThermabox() {
+	d.enabled = true
+}
+
+func startAPIServer(require *require.Assertions, tbox thermabox_interfaces.ThermaboxInterface, webserver *Webserver, port int) (string, func()) {
+	handler, err := InitializeWebServer(".", "/", tbox, nil, webserver)
+	require.Nil(err)
+	server := http.Server{}
+	server.Handler = handler
+	snl, err := stoppablenetlistener.New(port)
+	require.Nil(err)
+	go func() {
+		server.Serve(snl)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	return fmt.Sprintf("http://localhost:%v/api/v1", port), snl.Stop
+}
+
+func requireAPIError(require *require.Assertions, resp gorequest.Response, body string, status int, code string) {
+	require.Equal(status, resp.StatusCode, body)
+	require.Equal("application/json", resp.Header.Get("Content-Type"))
+	envelope := make(map[string]*APIError)
+	require.Nil(json.Unmarshal([]byte(body), &envelope), body)
+	require.NotNil(envelope["error"], body)
+	require.Equal(code, envelope["error"].Code)
+	require.NotEqual("", envelope["error"].Message)
+}
+
+func TestAPILimits(t *testing.T) {
+	require := require.New(t)
+
+	tbox := NewDummyThermaboxInterface()
+	url, stop := startAPIServer(require, tbox, New(), 31130)
+	defer stop()
+
+	resp, body, errs := gorequest.New().Get(url + "/limits").End()
+	require.Equal(0, len(errs))
+	require.Equal(200, resp.StatusCode)
+	require.JSONEq(`{"temperature": 114.14, "threshold": 0.2}`, body)
+
+	resp, body, _ = gorequest.New().Put(url + "/limits").Send(`{"temperature": 18, "threshold": 0.5}`).End()
+	require.Equal(200, resp.StatusCode, body)
+	require.JSONEq(`{"temperature": 18, "threshold": 0.5}`, body)
+	temp, threshold := tbox.GetLimits()
+	require.Equal(18.0, temp)
+	require.Equal(0.5, threshold)
+
+	for _, str := range []string{
+		`{"temperature": 18}`,
+		`{"temperature": 18, "threshold": -1}`,
+		`{"temperature": "abc", "threshold": 1}`,
+		`{"temperature": 18, "threshold": 1, "extra": 1}`,
+		`not json`,
+	} {
+		resp, body, _ = gorequest.New().Put(url + "/limits").Type("text").Send(str).End()
+		requireAPIError(require, resp, body, 400, "bad_request")
+	}
+	temp, _ = tbox.GetLimits()
+	require.Equal(18.0, temp)
+
+	resp, body, _ = gorequest.New().Post(url + "/limits").End()
+	requireAPIError(require, resp, body, 405, "method_not_allowed")
+
+	resp, body, _ = gorequest.New().Get(url + "/missing").End()
+	requireAPIError(require, resp, body, 404, "not_found")
+}
+
+func TestAPIResources(t *testing.T) {
+	require := require.New(t)
+
+	dummy := NewDummyThermaboxInterface()
+	tbox := &DummyAPIThermabox{
+		DummyThermaboxInterface: dummy,
+		DummyProfileThermabox:   &DummyProfileThermabox{DummyThermaboxInterface: dummy},
+		DummyFaultThermabox:     &DummyFaultThermabox{dummy, true},
+		DummyHistoryThermabox:   &DummyHistoryThermabox{DummyThermaboxInterface: dummy},
+	}
+	webserver := New()
+	url, stop := startAPIServer(require, tbox, webserver, 31131)
+	defer stop()
+
+	resp, body, _ := gorequest.New().Get(url + "/temperature").End()
+	require.Equal(200, resp.StatusCode)
+	require.JSONEq(`{"temperature": 114.14}`, body)
+
+	resp, body, _ = gorequest.New().Get(url + "/state").End()
+	require.Equal(200, resp.StatusCode)
+	require.JSONEq(`{"state": "stable"}`, body)
+
+	resp, body, _ = gorequest.New().Get(url + "/status").End()
+	requireAPIError(require, resp, body, 503, "unavailable")
+	webserver.setState(&thermabox_interfaces.ThermaboxState{Temperature: 20, State: thermabox_interfaces.STABLE})
+	resp, body, _ = gorequest.New().Get(url + "/status").End()
+	require.Equal(200, resp.StatusCode)
+	state := &thermabox_interfaces.ThermaboxState{}
+	require.Nil(json.Unmarshal([]byte(body), state))
+	require.Equal(20.0, state.Temperature)
+
+	resp, _, _ = gorequest.New().Post(url + "/enable").End()
+	require.Equal(204, resp.StatusCode)
+	require.True(tbox.enabled)
+	resp, _, _ = gorequest.New().Post(url + "/disable").End()
+	require.Equal(204, resp.StatusCode)
+	require.False(tbox.enabled)
+	resp, body, _ = gorequest.New().Get(url + "/enable").End()
+	requireAPIError(require, resp, body, 405, "method_not_allowed")
+
+	resp, _, _ = gorequest.New().Post(url + "/fault/reset").End()
+	require.Equal(204, resp.StatusCode)
+	resp, body, _ = gorequest.New().Post(url + "/fault/reset").End()
+	requireAPIError(require, resp, body, 409, "conflict")
+
+	resp, body, _ = gorequest.New().Get(url + "/history?from=1000&to=2000").End()
+	require.Equal(200, resp.StatusCode)
+	require.Equal(int64(1000), tbox.from)
+	resp, body, _ = gorequest.New().Get(url + "/history?from=2000&to=1000").End()
+	requireAPIError(require, resp, body, 400, "bad_request")
+	resp, body, _ = gorequest.New().Get(url + "/history?resolution=-1").End()
+	requireAPIError(require, resp, body, 400, "bad_request")
+
+	resp, _, _ = gorequest.New().Post(url + "/profile/start").End()
+	require.Equal(204, resp.StatusCode)
+	require.Equal([]string{"start"}, tbox.actions)
+	resp, body, _ = gorequest.New().Post(url + "/profile/jump").End()
+	requireAPIError(require, resp, body, 404, "not_found")
+	resp, body, _ = gorequest.New().Get(url + "/profile").End()
+	require.Equal(200, resp.StatusCode)
+	require.Contains(body, `"step_name":"rest"`)
+}
+
+func TestAPINotImplemented(t *testing.T) {
+	require := require.New(t)
+
+	url, stop := startAPIServer(require, NewDummyThermaboxInterface(), New(), 31132)
+	defer stop()
+
+	for _, r := range []*gorequest.SuperAgent{
+		gorequest.New().Post(url + "/fault/reset"),
+		gorequest.New().Get(url + "/history"),
+		gorequest.New().Post(url + "/profile/start"),
+		gorequest.New().Get(url + "/profile"),
+	} {
+		resp, body, _ := r.End()
+		requireAPIError(require, resp, body, 501, "not_implemented")
+	}
+}
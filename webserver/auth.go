@@ -0,0 +1,312 @@
+package webserver
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	websockets "github.com/homesound/simple-websockets"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/bcrypt"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Role is what an authenticated client may do. A control client may also
+// read
+type Role string
+
+const (
+	ROLE_NONE    Role = ""
+	ROLE_READ    Role = "read"
+	ROLE_CONTROL Role = "control"
+)
+
+func parseRole(val interface{}) (Role, error) {
+	if val == nil {
+		return ROLE_READ, nil
+	}
+	role := Role(fmt.Sprintf("%v", val))
+	if role != ROLE_READ && role != ROLE_CONTROL {
+		return ROLE_NONE, fmt.Errorf("Unknown role: %v", val)
+	}
+	return role, nil
+}
+
+// Allows returns whether the role grants the required role
+func (r Role) Allows(required Role) bool {
+	switch required {
+	case ROLE_NONE:
+		return true
+	case ROLE_READ:
+		return r == ROLE_READ || r == ROLE_CONTROL
+	default:
+		return r == required
+	}
+}
+
+type AuthToken struct {
+	Token string
+	Role  Role
+}
+
+// AuthUser is a user authenticated with HTTP basic auth. PasswordHash is a
+// bcrypt hash, as generated by e.g. `htpasswd -nbB user password`
+type AuthUser struct {
+	Username     string
+	PasswordHash string
+	Role         Role
+}
+
+// Auth holds the credentials clients authenticate with. Credentials without
+// a role are read-only
+type Auth struct {
+	Tokens []*AuthToken
+	Users  []*AuthUser
+}
+
+func (a *Auth) UnmarshalYAML(unmarshal func(i interface{}) error) error {
+	conf := struct {
+		Tokens []map[string]interface{} `yaml:"tokens"`
+		Users  []map[string]interface{} `yaml:"users"`
+	}{}
+	if err := unmarshal(&conf); err != nil {
+		return err
+	}
+	a.Tokens = make([]*AuthToken, 0)
+	for _, m := range conf.Tokens {
+		token, _ := m["token"].(string)
+		if token == "" {
+			return fmt.Errorf("Auth token is missing token")
+		}
+		role, err := parseRole(m["role"])
+		if err != nil {
+			return err
+		}
+		a.Tokens = append(a.Tokens, &AuthToken{token, role})
+	}
+	a.Users = make([]*AuthUser, 0)
+	for _, m := range conf.Users {
+		username, _ := m["username"].(string)
+		if username == "" {
+			return fmt.Errorf("Auth user is missing username")
+		}
+		hash, _ := m["password_hash"].(string)
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return fmt.Errorf("Auth user '%v' has an invalid password_hash: %v", username, err)
+		}
+		role, err := parseRole(m["role"])
+		if err != nil {
+			return err
+		}
+		a.Users = append(a.Users, &AuthUser{username, hash, role})
+	}
+	return nil
+}
+
+func parseAuth(data interface{}) (*Auth, error) {
+	b, err := yaml.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal key 'auth': %v: %v", data, err)
+	}
+	auth := &Auth{}
+	if err := yaml.Unmarshal(b, auth); err != nil {
+		return nil, fmt.Errorf("Failed while parsing auth: %v", err)
+	}
+	return auth, nil
+}
+
+// Enabled returns whether any credentials are configured. Without any, every
+// client has control
+func (a *Auth) Enabled() bool {
+	return a != nil && len(a.Tokens)+len(a.Users) > 0
+}
+
+func (a *Auth) authenticateToken(token string) Role {
+	role := ROLE_NONE
+	// Check every token so that the time taken does not depend on which one
+	// matches
+	for _, t := range a.Tokens {
+		if subtle.ConstantTimeCompare([]byte(t.Token), []byte(token)) == 1 {
+			role = t.Role
+		}
+	}
+	return role
+}
+
+func (a *Auth) authenticateUser(username string, password string) Role {
+	for _, u := range a.Users {
+		if u.Username != username {
+			continue
+		}
+		if bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) == nil {
+			return u.Role
+		}
+		return ROLE_NONE
+	}
+	return ROLE_NONE
+}
+
+// authenticate returns the role of the credentials in the request, from
+// either a bearer token or basic auth
+func (a *Auth) authenticate(req *http.Request) Role {
+	if !a.Enabled() {
+		return ROLE_CONTROL
+	}
+	if username, password, ok := req.BasicAuth(); ok {
+		return a.authenticateUser(username, password)
+	}
+	header := req.Header.Get("Authorization")
+	if strings.HasPrefix(header, "Bearer ") {
+		return a.authenticateToken(strings.TrimPrefix(header, "Bearer "))
+	}
+	return ROLE_NONE
+}
+
+// legacyControlRoutes are the legacy routes that change the thermabox
+var legacyControlRoutes = []string{"set-limits", "disable-thermabox", "enable-thermabox", "reset-fault"}
+
+// relativePath returns the path of a request relative to the base path,
+// without leading or trailing slashes
+func relativePath(basePath string, req *http.Request) string {
+	path := strings.TrimSuffix(req.URL.Path, "/")
+	rel := strings.TrimPrefix(path, strings.TrimSuffix(basePath, "/"))
+	return strings.TrimPrefix(rel, "/")
+}
+
+// requiredRole returns the role needed for a request. Static files and the
+// websocket are open, since websocket events are checked individually
+func requiredRole(basePath string, req *http.Request) Role {
+	rel := relativePath(basePath, req)
+	switch {
+	case rel == "ws" || rel == "static" || strings.HasPrefix(rel, "static/"):
+		return ROLE_NONE
+	case strings.HasPrefix(rel, "api/v1/"):
+		if req.Method == "GET" || req.Method == "HEAD" {
+			return ROLE_READ
+		}
+		return ROLE_CONTROL
+	}
+	for _, route := range legacyControlRoutes {
+		if rel == route {
+			return ROLE_CONTROL
+		}
+	}
+	if strings.HasPrefix(rel, "profile/") && rel != "profile/status" {
+		return ROLE_CONTROL
+	}
+	return ROLE_READ
+}
+
+// authHandler rejects requests without the credentials for the role the
+// route requires. /api/v1 routes are rejected with the JSON error envelope
+func authHandler(auth *Auth, basePath string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		rel := relativePath(basePath, req)
+		required := requiredRole(basePath, req)
+		// Without users, the browser has nothing to prompt for, so the page
+		// is open and asks for a token itself
+		if rel == "" && (auth == nil || len(auth.Users) == 0) {
+			required = ROLE_NONE
+		}
+		role := auth.authenticate(req)
+		// Browsers can not set headers on an EventSource, so the event stream
+		// also takes a token in the query
+		if role == ROLE_NONE && rel == "api/v1/events" {
+			role = auth.authenticateToken(req.URL.Query().Get("token"))
+		}
+		if role.Allows(required) {
+			next.ServeHTTP(w, req)
+			return
+		}
+		var err *APIError
+		if role == ROLE_NONE {
+			if len(auth.Users) > 0 {
+				w.Header().Set("WWW-Authenticate", `Basic realm="thermabox"`)
+			}
+			err = newAPIError(http.StatusUnauthorized, "unauthorized", "Missing or invalid credentials")
+		} else {
+			err = newAPIError(http.StatusForbidden, "forbidden", "Role '%v' may not %v %v", role, req.Method, req.URL.Path)
+		}
+		log.Warnf("Rejected '%v %v' from %v: %v", req.Method, req.URL.Path, req.RemoteAddr, err)
+		if strings.HasPrefix(req.URL.Path, filepath.Join(basePath, "api", "v1")) {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(err.Status)
+		w.Write([]byte(err.Message))
+	})
+}
+
+// wsAuth tracks the role each websocket client authenticated with through
+// the 'authenticate' event
+type wsAuth struct {
+	auth  *Auth
+	roles map[*websockets.WebsocketClient]Role
+	mutex sync.Mutex
+}
+
+func newWSAuth(auth *Auth) *wsAuth {
+	return &wsAuth{auth: auth, roles: make(map[*websockets.WebsocketClient]Role)}
+}
+
+func (a *wsAuth) role(w *websockets.WebsocketClient) Role {
+	if !a.auth.Enabled() {
+		return ROLE_CONTROL
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.roles[w]
+}
+
+// authenticate handles the 'authenticate' event. data holds either a token
+// or a username and password
+func (a *wsAuth) authenticate(w *websockets.WebsocketClient, data interface{}) {
+	m, _ := data.(map[string]interface{})
+	token, _ := m["token"].(string)
+	username, _ := m["username"].(string)
+	password, _ := m["password"].(string)
+	role := ROLE_CONTROL
+	if a.auth.Enabled() {
+		if token != "" {
+			role = a.auth.authenticateToken(token)
+		} else {
+			role = a.auth.authenticateUser(username, password)
+		}
+	}
+	a.mutex.Lock()
+	if role == ROLE_NONE {
+		delete(a.roles, w)
+	} else {
+		a.roles[w] = role
+	}
+	a.mutex.Unlock()
+	if role == ROLE_NONE {
+		log.Warnf("[websockets]: [authenticate]: Invalid credentials")
+		w.Emit("authenticate", "Invalid credentials")
+		return
+	}
+	w.Emit("authenticate", string(role))
+}
+
+// remove forgets the role of a client that has disconnected
+func (a *wsAuth) remove(w *websockets.WebsocketClient) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	delete(a.roles, w)
+}
+
+// guard wraps a websocket handler so that it only runs for clients with the
+// required role. Other clients are sent 'Unauthorized'
+func (a *wsAuth) guard(event string, required Role, h websockets.Handler) websockets.Handler {
+	return func(w *websockets.WebsocketClient, data interface{}) {
+		if !a.role(w).Allows(required) {
+			log.Warnf("[websockets]: [%v]: Unauthorized", event)
+			w.Emit(event, "Unauthorized")
+			return
+		}
+		h(w, data)
+	}
+}
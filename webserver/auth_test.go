@@ -0,0 +1,306 @@
+package webserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	websockets "github.com/homesound/simple-websockets"
+	"github.com/parnurzeal/gorequest"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func newTestAuth(require *require.Assertions) *Auth {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.Nil(err)
+	w := New()
+	require.Nil(yaml.Unmarshal([]byte(`
+webserver:
+  auth:
+    tokens:
+      - {token: reader, role: read}
+      - {token: controller, role: control}
+    users:
+      - {username: admin, password_hash: '`+string(hash)+`', role: control}
+      - {username: guest, password_hash: '`+string(hash)+`'}
+  cors_origins: [https://example.com]
+`), w))
+	return w.Auth
+}
+
+func TestParseYamlAuth(t *testing.T) {
+	require := require.New(t)
+
+	auth := newTestAuth(require)
+	require.True(auth.Enabled())
+	require.Equal(&AuthToken{"reader", ROLE_READ}, auth.Tokens[0])
+	require.Equal(ROLE_CONTROL, auth.Users[0].Role)
+	// Read-only by default
+	require.Equal(ROLE_READ, auth.Users[1].Role)
+
+	w := New()
+	require.Nil(yaml.Unmarshal([]byte(`webserver: {cors_origins: [https://a.com, https://b.com]}`), w))
+	require.Equal([]string{"https://a.com", "https://b.com"}, w.CorsOrigins)
+	require.False(w.Auth.Enabled())
+
+	w = New()
+	require.Nil(yaml.Unmarshal([]byte(`webserver: {port: 8080}`), w))
+	require.Equal([]string{"*"}, w.CorsOrigins)
+
+	for _, str := range []string{
+		`webserver: {auth: {tokens: [{role: read}]}}`,
+		`webserver: {auth: {tokens: [{token: abc, role: admin}]}}`,
+		`webserver: {auth: {users: [{username: admin, password_hash: plain}]}}`,
+		`webserver: {auth: {users: [{password_hash: plain}]}}`,
+		`webserver: {cors_origins: https://a.com}`,
+	} {
+		w = New()
+		require.NotNil(yaml.Unmarshal([]byte(str), w), str)
+	}
+}
+
+func TestRequiredRole(t *testing.T) {
+	require := require.New(t)
+
+	for _, c := range []struct {
+		base   string
+		method string
+		path   string
+		role   Role
+	}{
+		{"/", "GET", "/", ROLE_READ},
+		{"/", "GET", "/static/js/index.js", ROLE_NONE},
+		{"/", "GET", "/ws", ROLE_NONE},
+		{"/", "GET", "/get-temperature/", ROLE_READ},
+		{"/", "POST", "/set-limits", ROLE_CONTROL},
+		{"/", "GET", "/disable-thermabox", ROLE_CONTROL},
+		{"/", "POST", "/profile/start", ROLE_CONTROL},
+		{"/", "GET", "/profile/status", ROLE_READ},
+		{"/", "GET", "/api/v1/limits", ROLE_READ},
+		{"/", "PUT", "/api/v1/limits", ROLE_CONTROL},
+		{"/", "POST", "/api/v1/enable", ROLE_CONTROL},
+		{"/webserver", "POST", "/webserver/set-limits", ROLE_CONTROL},
+		{"/webserver", "GET", "/webserver/static/css/main.css", ROLE_NONE},
+	} {
+		req := httptest.NewRequest(c.method, c.path, nil)
+		require.Equal(c.role, requiredRole(c.base, req), "%v %v", c.method, c.path)
+	}
+	require.True(ROLE_CONTROL.Allows(ROLE_READ))
+	require.False(ROLE_READ.Allows(ROLE_CONTROL))
+	require.False(ROLE_NONE.Allows(ROLE_READ))
+	require.True(ROLE_NONE.Allows(ROLE_NONE))
+}
+
+func TestAuthRoutes(t *testing.T) {
+	require := require.New(t)
+
+	tbox := NewDummyThermaboxInterface()
+	webserver := New()
+	webserver.Auth = newTestAuth(require)
+	webserver.CorsOrigins = []string{"https://example.com"}
+	url, stop := startAPIServer(require, tbox, webserver, 31133)
+	defer stop()
+	base := "http://localhost:31133"
+
+	resp, body, _ := gorequest.New().Get(url + "/limits").End()
+	requireAPIError(require, resp, body, 401, "unauthorized")
+	require.Equal(`Basic realm="thermabox"`, resp.Header.Get("WWW-Authenticate"))
+	resp, body, _ = gorequest.New().Get(url+"/limits").Set("Authorization", "Bearer wrong").End()
+	requireAPIError(require, resp, body, 401, "unauthorized")
+	resp, _, _ = gorequest.New().Post(base + "/set-limits").Type("form").Send(`{"temperature": 10, "threshold": 1}`).End()
+	require.Equal(401, resp.StatusCode)
+
+	resp, _, _ = gorequest.New().Get(url+"/limits").Set("Authorization", "Bearer reader").End()
+	require.Equal(200, resp.StatusCode)
+	resp, body, _ = gorequest.New().Put(url+"/limits").Set("Authorization", "Bearer reader").Send(`{"temperature": 10, "threshold": 1}`).End()
+	requireAPIError(require, resp, body, 403, "forbidden")
+	resp, _, _ = gorequest.New().Get(url+"/limits").SetBasicAuth("guest", "secret").End()
+	require.Equal(200, resp.StatusCode)
+	resp, body, _ = gorequest.New().Get(url+"/limits").SetBasicAuth("admin", "wrong").End()
+	requireAPIError(require, resp, body, 401, "unauthorized")
+
+	resp, _, _ = gorequest.New().Put(url+"/limits").Set("Authorization", "Bearer controller").Send(`{"temperature": 10, "threshold": 1}`).End()
+	require.Equal(200, resp.StatusCode)
+	resp, _, _ = gorequest.New().Post(base+"/set-limits").SetBasicAuth("admin", "secret").Type("form").Send(`{"temperature": 12, "threshold": 1}`).End()
+	require.Equal(200, resp.StatusCode)
+	temp, _ := tbox.GetLimits()
+	require.Equal(12.0, temp)
+
+	// Only the event stream takes a token in the query
+	resp, body, _ = gorequest.New().Get(url + "/limits?token=reader").End()
+	requireAPIError(require, resp, body, 401, "unauthorized")
+	resp, body, _ = gorequest.New().Get(url + "/events?token=wrong").End()
+	requireAPIError(require, resp, body, 401, "unauthorized")
+	// Authenticated, but the dummy thermabox can not be subscribed to
+	resp, body, _ = gorequest.New().Get(url + "/events?token=reader").End()
+	requireAPIError(require, resp, body, 501, "not_implemented")
+
+	// Static files are open. The page is not, since the browser prompts for
+	// a user
+	resp, _, _ = gorequest.New().Get(base + "/static/js/index.js").End()
+	require.Equal(200, resp.StatusCode)
+	resp, _, _ = gorequest.New().Get(base + "/").End()
+	require.Equal(401, resp.StatusCode)
+
+	// CORS
+	resp, _, _ = gorequest.New().Get(url+"/limits").Set("Authorization", "Bearer reader").Set("Origin", "https://example.com").End()
+	require.Equal("https://example.com", resp.Header.Get("Access-Control-Allow-Origin"))
+	require.Equal("true", resp.Header.Get("Access-Control-Allow-Credentials"))
+	resp, _, _ = gorequest.New().Get(url+"/limits").Set("Authorization", "Bearer reader").Set("Origin", "https://evil.com").End()
+	require.Equal("", resp.Header.Get("Access-Control-Allow-Origin"))
+}
+
+func TestAuthTokensOnly(t *testing.T) {
+	require := require.New(t)
+
+	webserver := New()
+	webserver.Auth = newTestAuth(require)
+	webserver.Auth.Users = nil
+	url, stop := startAPIServer(require, NewDummyThermaboxInterface(), webserver, 31137)
+	defer stop()
+
+	// The page asks for a token itself
+	resp, _, _ := gorequest.New().Get("http://localhost:31137/").End()
+	require.Equal(200, resp.StatusCode)
+	resp, body, _ := gorequest.New().Get(url + "/limits").End()
+	requireAPIError(require, resp, body, 401, "unauthorized")
+	require.Equal("", resp.Header.Get("WWW-Authenticate"))
+}
+
+func TestWebsocketAuth(t *testing.T) {
+	require := require.New(t)
+
+	tbox := NewDummyThermaboxInterface()
+	webserver := New()
+	webserver.Auth = newTestAuth(require)
+	_, stop := startAPIServer(require, tbox, webserver, 31134)
+	defer stop()
+
+	u := url.URL{Scheme: "ws", Host: "localhost:31134", Path: "/ws"}
+	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	require.Nil(err)
+	defer c.Close()
+	client := websockets.NewClient(c)
+	go client.ProcessMessages()
+
+	responses := make(chan interface{}, 1)
+	for _, event := range []string{"authenticate", "get-temperature", "set-limits"} {
+		client.On(event, func(w *websockets.WebsocketClient, data interface{}) {
+			responses <- data
+		})
+	}
+	emit := func(event string, data interface{}) interface{} {
+		require.Nil(client.Emit(event, data))
+		select {
+		case data := <-responses:
+			return data
+		case <-time.After(time.Second):
+			require.FailNow("No response", event)
+			return nil
+		}
+	}
+	limits := map[string]interface{}{"temperature": 10.0, "threshold": 1.0}
+
+	require.Equal("Unauthorized", emit("get-temperature", nil))
+	require.Equal("Invalid credentials", emit("authenticate", map[string]interface{}{"token": "wrong"}))
+	require.Equal("read", emit("authenticate", map[string]interface{}{"token": "reader"}))
+	require.Equal(114.14, emit("get-temperature", nil))
+	require.Equal("Unauthorized", emit("set-limits", limits))
+	temp, _ := tbox.GetLimits()
+	require.Equal(114.14, temp)
+
+	require.Equal("control", emit("authenticate", map[string]interface{}{"username": "admin", "password": "secret"}))
+	require.Equal("OK", emit("set-limits", limits))
+	temp, _ = tbox.GetLimits()
+	require.Equal(10.0, temp)
+}
+
+func TestWebsocketOrigin(t *testing.T) {
+	require := require.New(t)
+
+	webserver := New()
+	webserver.CorsOrigins = []string{"https://example.com"}
+	_, stop := startAPIServer(require, NewDummyThermaboxInterface(), webserver, 31138)
+	defer stop()
+
+	dial := func(origin string) (*http.Response, error) {
+		header := http.Header{}
+		if origin != "" {
+			header.Set("Origin", origin)
+		}
+		c, resp, err := websocket.DefaultDialer.Dial("ws://localhost:31138/ws", header)
+		if err == nil {
+			c.Close()
+		}
+		return resp, err
+	}
+	for _, origin := range []string{"", "http://localhost:31138", "https://example.com"} {
+		_, err := dial(origin)
+		require.Nil(err, origin)
+	}
+	resp, err := dial("https://evil.com")
+	require.NotNil(err)
+	require.Equal(http.StatusForbidden, resp.StatusCode)
+
+	// '*' allows cross-origin requests, but not with credentials, which the
+	// websocket always has
+	check := checkOrigin([]string{"*"})
+	req := httptest.NewRequest("GET", "http://localhost/ws", nil)
+	req.Header.Set("Origin", "https://evil.com")
+	require.False(check(req))
+	require.False(checkOrigin(nil)(req))
+	req.Header.Set("Origin", "http://localhost")
+	require.True(check(req))
+}
+
+func TestWebsocketDisconnect(t *testing.T) {
+	require := require.New(t)
+
+	wsAuth := newWSAuth(newTestAuth(require))
+	server := newWSServer(nil)
+	server.On("authenticate", wsAuth.authenticate)
+	disconnected := make(chan *websockets.WebsocketClient, 1)
+	server.OnDisconnect(wsAuth.remove)
+	server.OnDisconnect(func(w *websockets.WebsocketClient) {
+		disconnected <- w
+	})
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	c, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(ts.URL, "http"), nil)
+	require.Nil(err)
+	client := websockets.NewClient(c)
+	go client.ProcessMessages()
+	responses := make(chan interface{}, 1)
+	client.On("authenticate", func(w *websockets.WebsocketClient, data interface{}) {
+		responses <- data
+	})
+	require.Nil(client.Emit("authenticate", map[string]interface{}{"token": "reader"}))
+	select {
+	case data := <-responses:
+		require.Equal("read", data)
+	case <-time.After(time.Second):
+		require.FailNow("No response")
+	}
+	wsAuth.mutex.Lock()
+	require.Equal(1, len(wsAuth.roles))
+	wsAuth.mutex.Unlock()
+
+	// The role is forgotten once the client disconnects
+	c.Close()
+	select {
+	case w := <-disconnected:
+		require.Equal(ROLE_NONE, wsAuth.role(w))
+	case <-time.After(time.Second):
+		require.FailNow("No disconnect")
+	}
+	wsAuth.mutex.Lock()
+	require.Equal(0, len(wsAuth.roles))
+	wsAuth.mutex.Unlock()
+}
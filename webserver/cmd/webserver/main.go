@@ -11,6 +11,7 @@ import (
 	"github.com/alecthomas/kingpin"
 	easyfiles "github.com/gurupras/go-easyfiles"
 	"github.com/gurupras/go-stoppable-net-listener"
+	thermabox_interfaces "github.com/gurupras/thermabox/interfaces"
 	"github.com/gurupras/thermabox/webserver"
 	log "github.com/sirupsen/logrus"
 )
@@ -18,6 +19,7 @@ import (
 type DummyThermaBoxInterface struct {
 	temperature float64
 	threshold   float64
+	disabled    bool
 }
 
 func (d *DummyThermaBoxInterface) GetTemperature() (float64, error) {
@@ -34,6 +36,23 @@ func (d *DummyThermaBoxInterface) SetLimits(temp float64, threshold float64) {
 	d.threshold = threshold
 }
 
+func (d *DummyThermaBoxInterface) RegisterChannel(c chan *thermabox_interfaces.ThermaboxState) {
+}
+
+func (d *DummyThermaBoxInterface) GetState() string {
+	return string(thermabox_interfaces.STABLE)
+}
+
+func (d *DummyThermaBoxInterface) DisableThermabox() {
+	log.Infof("Disabling thermabox")
+	d.disabled = true
+}
+
+func (d *DummyThermaBoxInterface) EnableThermabox() {
+	log.Infof("Enabling thermabox")
+	d.disabled = false
+}
+
 var (
 	app     = kingpin.New("webserver", "ThermaBox WebServer")
 	port    = app.Flag("port", "webserver port").Short('p').Default("8080").Int()
@@ -51,7 +70,7 @@ func main() {
 
 	if strings.Compare(*conf, "") != 0 {
 		if !easyfiles.Exists(*conf) {
-			log.Fatalf("Configuration file '%v' does not exist!")
+			log.Fatalf("Configuration file '%v' does not exist!", *conf)
 		}
 		ws := webserver.Webserver{}
 		data, err := ioutil.ReadFile(*conf)
@@ -66,7 +85,7 @@ func main() {
 	}
 
 	dummy := &DummyThermaBoxInterface{}
-	handler, err := webserver.InitializeWebServer(*path, "/", dummy, nil)
+	handler, err := webserver.InitializeWebServer(*path, "/", dummy, nil, webserver.New())
 	if err != nil {
 		log.Fatalf("%v", err)
 	}
@@ -0,0 +1,234 @@
+package webserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	thermabox_interfaces "github.com/gurupras/thermabox/interfaces"
+	websockets "github.com/homesound/simple-websockets"
+	log "github.com/sirupsen/logrus"
+)
+
+// throttle lets through at most one state per interval
+type throttle struct {
+	interval time.Duration
+	last     time.Time
+}
+
+func (t *throttle) allow(now time.Time) bool {
+	if !t.last.IsZero() && now.Sub(t.last) < t.interval {
+		return false
+	}
+	t.last = now
+	return true
+}
+
+// alertBuffer is the number of alerts buffered for a client before the
+// oldest are dropped
+const alertBuffer = 16
+
+// subscription is a client's subscription to the states and, if the
+// thermabox raises them, the alerts of the thermabox
+type subscription struct {
+	states thermabox_interfaces.Subscription
+	alerts thermabox_interfaces.AlertSubscription
+}
+
+// subscribe subscribes a client to tbox. Only the latest state matters to a
+// client, so states are coalesced while it is busy. Alerts are all kept
+func subscribe(tbox thermabox_interfaces.ThermaboxInterface) (*subscription, error) {
+	subscriber, ok := tbox.(thermabox_interfaces.ThermaboxSubscriberInterface)
+	if !ok {
+		return nil, notImplemented("Thermabox does not support subscribing")
+	}
+	s := &subscription{states: subscriber.Subscribe(1, thermabox_interfaces.COALESCE)}
+	if alerter, ok := tbox.(thermabox_interfaces.AlertSubscriberInterface); ok {
+		s.alerts = alerter.SubscribeAlerts(alertBuffer, thermabox_interfaces.DROP_OLDEST)
+	}
+	return s, nil
+}
+
+// alertC returns the channel of alerts, which is nil if the thermabox does
+// not raise alerts
+func (s *subscription) alertC() <-chan *thermabox_interfaces.Alert {
+	if s.alerts == nil {
+		return nil
+	}
+	return s.alerts.C()
+}
+
+func (s *subscription) Unsubscribe() {
+	s.states.Unsubscribe()
+	if s.alerts != nil {
+		s.alerts.Unsubscribe()
+	}
+}
+
+func parseInterval(str string) (time.Duration, error) {
+	if str == "" {
+		return 0, nil
+	}
+	interval, err := strconv.ParseFloat(str, 64)
+	if err != nil || interval < 0 {
+		return 0, badRequest("Failed to parse interval: %v", str)
+	}
+	return time.Duration(interval * float64(time.Second)), nil
+}
+
+// EventsHandler streams every state published by the thermabox and every
+// alert it raises as Server-Sent Events until the client disconnects. The
+// 'interval' query parameter limits the stream to one state every so many
+// seconds. Alerts are never held back
+func EventsHandler(webserver *Webserver, tbox thermabox_interfaces.ThermaboxInterface, w http.ResponseWriter, req *http.Request) error {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return fmt.Errorf("Streaming is not supported")
+	}
+	interval, err := parseInterval(req.FormValue("interval"))
+	if err != nil {
+		return err
+	}
+	sub, err := subscribe(tbox)
+	if err != nil {
+		return err
+	}
+	defer sub.Unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+	flusher.Flush()
+	send := func(event string, data interface{}) error {
+		b, err := json.Marshal(data)
+		if err != nil {
+			log.Errorf("Failed to marshal %v: %v", event, err)
+			return nil
+		}
+		if _, err := fmt.Fprintf(w, "event: %v\ndata: %s\n\n", event, b); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+	t := &throttle{interval: interval}
+	sendState := func(state *thermabox_interfaces.ThermaboxState) error {
+		if !t.allow(time.Now()) {
+			return nil
+		}
+		return send("state", state)
+	}
+	// The latest state is sent immediately
+	if state := webserver.getState(); state != nil {
+		if sendState(state) != nil {
+			return nil
+		}
+	}
+	for {
+		select {
+		case <-req.Context().Done():
+			return nil
+		case state, ok := <-sub.states.C():
+			if !ok || sendState(state) != nil {
+				return nil
+			}
+		case alert, ok := <-sub.alertC():
+			if !ok || send("alert", alert) != nil {
+				return nil
+			}
+		}
+	}
+}
+
+// wsSubscriptions tracks the websocket clients that subscribed to states and
+// alerts through the 'subscribe' event
+type wsSubscriptions struct {
+	webserver     *Webserver
+	tbox          thermabox_interfaces.ThermaboxInterface
+	subscriptions map[*websockets.WebsocketClient]*subscription
+	mutex         sync.Mutex
+}
+
+func newWSSubscriptions(webserver *Webserver, tbox thermabox_interfaces.ThermaboxInterface) *wsSubscriptions {
+	return &wsSubscriptions{
+		webserver:     webserver,
+		tbox:          tbox,
+		subscriptions: make(map[*websockets.WebsocketClient]*subscription),
+	}
+}
+
+// subscribe handles the 'subscribe' event. Every state is then emitted to
+// the client as a 'state' event, at most once every data["interval"]
+// seconds, and every alert as an 'alert' event. Subscribing again replaces
+// the interval
+func (ws *wsSubscriptions) subscribe(w *websockets.WebsocketClient, data interface{}) {
+	m, _ := data.(map[string]interface{})
+	var interval time.Duration
+	if val, ok := m["interval"]; ok {
+		seconds, ok := val.(float64)
+		if !ok || seconds < 0 {
+			w.Emit("subscribe", fmt.Sprintf("Failed to parse interval: %v", val))
+			return
+		}
+		interval = time.Duration(seconds * float64(time.Second))
+	}
+	ws.remove(w)
+	sub, err := subscribe(ws.tbox)
+	if err != nil {
+		w.Emit("subscribe", err.Error())
+		return
+	}
+	ws.mutex.Lock()
+	ws.subscriptions[w] = sub
+	ws.mutex.Unlock()
+	w.Emit("subscribe", "OK")
+	go func() {
+		emit := func(event string, data interface{}) bool {
+			// The client is only found to be gone once an emit fails
+			if err := w.Emit(event, data); err != nil {
+				log.Debugf("[websockets]: [%v]: Client went away: %v", event, err)
+				ws.remove(w)
+				return false
+			}
+			return true
+		}
+		t := &throttle{interval: interval}
+		emitState := func(state *thermabox_interfaces.ThermaboxState) bool {
+			return !t.allow(time.Now()) || emit("state", state)
+		}
+		if state := ws.webserver.getState(); state != nil && !emitState(state) {
+			return
+		}
+		for {
+			select {
+			case state, ok := <-sub.states.C():
+				if !ok || !emitState(state) {
+					return
+				}
+			case alert, ok := <-sub.alertC():
+				if !ok || !emit("alert", alert) {
+					return
+				}
+			}
+		}
+	}()
+}
+
+// unsubscribe handles the 'unsubscribe' event
+func (ws *wsSubscriptions) unsubscribe(w *websockets.WebsocketClient, data interface{}) {
+	ws.remove(w)
+	w.Emit("unsubscribe", "OK")
+}
+
+func (ws *wsSubscriptions) remove(w *websockets.WebsocketClient) {
+	ws.mutex.Lock()
+	sub, ok := ws.subscriptions[w]
+	delete(ws.subscriptions, w)
+	ws.mutex.Unlock()
+	if ok {
+		sub.Unsubscribe()
+	}
+}
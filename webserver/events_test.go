@@ -0,0 +1,293 @@
+package webserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	thermabox_interfaces "github.com/gurupras/thermabox/interfaces"
+	websockets "github.com/homesound/simple-websockets"
+	"github.com/parnurzeal/gorequest"
+	"github.com/stretchr/testify/require"
+)
+
+// DummySubscriberThermabox publishes states to its subscribers, coalescing
+// them like the thermabox does, and raises alerts
+type DummySubscriberThermabox struct {
+	*DummyThermaboxInterface
+	subscriptions      map[*dummySubscription]bool
+	alertSubscriptions map[*dummyAlertSubscription]bool
+	mutex              sync.Mutex
+}
+
+type dummySubscription struct {
+	tbox *DummySubscriberThermabox
+	c    chan *thermabox_interfaces.ThermaboxState
+}
+
+func NewDummySubscriberThermabox() *DummySubscriberThermabox {
+	return &DummySubscriberThermabox{
+		DummyThermaboxInterface: NewDummyThermaboxInterface(),
+		subscriptions:           make(map[*dummySubscription]bool),
+		alertSubscriptions:      make(map[*dummyAlertSubscription]bool),
+	}
+}
+
+func (d *DummySubscriberThermabox) Subscribe(buffer int, policy thermabox_interfaces.BufferPolicy) thermabox_interfaces.Subscription {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	s := &dummySubscription{d, make(chan *thermabox_interfaces.ThermaboxState, 1)}
+	d.subscriptions[s] = true
+	return s
+}
+
+func (d *DummySubscriberThermabox) publish(state *thermabox_interfaces.ThermaboxState) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for s := range d.subscriptions {
+		select {
+		case <-s.c:
+		default:
+		}
+		s.c <- state
+	}
+}
+
+func (d *DummySubscriberThermabox) SubscribeAlerts(buffer int, policy thermabox_interfaces.BufferPolicy) thermabox_interfaces.AlertSubscription {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	s := &dummyAlertSubscription{d, make(chan *thermabox_interfaces.Alert, buffer)}
+	d.alertSubscriptions[s] = true
+	return s
+}
+
+func (d *DummySubscriberThermabox) alert(alert *thermabox_interfaces.Alert) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for s := range d.alertSubscriptions {
+		s.c <- alert
+	}
+}
+
+// numSubscriptions returns the number of state and alert subscriptions
+func (d *DummySubscriberThermabox) numSubscriptions() (int, int) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return len(d.subscriptions), len(d.alertSubscriptions)
+}
+
+func (s *dummySubscription) C() <-chan *thermabox_interfaces.ThermaboxState {
+	return s.c
+}
+
+func (s *dummySubscription) Unsubscribe() {
+	s.tbox.mutex.Lock()
+	defer s.tbox.mutex.Unlock()
+	if s.tbox.subscriptions[s] {
+		delete(s.tbox.subscriptions, s)
+		close(s.c)
+	}
+}
+
+func (s *dummySubscription) Dropped() uint64 {
+	return 0
+}
+
+type dummyAlertSubscription struct {
+	tbox *DummySubscriberThermabox
+	c    chan *thermabox_interfaces.Alert
+}
+
+func (s *dummyAlertSubscription) C() <-chan *thermabox_interfaces.Alert {
+	return s.c
+}
+
+func (s *dummyAlertSubscription) Unsubscribe() {
+	s.tbox.mutex.Lock()
+	defer s.tbox.mutex.Unlock()
+	if s.tbox.alertSubscriptions[s] {
+		delete(s.tbox.alertSubscriptions, s)
+		close(s.c)
+	}
+}
+
+func (s *dummyAlertSubscription) Dropped() uint64 {
+	return 0
+}
+
+func TestThrottle(t *testing.T) {
+	require := require.New(t)
+
+	th := &throttle{interval: time.Second}
+	now := time.Now()
+	require.True(th.allow(now))
+	// Within the interval
+	require.False(th.allow(now.Add(500 * time.Millisecond)))
+	require.True(th.allow(now.Add(time.Second)))
+	require.False(th.allow(now.Add(1500 * time.Millisecond)))
+
+	// Without an interval, everything is let through
+	th = &throttle{}
+	require.True(th.allow(now))
+	require.True(th.allow(now))
+}
+
+func TestEventsRoute(t *testing.T) {
+	require := require.New(t)
+
+	webserver := New()
+	url, stop := startAPIServer(require, NewDummyThermaboxInterface(), webserver, 31135)
+	resp, body, _ := gorequest.New().Get(url + "/events").End()
+	requireAPIError(require, resp, body, 501, "not_implemented")
+	stop()
+
+	tbox := NewDummySubscriberThermabox()
+	url, stop = startAPIServer(require, tbox, webserver, 31135)
+	defer stop()
+
+	resp, body, _ = gorequest.New().Get(url + "/events?interval=abc").End()
+	requireAPIError(require, resp, body, 400, "bad_request")
+	resp, body, _ = gorequest.New().Post(url + "/events").End()
+	requireAPIError(require, resp, body, 405, "method_not_allowed")
+
+	webserver.setState(&thermabox_interfaces.ThermaboxState{Temperature: 20})
+	res, err := http.Get(url + "/events")
+	require.Nil(err)
+	defer res.Body.Close()
+	require.Equal(200, res.StatusCode)
+	require.Equal("text/event-stream", res.Header.Get("Content-Type"))
+
+	reader := bufio.NewReader(res.Body)
+	next := func(event string, v interface{}) {
+		line, err := reader.ReadString('\n')
+		require.Nil(err)
+		require.Equal("event: "+event+"\n", line)
+		data, err := reader.ReadString('\n')
+		require.Nil(err)
+		require.True(strings.HasPrefix(data, "data: "), data)
+		require.Nil(json.Unmarshal([]byte(strings.TrimPrefix(data, "data: ")), v))
+		blank, err := reader.ReadString('\n')
+		require.Nil(err)
+		require.Equal("\n", blank)
+	}
+	nextState := func() *thermabox_interfaces.ThermaboxState {
+		state := &thermabox_interfaces.ThermaboxState{}
+		next("state", state)
+		return state
+	}
+	// The latest state is sent on connecting
+	require.Equal(20.0, nextState().Temperature)
+	states, alerts := tbox.numSubscriptions()
+	require.Equal(1, states)
+	require.Equal(1, alerts)
+	tbox.publish(&thermabox_interfaces.ThermaboxState{Temperature: 21})
+	require.Equal(21.0, nextState().Temperature)
+
+	tbox.alert(&thermabox_interfaces.Alert{Type: thermabox_interfaces.RELAY_FAULT, Message: "stuck"})
+	alert := &thermabox_interfaces.Alert{}
+	next("alert", alert)
+	require.Equal(thermabox_interfaces.RELAY_FAULT, alert.Type)
+	require.Equal("stuck", alert.Message)
+
+	// Every client has its own subscription, which ends when it disconnects
+	res.Body.Close()
+	time.Sleep(100 * time.Millisecond)
+	states, alerts = tbox.numSubscriptions()
+	require.Equal(0, states)
+	require.Equal(0, alerts)
+}
+
+func TestWebsocketSubscribe(t *testing.T) {
+	require := require.New(t)
+
+	webserver := New()
+	tbox := NewDummySubscriberThermabox()
+	_, stop := startAPIServer(require, tbox, webserver, 31136)
+	defer stop()
+
+	u := url.URL{Scheme: "ws", Host: "localhost:31136", Path: "/ws"}
+	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	require.Nil(err)
+	defer c.Close()
+	client := websockets.NewClient(c)
+	go client.ProcessMessages()
+
+	responses := make(chan interface{}, 1)
+	for _, event := range []string{"subscribe", "unsubscribe"} {
+		client.On(event, func(w *websockets.WebsocketClient, data interface{}) {
+			responses <- data
+		})
+	}
+	states := make(chan float64, 10)
+	client.On("state", func(w *websockets.WebsocketClient, data interface{}) {
+		states <- data.(map[string]interface{})["temperature"].(float64)
+	})
+	alerts := make(chan string, 10)
+	client.On("alert", func(w *websockets.WebsocketClient, data interface{}) {
+		alerts <- data.(map[string]interface{})["message"].(string)
+	})
+	emit := func(event string, data interface{}) interface{} {
+		require.Nil(client.Emit(event, data))
+		select {
+		case data := <-responses:
+			return data
+		case <-time.After(time.Second):
+			require.FailNow("No response", event)
+			return nil
+		}
+	}
+	nextState := func() float64 {
+		select {
+		case temp := <-states:
+			return temp
+		case <-time.After(time.Second):
+			require.FailNow("No state")
+			return 0
+		}
+	}
+
+	require.Contains(emit("subscribe", map[string]interface{}{"interval": "abc"}), "Failed")
+	require.Equal("OK", emit("subscribe", map[string]interface{}{"interval": 0}))
+	tbox.publish(&thermabox_interfaces.ThermaboxState{Temperature: 20})
+	require.Equal(20.0, nextState())
+
+	// Throttled to one state an hour. Subscribing again replaces the
+	// subscription
+	webserver.setState(&thermabox_interfaces.ThermaboxState{Temperature: 20})
+	require.Equal("OK", emit("subscribe", map[string]interface{}{"interval": 3600}))
+	require.Equal(20.0, nextState())
+	numStates, numAlerts := tbox.numSubscriptions()
+	require.Equal(1, numStates)
+	require.Equal(1, numAlerts)
+	tbox.publish(&thermabox_interfaces.ThermaboxState{Temperature: 21})
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(0, len(states))
+
+	// Alerts are not throttled
+	tbox.alert(&thermabox_interfaces.Alert{Type: thermabox_interfaces.RELAY_FAULT, Message: "stuck"})
+	select {
+	case msg := <-alerts:
+		require.Equal("stuck", msg)
+	case <-time.After(time.Second):
+		require.FailNow("No alert")
+	}
+
+	require.Equal("OK", emit("unsubscribe", nil))
+	numStates, numAlerts = tbox.numSubscriptions()
+	require.Equal(0, numStates)
+	require.Equal(0, numAlerts)
+
+	// Disconnecting ends the subscription
+	require.Equal("OK", emit("subscribe", nil))
+	c.Close()
+	time.Sleep(100 * time.Millisecond)
+	numStates, numAlerts = tbox.numSubscriptions()
+	require.Equal(0, numStates)
+	require.Equal(0, numAlerts)
+}
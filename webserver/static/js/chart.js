@@ -0,0 +1,177 @@
+// A small canvas chart of temperature against the setpoint band, with the
+// periods the heating and cooling elements were on shaded behind it.
+// Samples are in the format returned by /api/history
+function TemperatureChart(canvas) {
+	this.canvas = canvas;
+	this.ctx = canvas.getContext('2d');
+	this.samples = [];
+	this.from = 0;
+	this.to = 0;
+	this.padding = {left: 50, right: 15, top: 15, bottom: 30};
+	this.colors = {
+		temperature: '#212121',
+		setpoint: '#1e88e5',
+		band: 'rgba(30, 136, 229, 0.15)',
+		heating: 'rgba(229, 57, 53, 0.2)',
+		cooling: 'rgba(3, 169, 244, 0.2)',
+		grid: '#e0e0e0',
+		text: '#616161',
+	};
+}
+
+TemperatureChart.prototype.setWindow = function(from, to) {
+	this.from = from;
+	this.to = to;
+	// Drop samples that have scrolled out of the window
+	while (this.samples.length > 0 && this.samples[0].timestamp + this.samples[0].duration < from) {
+		this.samples.shift();
+	}
+};
+
+TemperatureChart.prototype.setSamples = function(samples) {
+	this.samples = samples.slice();
+};
+
+// addSample appends a live sample. Samples that are not newer than the last
+// one are ignored
+TemperatureChart.prototype.addSample = function(sample) {
+	var last = this.samples[this.samples.length - 1];
+	if (last && last.timestamp >= sample.timestamp) {
+		return;
+	}
+	// Live samples last until the next one
+	if (last && !last.duration) {
+		last.duration = sample.timestamp - last.timestamp;
+	}
+	this.samples.push(sample);
+};
+
+TemperatureChart.prototype.resize = function() {
+	var ratio = window.devicePixelRatio || 1;
+	var width = this.canvas.clientWidth;
+	var height = this.canvas.clientHeight;
+	this.canvas.width = width * ratio;
+	this.canvas.height = height * ratio;
+	this.ctx.setTransform(ratio, 0, 0, ratio, 0, 0);
+	this.width = width;
+	this.height = height;
+};
+
+TemperatureChart.prototype.range = function() {
+	var min = Infinity;
+	var max = -Infinity;
+	this.samples.forEach(function(s) {
+		var low = 'min_temperature' in s ? s.min_temperature : s.temperature;
+		var high = 'max_temperature' in s ? s.max_temperature : s.temperature;
+		min = Math.min(min, low, s.setpoint - s.threshold);
+		max = Math.max(max, high, s.setpoint + s.threshold);
+	});
+	if (min === Infinity) {
+		return {min: 0, max: 1};
+	}
+	var margin = Math.max((max - min) * 0.1, 0.5);
+	return {min: Math.floor(min - margin), max: Math.ceil(max + margin)};
+};
+
+TemperatureChart.prototype.draw = function() {
+	this.resize();
+	var self = this;
+	var ctx = this.ctx;
+	var p = this.padding;
+	var plotWidth = this.width - p.left - p.right;
+	var plotHeight = this.height - p.top - p.bottom;
+	var range = this.range();
+	var span = Math.max(this.to - this.from, 1);
+
+	var x = function(t) {
+		return p.left + (t - self.from) / span * plotWidth;
+	};
+	var y = function(temp) {
+		return p.top + (range.max - temp) / (range.max - range.min) * plotHeight;
+	};
+	var end = function(s) {
+		return Math.min(s.timestamp + (s.duration || 0), self.to);
+	};
+
+	ctx.clearRect(0, 0, this.width, this.height);
+	ctx.save();
+	ctx.beginPath();
+	ctx.rect(p.left, p.top, plotWidth, plotHeight);
+	ctx.clip();
+
+	// Element periods. The fraction of the interval an element was on
+	// sets the opacity of its shading
+	this.samples.forEach(function(s) {
+		[['heating', s.heating], ['cooling', s.cooling]].forEach(function(e) {
+			if (!e[1]) {
+				return;
+			}
+			ctx.globalAlpha = Math.min(e[1], 1);
+			ctx.fillStyle = self.colors[e[0]];
+			ctx.fillRect(x(s.timestamp), p.top, Math.max(x(end(s)) - x(s.timestamp), 1), plotHeight);
+		});
+	});
+	ctx.globalAlpha = 1;
+
+	// Setpoint band
+	ctx.fillStyle = this.colors.band;
+	this.samples.forEach(function(s) {
+		ctx.fillRect(x(s.timestamp), y(s.setpoint + s.threshold), Math.max(x(end(s)) - x(s.timestamp), 1), y(s.setpoint - s.threshold) - y(s.setpoint + s.threshold));
+	});
+	this.line(function(s) { return s.setpoint; }, x, y, this.colors.setpoint, 1);
+	this.line(function(s) { return s.temperature; }, x, y, this.colors.temperature, 2);
+	ctx.restore();
+
+	this.axes(x, y, range);
+};
+
+TemperatureChart.prototype.line = function(value, x, y, color, width) {
+	var ctx = this.ctx;
+	ctx.strokeStyle = color;
+	ctx.lineWidth = width;
+	ctx.beginPath();
+	this.samples.forEach(function(s, idx) {
+		// Plot each sample at the middle of its interval
+		var t = s.timestamp + (s.duration || 0) / 2;
+		if (idx === 0) {
+			ctx.moveTo(x(t), y(value(s)));
+		} else {
+			ctx.lineTo(x(t), y(value(s)));
+		}
+	});
+	ctx.stroke();
+};
+
+TemperatureChart.prototype.axes = function(x, y, range) {
+	var ctx = this.ctx;
+	var p = this.padding;
+	ctx.strokeStyle = this.colors.grid;
+	ctx.fillStyle = this.colors.text;
+	ctx.lineWidth = 1;
+	ctx.font = '11px Roboto, sans-serif';
+
+	var step = Math.max(Math.ceil((range.max - range.min) / 6), 1);
+	ctx.textAlign = 'right';
+	ctx.textBaseline = 'middle';
+	for (var temp = range.min; temp <= range.max; temp += step) {
+		ctx.beginPath();
+		ctx.moveTo(p.left, y(temp));
+		ctx.lineTo(this.width - p.right, y(temp));
+		ctx.stroke();
+		ctx.fillText(temp + '°C', p.left - 5, y(temp));
+	}
+
+	var span = this.to - this.from;
+	var ticks = 6;
+	ctx.textAlign = 'center';
+	ctx.textBaseline = 'top';
+	for (var i = 0; i <= ticks; i++) {
+		var t = this.from + span * i / ticks;
+		var date = new Date(t);
+		var label = date.toLocaleTimeString([], {hour: '2-digit', minute: '2-digit'});
+		if (span > 24 * 3600 * 1000) {
+			label = date.toLocaleDateString([], {month: 'short', day: 'numeric'}) + ' ' + label;
+		}
+		ctx.fillText(label, x(t), this.height - p.bottom + 5);
+	}
+};
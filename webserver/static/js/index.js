@@ -1,35 +1,162 @@
-var socket;
+var chart;
+
+// Token sent with every request when the thermabox is configured with auth
+// tokens. Users with a password are prompted for by the browser instead
+var token = localStorage.getItem('token');
+var loggingIn = false;
+
+// login asks for a token and reloads the page with it
+function login() {
+	if (loggingIn) {
+		return;
+	}
+	loggingIn = true;
+	var t = window.prompt('Token');
+	if (t) {
+		localStorage.setItem('token', t);
+		location.reload();
+	}
+}
+
+// Length of the chart window in seconds
+var chartWindow = 3600;
+// Number of points to request from the history over a window
+var chartPoints = 300;
+// Windows up to this long are extended with the live state between
+// history refreshes
+var liveWindow = 6 * 3600;
+
+function updateStatus(status) {
+	$('#currentTemp').text(status.temperature.toFixed(2));
+	$('#state').text(status.state.replace('_', ' '));
+	$('#setpoint').text(status.setpoint + ' ± ' + status.threshold + '°C');
+	[['#heatingIndicator', status.heating_element], ['#coolingIndicator', status.cooling_element]].forEach(function(e) {
+		var indicator = $(e[0]);
+		var text = e[1].on ? 'on' : 'off';
+		if (e[1].pending) {
+			text = 'waiting';
+		}
+		indicator.toggleClass('on', e[1].on);
+		indicator.find('.element-status').text(text);
+	});
+	if (status.fault) {
+		$('#fault').text(status.fault);
+		$('#faultDiv').show();
+	} else {
+		$('#faultDiv').hide();
+	}
+
+	if (chartWindow <= liveWindow) {
+		chart.addSample({
+			timestamp: status.timestamp,
+			duration: 0,
+			temperature: status.temperature,
+			setpoint: status.setpoint,
+			threshold: status.threshold,
+			heating: status.heating_element.on ? 1 : 0,
+			cooling: status.cooling_element.on ? 1 : 0,
+		});
+		var now = Date.now();
+		chart.setWindow(now - chartWindow * 1000, now);
+		chart.draw();
+	}
+}
+
+function loadHistory() {
+	var to = Date.now();
+	var from = to - chartWindow * 1000;
+	$.get('/api/v1/history', {
+		from: from,
+		to: to,
+		resolution: Math.floor(chartWindow / chartPoints),
+	}, function(data) {
+		chart.setSamples(data);
+		chart.setWindow(from, to);
+		chart.draw();
+	}).fail(function(xhr) {
+		console.log('Failed to load history: ' + xhr.responseText);
+		chart.setSamples([]);
+		chart.setWindow(from, to);
+		chart.draw();
+	});
+}
+
 window.onload = function() {
-	socket = io();
+	chart = new TemperatureChart(document.getElementById('chart'));
+
+	$.ajaxSetup({
+		beforeSend: function(xhr) {
+			if (token) {
+				xhr.setRequestHeader('Authorization', 'Bearer ' + token);
+			}
+		},
+	});
+	// Without WWW-Authenticate, the browser does not prompt for a user, so
+	// a token is needed
+	$(document).ajaxError(function(e, xhr) {
+		if (xhr.status === 401 && !xhr.getResponseHeader('WWW-Authenticate')) {
+			login();
+		}
+	});
 
-	socket.on('get-temperature', function(msg) {
-		console.log("socket.io [get-temperature]: json stringify: " + JSON.stringify(msg));
-		$('#currentTemp').text(msg.temp);
+	// The server pushes the state as it is published. EventSource reconnects
+	// on its own if the stream is dropped. It can not set headers, so the
+	// token is sent in the query
+	var url = '/api/v1/events?interval=1';
+	if (token) {
+		url += '&token=' + encodeURIComponent(token);
+	}
+	var events = new EventSource(url);
+	events.addEventListener('state', function(e) {
+		updateStatus(JSON.parse(e.data));
 	});
 
+	// Refresh the history about as often as a new point is due
+	var lastLoad = 0;
 	setInterval(function() {
-		socket.emit('get-temperature');
-		$.get('/get-temperature', function(data) {
-			$('#currentTemp').text(data);
-		});
-	}, 300);
+		if (Date.now() - lastLoad >= Math.max(chartWindow / chartPoints, 10) * 1000) {
+			lastLoad = Date.now();
+			loadHistory();
+		}
+	}, 5000);
+
+	$('#windows .window').on('click', function() {
+		$('#windows .window').removeClass('active');
+		$(this).addClass('active');
+		chartWindow = Number($(this).data('window'));
+		lastLoad = Date.now();
+		loadHistory();
+	});
+
+	$(window).on('resize', function() {
+		chart.draw();
+	});
+
+	$('#resetFault').on('click', function() {
+		$.post('/api/v1/fault/reset');
+	});
 
 	$('#sync').on('click', function() {
 		var data = {
 			temp: Number($('#temperature').val()),
 			threshold: Number($('#threshold').val()),
 		};
-		socket.emit('set-limits', data);
-		$.post("/set-limits", {
-			temperature: data.temp,
-			threshold: data.threshold,
+		$.ajax({
+			url: '/api/v1/limits',
+			method: 'PUT',
+			contentType: 'application/json',
+			data: JSON.stringify({temperature: data.temp, threshold: data.threshold}),
+		}).fail(function(xhr) {
+			Materialize.toast(JSON.parse(xhr.responseText).error.message, 4000);
 		});
 	});
 
 	// Update the current limits
-	$.get("/get-limits", function(data) {
-		var json = JSON.parse(data);
+	$.get('/api/v1/limits', function(json) {
 		$('#temperature').val(json.temperature);
 		$('#threshold').val(json.threshold);
 	});
+
+	lastLoad = Date.now();
+	loadHistory();
 }
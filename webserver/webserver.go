@@ -6,10 +6,12 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 
 	yaml "gopkg.in/yaml.v2"
 
@@ -28,7 +30,17 @@ type Webserver struct {
 	Forward string            `yaml:"forward"`
 	Publish string            `yaml:"publish"`
 	Https   map[string]string `yaml:"https"`
-	snl     *stoppablenetlistener.StoppableNetListener
+	Auth    *Auth             `yaml:"auth"`
+	// CorsOrigins are the origins allowed to make cross-origin requests.
+	// Every origin is allowed by default. The websocket only accepts
+	// cross-origin connections from origins that are listed
+	CorsOrigins []string `yaml:"cors_origins"`
+	snl         *stoppablenetlistener.StoppableNetListener
+	// Latest state published by the thermabox
+	state *thermabox_interfaces.ThermaboxState
+	// Subscription to the thermabox's states, if it supports subscribing
+	subscription thermabox_interfaces.Subscription
+	mutex        sync.Mutex
 }
 
 func New() *Webserver {
@@ -86,15 +98,37 @@ unmarshal:
 		w.Https["key"] = https["key"].(string)
 		w.Https["cert"] = https["cert"].(string)
 	}
+	if data, ok := m["auth"]; ok {
+		auth, err := parseAuth(data)
+		if err != nil {
+			return err
+		}
+		w.Auth = auth
+	}
+	w.CorsOrigins = []string{"*"}
+	if data, ok := m["cors_origins"]; ok {
+		origins, ok := data.([]interface{})
+		if !ok {
+			return fmt.Errorf("Failed while parsing cors_origins: %v", data)
+		}
+		w.CorsOrigins = make([]string, len(origins))
+		for idx, origin := range origins {
+			w.CorsOrigins[idx] = fmt.Sprintf("%v", origin)
+		}
+	}
 	return nil
 }
 
 func (w *Webserver) Stop() {
 	if w.snl != nil {
-		log.Info("Stopping webserver on port: %v", w.Port)
+		log.Infof("Stopping webserver on port: %v", w.Port)
 		w.snl.Stop()
 		w.snl = nil
 	}
+	if w.subscription != nil {
+		w.subscription.Unsubscribe()
+		w.subscription = nil
+	}
 }
 
 func (w *Webserver) SetLimits(tbox thermabox_interfaces.ThermaboxInterface, temp float64, threshold float64) {
@@ -116,34 +150,58 @@ func (w *Webserver) EnableThermabox(tbox thermabox_interfaces.ThermaboxInterface
 	tbox.EnableThermabox()
 }
 
+func (w *Webserver) setState(state *thermabox_interfaces.ThermaboxState) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.state = state
+}
+
+func (w *Webserver) getState() *thermabox_interfaces.ThermaboxState {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.state
+}
+
 func (w *Webserver) Start(tbox thermabox_interfaces.ThermaboxInterface) {
 	handler, err := InitializeWebServer(w.Path, "/", tbox, nil, w)
 	if err != nil {
 		log.Fatalf("%v", err)
 	}
 
-	// Register a channel with thermabox to receive updated
-	tboxChan := make(chan *thermabox_interfaces.ThermaboxState, 0)
+	// Receive the states published by the thermabox. Only the latest state
+	// matters, so states are coalesced while a publish is in progress
+	var states <-chan *thermabox_interfaces.ThermaboxState
+	if subscriber, ok := tbox.(thermabox_interfaces.ThermaboxSubscriberInterface); ok {
+		w.subscription = subscriber.Subscribe(1, thermabox_interfaces.COALESCE)
+		states = w.subscription.C()
+	} else {
+		tboxChan := make(chan *thermabox_interfaces.ThermaboxState, 1)
+		tbox.RegisterChannel(tboxChan)
+		states = tboxChan
+	}
 	go func() {
-		for data := range tboxChan {
+		for data := range states {
+			w.setState(data)
 			if strings.Compare(w.Publish, "") != 0 {
 				gorequest.New().Post(w.Publish).Send(data).End()
 			}
 		}
 	}()
-	tbox.RegisterChannel(tboxChan)
+
+	if !w.Auth.Enabled() {
+		log.Warnf("No auth configured. Anyone who can reach port %v can control the thermabox", w.Port)
+	}
 
 	mux := http.NewServeMux()
 	mux.Handle("/", handler)
-	corsHandler := cors.Default().Handler(mux)
 	server := http.Server{}
-	server.Handler = corsHandler
+	server.Handler = mux
 	snl, err := stoppablenetlistener.New(w.Port)
 	if err != nil {
 		log.Fatalf("%v", err)
 	}
 	w.snl = snl
-	log.Info("Starting webserver on port: %v", w.Port)
+	log.Infof("Starting webserver on port: %v", w.Port)
 	if len(w.Https) == 0 {
 		// Only HTTP server
 		server.Serve(snl)
@@ -163,6 +221,53 @@ func (w *Webserver) Start(tbox thermabox_interfaces.ThermaboxInterface) {
 	}
 }
 
+// corsHandler allows cross-origin requests from origins. Credentials are
+// only allowed when the origins are listed rather than '*'
+func corsHandler(origins []string, next http.Handler) http.Handler {
+	if len(origins) == 0 {
+		origins = []string{"*"}
+	}
+	return cors.New(cors.Options{
+		AllowedOrigins:   origins,
+		AllowedMethods:   []string{"GET", "HEAD", "POST", "PUT", "DELETE"},
+		AllowedHeaders:   []string{"Authorization", "Content-Type"},
+		AllowCredentials: !allowsAnyOrigin(origins),
+	}).Handler(next)
+}
+
+func allowsAnyOrigin(origins []string) bool {
+	for _, origin := range origins {
+		if origin == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// checkOrigin allows requests without an origin, from the same origin and
+// from the origins that corsHandler allows to send credentials, i.e. only
+// when origins are listed rather than '*'
+func checkOrigin(origins []string) func(req *http.Request) bool {
+	return func(req *http.Request) bool {
+		origin := req.Header.Get("Origin")
+		if origin == "" {
+			return true
+		}
+		if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, req.Host) {
+			return true
+		}
+		if allowsAnyOrigin(origins) {
+			return false
+		}
+		for _, allowed := range origins {
+			if strings.EqualFold(allowed, origin) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
 func IndexHandler(path string, w http.ResponseWriter, req *http.Request) error {
 	indexFile := filepath.Join(path, "static", "html", "index.html")
 	f, err := os.Open(indexFile)
@@ -174,32 +279,30 @@ func IndexHandler(path string, w http.ResponseWriter, req *http.Request) error {
 	return err
 }
 
+// The handlers below serve the legacy routes. They are shims over the same
+// calls as the /api/v1 routes, keeping the legacy response formats
+
 func GetTemperatureHandler(webserver *Webserver, tbox thermabox_interfaces.ThermaboxInterface, w http.ResponseWriter, req *http.Request) error {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.WriteHeader(200)
-	temp, err := tbox.GetTemperature()
+	temp, err := getTemperature(tbox)
 	if err != nil {
 		return err
 	}
+	w.WriteHeader(200)
 	w.Write([]byte(fmt.Sprintf("%v", temp)))
 	return nil
 }
 
 func GetTemperatureLimits(webserver *Webserver, tbox thermabox_interfaces.ThermaboxInterface, w http.ResponseWriter, req *http.Request) error {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	b, err := json.Marshal(getLimits(tbox))
+	if err != nil {
+		return err
+	}
 	w.WriteHeader(200)
-	temp, threshold := tbox.GetLimits()
-	m := make(map[string]interface{})
-	m["temperature"] = temp
-	m["threshold"] = threshold
-	b, _ := json.Marshal(m)
 	w.Write(b)
 	return nil
 }
 
 func SetTemperatureLimits(webserver *Webserver, tbox thermabox_interfaces.ThermaboxInterface, w http.ResponseWriter, req *http.Request) error {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.WriteHeader(200)
 	temp, err := strconv.ParseFloat(req.FormValue("temperature"), 64)
 	if err != nil {
 		return fmt.Errorf("Failed to parse float64: %v: %v", req.FormValue("temperature"), err)
@@ -208,71 +311,145 @@ func SetTemperatureLimits(webserver *Webserver, tbox thermabox_interfaces.Therma
 	if err != nil {
 		return fmt.Errorf("Failed to parse float64: %v: %v", req.FormValue("threshold"), err)
 	}
+	limits := &Limits{&temp, &threshold}
+	if err := limits.validate(); err != nil {
+		return err
+	}
 	webserver.SetLimits(tbox, temp, threshold)
+	w.WriteHeader(200)
 	return nil
 }
 
 func GetStateHandler(webserver *Webserver, tbox thermabox_interfaces.ThermaboxInterface, w http.ResponseWriter, req *http.Request) error {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.WriteHeader(200)
-	state := tbox.GetState()
-	w.Write([]byte(state))
+	w.Write([]byte(tbox.GetState()))
 	return nil
 }
 
 func DisableThermaboxHandler(webserver *Webserver, tbox thermabox_interfaces.ThermaboxInterface, w http.ResponseWriter, req *http.Request) error {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	webserver.DisableThermabox(tbox)
 	w.WriteHeader(200)
-	tbox.DisableThermabox()
 	return nil
 }
 
 func EnableThermaboxHandler(webserver *Webserver, tbox thermabox_interfaces.ThermaboxInterface, w http.ResponseWriter, req *http.Request) error {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+	webserver.EnableThermabox(tbox)
 	w.WriteHeader(200)
-	tbox.EnableThermabox()
 	return nil
 }
 
+// profileActions maps the name of a profile action, as used in routes and
+// websocket events, to the corresponding call
+var profileActions = map[string]func(thermabox_interfaces.ProfileInterface) error{
+	"start":  thermabox_interfaces.ProfileInterface.StartProfile,
+	"pause":  thermabox_interfaces.ProfileInterface.PauseProfile,
+	"resume": thermabox_interfaces.ProfileInterface.ResumeProfile,
+	"skip":   thermabox_interfaces.ProfileInterface.SkipProfileStep,
+	"stop":   thermabox_interfaces.ProfileInterface.StopProfile,
+}
+
+func ProfileActionHandler(action string, webserver *Webserver, tbox thermabox_interfaces.ThermaboxInterface, w http.ResponseWriter, req *http.Request) error {
+	if err := profileAction(action, tbox); err != nil {
+		return err
+	}
+	w.WriteHeader(200)
+	return nil
+}
+
+func ResetFaultHandler(webserver *Webserver, tbox thermabox_interfaces.ThermaboxInterface, w http.ResponseWriter, req *http.Request) error {
+	if err := resetFault(tbox); err != nil {
+		return err
+	}
+	w.WriteHeader(200)
+	return nil
+}
+
+// writeJSONHandler writes v, as returned alongside err, for a legacy route
+func writeJSONHandler(w http.ResponseWriter, v interface{}, err error) error {
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	w.WriteHeader(200)
+	w.Write(b)
+	return nil
+}
+
+func StatusHandler(webserver *Webserver, tbox thermabox_interfaces.ThermaboxInterface, w http.ResponseWriter, req *http.Request) error {
+	state, err := getStatus(webserver)
+	return writeJSONHandler(w, state, err)
+}
+
+func HistoryHandler(webserver *Webserver, tbox thermabox_interfaces.ThermaboxInterface, w http.ResponseWriter, req *http.Request) error {
+	samples, err := getHistory(tbox, req)
+	return writeJSONHandler(w, samples, err)
+}
+
+func ProfileStatusHandler(webserver *Webserver, tbox thermabox_interfaces.ThermaboxInterface, w http.ResponseWriter, req *http.Request) error {
+	status, err := getProfileStatus(tbox)
+	return writeJSONHandler(w, status, err)
+}
+
 func InitializeWebServer(path string, webserverBasePath string, tbox thermabox_interfaces.ThermaboxInterface, ws *websockets.WebsocketServer, webserver *Webserver) (http.Handler, error) {
+	if webserver == nil {
+		webserver = New()
+	}
 	r := mux.NewRouter()
+	// What is kept per client is only released on disconnecting when the
+	// websocket is served here
+	var events wsEvents = ws
+	var server *wsServer
 	if ws == nil {
-		ws = websockets.NewServer(r)
+		server = newWSServer(webserver.CorsOrigins)
+		r.Handle("/ws", server)
+		events = server
 	}
 
-	// Set up websocket routes
-	ws.On("get-limits", func(w *websockets.WebsocketClient, data interface{}) {
+	// Set up websocket routes. When auth is configured, clients must send
+	// the 'authenticate' event before any other
+	wsAuth := newWSAuth(webserver.Auth)
+	events.On("authenticate", wsAuth.authenticate)
+	on := func(event string, role Role, h websockets.Handler) {
+		events.On(event, wsAuth.guard(event, role, h))
+	}
+	on("get-limits", ROLE_READ, func(w *websockets.WebsocketClient, data interface{}) {
 		temp, threshold := tbox.GetLimits()
 		m := make(map[string]interface{})
 		m["temperature"] = temp
 		m["threshold"] = threshold
 		w.Emit("get-limits", m)
 	})
-	ws.On("set-limits", func(w *websockets.WebsocketClient, data interface{}) {
-		log.Infof("[websockets]: [set-limits]: type=%t", data)
-		m := data.(map[string]interface{})
-		temp := m["temperature"].(float64)
-		threshold := m["threshold"].(float64)
+	on("set-limits", ROLE_CONTROL, func(w *websockets.WebsocketClient, data interface{}) {
+		limits, err := limitsFromEvent(data)
+		if err != nil {
+			log.Errorf("[websockets]: [set-limits]: %v", err)
+			w.Emit("set-limits", err.Error())
+			return
+		}
+		temp, threshold := *limits.Temperature, *limits.Threshold
 		webserver.SetLimits(tbox, temp, threshold)
 		log.Infof("[websockets]: [set-limits]: Set limits to %v (+/- %v)", temp, threshold)
 		w.Emit("set-limits", "OK")
 	})
 
-	ws.On("disable-thermabox", func(w *websockets.WebsocketClient, data interface{}) {
+	on("disable-thermabox", ROLE_CONTROL, func(w *websockets.WebsocketClient, data interface{}) {
 		log.Infof("[websockets]: [disable-thermabox]: type=%t", data)
 		webserver.DisableThermabox(tbox)
 		log.Infof("[websockets]: [disable-thermabox]: Thermabox disabled")
 		w.Emit("disable-thermabox", "OK")
 	})
 
-	ws.On("enable-thermabox", func(w *websockets.WebsocketClient, data interface{}) {
+	on("enable-thermabox", ROLE_CONTROL, func(w *websockets.WebsocketClient, data interface{}) {
 		log.Infof("[websockets]: [enable-thermabox]: type=%t", data)
 		webserver.EnableThermabox(tbox)
 		log.Infof("[websockets]: [enable-thermabox]: Thermabox enabled")
 		w.Emit("enable-thermabox", "OK")
 	})
 
-	ws.On("get-temperature", func(w *websockets.WebsocketClient, data interface{}) {
+	on("get-temperature", ROLE_READ, func(w *websockets.WebsocketClient, data interface{}) {
 		temp, err := tbox.GetTemperature()
 		if err != nil {
 			log.Errorf("Failed to get temperature: %v", err)
@@ -281,77 +458,132 @@ func InitializeWebServer(path string, webserverBasePath string, tbox thermabox_i
 		log.Debugf("[websockets]: [get-temperature]: Sending back temp: %v", temp)
 		w.Emit("get-temperature", temp)
 	})
-	ws.On("get-state", func(w *websockets.WebsocketClient, data interface{}) {
+	on("get-state", ROLE_READ, func(w *websockets.WebsocketClient, data interface{}) {
 		state := tbox.GetState()
 		w.Emit("get-state", state)
 	})
 
+	on("reset-fault", ROLE_CONTROL, func(w *websockets.WebsocketClient, data interface{}) {
+		fault, ok := tbox.(thermabox_interfaces.FaultInterface)
+		if !ok {
+			w.Emit("reset-fault", "Thermabox does not support resetting faults")
+			return
+		}
+		if err := fault.ResetFault(); err != nil {
+			log.Errorf("[websockets]: [reset-fault]: %v", err)
+			w.Emit("reset-fault", err.Error())
+			return
+		}
+		log.Infof("[websockets]: [reset-fault]: Fault reset")
+		w.Emit("reset-fault", "OK")
+	})
+
+	for action, fn := range profileActions {
+		event := "profile-" + action
+		fn := fn
+		on(event, ROLE_CONTROL, func(w *websockets.WebsocketClient, data interface{}) {
+			profile, err := getProfileInterface(tbox)
+			if err == nil {
+				err = fn(profile)
+			}
+			if err != nil {
+				log.Errorf("[websockets]: [%v]: %v", event, err)
+				w.Emit(event, err.Error())
+				return
+			}
+			log.Infof("[websockets]: [%v]: OK", event)
+			w.Emit(event, "OK")
+		})
+	}
+	subscriptions := newWSSubscriptions(webserver, tbox)
+	on("subscribe", ROLE_READ, subscriptions.subscribe)
+	on("unsubscribe", ROLE_READ, subscriptions.unsubscribe)
+	if server != nil {
+		server.OnDisconnect(wsAuth.remove)
+		server.OnDisconnect(subscriptions.remove)
+	}
+	on("profile-status", ROLE_READ, func(w *websockets.WebsocketClient, data interface{}) {
+		profile, err := getProfileInterface(tbox)
+		if err != nil {
+			w.Emit("profile-status", err.Error())
+			return
+		}
+		status, err := profile.GetProfileStatus()
+		if err != nil {
+			w.Emit("profile-status", err.Error())
+			return
+		}
+		w.Emit("profile-status", status)
+	})
+
 	staticPath := "static"
 	webserverBasePath += "/"
 	webserverBasePath = filepath.Clean(webserverBasePath)
 	staticPath = filepath.Join(webserverBasePath, "static") + "/"
 	log.Infof("webserverBasePath=%v staticPath=%v", webserverBasePath, staticPath)
 
-	r.HandleFunc(webserverBasePath, func(w http.ResponseWriter, req *http.Request) {
-		if err := IndexHandler(path, w, req); err != nil {
-			msg := fmt.Sprintf("Failed to handle '/': %v", err)
-			log.Errorf(msg)
-			w.WriteHeader(503)
-			w.Write([]byte(msg))
-		}
+	initializeAPI(r, webserverBasePath, tbox, webserver)
+
+	// route registers a legacy handler under the base path. Errors are
+	// logged and returned as a 503
+	route := func(name string, h func(w http.ResponseWriter, req *http.Request) error) {
+		r.HandleFunc(filepath.Join(webserverBasePath, name+"/"), func(w http.ResponseWriter, req *http.Request) {
+			if err := h(w, req); err != nil {
+				msg := fmt.Sprintf("Failed to handle '/%v': %v", name, err)
+				log.Errorf("%v", msg)
+				w.WriteHeader(503)
+				w.Write([]byte(msg))
+			}
+		})
+	}
+
+	route("", func(w http.ResponseWriter, req *http.Request) error {
+		return IndexHandler(path, w, req)
 	})
 	// Extra paths
-	r.HandleFunc(filepath.Join(webserverBasePath, "get-temperature/"), func(w http.ResponseWriter, req *http.Request) {
-		if err := GetTemperatureHandler(webserver, tbox, w, req); err != nil {
-			msg := fmt.Sprintf("Failed to handle '/get-temperature': %v", err)
-			log.Errorf(msg)
-			w.WriteHeader(503)
-			w.Write([]byte(msg))
-		}
+	route("get-temperature", func(w http.ResponseWriter, req *http.Request) error {
+		return GetTemperatureHandler(webserver, tbox, w, req)
 	})
-	r.HandleFunc(filepath.Join(webserverBasePath, "get-limits/"), func(w http.ResponseWriter, req *http.Request) {
-		if err := GetTemperatureLimits(webserver, tbox, w, req); err != nil {
-			msg := fmt.Sprintf("Failed to handle '/get-limits': %v", err)
-			log.Errorf(msg)
-			w.WriteHeader(503)
-			w.Write([]byte(msg))
-		}
+	route("get-limits", func(w http.ResponseWriter, req *http.Request) error {
+		return GetTemperatureLimits(webserver, tbox, w, req)
 	})
-	r.HandleFunc(filepath.Join(webserverBasePath, "set-limits/"), func(w http.ResponseWriter, req *http.Request) {
-		if err := SetTemperatureLimits(webserver, tbox, w, req); err != nil {
-			msg := fmt.Sprintf("Failed to handle '/set-limits': %v", err)
-			log.Errorf(msg)
-			w.WriteHeader(503)
-			w.Write([]byte(msg))
-		}
+	route("set-limits", func(w http.ResponseWriter, req *http.Request) error {
+		return SetTemperatureLimits(webserver, tbox, w, req)
 	})
-	r.HandleFunc(filepath.Join(webserverBasePath, "get-state/"), func(w http.ResponseWriter, req *http.Request) {
-		if err := GetStateHandler(webserver, tbox, w, req); err != nil {
-			msg := fmt.Sprintf("Failed to handle '/get-state': %v", err)
-			log.Errorf(msg)
-			w.WriteHeader(503)
-			w.Write([]byte(msg))
-		}
+	route("get-state", func(w http.ResponseWriter, req *http.Request) error {
+		return GetStateHandler(webserver, tbox, w, req)
 	})
 
-	r.HandleFunc(filepath.Join(webserverBasePath, "disable-thermabox/"), func(w http.ResponseWriter, req *http.Request) {
-		if err := DisableThermaboxHandler(webserver, tbox, w, req); err != nil {
-			msg := fmt.Sprintf("Failed to handle '/disable-thermabox': %v", err)
-			log.Errorf(msg)
-			w.WriteHeader(503)
-			w.Write([]byte(msg))
-		}
+	route("disable-thermabox", func(w http.ResponseWriter, req *http.Request) error {
+		return DisableThermaboxHandler(webserver, tbox, w, req)
 	})
 
-	r.HandleFunc(filepath.Join(webserverBasePath, "enable-thermabox/"), func(w http.ResponseWriter, req *http.Request) {
-		if err := EnableThermaboxHandler(webserver, tbox, w, req); err != nil {
-			msg := fmt.Sprintf("Failed to handle '/enable-thermabox': %v", err)
-			log.Errorf(msg)
-			w.WriteHeader(503)
-			w.Write([]byte(msg))
-		}
+	route("enable-thermabox", func(w http.ResponseWriter, req *http.Request) error {
+		return EnableThermaboxHandler(webserver, tbox, w, req)
+	})
+
+	route("reset-fault", func(w http.ResponseWriter, req *http.Request) error {
+		return ResetFaultHandler(webserver, tbox, w, req)
+	})
+
+	route("api/status", func(w http.ResponseWriter, req *http.Request) error {
+		return StatusHandler(webserver, tbox, w, req)
+	})
+
+	route("api/history", func(w http.ResponseWriter, req *http.Request) error {
+		return HistoryHandler(webserver, tbox, w, req)
+	})
+
+	for action := range profileActions {
+		action := action
+		route("profile/"+action, func(w http.ResponseWriter, req *http.Request) error {
+			return ProfileActionHandler(action, webserver, tbox, w, req)
+		})
+	}
+	route("profile/status", func(w http.ResponseWriter, req *http.Request) error {
+		return ProfileStatusHandler(webserver, tbox, w, req)
 	})
 
 	r.PathPrefix(staticPath).Handler(http.StripPrefix(staticPath, http.FileServer(http.Dir(filepath.Join(path, "static")))))
-	return r, nil
+	return corsHandler(webserver.CorsOrigins, authHandler(webserver.Auth, webserverBasePath, r)), nil
 }
@@ -2,6 +2,7 @@ package webserver
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/url"
 	"sync"
@@ -12,6 +13,7 @@ import (
 
 	"github.com/gorilla/websocket"
 	"github.com/gurupras/go-stoppable-net-listener"
+	thermabox_interfaces "github.com/gurupras/thermabox/interfaces"
 	websockets "github.com/homesound/simple-websockets"
 	"github.com/parnurzeal/gorequest"
 	log "github.com/sirupsen/logrus"
@@ -67,7 +69,7 @@ webserver:
 func TestWebServer(t *testing.T) {
 	require := require.New(t)
 
-	handler, err := InitializeWebServer(".", "/", nil, nil)
+	handler, err := InitializeWebServer(".", "/", nil, nil, New())
 	require.Nil(err)
 	require.NotNil(handler)
 
@@ -118,6 +120,15 @@ func (d *DummyThermaboxInterface) SetLimits(temp float64, threshold float64) {
 	d.threshold = threshold
 }
 
+func (d *DummyThermaboxInterface) RegisterChannel(c chan *thermabox_interfaces.ThermaboxState) {
+}
+
+func (d *DummyThermaboxInterface) DisableThermabox() {
+}
+
+func (d *DummyThermaboxInterface) EnableThermabox() {
+}
+
 func (d *DummyThermaboxInterface) GetState() string {
 	temp, _ := d.GetTemperature()
 	if temp < d.temperature-d.threshold {
@@ -132,7 +143,7 @@ func (d *DummyThermaboxInterface) GetState() string {
 func TestWebsockets(t *testing.T) {
 	require := require.New(t)
 
-	handler, err := InitializeWebServer(".", "/", NewDummyThermaboxInterface(), nil)
+	handler, err := InitializeWebServer(".", "/", NewDummyThermaboxInterface(), nil, New())
 	require.Nil(err)
 	require.NotNil(handler)
 
@@ -204,13 +215,61 @@ func TestWebsockets(t *testing.T) {
 	wg.Wait()
 }
 
+func TestWebsocketSetLimitsValidation(t *testing.T) {
+	require := require.New(t)
+
+	tbox := NewDummyThermaboxInterface()
+	_, stop := startAPIServer(require, tbox, New(), 31139)
+	defer stop()
+
+	u := url.URL{Scheme: "ws", Host: "localhost:31139", Path: "/ws"}
+	c, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	require.Nil(err)
+	defer c.Close()
+	client := websockets.NewClient(c)
+	go client.ProcessMessages()
+
+	responses := make(chan interface{}, 1)
+	client.On("set-limits", func(w *websockets.WebsocketClient, data interface{}) {
+		responses <- data
+	})
+	setLimits := func(data interface{}) interface{} {
+		require.Nil(client.Emit("set-limits", data))
+		select {
+		case data := <-responses:
+			return data
+		case <-time.After(time.Second):
+			require.FailNow("No response to set-limits")
+			return nil
+		}
+	}
+
+	for _, data := range []interface{}{
+		nil,
+		"18",
+		map[string]interface{}{"temperature": 18},
+		map[string]interface{}{"temperature": "18", "threshold": 0.5},
+		map[string]interface{}{"temperature": 18, "threshold": -1},
+	} {
+		require.NotEqual("OK", setLimits(data), "%v", data)
+	}
+	temp, threshold := tbox.GetLimits()
+	require.Equal(114.14, temp)
+	require.Equal(0.2, threshold)
+
+	require.Equal("OK", setLimits(map[string]interface{}{"temperature": 18, "threshold": 0.5}))
+	temp, threshold = tbox.GetLimits()
+	require.Equal(18.0, temp)
+	require.Equal(0.5, threshold)
+}
+
 // Test whether we are able to handle webserver under paths other than "/"
 // FIXME: Don't know how to write this test. We need to be able to run
 // two independent servers without registering paths via http.Handle*
 func TestSubWebServer(t *testing.T) {
 	require := require.New(t)
 
-	handler, err := InitializeWebServer(".", "/webserver", nil, nil)
+	handler, err := InitializeWebServer(".", "/webserver", nil, nil, New())
 	require.Nil(err)
 	require.NotNil(handler)
 
@@ -240,7 +299,7 @@ func TestPOSTSetLimits(t *testing.T) {
 	require := require.New(t)
 
 	tbox := NewDummyThermaboxInterface()
-	handler, err := InitializeWebServer(".", "/", tbox, nil)
+	handler, err := InitializeWebServer(".", "/", tbox, nil, New())
 	require.Nil(err)
 	require.NotNil(handler)
 
@@ -289,3 +348,213 @@ func TestPOSTSetLimits(t *testing.T) {
 	require.Equal(data["threshold"], threshold)
 	snl.Stop()
 }
+
+type DummyProfileThermabox struct {
+	*DummyThermaboxInterface
+	actions []string
+}
+
+func (d *DummyProfileThermabox) StartProfile() error {
+	d.actions = append(d.actions, "start")
+	return nil
+}
+func (d *DummyProfileThermabox) PauseProfile() error {
+	d.actions = append(d.actions, "pause")
+	return nil
+}
+func (d *DummyProfileThermabox) ResumeProfile() error {
+	d.actions = append(d.actions, "resume")
+	return nil
+}
+func (d *DummyProfileThermabox) SkipProfileStep() error {
+	d.actions = append(d.actions, "skip")
+	return nil
+}
+func (d *DummyProfileThermabox) StopProfile() error {
+	d.actions = append(d.actions, "stop")
+	return nil
+}
+func (d *DummyProfileThermabox) GetProfileStatus() (*thermabox_interfaces.ProfileStatus, error) {
+	return &thermabox_interfaces.ProfileStatus{Running: true, Step: 1, Steps: 3, StepName: "rest"}, nil
+}
+
+func TestProfileRoutes(t *testing.T) {
+	require := require.New(t)
+
+	tbox := &DummyProfileThermabox{NewDummyThermaboxInterface(), nil}
+	handler, err := InitializeWebServer(".", "/", tbox, nil, New())
+	require.Nil(err)
+
+	mux := http.NewServeMux()
+	mux.Handle("/", handler)
+	server := http.Server{}
+	server.Handler = mux
+	snl, err := stoppablenetlistener.New(31125)
+	require.Nil(err)
+	defer snl.Stop()
+	go func() {
+		server.Serve(snl)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	for _, action := range []string{"start", "pause", "resume", "skip", "stop"} {
+		resp, _, errs := gorequest.New().Post("http://localhost:31125/profile/" + action).End()
+		require.Equal(0, len(errs))
+		require.Equal(200, resp.StatusCode)
+	}
+	require.Equal([]string{"start", "pause", "resume", "skip", "stop"}, tbox.actions)
+
+	resp, body, errs := gorequest.New().Get("http://localhost:31125/profile/status").EndBytes()
+	require.Equal(0, len(errs))
+	require.Equal(200, resp.StatusCode)
+	status := thermabox_interfaces.ProfileStatus{}
+	require.Nil(json.Unmarshal(body, &status))
+	require.Equal("rest", status.StepName)
+	require.Equal(1, status.Step)
+
+	// Thermaboxes without profile support
+	handler, err = InitializeWebServer(".", "/", NewDummyThermaboxInterface(), nil, New())
+	require.Nil(err)
+	server2 := http.Server{}
+	server2.Handler = handler
+	snl2, err := stoppablenetlistener.New(31126)
+	require.Nil(err)
+	defer snl2.Stop()
+	go func() {
+		server2.Serve(snl2)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	resp, _, _ = gorequest.New().Post("http://localhost:31126/profile/start").End()
+	require.Equal(503, resp.StatusCode)
+}
+
+type DummyFaultThermabox struct {
+	*DummyThermaboxInterface
+	faulted bool
+}
+
+func (d *DummyFaultThermabox) ResetFault() error {
+	if !d.faulted {
+		return fmt.Errorf("Thermabox is not in a fault state")
+	}
+	d.faulted = false
+	return nil
+}
+
+func TestResetFaultRoute(t *testing.T) {
+	require := require.New(t)
+
+	tbox := &DummyFaultThermabox{NewDummyThermaboxInterface(), true}
+	handler, err := InitializeWebServer(".", "/", tbox, nil, New())
+	require.Nil(err)
+
+	server := http.Server{}
+	server.Handler = handler
+	snl, err := stoppablenetlistener.New(31127)
+	require.Nil(err)
+	defer snl.Stop()
+	go func() {
+		server.Serve(snl)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	resp, _, errs := gorequest.New().Post("http://localhost:31127/reset-fault").End()
+	require.Equal(0, len(errs))
+	require.Equal(200, resp.StatusCode)
+	require.False(tbox.faulted)
+
+	// Nothing to reset
+	resp, _, _ = gorequest.New().Post("http://localhost:31127/reset-fault").End()
+	require.Equal(503, resp.StatusCode)
+}
+
+type DummyHistoryThermabox struct {
+	*DummyThermaboxInterface
+	from       int64
+	to         int64
+	resolution time.Duration
+}
+
+func (d *DummyHistoryThermabox) GetHistory(from int64, to int64, resolution time.Duration) ([]*thermabox_interfaces.HistorySample, error) {
+	d.from, d.to, d.resolution = from, to, resolution
+	return []*thermabox_interfaces.HistorySample{
+		{Timestamp: from, Duration: 5000, Temperature: 20, State: thermabox_interfaces.STABLE},
+	}, nil
+}
+
+func TestHistoryRoute(t *testing.T) {
+	require := require.New(t)
+
+	tbox := &DummyHistoryThermabox{DummyThermaboxInterface: NewDummyThermaboxInterface()}
+	handler, err := InitializeWebServer(".", "/", tbox, nil, New())
+	require.Nil(err)
+
+	server := http.Server{}
+	server.Handler = handler
+	snl, err := stoppablenetlistener.New(31128)
+	require.Nil(err)
+	defer snl.Stop()
+	go func() {
+		server.Serve(snl)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	resp, body, errs := gorequest.New().Get("http://localhost:31128/api/history?from=1000&to=5000&resolution=60").End()
+	require.Equal(0, len(errs))
+	require.Equal(200, resp.StatusCode)
+	require.Equal(int64(1000), tbox.from)
+	require.Equal(int64(5000), tbox.to)
+	require.Equal(time.Minute, tbox.resolution)
+	samples := make([]*thermabox_interfaces.HistorySample, 0)
+	require.Nil(json.Unmarshal([]byte(body), &samples))
+	require.Equal(1, len(samples))
+	require.Equal(20.0, samples[0].Temperature)
+
+	// Defaults to the last hour
+	resp, _, _ = gorequest.New().Get("http://localhost:31128/api/history").End()
+	require.Equal(200, resp.StatusCode)
+	require.Equal(int64(time.Hour/time.Millisecond), tbox.to-tbox.from)
+	require.Equal(time.Duration(0), tbox.resolution)
+
+	resp, _, _ = gorequest.New().Get("http://localhost:31128/api/history?from=abc").End()
+	require.Equal(503, resp.StatusCode)
+}
+
+func TestStatusRoute(t *testing.T) {
+	require := require.New(t)
+
+	webserver := New()
+	handler, err := InitializeWebServer(".", "/", NewDummyThermaboxInterface(), nil, webserver)
+	require.Nil(err)
+
+	server := http.Server{}
+	server.Handler = handler
+	snl, err := stoppablenetlistener.New(31129)
+	require.Nil(err)
+	defer snl.Stop()
+	go func() {
+		server.Serve(snl)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// Nothing published yet
+	resp, _, _ := gorequest.New().Get("http://localhost:31129/api/status").End()
+	require.Equal(503, resp.StatusCode)
+
+	webserver.setState(&thermabox_interfaces.ThermaboxState{
+		Temperature:    19.5,
+		Setpoint:       20,
+		Threshold:      0.5,
+		State:          thermabox_interfaces.HEATING_UP,
+		HeatingElement: thermabox_interfaces.ElementState{On: true},
+	})
+	resp, body, errs := gorequest.New().Get("http://localhost:31129/api/status").End()
+	require.Equal(0, len(errs))
+	require.Equal(200, resp.StatusCode)
+	state := &thermabox_interfaces.ThermaboxState{}
+	require.Nil(json.Unmarshal([]byte(body), state))
+	require.Equal(20.0, state.Setpoint)
+	require.Equal(thermabox_interfaces.HEATING_UP, state.State)
+	require.True(state.HeatingElement.On)
+	require.False(state.CoolingElement.On)
+}
@@ -0,0 +1,71 @@
+package webserver
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	websockets "github.com/homesound/simple-websockets"
+	log "github.com/sirupsen/logrus"
+)
+
+// wsEvents is where websocket event handlers are registered
+type wsEvents interface {
+	On(event string, h websockets.Handler)
+}
+
+// wsServer serves the websocket. Unlike websockets.WebsocketServer, it knows
+// when a client disconnects, so that what is kept per client can be released
+type wsServer struct {
+	upgrader           websocket.Upgrader
+	handlers           map[string]websockets.Handler
+	disconnectHandlers []func(*websockets.WebsocketClient)
+	mutex              sync.Mutex
+}
+
+// newWSServer returns a server that only accepts connections from the same
+// origin and from the listed origins, since a browser sends its credentials
+// along with the connection whatever page opens it
+func newWSServer(origins []string) *wsServer {
+	return &wsServer{
+		upgrader: websocket.Upgrader{CheckOrigin: checkOrigin(origins)},
+		handlers: make(map[string]websockets.Handler),
+	}
+}
+
+// On registers the handler for an event. Handlers must be registered before
+// clients connect
+func (s *wsServer) On(event string, h websockets.Handler) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.handlers[event] = h
+}
+
+// OnDisconnect registers a function to call once a client has disconnected
+func (s *wsServer) OnDisconnect(h func(*websockets.WebsocketClient)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.disconnectHandlers = append(s.disconnectHandlers, h)
+}
+
+func (s *wsServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	conn, err := s.upgrader.Upgrade(w, req, nil)
+	if err != nil {
+		log.Warnf("[websockets]: Failed to upgrade connection from %v: %v", req.RemoteAddr, err)
+		return
+	}
+	defer conn.Close()
+	client := websockets.NewClient(conn)
+	s.mutex.Lock()
+	for event, h := range s.handlers {
+		client.On(event, h)
+	}
+	disconnectHandlers := s.disconnectHandlers
+	s.mutex.Unlock()
+
+	client.ProcessMessages()
+	log.Debugf("[websockets]: Client %v disconnected", req.RemoteAddr)
+	for _, h := range disconnectHandlers {
+		h(client)
+	}
+}